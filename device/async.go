@@ -0,0 +1,315 @@
+// Copyright 2018 Dan Jacques. All rights reserved.
+// Use of this source code is governed under the MIT License
+// that can be found in the LICENSE file.
+
+package device
+
+import (
+	"sync"
+
+	"github.com/danjacques/gopushpixels/protocol"
+	"github.com/danjacques/gopushpixels/protocol/pixelpusher"
+
+	"github.com/pkg/errors"
+)
+
+// MaxAsyncPendingDatagrams is the maximum number of raw datagrams that an
+// AsyncSender will hold pending. Datagrams sent beyond this limit will be
+// dropped.
+const MaxAsyncPendingDatagrams = 64
+
+// AsyncSenderStats is a set of statistics collected by an AsyncSender.
+type AsyncSenderStats struct {
+	// Sent is the number of packets and datagrams that were sent to the
+	// underlying Sender.
+	Sent int64
+	// Overwritten is the number of pending strip states that were overwritten by
+	// newer state for the same strip before they could be sent.
+	Overwritten int64
+	// Dropped is the number of raw datagrams that were dropped because too many
+	// datagrams were already pending.
+	Dropped int64
+	// Errors is the number of send errors returned by the underlying Sender.
+	Errors int64
+}
+
+// AsyncSender is a Sender that sends data to an underlying Sender on its own
+// goroutine, so that producers never block on the network.
+//
+// Pending pixel data is held in a per-strip "latest state" slot: if a strip's
+// state is sent while a previous state for that strip is still pending, the
+// previous state is overwritten. Commands are never overwritten, and are sent
+// in the order in which they were supplied relative to pixel data.
+//
+// Raw datagrams are queued separately, up to MaxAsyncPendingDatagrams, and are
+// sent ahead of pending packet data.
+//
+// Because sending is asynchronous, errors cannot be returned to the call that
+// produced them. Instead, the next call to SendPacket or SendDatagram will
+// return the most recent asynchronous error, if any.
+//
+// AsyncSender takes ownership of its underlying Sender. Close sends all
+// pending data, then closes the underlying Sender.
+//
+// Unlike other Senders, AsyncSender is safe for concurrent use.
+type AsyncSender struct {
+	base Sender
+
+	// wakeC is signalled when new data is pending.
+	wakeC chan struct{}
+	// stopC is closed to instruct the send goroutine to stop.
+	stopC chan struct{}
+	// doneC is closed when the send goroutine has exited.
+	doneC chan struct{}
+
+	closeOnce sync.Once
+	closeErr  error
+
+	// mu protects the following state.
+	mu sync.Mutex
+	// pending is the pending packet data.
+	pending stripCoalescer
+	// datagrams is the set of pending raw datagrams.
+	datagrams [][]byte
+	// stats is the current set of stats.
+	stats AsyncSenderStats
+	// err is the last asynchronous send error.
+	err error
+	// closed is true once Close has been called. It is set before stopC is
+	// closed, so data enqueued while it is false is sent before run exits.
+	closed bool
+}
+
+var _ Sender = (*AsyncSender)(nil)
+
+// MakeAsyncSender creates a new AsyncSender which sends to base, and starts its
+// send goroutine.
+//
+// The AsyncSender must be closed when finished.
+func MakeAsyncSender(base Sender) *AsyncSender {
+	as := &AsyncSender{
+		base:  base,
+		wakeC: make(chan struct{}, 1),
+		stopC: make(chan struct{}),
+		doneC: make(chan struct{}),
+	}
+	go as.run()
+	return as
+}
+
+// SendPacket implements Sender.
+//
+// SendPacket does not block on the network. Pixel data in packet is copied, so
+// packet may be reused after SendPacket returns.
+func (as *AsyncSender) SendPacket(packet *protocol.Packet) error {
+	return as.enqueue(func() {
+		as.stats.Overwritten += int64(as.pending.add(packet))
+	})
+}
+
+// SendDatagram implements Sender.
+//
+// SendDatagram does not block on the network. d is copied, so it may be reused
+// after SendDatagram returns.
+func (as *AsyncSender) SendDatagram(d []byte) error {
+	return as.enqueue(func() {
+		if len(as.datagrams) >= MaxAsyncPendingDatagrams {
+			as.stats.Dropped++
+			return
+		}
+		as.datagrams = append(as.datagrams, append([]byte(nil), d...))
+	})
+}
+
+// MaxDatagramSize implements Sender.
+func (as *AsyncSender) MaxDatagramSize() int { return as.base.MaxDatagramSize() }
+
+// Close implements Sender.
+//
+// Close blocks until all pending data has been sent, then closes the underlying
+// Sender. If closing the underlying Sender succeeds, Close returns the most
+// recent asynchronous send error, if any.
+func (as *AsyncSender) Close() error {
+	as.closeOnce.Do(func() {
+		as.mu.Lock()
+		as.closed = true
+		as.mu.Unlock()
+
+		close(as.stopC)
+		<-as.doneC
+
+		as.closeErr = as.base.Close()
+		if as.closeErr == nil {
+			as.mu.Lock()
+			as.closeErr, as.err = as.err, nil
+			as.mu.Unlock()
+		}
+	})
+	return as.closeErr
+}
+
+// Stats returns the AsyncSender's current stats.
+func (as *AsyncSender) Stats() AsyncSenderStats {
+	as.mu.Lock()
+	defer as.mu.Unlock()
+	return as.stats
+}
+
+func (as *AsyncSender) enqueue(fn func()) error {
+	as.mu.Lock()
+	if as.closed {
+		as.mu.Unlock()
+		return errors.New("sender is closed")
+	}
+	fn()
+	err := as.err
+	as.err = nil
+	as.mu.Unlock()
+
+	select {
+	case as.wakeC <- struct{}{}:
+	default:
+		// A wake-up is already pending.
+	}
+	return err
+}
+
+func (as *AsyncSender) run() {
+	defer close(as.doneC)
+
+	for {
+		select {
+		case <-as.wakeC:
+			as.sendPending()
+
+		case <-as.stopC:
+			// Send any remaining data before exiting.
+			as.sendPending()
+			return
+		}
+	}
+}
+
+// sendPending sends pending data until none remains.
+//
+// Data enqueued while sendPending is sending will be coalesced and sent in a
+// subsequent round.
+func (as *AsyncSender) sendPending() {
+	for {
+		as.mu.Lock()
+		datagrams := as.datagrams
+		as.datagrams = nil
+		pkts := as.pending.take()
+		as.mu.Unlock()
+
+		if len(datagrams) == 0 && len(pkts) == 0 {
+			return
+		}
+
+		for _, d := range datagrams {
+			as.recordResult(as.base.SendDatagram(d))
+		}
+		for _, pkt := range pkts {
+			as.recordResult(as.base.SendPacket(pkt))
+		}
+	}
+}
+
+func (as *AsyncSender) recordResult(err error) {
+	as.mu.Lock()
+	defer as.mu.Unlock()
+
+	if err != nil {
+		as.stats.Errors++
+		as.err = err
+		return
+	}
+	as.stats.Sent++
+}
+
+// stripCoalescer accumulates packet data, retaining only the latest state of
+// each strip.
+//
+// Commands act as barriers: pixel data supplied after a command will not be
+// coalesced with pixel data supplied before it.
+//
+// stripCoalescer is not safe for concurrent use.
+type stripCoalescer struct {
+	entries []*coalescerEntry
+}
+
+// coalescerEntry is a single stripCoalescer entry. It holds either a command
+// or a set of strip states.
+type coalescerEntry struct {
+	command pixelpusher.Command
+
+	strips     []*pixelpusher.StripState
+	stripIndex map[pixelpusher.StripNumber]int
+}
+
+// add adds the contents of pkt to the coalescer. Strip states are cloned, so
+// pkt may be reused after add returns.
+//
+// add returns the number of pending strip states that were overwritten by
+// strip states in pkt.
+func (sc *stripCoalescer) add(pkt *protocol.Packet) (overwritten int) {
+	if pkt == nil || pkt.PixelPusher == nil {
+		return
+	}
+	pp := pkt.PixelPusher
+
+	if pp.Command != nil {
+		sc.entries = append(sc.entries, &coalescerEntry{command: pp.Command})
+		return
+	}
+	if len(pp.StripStates) == 0 {
+		return
+	}
+
+	// Coalesce into our last entry, if it holds strip states.
+	var e *coalescerEntry
+	if len(sc.entries) > 0 {
+		if last := sc.entries[len(sc.entries)-1]; last.command == nil {
+			e = last
+		}
+	}
+	if e == nil {
+		e = &coalescerEntry{
+			stripIndex: make(map[pixelpusher.StripNumber]int, len(pp.StripStates)),
+		}
+		sc.entries = append(sc.entries, e)
+	}
+
+	for _, ss := range pp.StripStates {
+		if idx, ok := e.stripIndex[ss.StripNumber]; ok {
+			// Overwrite the pending state in place, reusing its buffer.
+			e.strips[idx].Pixels.CloneFrom(&ss.Pixels)
+			overwritten++
+			continue
+		}
+
+		e.stripIndex[ss.StripNumber] = len(e.strips)
+		e.strips = append(e.strips, ss.Clone())
+	}
+	return
+}
+
+// take returns the coalescer's pending data as a series of packets, in order,
+// and resets the coalescer.
+func (sc *stripCoalescer) take() []*protocol.Packet {
+	if len(sc.entries) == 0 {
+		return nil
+	}
+
+	pkts := make([]*protocol.Packet, len(sc.entries))
+	for i, e := range sc.entries {
+		pkts[i] = &protocol.Packet{
+			PixelPusher: &pixelpusher.Packet{
+				Command:     e.command,
+				StripStates: e.strips,
+			},
+		}
+	}
+	sc.entries = nil
+	return pkts
+}
@@ -0,0 +1,237 @@
+// Copyright 2018 Dan Jacques. All rights reserved.
+// Use of this source code is governed under the MIT License
+// that can be found in the LICENSE file.
+
+package device
+
+import (
+	"sync"
+	"time"
+
+	"github.com/danjacques/gopushpixels/pixel"
+	"github.com/danjacques/gopushpixels/protocol"
+	"github.com/danjacques/gopushpixels/protocol/pixelpusher"
+
+	"github.com/pkg/errors"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+// gatedSender is a Sender which blocks each send until it is released.
+type gatedSender struct {
+	gateC chan struct{}
+
+	mu        sync.Mutex
+	packets   []*protocol.Packet
+	datagrams [][]byte
+	err       error
+	closed    bool
+}
+
+func (gs *gatedSender) SendDatagram(d []byte) error {
+	<-gs.gateC
+
+	gs.mu.Lock()
+	defer gs.mu.Unlock()
+	gs.datagrams = append(gs.datagrams, d)
+	return gs.err
+}
+
+func (gs *gatedSender) SendPacket(pkt *protocol.Packet) error {
+	<-gs.gateC
+
+	gs.mu.Lock()
+	defer gs.mu.Unlock()
+	gs.packets = append(gs.packets, pkt)
+	return gs.err
+}
+
+func (gs *gatedSender) MaxDatagramSize() int { return 1024 }
+
+func (gs *gatedSender) Close() error {
+	gs.mu.Lock()
+	defer gs.mu.Unlock()
+	gs.closed = true
+	return nil
+}
+
+func (gs *gatedSender) getPackets() []*protocol.Packet {
+	gs.mu.Lock()
+	defer gs.mu.Unlock()
+	return append([]*protocol.Packet(nil), gs.packets...)
+}
+
+var _ = Describe("AsyncSender", func() {
+	var gs *gatedSender
+	var as *AsyncSender
+	BeforeEach(func() {
+		gs = &gatedSender{
+			gateC: make(chan struct{}),
+		}
+		as = MakeAsyncSender(gs)
+	})
+	AfterEach(func() {
+		// Open the gate, so everything can flush.
+		select {
+		case <-gs.gateC:
+		default:
+			close(gs.gateC)
+		}
+		_ = as.Close()
+	})
+
+	stripPacket := func(strip int, v byte) *protocol.Packet {
+		ss := pixelpusher.StripState{StripNumber: pixelpusher.StripNumber(strip)}
+		ss.Pixels.Reset(1)
+		ss.Pixels.SetPixel(0, pixel.P{Red: v})
+		return &protocol.Packet{
+			PixelPusher: &pixelpusher.Packet{
+				StripStates: []*pixelpusher.StripState{&ss},
+			},
+		}
+	}
+
+	commandPacket := func() *protocol.Packet {
+		return &protocol.Packet{
+			PixelPusher: &pixelpusher.Packet{
+				Command: &pixelpusher.GlobalBrightnessSetCommand{Parameter: 0xFFFF},
+			},
+		}
+	}
+
+	stripValues := func(pkt *protocol.Packet) map[pixelpusher.StripNumber]byte {
+		values := make(map[pixelpusher.StripNumber]byte)
+		for _, ss := range pkt.PixelPusher.StripStates {
+			values[ss.StripNumber] = ss.Pixels.Pixel(0).Red
+		}
+		return values
+	}
+
+	It("does not block producers, and coalesces pending strip states", func(done Done) {
+		defer close(done)
+
+		// The first packet will be picked up by the send goroutine, which will
+		// block on the gate. Wait for it to be consumed from pending.
+		Expect(as.SendPacket(stripPacket(0, 1))).To(Succeed())
+		Eventually(func() bool {
+			as.mu.Lock()
+			defer as.mu.Unlock()
+			return len(as.pending.entries) == 0
+		}).Should(BeTrue())
+
+		// These will all be pending.
+		for i := 2; i <= 5; i++ {
+			Expect(as.SendPacket(stripPacket(0, byte(i)))).To(Succeed())
+			Expect(as.SendPacket(stripPacket(1, byte(i)))).To(Succeed())
+		}
+		Expect(as.Stats().Overwritten).To(BeEquivalentTo(6))
+
+		close(gs.gateC)
+		Expect(as.Close()).To(Succeed())
+
+		pkts := gs.getPackets()
+		Expect(pkts).To(HaveLen(2))
+		Expect(stripValues(pkts[0])).To(Equal(map[pixelpusher.StripNumber]byte{0: 1}))
+		Expect(stripValues(pkts[1])).To(Equal(map[pixelpusher.StripNumber]byte{0: 5, 1: 5}))
+		Expect(as.Stats().Sent).To(BeEquivalentTo(2))
+		Expect(gs.closed).To(BeTrue())
+	})
+
+	It("does not coalesce strip states across commands", func(done Done) {
+		defer close(done)
+
+		Expect(as.SendPacket(stripPacket(0, 1))).To(Succeed())
+		Expect(as.SendPacket(commandPacket())).To(Succeed())
+		Expect(as.SendPacket(stripPacket(0, 2))).To(Succeed())
+
+		close(gs.gateC)
+		Expect(as.Close()).To(Succeed())
+
+		pkts := gs.getPackets()
+		Expect(pkts).To(HaveLen(3))
+		Expect(stripValues(pkts[0])).To(Equal(map[pixelpusher.StripNumber]byte{0: 1}))
+		Expect(pkts[1].PixelPusher.Command).ToNot(BeNil())
+		Expect(stripValues(pkts[2])).To(Equal(map[pixelpusher.StripNumber]byte{0: 2}))
+		Expect(as.Stats().Overwritten).To(BeZero())
+	})
+
+	It("drops datagrams when too many are pending", func(done Done) {
+		defer close(done)
+
+		for i := 0; i < MaxAsyncPendingDatagrams+2; i++ {
+			Expect(as.SendDatagram([]byte{byte(i)})).To(Succeed())
+		}
+
+		close(gs.gateC)
+		Expect(as.Close()).To(Succeed())
+
+		st := as.Stats()
+		Expect(st.Dropped).To(BeNumerically(">=", 1))
+		Expect(st.Sent + st.Dropped).To(BeEquivalentTo(MaxAsyncPendingDatagrams + 2))
+	})
+
+	It("reports asynchronous send errors", func(done Done) {
+		defer close(done)
+
+		gs.err = errors.New("test error")
+		close(gs.gateC)
+
+		Expect(as.SendPacket(stripPacket(0, 1))).To(Succeed())
+		Eventually(func() int64 { return as.Stats().Errors }).Should(BeEquivalentTo(1))
+		Expect(as.SendPacket(stripPacket(0, 2))).To(MatchError("test error"))
+	})
+
+	It("delivers every send that succeeds while closing concurrently", func(done Done) {
+		defer close(done)
+
+		// The race is narrow, so repeat it several times.
+		for round := 0; round < 100; round++ {
+			gs := &gatedSender{gateC: make(chan struct{})}
+			close(gs.gateC)
+			as := MakeAsyncSender(gs)
+
+			const senders, sends = 4, 8
+			var (
+				wg        sync.WaitGroup
+				mu        sync.Mutex
+				succeeded [][]byte
+			)
+			// Hold the AsyncSender's lock while starting the senders and Close, so
+			// that they contend with each other when it is released.
+			as.mu.Lock()
+			for i := 0; i < senders; i++ {
+				wg.Add(1)
+				go func(i int) {
+					defer wg.Done()
+					for j := 0; j < sends; j++ {
+						d := []byte{byte(i), byte(j)}
+						if as.SendDatagram(d) == nil {
+							mu.Lock()
+							succeeded = append(succeeded, d)
+							mu.Unlock()
+						}
+					}
+				}(i)
+			}
+			// Give the senders a chance to block on the lock.
+			time.Sleep(time.Millisecond)
+			closeErrC := make(chan error)
+			go func() { closeErrC <- as.Close() }()
+			as.mu.Unlock()
+
+			Expect(<-closeErrC).To(Succeed())
+			wg.Wait()
+
+			gs.mu.Lock()
+			Expect(gs.datagrams).To(ConsistOf(succeeded))
+			gs.mu.Unlock()
+		}
+	}, 10)
+
+	It("refuses to send after it has been closed", func() {
+		close(gs.gateC)
+		Expect(as.Close()).To(Succeed())
+		Expect(as.SendPacket(stripPacket(0, 1))).ToNot(Succeed())
+	})
+})
@@ -0,0 +1,288 @@
+// Copyright 2018 Dan Jacques. All rights reserved.
+// Use of this source code is governed under the MIT License
+// that can be found in the LICENSE file.
+
+package device
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/danjacques/gopushpixels/protocol"
+	"github.com/danjacques/gopushpixels/support/logging"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// DefaultAsyncListenerQueueSize is the default queue size for an asynchronous
+// Listener.
+const DefaultAsyncListenerQueueSize = 256
+
+// asyncListenerSeq is used to generate unique default asynchronous Listener
+// names, so that unnamed Listeners don't share metrics.
+var asyncListenerSeq int64
+
+// OverflowPolicy determines what happens when a packet is delivered to an
+// asynchronous Listener whose queue is full.
+type OverflowPolicy int
+
+const (
+	// DropOldest discards the oldest queued packet to make room for the new
+	// packet.
+	DropOldest OverflowPolicy = iota
+	// DropNewest discards the new packet.
+	DropNewest
+	// Block blocks the routing goroutine until there is room in the queue.
+	Block
+)
+
+// AsyncListenerOptions configures an asynchronous Listener. See Router's
+// AddAsyncListener for more information.
+type AsyncListenerOptions struct {
+	// Name is the name of the Listener, used for logging and metrics. If empty,
+	// a name that is unique within the process will be generated from the
+	// Listener's type.
+	Name string
+
+	// QueueSize is the maximum number of packets that may be queued for the
+	// Listener. If <= 0, DefaultAsyncListenerQueueSize will be used.
+	QueueSize int
+
+	// Overflow is the policy to apply when the Listener's queue is full.
+	Overflow OverflowPolicy
+}
+
+// AsyncListenerStats is a set of statistics for an asynchronous Listener.
+type AsyncListenerStats struct {
+	// Delivered is the number of packets that have been delivered.
+	Delivered int64
+	// Dropped is the number of packets that have been dropped due to overflow.
+	Dropped int64
+	// Panics is the number of panics that have been recovered from the
+	// Listener's HandlePacket method.
+	Panics int64
+	// Queued is the number of packets currently queued.
+	Queued int
+	// Lag is the amount of time that the most recently delivered packet spent in
+	// the queue.
+	Lag time.Duration
+}
+
+// AddAsyncListener registers a Listener with this Router, which will receive
+// packets asynchronously.
+//
+// Unlike Listeners added with AddListener, which are called synchronously
+// before each packet is sent, an asynchronous Listener receives packets
+// through its own bounded queue, processed by its own goroutine. A slow
+// asynchronous Listener will not delay routing, unless its overflow policy is
+// Block. Each queued packet is a private clone, so the Listener is free to
+// retain it.
+//
+// If the Listener panics while handling a packet, the panic will be recovered
+// and logged, and the Listener will continue to receive packets.
+//
+// The Listener is stopped, after processing its queued packets, when it is
+// removed with RemoveListener or when the Router is shut down.
+func (r *Router) AddAsyncListener(l Listener, opts AsyncListenerOptions) {
+	al := newAsyncListener(l, &opts, r.logger())
+	go al.run()
+
+	// If the Listener is already registered, replace it.
+	if prev, ok := r.listeners.Load(l); ok {
+		stopListener(prev)
+	}
+	r.listeners.Store(l, al)
+}
+
+// AsyncListenerStats returns the current statistics for l.
+//
+// If l is not registered as an asynchronous Listener, AsyncListenerStats
+// returns false.
+func (r *Router) AsyncListenerStats(l Listener) (AsyncListenerStats, bool) {
+	v, ok := r.listeners.Load(l)
+	if !ok {
+		return AsyncListenerStats{}, false
+	}
+	al, ok := v.(*asyncListener)
+	if !ok {
+		return AsyncListenerStats{}, false
+	}
+	return al.getStats(), true
+}
+
+// stopListener stops a value stored in a Router's listeners map, if it is an
+// asynchronous Listener.
+func stopListener(v interface{}) {
+	if al, ok := v.(*asyncListener); ok {
+		al.stop()
+	}
+}
+
+// asyncListenerItem is a single queued packet.
+type asyncListenerItem struct {
+	d        D
+	pkt      *protocol.Packet
+	enqueued time.Time
+}
+
+// asyncListener delivers packets to a Listener on its own goroutine.
+type asyncListener struct {
+	l        Listener
+	name     string
+	overflow OverflowPolicy
+	logger   logging.L
+	labels   prometheus.Labels
+
+	queueC chan *asyncListenerItem
+	// stopC is closed when the listener is stopped.
+	stopC    chan struct{}
+	stopOnce sync.Once
+	// doneC is closed when the listener's goroutine has exited.
+	doneC chan struct{}
+
+	statsMu sync.Mutex
+	stats   AsyncListenerStats
+}
+
+func newAsyncListener(l Listener, opts *AsyncListenerOptions, logger logging.L) *asyncListener {
+	name := opts.Name
+	if name == "" {
+		name = fmt.Sprintf("%T#%d", l, atomic.AddInt64(&asyncListenerSeq, 1))
+	}
+
+	queueSize := opts.QueueSize
+	if queueSize <= 0 {
+		queueSize = DefaultAsyncListenerQueueSize
+	}
+
+	return &asyncListener{
+		l:        l,
+		name:     name,
+		overflow: opts.Overflow,
+		logger:   logger,
+		labels:   prometheus.Labels{"listener": name},
+		queueC:   make(chan *asyncListenerItem, queueSize),
+		stopC:    make(chan struct{}),
+		doneC:    make(chan struct{}),
+	}
+}
+
+// enqueue adds a packet to the listener's queue, applying its overflow policy
+// if the queue is full.
+func (al *asyncListener) enqueue(d D, pkt *protocol.Packet) {
+	select {
+	case <-al.stopC:
+		return
+	default:
+	}
+
+	item := asyncListenerItem{
+		d:        d,
+		enqueued: time.Now(),
+	}
+	if pkt != nil {
+		item.pkt = pkt.Clone()
+	}
+
+	switch al.overflow {
+	case Block:
+		select {
+		case al.queueC <- &item:
+		case <-al.stopC:
+		}
+
+	case DropNewest:
+		select {
+		case al.queueC <- &item:
+		default:
+			al.recordDrop()
+		}
+
+	default:
+		// DropOldest
+		for {
+			select {
+			case al.queueC <- &item:
+				return
+			default:
+			}
+
+			// The queue is full; discard its oldest item and try again.
+			select {
+			case <-al.queueC:
+				al.recordDrop()
+			default:
+			}
+		}
+	}
+}
+
+func (al *asyncListener) stop() {
+	al.stopOnce.Do(func() { close(al.stopC) })
+	<-al.doneC
+}
+
+func (al *asyncListener) run() {
+	defer close(al.doneC)
+
+	for {
+		select {
+		case item := <-al.queueC:
+			al.deliver(item)
+
+		case <-al.stopC:
+			// Deliver any remaining queued packets.
+			for {
+				select {
+				case item := <-al.queueC:
+					al.deliver(item)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+func (al *asyncListener) deliver(item *asyncListenerItem) {
+	lag := time.Since(item.enqueued)
+	listenerLagGauge.With(al.labels).Set(lag.Seconds())
+
+	defer func() {
+		if err := recover(); err != nil {
+			al.logger.Errorf("Listener %q panicked handling packet for %s: %v", al.name, item.d.ID(), err)
+			listenerPanics.With(al.labels).Inc()
+
+			al.statsMu.Lock()
+			defer al.statsMu.Unlock()
+			al.stats.Panics++
+		}
+	}()
+
+	al.l.HandlePacket(item.d, item.pkt)
+	listenerDelivered.With(al.labels).Inc()
+
+	al.statsMu.Lock()
+	defer al.statsMu.Unlock()
+	al.stats.Delivered++
+	al.stats.Lag = lag
+}
+
+func (al *asyncListener) recordDrop() {
+	listenerDropped.With(al.labels).Inc()
+
+	al.statsMu.Lock()
+	defer al.statsMu.Unlock()
+	al.stats.Dropped++
+}
+
+func (al *asyncListener) getStats() AsyncListenerStats {
+	al.statsMu.Lock()
+	defer al.statsMu.Unlock()
+
+	st := al.stats
+	st.Queued = len(al.queueC)
+	return st
+}
@@ -0,0 +1,251 @@
+// Copyright 2018 Dan Jacques. All rights reserved.
+// Use of this source code is governed under the MIT License
+// that can be found in the LICENSE file.
+
+package device
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"github.com/danjacques/gopushpixels/protocol"
+	"github.com/danjacques/gopushpixels/protocol/pixelpusher"
+	"github.com/danjacques/gopushpixels/support/byteslicereader"
+	"github.com/danjacques/gopushpixels/support/network"
+
+	"github.com/pkg/errors"
+)
+
+// Segment is a contiguous range of pixels on a physical device's strip.
+type Segment struct {
+	// DeviceID is the ID of the physical device.
+	DeviceID string
+	// Strip is the index of the strip on the physical device.
+	Strip int
+	// Offset is the index of the first pixel of the range on the physical strip.
+	Offset int
+	// Length is the number of pixels in the range.
+	Length int
+	// Reverse, if true, maps the range in reverse order, so that the first
+	// logical pixel is the last pixel in the range.
+	Reverse bool
+}
+
+// CompositeStrip is a single logical strip of a Composite, made up of one or
+// more Segments.
+type CompositeStrip struct {
+	// Flags are the logical strip's flags.
+	Flags pixelpusher.StripFlags
+	// Segments are the physical pixel ranges that make up the logical strip, in
+	// order.
+	Segments []Segment
+}
+
+// Len returns the number of pixels in the strip.
+func (cs *CompositeStrip) Len() int {
+	count := 0
+	for _, seg := range cs.Segments {
+		count += seg.Length
+	}
+	return count
+}
+
+// Composite is a virtual device whose logical strips are made up of ranges of
+// pixels on one or more physical devices.
+//
+// A Composite is a PixelPusher-like device, with its own ID, ordinal, and
+// discovery headers. Pixel packets sent to a Composite are translated into
+// packets for its physical devices through a Merger. A Composite can be
+// registered in a Registry and routed to, and recorded, like any other device.
+//
+// Composites that share a Merger may each own a different range of the same
+// physical strip. Physical pixels that are not part of any Composite's
+// Segments will be sent as black.
+//
+// Command packets are not supported.
+type Composite struct {
+	id      string
+	ordinal Ordinal
+	merger  *Merger
+	strips  []CompositeStrip
+	dh      *protocol.DiscoveryHeaders
+	created time.Time
+
+	doneC     chan struct{}
+	closeOnce sync.Once
+
+	// mu protects info.
+	mu sync.Mutex
+	// info is the Composite's running info.
+	info Info
+}
+
+var _ D = (*Composite)(nil)
+
+// MakeComposite creates a new Composite device, which writes to its physical
+// devices through mg.
+//
+// MakeComposite returns an error if strips is invalid.
+func MakeComposite(id string, ordinal Ordinal, mg *Merger, strips []CompositeStrip) (*Composite, error) {
+	if len(strips) == 0 || len(strips) > 255 {
+		return nil, errors.Errorf("invalid strip count (%d)", len(strips))
+	}
+
+	pixelsPerStrip := 0
+	flags := make([]pixelpusher.StripFlags, len(strips))
+	for i := range strips {
+		cs := &strips[i]
+		for j, seg := range cs.Segments {
+			switch {
+			case seg.DeviceID == "":
+				return nil, errors.Errorf("strip #%d segment #%d has no device ID", i, j)
+			case seg.Strip < 0, seg.Offset < 0, seg.Length <= 0:
+				return nil, errors.Errorf("strip #%d segment #%d has an invalid range", i, j)
+			}
+		}
+
+		if l := cs.Len(); l > pixelsPerStrip {
+			pixelsPerStrip = l
+		}
+		flags[i] = cs.Flags
+	}
+	if pixelsPerStrip > 0xFFFF {
+		return nil, errors.Errorf("too many pixels per strip (%d)", pixelsPerStrip)
+	}
+
+	c := Composite{
+		id:      id,
+		ordinal: ordinal,
+		merger:  mg,
+		strips:  append([]CompositeStrip(nil), strips...),
+		created: time.Now(),
+		doneC:   make(chan struct{}),
+	}
+	c.info.Created = c.created
+
+	c.dh = &protocol.DiscoveryHeaders{
+		DeviceHeader: protocol.DeviceHeader{
+			DeviceType:       protocol.PixelPusherDeviceType,
+			ProtocolVersion:  protocol.DefaultProtocolVersion,
+			SoftwareRevision: pixelpusher.LatestSoftwareRevision,
+		},
+		PixelPusher: &pixelpusher.Device{
+			DeviceHeader: pixelpusher.DeviceHeader{
+				StripsAttached:     uint8(len(strips)),
+				MaxStripsPerPacket: uint8(len(strips)),
+				PixelsPerStrip:     uint16(pixelsPerStrip),
+				ControllerOrdinal:  int32(ordinal.Controller),
+				GroupOrdinal:       int32(ordinal.Group),
+			},
+			DeviceHeaderExt101: pixelpusher.DeviceHeaderExt101{
+				MyPort: pixelpusher.DefaultPort,
+			},
+			DeviceHeaderExt109: pixelpusher.DeviceHeaderExt109{
+				StripFlags: flags,
+			},
+		},
+	}
+	return &c, nil
+}
+
+// MakeSubDevice creates a Composite that presents each of segs as its own
+// logical strip. It is a convenience for splitting physical strips into
+// independently-addressable sub-devices (see StripSegments).
+func MakeSubDevice(id string, ordinal Ordinal, mg *Merger, segs ...Segment) (*Composite, error) {
+	strips := make([]CompositeStrip, len(segs))
+	for i, seg := range segs {
+		strips[i].Segments = []Segment{seg}
+	}
+	return MakeComposite(id, ordinal, mg, strips)
+}
+
+// Strips returns the Composite's logical strips.
+func (c *Composite) Strips() []CompositeStrip { return c.strips }
+
+// Close marks the Composite done.
+//
+// The Composite's Merger is not closed, since it may be shared.
+func (c *Composite) Close() error {
+	c.closeOnce.Do(func() { close(c.doneC) })
+	return nil
+}
+
+// ID implements D.
+func (c *Composite) ID() string { return c.id }
+
+// Ordinal implements D.
+func (c *Composite) Ordinal() Ordinal { return c.ordinal }
+
+// Sender implements D.
+//
+// A Composite's Senders are safe for concurrent use.
+func (c *Composite) Sender() (Sender, error) {
+	if IsDone(c) {
+		return nil, errors.New("composite device is closed")
+	}
+	return &compositeSender{c}, nil
+}
+
+// DiscoveryHeaders implements D.
+func (c *Composite) DiscoveryHeaders() *protocol.DiscoveryHeaders { return c.dh }
+
+// DoneC implements D.
+func (c *Composite) DoneC() <-chan struct{} { return c.doneC }
+
+// Addr implements D.
+//
+// A Composite has no address, and Addr will always return nil.
+func (c *Composite) Addr() net.Addr { return nil }
+
+// Info implements D.
+func (c *Composite) Info() Info {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.info
+}
+
+// sendPacket translates pkt into physical packets and sends them through the
+// Composite's Merger.
+func (c *Composite) sendPacket(pkt *protocol.Packet) error {
+	pp := pkt.PixelPusher
+	switch {
+	case pp == nil:
+		return errors.New("composite devices only support PixelPusher packets")
+	case pp.Command != nil:
+		return errors.New("composite devices do not support commands")
+	case IsDone(c):
+		return errors.New("composite device is closed")
+	}
+
+	err := c.merger.write(c.strips, pp)
+
+	c.mu.Lock()
+	c.info.PacketsSent++
+	c.mu.Unlock()
+	return err
+}
+
+// compositeSender is a Sender for a Composite.
+type compositeSender struct {
+	c *Composite
+}
+
+func (cs *compositeSender) SendPacket(pkt *protocol.Packet) error { return cs.c.sendPacket(pkt) }
+
+func (cs *compositeSender) SendDatagram(b []byte) error {
+	pr, err := cs.c.dh.PacketReader()
+	if err != nil {
+		return err
+	}
+
+	var pkt protocol.Packet
+	if err := pr.ReadPacket(&byteslicereader.R{Buffer: b}, &pkt); err != nil {
+		return errors.Wrap(err, "could not parse datagram")
+	}
+	return cs.c.sendPacket(&pkt)
+}
+
+func (cs *compositeSender) MaxDatagramSize() int { return network.MaxUDPSize }
+
+func (cs *compositeSender) Close() error { return nil }
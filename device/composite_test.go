@@ -0,0 +1,219 @@
+// Copyright 2018 Dan Jacques. All rights reserved.
+// Use of this source code is governed under the MIT License
+// that can be found in the LICENSE file.
+
+package device
+
+import (
+	"github.com/danjacques/gopushpixels/pixel"
+	"github.com/danjacques/gopushpixels/protocol"
+	"github.com/danjacques/gopushpixels/protocol/pixelpusher"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+// makePixelPusherHeaders returns discovery headers for a PixelPusher with the
+// specified strip layout.
+func makePixelPusherHeaders(strips, pixelsPerStrip int) protocol.DiscoveryHeaders {
+	return protocol.DiscoveryHeaders{
+		DeviceHeader: protocol.DeviceHeader{
+			DeviceType: protocol.PixelPusherDeviceType,
+		},
+		PixelPusher: &pixelpusher.Device{
+			DeviceHeader: pixelpusher.DeviceHeader{
+				StripsAttached: uint8(strips),
+				PixelsPerStrip: uint16(pixelsPerStrip),
+			},
+			DeviceHeaderExt109: pixelpusher.DeviceHeaderExt109{
+				StripFlags: make([]pixelpusher.StripFlags, strips),
+			},
+		},
+	}
+}
+
+var _ = Describe("Composite", func() {
+	var reg *Registry
+	var mg *Merger
+	var d0, d1 *testD
+	var c *Composite
+	BeforeEach(func() {
+		reg = &Registry{}
+
+		d0 = makeTestD("d0")
+		d0.headers = makePixelPusherHeaders(1, 8)
+		reg.Add(d0)
+
+		d1 = makeTestD("d1")
+		d1.headers = makePixelPusherHeaders(2, 4)
+		reg.Add(d1)
+
+		mg = MakeMerger(reg)
+
+		var err error
+		c, err = MakeComposite("composite", Ordinal{Group: 9, Controller: 1}, mg, []CompositeStrip{
+			{Segments: []Segment{
+				{DeviceID: "d0", Strip: 0, Offset: 5, Length: 3},
+				{DeviceID: "d1", Strip: 1, Offset: 0, Length: 2, Reverse: true},
+			}},
+		})
+		Expect(err).ToNot(HaveOccurred())
+	})
+	AfterEach(func() {
+		Expect(c.Close()).To(Succeed())
+		Expect(mg.Close()).To(Succeed())
+		d0.markDone()
+		d1.markDone()
+	})
+
+	pixelN := func(n int) pixel.P { return pixel.P{Red: uint8(n)} }
+
+	It("rejects invalid segments", func() {
+		_, err := MakeComposite("bad", InvalidOrdinal(), mg, []CompositeStrip{
+			{Segments: []Segment{{DeviceID: "d0", Length: 0}}},
+		})
+		Expect(err).To(HaveOccurred())
+
+		_, err = MakeComposite("bad", InvalidOrdinal(), mg, nil)
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("presents its logical layout as discovery headers", func() {
+		dh := c.DiscoveryHeaders()
+		Expect(dh.NumStrips()).To(Equal(1))
+		Expect(dh.PixelPusher.PixelsPerStrip).To(BeEquivalentTo(5))
+		Expect(c.Ordinal()).To(Equal(Ordinal{Group: 9, Controller: 1}))
+
+		By("registering like any other device")
+		reg.Add(c)
+		Expect(reg.GetUniqueOrdinal(Ordinal{Group: 9, Controller: 1})).To(Equal(c))
+	})
+
+	It("translates a Mutable's sync packet into physical packets", func() {
+		var m Mutable
+		m.Initialize(c.DiscoveryHeaders())
+		for i := 0; i < 5; i++ {
+			m.SetPixel(0, i, pixelN(i+1))
+		}
+
+		s, err := c.Sender()
+		Expect(err).ToNot(HaveOccurred())
+		defer s.Close()
+		Expect(s.SendPacket(m.SyncPacket())).To(Succeed())
+
+		Expect(d0.packets).To(HaveLen(1))
+		ss := d0.packets[0].PixelPusher.StripStates
+		Expect(ss).To(HaveLen(1))
+		Expect(ss[0].Pixels.Pixel(4)).To(Equal(pixel.P{}))
+		Expect(ss[0].Pixels.Pixel(5)).To(Equal(pixelN(1)))
+		Expect(ss[0].Pixels.Pixel(7)).To(Equal(pixelN(3)))
+
+		Expect(d1.packets).To(HaveLen(1))
+		ss = d1.packets[0].PixelPusher.StripStates
+		Expect(ss).To(HaveLen(2))
+		Expect(ss[1].StripNumber).To(BeEquivalentTo(1))
+		Expect(ss[1].Pixels.Pixel(0)).To(Equal(pixelN(5)))
+		Expect(ss[1].Pixels.Pixel(1)).To(Equal(pixelN(4)))
+
+		By("only sending physical devices whose pixels changed")
+		m.SetPixel(0, 0, pixelN(42))
+		Expect(s.SendPacket(m.SyncPacket())).To(Succeed())
+		Expect(d0.packets).To(HaveLen(2))
+		Expect(d1.packets).To(HaveLen(1))
+	})
+
+	It("reports an error if a physical device is not registered", func() {
+		d1.markDone()
+
+		var m Mutable
+		m.Initialize(c.DiscoveryHeaders())
+		m.SetPixel(0, 0, pixelN(1))
+
+		s, err := c.Sender()
+		Expect(err).ToNot(HaveOccurred())
+		Expect(s.SendPacket(m.SyncPacket())).ToNot(Succeed())
+
+		By("still sending to the registered device")
+		Expect(d0.packets).To(HaveLen(1))
+	})
+
+	It("rejects commands", func() {
+		s, err := c.Sender()
+		Expect(err).ToNot(HaveOccurred())
+
+		pkt := protocol.Packet{PixelPusher: &pixelpusher.Packet{Command: &pixelpusher.ResetCommand{}}}
+		Expect(s.SendPacket(&pkt)).ToNot(Succeed())
+	})
+})
+
+var _ = Describe("Sub-devices", func() {
+	var reg *Registry
+	var mg *Merger
+	var d *testD
+	BeforeEach(func() {
+		reg = &Registry{}
+		mg = MakeMerger(reg)
+
+		d = makeTestD("physical")
+		d.headers = makePixelPusherHeaders(1, 10)
+		d.headers.PixelPusher.Segments = 3
+		reg.Add(d)
+	})
+	AfterEach(func() {
+		Expect(mg.Close()).To(Succeed())
+		d.markDone()
+	})
+
+	It("splits a strip into its advertised segments", func() {
+		segs := StripSegments(d, 0)
+		Expect(segs).To(Equal([]Segment{
+			{DeviceID: "physical", Strip: 0, Offset: 0, Length: 4},
+			{DeviceID: "physical", Strip: 0, Offset: 4, Length: 3},
+			{DeviceID: "physical", Strip: 0, Offset: 7, Length: 3},
+		}))
+
+		Expect(StripSegments(d, 1)).To(BeNil())
+
+		d.headers.PixelPusher.Segments = 0
+		Expect(StripSegments(d, 0)).To(Equal([]Segment{
+			{DeviceID: "physical", Strip: 0, Offset: 0, Length: 10},
+		}))
+	})
+
+	It("merges writes from independent sub-devices", func() {
+		segs := StripSegments(d, 0)
+		a, err := MakeSubDevice("a", InvalidOrdinal(), mg, segs[0])
+		Expect(err).ToNot(HaveOccurred())
+		b, err := MakeSubDevice("b", InvalidOrdinal(), mg, segs[2])
+		Expect(err).ToNot(HaveOccurred())
+
+		send := func(sd *Composite, v pixel.P) {
+			var m Mutable
+			m.Initialize(sd.DiscoveryHeaders())
+			for i := 0; i < m.PixelsPerStrip(); i++ {
+				m.SetPixel(0, i, v)
+			}
+
+			s, err := sd.Sender()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(s.SendPacket(m.SyncPacket())).To(Succeed())
+		}
+		red, blue := pixel.P{Red: 0xFF}, pixel.P{Blue: 0xFF}
+
+		send(a, red)
+		send(b, blue)
+
+		Expect(d.packets).To(HaveLen(2))
+		px := &d.packets[1].PixelPusher.StripStates[0].Pixels
+		for i := 0; i < 10; i++ {
+			switch {
+			case i < 4:
+				Expect(px.Pixel(i)).To(Equal(red))
+			case i < 7:
+				Expect(px.Pixel(i)).To(Equal(pixel.P{}))
+			default:
+				Expect(px.Pixel(i)).To(Equal(blue))
+			}
+		}
+	})
+})
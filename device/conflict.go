@@ -0,0 +1,263 @@
+// Copyright 2018 Dan Jacques. All rights reserved.
+// Use of this source code is governed under the MIT License
+// that can be found in the LICENSE file.
+
+package device
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	// DefaultFlapThreshold is the default number of address changes within a
+	// Registry's FlapWindow that constitute flapping.
+	DefaultFlapThreshold = 3
+	// DefaultFlapWindow is the default window in which a Registry counts a
+	// device's address changes.
+	DefaultFlapWindow = time.Minute
+)
+
+// ConflictType is the type of a registration Conflict.
+type ConflictType string
+
+const (
+	// OrdinalConflict indicates that multiple devices claim the same ordinal.
+	OrdinalConflict ConflictType = "ordinal"
+	// AddressConflict indicates that multiple devices announce the same IP
+	// address.
+	AddressConflict ConflictType = "address"
+	// AddressFlapping indicates that a single device has repeatedly changed its
+	// IP address.
+	AddressFlapping ConflictType = "flapping"
+)
+
+// conflictTypes is the set of all ConflictType values.
+var conflictTypes = []ConflictType{OrdinalConflict, AddressConflict, AddressFlapping}
+
+// Conflict is a registration conflict detected by a Registry.
+type Conflict struct {
+	// Type is the type of conflict.
+	Type ConflictType
+
+	// DeviceIDs are the IDs of the devices involved in the conflict, sorted.
+	DeviceIDs []string
+
+	// Ordinal, for OrdinalConflict, is the contested ordinal.
+	Ordinal Ordinal
+	// Address, for AddressConflict, is the contested IP address. For
+	// AddressFlapping, it is the device's current IP address.
+	Address string
+	// Changes, for AddressFlapping, is the number of address changes within the
+	// Registry's FlapWindow.
+	Changes int
+
+	// Since is the time when the conflict was first detected.
+	Since time.Time
+}
+
+func (c *Conflict) String() string {
+	switch c.Type {
+	case OrdinalConflict:
+		return fmt.Sprintf("devices %v claim ordinal %s", c.DeviceIDs, &c.Ordinal)
+	case AddressConflict:
+		return fmt.Sprintf("devices %v announce address %s", c.DeviceIDs, c.Address)
+	case AddressFlapping:
+		return fmt.Sprintf("device %s changed address %d times (now %s)", c.DeviceIDs[0], c.Changes, c.Address)
+	default:
+		return string(c.Type)
+	}
+}
+
+// key returns a string that identifies this conflict, regardless of when it
+// was detected.
+func (c *Conflict) key() string {
+	switch c.Type {
+	case AddressFlapping:
+		// A flapping device's address and change count will vary while it flaps.
+		return fmt.Sprintf("%s|%v", c.Type, c.DeviceIDs)
+	default:
+		return fmt.Sprintf("%s|%v|%v|%s", c.Type, c.DeviceIDs, c.Ordinal, c.Address)
+	}
+}
+
+// TieBreakPolicy determines how a Registry chooses a device for an ordinal
+// that is claimed by multiple devices.
+type TieBreakPolicy int
+
+const (
+	// NoTieBreak chooses no device. GetUniqueOrdinal will return nil for
+	// conflicting ordinals.
+	NoTieBreak TieBreakPolicy = iota
+	// LowestID chooses the device with the lexicographically lowest ID.
+	LowestID
+	// FirstRegistered chooses the device that was registered first.
+	FirstRegistered
+)
+
+// choose selects a device from entries according to the policy. It returns
+// nil if no device could be chosen.
+func (p TieBreakPolicy) choose(entries map[*registryEntry]struct{}) *registryEntry {
+	var best *registryEntry
+	for e := range entries {
+		if IsDone(e.device) {
+			continue
+		}
+
+		switch {
+		case best == nil:
+			best = e
+		case p == LowestID && e.deviceID < best.deviceID:
+			best = e
+		case p == FirstRegistered && e.seq < best.seq:
+			best = e
+		}
+	}
+	return best
+}
+
+// Conflicts returns the Registry's current registration conflicts.
+func (reg *Registry) Conflicts() []Conflict {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+
+	reg.updateConflictsLocked(time.Now())
+
+	conflicts := make([]Conflict, 0, len(reg.conflicts))
+	for _, c := range reg.conflicts {
+		clone := *c
+		clone.DeviceIDs = append([]string(nil), c.DeviceIDs...)
+		conflicts = append(conflicts, clone)
+	}
+	sort.Slice(conflicts, func(i, j int) bool { return conflicts[i].key() < conflicts[j].key() })
+	return conflicts
+}
+
+// updateConflictsLocked recalculates the Registry's conflicts, logging and
+// updating metrics for conflicts that have been detected or resolved.
+func (reg *Registry) updateConflictsLocked(now time.Time) {
+	var detected []*Conflict
+	add := func(c *Conflict) {
+		sort.Strings(c.DeviceIDs)
+		detected = append(detected, c)
+	}
+
+	for ordinal, entries := range reg.ordinalMap {
+		if !ordinal.IsValid() {
+			continue
+		}
+		if ids := liveEntryIDs(entries); len(ids) > 1 {
+			add(&Conflict{Type: OrdinalConflict, DeviceIDs: ids, Ordinal: ordinal})
+		}
+	}
+
+	for addr, entries := range reg.addrMap {
+		if ids := liveEntryIDs(entries); len(ids) > 1 {
+			add(&Conflict{Type: AddressConflict, DeviceIDs: ids, Address: addr})
+		}
+	}
+
+	threshold, window := reg.flapParams()
+	for _, e := range reg.devices {
+		e.pruneAddrChanges(now, window)
+		if len(e.addrChanges) >= threshold && !IsDone(e.device) {
+			add(&Conflict{
+				Type:      AddressFlapping,
+				DeviceIDs: []string{e.deviceID},
+				Address:   e.registeredAddr,
+				Changes:   len(e.addrChanges),
+			})
+		}
+	}
+
+	conflicts := make(map[string]*Conflict, len(detected))
+	for _, c := range detected {
+		key := c.key()
+		if prev := reg.conflicts[key]; prev != nil {
+			c.Since = prev.Since
+		} else {
+			c.Since = now
+			reg.logger().Warnf("Registry conflict detected: %s", c)
+			registryConflictsDetected.With(prometheus.Labels{"type": string(c.Type)}).Inc()
+		}
+		conflicts[key] = c
+	}
+	for key, c := range reg.conflicts {
+		if _, ok := conflicts[key]; !ok {
+			reg.logger().Infof("Registry conflict resolved: %s", c)
+		}
+	}
+	reg.conflicts = conflicts
+
+	for _, t := range conflictTypes {
+		count := 0
+		for _, c := range conflicts {
+			if c.Type == t {
+				count++
+			}
+		}
+		registryConflictsGauge.With(prometheus.Labels{"type": string(t)}).Set(float64(count))
+	}
+}
+
+func (reg *Registry) flapParams() (threshold int, window time.Duration) {
+	threshold, window = reg.FlapThreshold, reg.FlapWindow
+	if threshold <= 0 {
+		threshold = DefaultFlapThreshold
+	}
+	if window <= 0 {
+		window = DefaultFlapWindow
+	}
+	return
+}
+
+// liveEntryIDs returns the IDs of the entries that are not done.
+func liveEntryIDs(entries map[*registryEntry]struct{}) []string {
+	var ids []string
+	for e := range entries {
+		if !IsDone(e.device) {
+			ids = append(ids, e.deviceID)
+		}
+	}
+	return ids
+}
+
+// deviceIPAddress returns the IP address of d, or an empty string if it has
+// none.
+func deviceIPAddress(d D) string {
+	var ip net.IP
+	switch addr := d.Addr().(type) {
+	case *net.UDPAddr:
+		if addr != nil {
+			ip = addr.IP
+		}
+	case *net.TCPAddr:
+		if addr != nil {
+			ip = addr.IP
+		}
+	case *net.IPAddr:
+		if addr != nil {
+			ip = addr.IP
+		}
+	}
+
+	if len(ip) == 0 || ip.IsUnspecified() {
+		return ""
+	}
+	return ip.String()
+}
+
+// pruneAddrChanges discards address changes that occurred before the window
+// ending at now.
+func (e *registryEntry) pruneAddrChanges(now time.Time, window time.Duration) {
+	cutoff := now.Add(-window)
+	i := 0
+	for i < len(e.addrChanges) && e.addrChanges[i].Before(cutoff) {
+		i++
+	}
+	e.addrChanges = e.addrChanges[i:]
+}
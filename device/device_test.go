@@ -5,7 +5,9 @@
 package device
 
 import (
+	"net"
 	"testing"
+	"time"
 
 	"github.com/danjacques/gopushpixels/protocol"
 
@@ -19,9 +21,12 @@ type testD struct {
 	id      string
 	ordinal Ordinal
 	headers protocol.DiscoveryHeaders
+	addr    net.Addr
 
 	datagrams [][]byte
 	packets   []*protocol.Packet
+	// packetTimes is the time at which each of packets was sent.
+	packetTimes []time.Time
 
 	doneC chan struct{}
 	done  bool
@@ -40,6 +45,7 @@ func (td *testD) DiscoveryHeaders() *protocol.DiscoveryHeaders {
 	return &td.headers
 }
 func (td *testD) DoneC() <-chan struct{} { return td.doneC }
+func (td *testD) Addr() net.Addr         { return td.addr }
 
 func (td *testD) Sender() (Sender, error) {
 	return &testSender{d: td}, nil
@@ -64,6 +70,7 @@ func (ts *testSender) SendDatagram(v []byte) error {
 
 func (ts *testSender) SendPacket(pkt *protocol.Packet) error {
 	ts.d.packets = append(ts.d.packets, pkt)
+	ts.d.packetTimes = append(ts.d.packetTimes, time.Now())
 	return nil
 }
 
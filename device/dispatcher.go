@@ -27,6 +27,13 @@ type packetDispatcher struct {
 	// logger is the logger to use. It must not be nil.
 	logger logging.L
 
+	// pacing, if not nil, enables paced dispatch. See Pacing for more
+	// information.
+	pacing *Pacing
+	// pacer is the dispatcher's asynchronous paced sender. It is created on
+	// start if pacing is not nil.
+	pacer *AsyncSender
+
 	// onShutdown is called when this packet dispatcher is shutdown. It is passed
 	// a pointer to the dispatcher instance that is being shut down.
 	onShutdown func(*packetDispatcher)
@@ -66,6 +73,13 @@ func (pd *packetDispatcher) RetainAndStart() error {
 	pd.shutdownC = make(chan struct{})
 	pd.refs = 1
 
+	if pd.pacing != nil {
+		pd.pacer = MakeAsyncSender(&pacedSender{
+			pd:     pd,
+			pacing: *pd.pacing,
+		})
+	}
+
 	// Automatically shutdown when our base Device is Done.
 	go pd.shutdownWhenDeviceIsDone()
 
@@ -105,6 +119,13 @@ func (pd *packetDispatcher) shutdownLocked() error {
 		pd.onShutdown(pd)
 	}
 
+	// Stop our pacer, sending any pending data.
+	if pd.pacer != nil {
+		if err := pd.pacer.Close(); err != nil {
+			pd.logger.Warnf("Failed to send final paced data: %s", err)
+		}
+	}
+
 	// Close our underlying connection.
 	err := pd.withSender(func(ds network.DatagramSender) error {
 		if err := pd.stream.Flush(ds); err != nil {
@@ -162,7 +183,15 @@ func (pd *packetDispatcher) SendDatagram(data []byte) error {
 //
 // SendPacket sends packet through the dispatcher state, blocking until the
 // packet has been successfully sent.
+//
+// If the dispatcher is paced, SendPacket will instead enqueue the packet and
+// return immediately. In this case, the returned error will be from a previous
+// failed asynchronous send, if any.
 func (pd *packetDispatcher) SendPacket(packet *protocol.Packet) error {
+	if pd.pacer != nil {
+		return pd.pacer.SendPacket(packet)
+	}
+
 	// Take out a lock on our PacketStream.
 	pd.mu.Lock()
 	defer pd.mu.Unlock()
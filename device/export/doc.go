@@ -0,0 +1,13 @@
+// Copyright 2018 Dan Jacques. All rights reserved.
+// Use of this source code is governed under the MIT License
+// that can be found in the LICENSE file.
+
+// Package export writes device Snapshots, and Snapshot histories, in formats
+// suitable for inspection by operators and external tools.
+//
+// A single Snapshot can be written as a PNG image, with a row of pixels for
+// each strip; as JSON; or as raw RGB bytes. A history window, as returned by
+// device.SnapshotManager's SnapshotHistory, can be written for a single strip
+// as a PNG image, with a row of pixels for each Snapshot (time flowing
+// downwards); as JSON; or as raw RGB bytes.
+package export
@@ -0,0 +1,172 @@
+// Copyright 2018 Dan Jacques. All rights reserved.
+// Use of this source code is governed under the MIT License
+// that can be found in the LICENSE file.
+
+package export
+
+import (
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+	"time"
+
+	"github.com/danjacques/gopushpixels/device"
+	"github.com/danjacques/gopushpixels/pixel"
+	"github.com/danjacques/gopushpixels/protocol/pixelpusher"
+
+	"github.com/pkg/errors"
+)
+
+// SnapshotPNG writes s to w as a PNG image.
+//
+// The image has a row for each strip, and a column for each pixel. Strips
+// that are shorter than the longest strip are padded with transparent pixels.
+func SnapshotPNG(w io.Writer, s *device.Snapshot) error {
+	width := 0
+	for _, ss := range s.Strips {
+		if l := ss.Pixels.Len(); l > width {
+			width = l
+		}
+	}
+
+	img := image.NewNRGBA(image.Rect(0, 0, width, len(s.Strips)))
+	for y, ss := range s.Strips {
+		drawRow(img, y, &ss.Pixels)
+	}
+	return png.Encode(w, img)
+}
+
+// HistoryPNG writes the specified strip of each Snapshot in history to w as a
+// PNG image.
+//
+// The image has a row for each Snapshot, oldest first, and a column for each
+// pixel. Snapshots that don't have the strip are drawn as transparent rows.
+func HistoryPNG(w io.Writer, history []*device.Snapshot, strip int) error {
+	width := 0
+	for _, s := range history {
+		if ss := getStrip(s, strip); ss != nil {
+			if l := ss.Pixels.Len(); l > width {
+				width = l
+			}
+		}
+	}
+	if width == 0 {
+		return errors.Errorf("no snapshot has strip #%d", strip)
+	}
+
+	img := image.NewNRGBA(image.Rect(0, 0, width, len(history)))
+	for y, s := range history {
+		if ss := getStrip(s, strip); ss != nil {
+			drawRow(img, y, &ss.Pixels)
+		}
+	}
+	return png.Encode(w, img)
+}
+
+// SnapshotRaw writes s to w as raw RGB bytes, with three bytes per pixel.
+//
+// Strips are written in order, each immediately following the last.
+func SnapshotRaw(w io.Writer, s *device.Snapshot) error {
+	for _, ss := range s.Strips {
+		if err := writeRaw(w, &ss.Pixels); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// HistoryRaw writes the specified strip of each Snapshot in history to w as
+// raw RGB bytes, with three bytes per pixel.
+//
+// Snapshots are written oldest first, each immediately following the last.
+// Snapshots that don't have the strip are skipped.
+func HistoryRaw(w io.Writer, history []*device.Snapshot, strip int) error {
+	for _, s := range history {
+		if ss := getStrip(s, strip); ss != nil {
+			if err := writeRaw(w, &ss.Pixels); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Strip is the JSON representation of a single strip.
+type Strip struct {
+	// Number is the strip number.
+	Number int `json:"strip"`
+	// Pixels are the strip's pixels, each as a hex "rrggbb" string.
+	Pixels []string `json:"pixels"`
+}
+
+// Snapshot is the JSON representation of a device.Snapshot.
+type Snapshot struct {
+	// ID is the snapshot device ID.
+	ID string `json:"id"`
+	// Time is the time when the snapshot's state was last updated.
+	Time time.Time `json:"time"`
+	// Strips are the device's strips.
+	Strips []*Strip `json:"strips"`
+}
+
+// MakeSnapshot converts s into its JSON representation.
+func MakeSnapshot(s *device.Snapshot) *Snapshot {
+	js := Snapshot{
+		ID:     s.ID,
+		Time:   s.Time,
+		Strips: make([]*Strip, len(s.Strips)),
+	}
+	for i, ss := range s.Strips {
+		st := Strip{
+			Number: int(ss.StripNumber),
+			Pixels: make([]string, ss.Pixels.Len()),
+		}
+		for j := range st.Pixels {
+			p := ss.Pixels.Pixel(j)
+			st.Pixels[j] = fmt.Sprintf("%02x%02x%02x", p.Red, p.Green, p.Blue)
+		}
+		js.Strips[i] = &st
+	}
+	return &js
+}
+
+// SnapshotJSON writes s to w as JSON.
+func SnapshotJSON(w io.Writer, s *device.Snapshot) error {
+	return json.NewEncoder(w).Encode(MakeSnapshot(s))
+}
+
+// HistoryJSON writes history to w as a JSON array of snapshots, oldest first.
+func HistoryJSON(w io.Writer, history []*device.Snapshot) error {
+	js := make([]*Snapshot, len(history))
+	for i, s := range history {
+		js[i] = MakeSnapshot(s)
+	}
+	return json.NewEncoder(w).Encode(js)
+}
+
+func getStrip(s *device.Snapshot, strip int) *pixelpusher.StripState {
+	if strip < 0 || strip >= len(s.Strips) {
+		return nil
+	}
+	return s.Strips[strip]
+}
+
+func drawRow(img *image.NRGBA, y int, pixels *pixel.Buffer) {
+	for x := 0; x < pixels.Len(); x++ {
+		p := pixels.Pixel(x)
+		img.SetNRGBA(x, y, color.NRGBA{R: p.Red, G: p.Green, B: p.Blue, A: 0xFF})
+	}
+}
+
+func writeRaw(w io.Writer, pixels *pixel.Buffer) error {
+	buf := make([]byte, 0, pixels.Len()*3)
+	for i := 0; i < pixels.Len(); i++ {
+		p := pixels.Pixel(i)
+		buf = append(buf, p.Red, p.Green, p.Blue)
+	}
+	_, err := w.Write(buf)
+	return err
+}
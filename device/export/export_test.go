@@ -0,0 +1,111 @@
+// Copyright 2018 Dan Jacques. All rights reserved.
+// Use of this source code is governed under the MIT License
+// that can be found in the LICENSE file.
+
+package export
+
+import (
+	"bytes"
+	"encoding/json"
+	"image/color"
+	"image/png"
+	"testing"
+	"time"
+
+	"github.com/danjacques/gopushpixels/device"
+	"github.com/danjacques/gopushpixels/pixel"
+	"github.com/danjacques/gopushpixels/protocol/pixelpusher"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+func makeSnapshot(t time.Time, strips ...[]pixel.P) *device.Snapshot {
+	s := device.Snapshot{
+		ID:     "foo",
+		Time:   t,
+		Strips: make([]*pixelpusher.StripState, len(strips)),
+	}
+	for i, pixels := range strips {
+		ss := pixelpusher.StripState{StripNumber: pixelpusher.StripNumber(i)}
+		ss.Pixels.Reset(len(pixels))
+		ss.Pixels.SetPixels(pixels...)
+		s.Strips[i] = &ss
+	}
+	return &s
+}
+
+var _ = Describe("Export", func() {
+	red, green, blue := pixel.P{Red: 0xFF}, pixel.P{Green: 0xFF}, pixel.P{Blue: 0xFF}
+	now := time.Date(2018, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	var s0, s1 *device.Snapshot
+	BeforeEach(func() {
+		s0 = makeSnapshot(now, []pixel.P{red, green, blue}, []pixel.P{blue})
+		s1 = makeSnapshot(now.Add(time.Second), []pixel.P{blue, blue, red})
+	})
+
+	It("writes a snapshot as a PNG", func() {
+		var buf bytes.Buffer
+		Expect(SnapshotPNG(&buf, s0)).To(Succeed())
+
+		img, err := png.Decode(&buf)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(img.Bounds().Dx()).To(Equal(3))
+		Expect(img.Bounds().Dy()).To(Equal(2))
+
+		nrgba := color.NRGBAModel.Convert
+		Expect(nrgba(img.At(1, 0))).To(Equal(color.NRGBA{G: 0xFF, A: 0xFF}))
+		Expect(nrgba(img.At(0, 1))).To(Equal(color.NRGBA{B: 0xFF, A: 0xFF}))
+		Expect(nrgba(img.At(1, 1)).(color.NRGBA).A).To(BeZero())
+	})
+
+	It("writes a history window as a PNG", func() {
+		var buf bytes.Buffer
+		Expect(HistoryPNG(&buf, []*device.Snapshot{s0, s1}, 0)).To(Succeed())
+
+		img, err := png.Decode(&buf)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(img.Bounds().Dx()).To(Equal(3))
+		Expect(img.Bounds().Dy()).To(Equal(2))
+
+		nrgba := color.NRGBAModel.Convert
+		Expect(nrgba(img.At(2, 0))).To(Equal(color.NRGBA{B: 0xFF, A: 0xFF}))
+		Expect(nrgba(img.At(2, 1))).To(Equal(color.NRGBA{R: 0xFF, A: 0xFF}))
+
+		Expect(HistoryPNG(&buf, []*device.Snapshot{s0, s1}, 2)).ToNot(Succeed())
+	})
+
+	It("writes raw RGB", func() {
+		var buf bytes.Buffer
+		Expect(SnapshotRaw(&buf, s0)).To(Succeed())
+		Expect(buf.Bytes()).To(Equal([]byte{
+			0xFF, 0, 0, 0, 0xFF, 0, 0, 0, 0xFF,
+			0, 0, 0xFF,
+		}))
+
+		buf.Reset()
+		Expect(HistoryRaw(&buf, []*device.Snapshot{s0, s1}, 1)).To(Succeed())
+		Expect(buf.Bytes()).To(Equal([]byte{0, 0, 0xFF}))
+	})
+
+	It("writes JSON", func() {
+		var buf bytes.Buffer
+		Expect(HistoryJSON(&buf, []*device.Snapshot{s0, s1})).To(Succeed())
+
+		var history []*Snapshot
+		Expect(json.Unmarshal(buf.Bytes(), &history)).To(Succeed())
+		Expect(history).To(HaveLen(2))
+		Expect(history[0].ID).To(Equal("foo"))
+		Expect(history[0].Time.Equal(now)).To(BeTrue())
+		Expect(history[0].Strips).To(Equal([]*Strip{
+			{Number: 0, Pixels: []string{"ff0000", "00ff00", "0000ff"}},
+			{Number: 1, Pixels: []string{"0000ff"}},
+		}))
+	})
+})
+
+func TestExport(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Export")
+}
@@ -0,0 +1,184 @@
+// Copyright 2018 Dan Jacques. All rights reserved.
+// Use of this source code is governed under the MIT License
+// that can be found in the LICENSE file.
+
+package device
+
+import (
+	"sort"
+	"time"
+
+	"github.com/danjacques/gopushpixels/protocol"
+
+	"github.com/pkg/errors"
+)
+
+// Frame is a set of packets, potentially spanning many devices, which are
+// staged and then sent together.
+//
+// Routing a packet through a Router sends it immediately, so when a single
+// animation spans many devices, each device updates at a slightly different
+// moment. A Frame instead stages packets until Commit is called, and then
+// sends all staged packets back to back in a tight burst.
+//
+// A Frame is created by a Router's BeginFrame method. Once committed or
+// discarded, a Frame may not be reused.
+//
+// Frame is not safe for concurrent use.
+type Frame struct {
+	r *Router
+
+	// entries are the per-device staged packets, in the order in which the
+	// devices were first staged.
+	entries []*frameEntry
+	// entryMap maps a device's connection to its entry.
+	entryMap map[*routerConnection]*frameEntry
+
+	// finished is true if the frame has been committed or discarded.
+	finished bool
+}
+
+// frameEntry is the set of packets staged for a single device.
+type frameEntry struct {
+	rc   *routerConnection
+	pkts []*protocol.Packet
+
+	// delay is the amount of time after the start of the commit to wait before
+	// sending to this device.
+	delay time.Duration
+}
+
+// BeginFrame begins a new Frame.
+//
+// The Frame must be either committed or discarded when finished.
+func (r *Router) BeginFrame() *Frame {
+	return &Frame{
+		r: r,
+	}
+}
+
+// Route stages a packet for the device identified by the specified ordinal or
+// id. The device is resolved immediately, using the same rules as the Router's
+// Route method.
+//
+// If no device could be found, Route returns ErrNoRoute, and the packet will
+// not be staged.
+//
+// pkt is retained by the Frame until it is committed or discarded, and must
+// not be modified until then.
+func (f *Frame) Route(ordinal Ordinal, id string, pkt *protocol.Packet) error {
+	if f.finished {
+		return errors.New("frame is already finished")
+	}
+
+	rcs, err := f.r.resolve(ordinal, id)
+	if err != nil {
+		return err
+	}
+	f.stage(rcs, pkt)
+	return nil
+}
+
+func (f *Frame) stage(rcs []*routerConnection, pkt *protocol.Packet) {
+	for _, rc := range rcs {
+		e := f.entryMap[rc]
+		if e == nil {
+			e = &frameEntry{rc: rc}
+			if f.entryMap == nil {
+				f.entryMap = make(map[*routerConnection]*frameEntry)
+			}
+			f.entryMap[rc] = e
+			f.entries = append(f.entries, e)
+		}
+		e.pkts = append(e.pkts, pkt)
+	}
+}
+
+// RouteMutable stages the synchronizing packet generated by m (see Mutable's
+// SyncPacket) for the device identified by the specified ordinal or id.
+//
+// If m has no modifications, nothing will be staged, and RouteMutable will
+// return nil.
+//
+// Note that m's modifications are cleared when the packet is generated,
+// regardless of whether the packet is ultimately committed.
+func (f *Frame) RouteMutable(ordinal Ordinal, id string, m *Mutable) error {
+	if f.finished {
+		return errors.New("frame is already finished")
+	}
+
+	// Resolve the device before generating the packet, so that m retains its
+	// modifications if the device cannot be found.
+	rcs, err := f.r.resolve(ordinal, id)
+	if err != nil {
+		return err
+	}
+
+	if pkt := m.SyncPacket(); pkt != nil {
+		f.stage(rcs, pkt)
+	}
+	return nil
+}
+
+// Discard discards the Frame's staged packets without sending them.
+func (f *Frame) Discard() {
+	f.entries, f.entryMap = nil, nil
+	f.finished = true
+}
+
+// Commit sends all staged packets.
+//
+// The Router's Listeners are notified of every staged packet first. Afterwards,
+// each device's packets are sent back to back. If the Router has a Skew
+// function, each device's send is delayed so that all devices update together.
+//
+// Commit attempts to send to every device, even if some sends fail. If any
+// sends failed, the first error will be returned.
+func (f *Frame) Commit() error {
+	if f.finished {
+		return errors.New("frame is already finished")
+	}
+	entries := f.entries
+	f.Discard()
+
+	// Dispatch to our listeners before sending, so that listeners don't slow
+	// down our burst.
+	for _, e := range entries {
+		for _, pkt := range e.pkts {
+			f.r.dispatchPacketToListeners(e.rc.device, pkt)
+		}
+	}
+
+	// Calculate each entry's delay, and order our entries by it. Devices with the
+	// largest skew are sent to first, with no delay.
+	if skew := f.r.Skew; skew != nil {
+		var maxSkew time.Duration
+		for _, e := range entries {
+			e.delay = skew(e.rc.device)
+			if e.delay > maxSkew {
+				maxSkew = e.delay
+			}
+		}
+		for _, e := range entries {
+			e.delay = maxSkew - e.delay
+		}
+		sort.SliceStable(entries, func(i, j int) bool { return entries[i].delay < entries[j].delay })
+	}
+
+	var err error
+	start := time.Now()
+	for _, e := range entries {
+		if e.delay > 0 {
+			if wait := time.Until(start.Add(e.delay)); wait > 0 {
+				time.Sleep(wait)
+			}
+		}
+
+		for _, pkt := range e.pkts {
+			if serr := e.rc.sendPacket(pkt); serr != nil && err == nil {
+				err = errors.Wrapf(serr, "failed to send to %s", e.rc.device.ID())
+			}
+		}
+	}
+	return err
+}
@@ -28,7 +28,7 @@ type Local struct {
 	DeviceID string
 
 	// OnPacketData is wthe callback that is called when new packet data is
-	// received.
+	// received. addr is the address of the packet's sender.
 	//
 	// OnPacketData must not be nil.
 	//
@@ -36,7 +36,7 @@ type Local struct {
 	// Retain it and Release it to prevent it from reentering the pool. The buffer
 	// that is handed to the callback is automatically Released when the callback
 	// returns; the callback SHOULD NOT release the buffer.
-	OnPacketData func(buf *bufferpool.Buffer)
+	OnPacketData func(buf *bufferpool.Buffer, addr *net.UDPAddr)
 
 	// UDPPacketPool, if not nil, is the packet pool to use for UDP packet data.
 	//
@@ -217,11 +217,11 @@ func (d *Local) listenForPackets() {
 		d.logger.Debugf("Received packet from %s (%d byte(s)) on %s:\n%s",
 			addr, size, d.DeviceID, fmtutil.Hex(buf.Bytes()))
 
-		d.dispatchPacketToCallback(buf)
+		d.dispatchPacketToCallback(buf, addr)
 	}
 }
 
-func (d *Local) dispatchPacketToCallback(buf *bufferpool.Buffer) {
+func (d *Local) dispatchPacketToCallback(buf *bufferpool.Buffer, addr *net.UDPAddr) {
 	defer buf.Release()
 
 	defer func() {
@@ -229,5 +229,5 @@ func (d *Local) dispatchPacketToCallback(buf *bufferpool.Buffer) {
 			d.logger.Warnf("Dropping panic in callback: %s", err)
 		}
 	}()
-	d.OnPacketData(buf)
+	d.OnPacketData(buf, addr)
 }
@@ -0,0 +1,215 @@
+// Copyright 2018 Dan Jacques. All rights reserved.
+// Use of this source code is governed under the MIT License
+// that can be found in the LICENSE file.
+
+package device
+
+import (
+	"sync"
+
+	"github.com/danjacques/gopushpixels/protocol/pixelpusher"
+
+	"github.com/pkg/errors"
+)
+
+// Merger assembles full physical strip packets from writes to ranges of pixels
+// on those strips.
+//
+// A Merger holds the current pixel state of each physical device that it has
+// written to. Each write updates only the pixels that it covers, and the
+// physical device is sent its full, merged strips. This allows several
+// virtual devices (see Composite) that share a Merger to each own a different
+// range of the same physical strip without clobbering each other.
+//
+// Physical devices are resolved by ID through a Registry at write time, so a
+// Merger tracks physical devices as they are rediscovered.
+//
+// Merger is safe for concurrent use.
+type Merger struct {
+	reg *Registry
+
+	// mu protects the following data, and serializes writes.
+	mu sync.Mutex
+	// targets are the physical devices, keyed on their device ID.
+	targets map[string]*mergerTarget
+	// closed is true if the Merger has been closed.
+	closed bool
+}
+
+// mergerTarget is the state of a single physical device.
+type mergerTarget struct {
+	d      D
+	sender Sender
+	m      Mutable
+}
+
+// MakeMerger creates a new Merger whose physical devices are resolved through
+// reg, which must not be nil.
+func MakeMerger(reg *Registry) *Merger {
+	return &Merger{reg: reg}
+}
+
+// Close closes the Merger's physical device Senders. Subsequent writes will
+// fail.
+func (mg *Merger) Close() error {
+	mg.mu.Lock()
+	defer mg.mu.Unlock()
+
+	mg.closed = true
+
+	var err error
+	for id, t := range mg.targets {
+		if cerr := t.sender.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+		delete(mg.targets, id)
+	}
+	return err
+}
+
+// write maps the pixels in pp's strip states through strips into their
+// physical devices, and sends each physical device that was modified.
+//
+// If a physical device could not be resolved, or a send fails, the remaining
+// physical devices are still sent to, and the first error is returned.
+func (mg *Merger) write(strips []CompositeStrip, pp *pixelpusher.Packet) error {
+	mg.mu.Lock()
+	defer mg.mu.Unlock()
+
+	if mg.closed {
+		return errors.New("merger is closed")
+	}
+
+	var err error
+	touched := make([]*mergerTarget, 0, len(mg.targets))
+	for _, ss := range pp.StripStates {
+		if int(ss.StripNumber) >= len(strips) {
+			continue
+		}
+
+		pos := 0
+		for _, seg := range strips[ss.StripNumber].Segments {
+			t, terr := mg.getTargetLocked(seg.DeviceID)
+			if terr != nil {
+				if err == nil {
+					err = terr
+				}
+				pos += seg.Length
+				continue
+			}
+
+			for i := 0; i < seg.Length && pos+i < ss.Pixels.Len(); i++ {
+				idx := i
+				if seg.Reverse {
+					idx = seg.Length - 1 - i
+				}
+				t.m.SetPixel(seg.Strip, seg.Offset+idx, ss.Pixels.Pixel(pos+i))
+			}
+			pos += seg.Length
+			touched = appendTargetOnce(touched, t)
+		}
+	}
+
+	for _, t := range touched {
+		tpkt := t.m.SyncPacket()
+		if tpkt == nil {
+			continue
+		}
+		if serr := t.sender.SendPacket(tpkt); serr != nil && err == nil {
+			err = errors.Wrapf(serr, "failed to send to %s", t.d.ID())
+		}
+	}
+	return err
+}
+
+// getTargetLocked returns the target for the physical device with the
+// specified ID, resolving it through the Merger's Registry.
+//
+// If the physical device has changed since it was last resolved (e.g., it was
+// rediscovered), its Sender is replaced and its full state will be resent.
+func (mg *Merger) getTargetLocked(id string) (*mergerTarget, error) {
+	d := mg.reg.Get(id)
+	if d == nil {
+		return nil, errors.Errorf("physical device %q is not registered", id)
+	}
+
+	t := mg.targets[id]
+	if t != nil && t.d == d {
+		return t, nil
+	}
+
+	sender, err := d.Sender()
+	if err != nil {
+		return nil, errors.Wrapf(err, "could not create Sender for %s", id)
+	}
+
+	if t == nil {
+		t = &mergerTarget{}
+		if mg.targets == nil {
+			mg.targets = make(map[string]*mergerTarget)
+		}
+		mg.targets[id] = t
+	} else if t.sender != nil {
+		_ = t.sender.Close()
+	}
+	t.d, t.sender = d, sender
+
+	// (Re)initialize our physical state, and mark it all modified so that the
+	// new device receives its full state. Initialize retains the pixels of
+	// strips whose layout hasn't changed.
+	t.m.Initialize(d.DiscoveryHeaders())
+	for i := range t.m.strips {
+		t.m.strips[i].modified = true
+	}
+	return t, nil
+}
+
+func appendTargetOnce(targets []*mergerTarget, t *mergerTarget) []*mergerTarget {
+	for _, existing := range targets {
+		if existing == t {
+			return targets
+		}
+	}
+	return append(targets, t)
+}
+
+// StripSegments divides strip of the physical device d into the number of
+// segments that it advertises in its discovery headers, returning a Segment
+// for each.
+//
+// If d doesn't advertise segments, StripSegments returns a single Segment
+// spanning the full strip. If strip doesn't exist, StripSegments returns nil.
+//
+// The returned Segments can be used to construct sub-devices with
+// MakeSubDevice.
+func StripSegments(d D, strip int) []Segment {
+	dh := d.DiscoveryHeaders()
+	if dh == nil || dh.PixelPusher == nil || strip < 0 || strip >= dh.NumStrips() {
+		return nil
+	}
+	pp := dh.PixelPusher
+
+	pixels := int(pp.PixelsPerStrip)
+	count := int(pp.Segments)
+	if count <= 0 || count > pixels {
+		count = 1
+	}
+
+	segs := make([]Segment, count)
+	offset := 0
+	for i := range segs {
+		// Distribute any remainder across the leading segments.
+		length := pixels / count
+		if i < pixels%count {
+			length++
+		}
+		segs[i] = Segment{
+			DeviceID: d.ID(),
+			Strip:    strip,
+			Offset:   offset,
+			Length:   length,
+		}
+		offset += length
+	}
+	return segs
+}
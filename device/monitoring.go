@@ -47,6 +47,42 @@ var (
 		Help: "Count of errors encountered writing packets to a remote device.",
 	},
 		[]string{"type", "id"})
+
+	registryConflictsGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "device_registry_conflicts",
+		Help: "Number of current device registry conflicts, by type.",
+	},
+		[]string{"type"})
+
+	registryConflictsDetected = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "device_registry_conflicts_detected",
+		Help: "Count of device registry conflicts that have been detected, by type.",
+	},
+		[]string{"type"})
+
+	listenerDelivered = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "router_listener_delivered",
+		Help: "Count of packets delivered to an asynchronous Router listener.",
+	},
+		[]string{"listener"})
+
+	listenerDropped = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "router_listener_dropped",
+		Help: "Count of packets dropped due to asynchronous Router listener overflow.",
+	},
+		[]string{"listener"})
+
+	listenerPanics = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "router_listener_panics",
+		Help: "Count of panics recovered from an asynchronous Router listener.",
+	},
+		[]string{"listener"})
+
+	listenerLagGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "router_listener_lag_seconds",
+		Help: "Time that the most recently delivered packet spent queued for an asynchronous Router listener.",
+	},
+		[]string{"listener"})
 )
 
 // RegisterMonitoring registers all of this package's monitoring metrics.
@@ -58,6 +94,12 @@ func RegisterMonitoring(reg prometheus.Registerer) {
 		deviceWritePackets,
 		deviceWriteBytes,
 		deviceWriteErrors,
+		registryConflictsGauge,
+		registryConflictsDetected,
+		listenerDelivered,
+		listenerDropped,
+		listenerPanics,
+		listenerLagGauge,
 	)
 }
 
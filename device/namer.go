@@ -0,0 +1,32 @@
+// Copyright 2018 Dan Jacques. All rights reserved.
+// Use of this source code is governed under the MIT License
+// that can be found in the LICENSE file.
+
+package device
+
+// Namer maps device IDs to human-friendly names, and back.
+//
+// A Namer can be installed in a Router, allowing routes and routing rules to
+// refer to devices by name instead of by ID.
+type Namer interface {
+	// Name returns the name assigned to the device with the specified ID. If
+	// the device has no name, Name returns an empty string.
+	Name(id string) string
+
+	// ResolveName returns the ID of the device that has been assigned name. If
+	// no device has been assigned name, ResolveName returns an empty string.
+	ResolveName(name string) string
+}
+
+// resolveID returns the device ID that id refers to. If n is not nil and id is
+// the name of a device, that device's ID is returned. Otherwise, id is
+// returned unmodified.
+func resolveID(n Namer, id string) string {
+	if n == nil || id == "" {
+		return id
+	}
+	if resolved := n.ResolveName(id); resolved != "" {
+		return resolved
+	}
+	return id
+}
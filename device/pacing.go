@@ -0,0 +1,105 @@
+// Copyright 2018 Dan Jacques. All rights reserved.
+// Use of this source code is governed under the MIT License
+// that can be found in the LICENSE file.
+
+package device
+
+import (
+	"time"
+
+	"github.com/danjacques/gopushpixels/protocol"
+	"github.com/danjacques/gopushpixels/support/network"
+)
+
+// Pacing configures paced packet dispatch for a Remote device.
+//
+// By default, a Remote's Sender sends packets as fast as they are supplied,
+// which can overrun slower devices. With pacing enabled, SendPacket enqueues
+// the packet and returns immediately, and a dedicated goroutine sends enqueued
+// data, spacing successive datagrams by the device's advertised update period
+// (see pixelpusher.Device's UpdatePeriodDuration). The period is read from the
+// device's current headers before each datagram, so it adapts as discovery
+// updates them.
+//
+// If packets are supplied faster than they can be sent, pending pixel data is
+// coalesced, so that only the latest state of each strip is sent. See
+// AsyncSender for more information.
+//
+// Raw datagrams sent through a Sender's SendDatagram method are not paced.
+type Pacing struct {
+	// MinPeriod is the minimum amount of time in between datagrams. It is used
+	// if the device advertises a shorter (or no) update period.
+	MinPeriod time.Duration
+
+	// MaxPeriod, if > 0, is the maximum amount of time in between datagrams,
+	// regardless of the device's advertised update period.
+	MaxPeriod time.Duration
+}
+
+// period returns the amount of time to wait in between datagrams sent to d.
+func (p *Pacing) period(d D) time.Duration {
+	var period time.Duration
+	if dh := d.DiscoveryHeaders(); dh != nil && dh.PixelPusher != nil {
+		period = dh.PixelPusher.UpdatePeriodDuration()
+	}
+
+	if period < p.MinPeriod {
+		period = p.MinPeriod
+	}
+	if p.MaxPeriod > 0 && period > p.MaxPeriod {
+		period = p.MaxPeriod
+	}
+	return period
+}
+
+// pacedSender is a Sender that sends packets through a packetDispatcher's
+// PacketStream, spacing out the resulting datagrams. It is wrapped in an
+// AsyncSender to implement paced dispatch.
+//
+// While a pacedSender is in use, it has exclusive use of its dispatcher's
+// PacketStream.
+type pacedSender struct {
+	pd     *packetDispatcher
+	pacing Pacing
+
+	// lastSent is the time when the last datagram was sent.
+	lastSent time.Time
+}
+
+// SendPacket implements Sender.
+func (ps *pacedSender) SendPacket(pkt *protocol.Packet) error {
+	// Flush after each packet so that commands and pixel data are sent in order.
+	if err := ps.pd.stream.Send(ps, pkt); err != nil {
+		return err
+	}
+	return ps.pd.stream.Flush(ps)
+}
+
+// SendDatagram implements network.DatagramSender.
+//
+// It blocks until the device's update period has elapsed since the last
+// datagram was sent, then sends data through the dispatcher.
+func (ps *pacedSender) SendDatagram(data []byte) error {
+	if !ps.lastSent.IsZero() {
+		if delay := time.Until(ps.lastSent.Add(ps.pacing.period(ps.pd.d))); delay > 0 {
+			time.Sleep(delay)
+		}
+	}
+
+	err := ps.pd.SendDatagram(data)
+	ps.lastSent = time.Now()
+	return err
+}
+
+// MaxDatagramSize implements network.DatagramSender.
+func (ps *pacedSender) MaxDatagramSize() (v int) {
+	_ = ps.pd.withSender(func(ds network.DatagramSender) error {
+		v = ds.MaxDatagramSize()
+		return nil
+	})
+	return
+}
+
+// Close implements network.DatagramSender. The dispatcher's connection is owned
+// by the dispatcher, so Close does nothing.
+func (ps *pacedSender) Close() error { return nil }
@@ -5,13 +5,42 @@
 package device
 
 import (
+	"context"
 	"sort"
 	"sync"
+	"time"
+
+	"github.com/danjacques/gopushpixels/protocol"
+	"github.com/danjacques/gopushpixels/support/logging"
 )
 
 // Registry is a generic device registry. It tracks devices by ID, records
 // which group devices belong to, and removes device entries when they expire.
+//
+// Changes to the Registry's devices can be observed using Watch.
+//
+// The Registry detects registration conflicts: multiple devices claiming the
+// same ordinal, multiple devices announcing the same IP address, and devices
+// whose IP address repeatedly changes. Conflicts are logged, exported as
+// metrics, and can be queried using Conflicts.
 type Registry struct {
+	// Logger, if not nil, is the logger to use. Registration conflicts are
+	// logged as they are detected and resolved.
+	Logger logging.L
+
+	// TieBreak is the policy used by GetUniqueOrdinal to choose a device for an
+	// ordinal that is claimed by multiple devices. The default, NoTieBreak,
+	// chooses no device.
+	TieBreak TieBreakPolicy
+
+	// FlapThreshold is the number of IP address changes within FlapWindow after
+	// which a device is considered to be flapping. If <= 0,
+	// DefaultFlapThreshold will be used.
+	FlapThreshold int
+	// FlapWindow is the window in which address changes are counted. If <= 0,
+	// DefaultFlapWindow will be used.
+	FlapWindow time.Duration
+
 	mu sync.RWMutex
 	// Map of active devices.
 	devices map[string]*registryEntry
@@ -19,6 +48,39 @@ type Registry struct {
 	groupMap map[int]map[*registryEntry]struct{}
 	// Maintain a map of the devices that claim an Ordinal.
 	ordinalMap map[Ordinal]map[*registryEntry]struct{}
+	// Maintain a map of the devices that announce an IP address.
+	addrMap map[string]map[*registryEntry]struct{}
+
+	// conflicts is the current set of registration conflicts, keyed on their
+	// key.
+	conflicts map[string]*Conflict
+	// nextSeq is the registration sequence number of the next new entry.
+	nextSeq uint64
+
+	// watchers receive events when devices are added, updated, or removed.
+	watchers RegistryWatchers
+}
+
+// Watch returns a channel that receives an event whenever a device is added to
+// the Registry, has its discovery headers or ordinal changed, or is removed.
+//
+// The channel first receives an Initial DeviceAdded event for each device that
+// is currently registered, sorted by ID. It is closed when c is cancelled.
+func (reg *Registry) Watch(c context.Context) <-chan RegistryEvent {
+	reg.mu.RLock()
+	defer reg.mu.RUnlock()
+
+	snapshot := make([]D, 0, len(reg.devices))
+	for _, e := range reg.devices {
+		if !IsDone(e.device) {
+			snapshot = append(snapshot, e.device)
+		}
+	}
+	sort.Slice(snapshot, func(i, j int) bool {
+		return snapshot[i].ID() < snapshot[j].ID()
+	})
+
+	return reg.watchers.Watch(c, snapshot)
 }
 
 // Add adds or update's d's registration in the Registry.
@@ -46,7 +108,9 @@ func (reg *Registry) Add(d D) {
 			reg:      reg,
 			device:   d,
 			deviceID: id,
+			seq:      reg.nextSeq,
 		}
+		reg.nextSeq++
 
 		if reg.devices == nil {
 			reg.devices = make(map[string]*registryEntry)
@@ -55,12 +119,44 @@ func (reg *Registry) Add(d D) {
 		isNew = true
 	}
 
-	// Update our device group accounting.
+	// Determine what has changed since the device was last observed.
+	dh := e.device.DiscoveryHeaders()
+	var changes []protocol.HeaderChange
+	if !isNew {
+		changes = protocol.DiffDiscoveryHeaders(e.headers, dh)
+		if len(changes) == 0 {
+			if ordinal := e.device.Ordinal(); ordinal != e.registeredOrdinal {
+				changes = append(changes, protocol.HeaderChange{
+					Field: "Ordinal",
+					Old:   e.registeredOrdinal,
+					New:   ordinal,
+				})
+			}
+		}
+	}
+
+	// Always refresh our headers, even if nothing reportable changed, so that
+	// volatile fields like DeltaSequence are diffed against their latest value.
+	e.headers = nil
+	if dh != nil {
+		e.headers = dh.Clone()
+	}
+
+	// Update our device group and address accounting, and check for conflicts.
+	now := time.Now()
 	reg.updateOrdinalLocked(e, isNew)
+	reg.updateAddrLocked(e, isNew, now)
+	reg.updateConflictsLocked(now)
+
+	switch {
+	case isNew:
+		reg.watchers.Send(RegistryEvent{Type: DeviceAdded, Device: e.device})
 
-	if isNew {
 		// Unregister the device from the Registry when it is Done.
 		go e.manageEntryLifecycle()
+
+	case len(changes) > 0:
+		reg.watchers.Send(RegistryEvent{Type: DeviceUpdated, Device: e.device, Changes: changes})
 	}
 }
 
@@ -86,6 +182,23 @@ func (reg *Registry) checkDeviceRegistration(id string) bool {
 		return false
 	}
 
+	// Has the device's address changed?
+	if deviceIPAddress(e.device) != e.registeredAddr {
+		return false
+	}
+
+	// Have the device's headers changed since they were last registered?
+	dh := e.device.DiscoveryHeaders()
+	if len(protocol.DiffDiscoveryHeaders(e.headers, dh)) > 0 {
+		return false
+	}
+
+	// Has the device's DeltaSequence increased? This isn't reported as a change,
+	// but we must record it so that a later reset is.
+	if headersDeltaSequence(e.headers) != headersDeltaSequence(dh) {
+		return false
+	}
+
 	// Finally, is the device Done? If so, we will have to reregister.
 	if IsDone(e.device) {
 		return false
@@ -93,6 +206,15 @@ func (reg *Registry) checkDeviceRegistration(id string) bool {
 	return true
 }
 
+// headersDeltaSequence returns dh's PixelPusher DeltaSequence, or 0 if it has
+// none.
+func headersDeltaSequence(dh *protocol.DiscoveryHeaders) uint32 {
+	if dh != nil && dh.PixelPusher != nil {
+		return dh.PixelPusher.DeltaSequence
+	}
+	return 0
+}
+
 // Get returns the registered device for the specified ID.
 //
 // If no device is registered for this ID, Get will return nil.
@@ -115,12 +237,19 @@ func (reg *Registry) Get(id string) D {
 // GetUniqueOrdinal returns the registered device for the specified ordinal.
 //
 // If there is no device that is uniquely registered for o, GetOrdinal will
-// return nil.
+// return nil, unless the Registry's TieBreak policy chooses one of the devices
+// registered for o.
 func (reg *Registry) GetUniqueOrdinal(o Ordinal) D {
 	reg.mu.RLock()
 	defer reg.mu.RUnlock()
 
 	emap := reg.ordinalMap[o]
+	if len(emap) > 1 && reg.TieBreak != NoTieBreak {
+		if e := reg.TieBreak.choose(emap); e != nil {
+			return e.device
+		}
+		return nil
+	}
 	if len(emap) == 1 {
 		// Exactly one device is registered for this Ordinal.
 		for e := range emap {
@@ -224,6 +353,45 @@ func (reg *Registry) updateOrdinalLocked(e *registryEntry, isNew bool) {
 	}
 }
 
+func (reg *Registry) updateAddrLocked(e *registryEntry, isNew bool, now time.Time) {
+	addr := deviceIPAddress(e.device)
+	if !isNew && e.registeredAddr == addr {
+		return
+	}
+
+	if !isNew {
+		if e.registeredAddr != "" && addr != "" {
+			// The device has changed its address.
+			e.addrChanges = append(e.addrChanges, now)
+		}
+		reg.removeFromAddrMapLocked(e)
+	}
+
+	if addr != "" {
+		if reg.addrMap == nil {
+			reg.addrMap = make(map[string]map[*registryEntry]struct{})
+		}
+		entryMap := reg.addrMap[addr]
+		if entryMap == nil {
+			entryMap = make(map[*registryEntry]struct{})
+			reg.addrMap[addr] = entryMap
+		}
+		entryMap[e] = struct{}{}
+	}
+	e.registeredAddr = addr
+}
+
+func (reg *Registry) removeFromAddrMapLocked(e *registryEntry) {
+	if e.registeredAddr == "" {
+		return
+	}
+	delete(reg.addrMap[e.registeredAddr], e)
+	if len(reg.addrMap[e.registeredAddr]) == 0 {
+		delete(reg.addrMap, e.registeredAddr)
+	}
+	e.registeredAddr = ""
+}
+
 func (reg *Registry) removeFromGroupMapLocked(e *registryEntry) {
 	delete(reg.groupMap[e.registeredGroup], e)
 	if len(reg.groupMap[e.registeredGroup]) == 0 {
@@ -240,6 +408,8 @@ func (reg *Registry) removeFromOrdinalMapLocked(e *registryEntry) {
 	e.registeredOrdinal = Ordinal{}
 }
 
+func (reg *Registry) logger() logging.L { return logging.Must(reg.Logger) }
+
 func (reg *Registry) unregisterDoneEntriesLocked() {
 	for _, e := range reg.devices {
 		if IsDone(e.device) {
@@ -252,6 +422,7 @@ func (reg *Registry) unregisterEntry(e *registryEntry) {
 	reg.mu.Lock()
 	defer reg.mu.Unlock()
 	reg.unregisterEntryLocked(e)
+	reg.updateConflictsLocked(time.Now())
 }
 
 func (reg *Registry) unregisterEntryLocked(e *registryEntry) {
@@ -265,9 +436,12 @@ func (reg *Registry) unregisterEntryLocked(e *registryEntry) {
 	// Remove this entry from its group/ordinal maps.
 	reg.removeFromGroupMapLocked(e)
 	reg.removeFromOrdinalMapLocked(e)
+	reg.removeFromAddrMapLocked(e)
 
 	// Remove this entry from the devices map.
 	delete(reg.devices, e.deviceID)
+
+	reg.watchers.Send(RegistryEvent{Type: DeviceRemoved, Device: e.device})
 }
 
 type registryEntry struct {
@@ -278,9 +452,21 @@ type registryEntry struct {
 	device D
 	// deviceID is a copy of device's ID.
 	deviceID string
+	// headers is a copy of device's discovery headers, as of its last reported
+	// change. It may be nil.
+	headers *protocol.DiscoveryHeaders
+
+	// seq is the entry's registration sequence number. Entries registered
+	// earlier have lower sequence numbers.
+	seq uint64
 
 	registeredGroup   int
 	registeredOrdinal Ordinal
+	registeredAddr    string
+
+	// addrChanges are the times of the device's recent address changes, oldest
+	// first.
+	addrChanges []time.Time
 }
 
 func (e *registryEntry) manageEntryLifecycle() {
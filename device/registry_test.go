@@ -5,7 +5,13 @@
 package device
 
 import (
+	"context"
 	"fmt"
+	"net"
+	"time"
+
+	"github.com/danjacques/gopushpixels/protocol"
+	"github.com/danjacques/gopushpixels/protocol/pixelpusher"
 
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
@@ -156,4 +162,172 @@ var _ = Describe("Registry", func() {
 			})
 		})
 	})
+
+	Context("when watched", func() {
+		var d0, d1 *testD
+		var cancelFunc context.CancelFunc
+		var eventC <-chan RegistryEvent
+		BeforeEach(func() {
+			d0 = makeTestD("foo")
+			d0.ordinal = Ordinal{Group: 1, Controller: 1}
+			reg.Add(d0)
+
+			var c context.Context
+			c, cancelFunc = context.WithCancel(context.Background())
+			eventC = reg.Watch(c)
+		})
+		AfterEach(func() {
+			cancelFunc()
+			d0.markDone()
+			if d1 != nil {
+				d1.markDone()
+			}
+		})
+
+		It("delivers an initial snapshot, followed by changes", func() {
+			Eventually(eventC).Should(Receive(Equal(RegistryEvent{Type: DeviceAdded, Device: d0, Initial: true})))
+
+			By("adding a device")
+			d1 = makeTestD("bar")
+			reg.Add(d1)
+			Eventually(eventC).Should(Receive(Equal(RegistryEvent{Type: DeviceAdded, Device: d1})))
+
+			By("re-adding an unchanged device")
+			reg.Add(d0)
+			Consistently(eventC).ShouldNot(Receive())
+
+			By("changing a device's ordinal")
+			d0.ordinal = Ordinal{Group: 2, Controller: 1}
+			reg.Add(d0)
+			Eventually(eventC).Should(Receive(Equal(RegistryEvent{
+				Type:   DeviceUpdated,
+				Device: d0,
+				Changes: []protocol.HeaderChange{
+					{Field: "Ordinal", Old: Ordinal{Group: 1, Controller: 1}, New: Ordinal{Group: 2, Controller: 1}},
+				},
+			})))
+
+			By("changing a device's headers")
+			d0.headers.ProductID = 42
+			reg.Add(d0)
+			Eventually(eventC).Should(Receive(Equal(RegistryEvent{
+				Type:    DeviceUpdated,
+				Device:  d0,
+				Changes: []protocol.HeaderChange{{Field: "ProductID", Old: uint16(0), New: uint16(42)}},
+			})))
+
+			By("closing a device")
+			d1.markDone()
+			Eventually(eventC).Should(Receive(Equal(RegistryEvent{Type: DeviceRemoved, Device: d1})))
+		})
+
+		It("reports a DeltaSequence reset after it has increased", func() {
+			Eventually(eventC).Should(Receive(Equal(RegistryEvent{Type: DeviceAdded, Device: d0, Initial: true})))
+
+			d1 = makeTestD("bar")
+			d1.headers.PixelPusher = &pixelpusher.Device{}
+			reg.Add(d1)
+			Eventually(eventC).Should(Receive(Equal(RegistryEvent{Type: DeviceAdded, Device: d1})))
+
+			By("not reporting an increase")
+			d1.headers.PixelPusher.DeltaSequence = 5
+			reg.Add(d1)
+			Consistently(eventC).ShouldNot(Receive())
+
+			By("reporting the reset")
+			d1.headers.PixelPusher.DeltaSequence = 0
+			reg.Add(d1)
+			Eventually(eventC).Should(Receive(Equal(RegistryEvent{
+				Type:    DeviceUpdated,
+				Device:  d1,
+				Changes: []protocol.HeaderChange{{Field: "DeltaSequence", Old: uint32(5), New: uint32(0)}},
+			})))
+		})
+
+		It("closes the channel when cancelled", func() {
+			Eventually(eventC).Should(Receive())
+			cancelFunc()
+			Eventually(eventC).Should(BeClosed())
+		})
+	})
+
+	Context("detecting conflicts", func() {
+		var d0, d1 *testD
+		BeforeEach(func() {
+			d0 = makeTestD("foo")
+			d0.ordinal = Ordinal{Group: 1, Controller: 1}
+			d0.addr = &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 5078}
+			reg.Add(d0)
+
+			d1 = makeTestD("bar")
+			d1.ordinal = Ordinal{Group: 1, Controller: 2}
+			d1.addr = &net.UDPAddr{IP: net.IPv4(10, 0, 0, 2), Port: 5078}
+			reg.Add(d1)
+		})
+		AfterEach(func() {
+			d0.markDone()
+			d1.markDone()
+		})
+
+		It("reports no conflicts for distinct devices", func() {
+			Expect(reg.Conflicts()).To(BeEmpty())
+		})
+
+		It("detects and resolves ordinal conflicts", func() {
+			d1.ordinal = d0.ordinal
+			reg.Add(d1)
+
+			conflicts := reg.Conflicts()
+			Expect(conflicts).To(HaveLen(1))
+			Expect(conflicts[0].Type).To(Equal(OrdinalConflict))
+			Expect(conflicts[0].DeviceIDs).To(Equal([]string{"bar", "foo"}))
+			Expect(conflicts[0].Ordinal).To(Equal(d0.ordinal))
+			Expect(conflicts[0].Since.IsZero()).To(BeFalse())
+			Expect(reg.GetUniqueOrdinal(d0.ordinal)).To(BeNil())
+
+			By("resolving when a device is done")
+			d1.markDone()
+			Eventually(reg.Conflicts).Should(BeEmpty())
+		})
+
+		It("chooses a device for a conflicting ordinal using its TieBreak policy", func() {
+			d1.ordinal = d0.ordinal
+			reg.Add(d1)
+
+			reg.TieBreak = LowestID
+			Expect(reg.GetUniqueOrdinal(d0.ordinal)).To(Equal(d1))
+
+			reg.TieBreak = FirstRegistered
+			Expect(reg.GetUniqueOrdinal(d0.ordinal)).To(Equal(d0))
+		})
+
+		It("detects duplicate addresses", func() {
+			d1.addr = d0.addr
+			reg.Add(d1)
+
+			conflicts := reg.Conflicts()
+			Expect(conflicts).To(HaveLen(1))
+			Expect(conflicts[0].Type).To(Equal(AddressConflict))
+			Expect(conflicts[0].Address).To(Equal("10.0.0.1"))
+			Expect(conflicts[0].DeviceIDs).To(Equal([]string{"bar", "foo"}))
+		})
+
+		It("detects devices whose address flaps", func() {
+			reg.FlapWindow = time.Hour
+			for i := 0; i < DefaultFlapThreshold; i++ {
+				d0.addr = &net.UDPAddr{IP: net.IPv4(10, 0, 1, byte(i)), Port: 5078}
+				reg.Add(d0)
+			}
+
+			conflicts := reg.Conflicts()
+			Expect(conflicts).To(HaveLen(1))
+			Expect(conflicts[0].Type).To(Equal(AddressFlapping))
+			Expect(conflicts[0].DeviceIDs).To(Equal([]string{"foo"}))
+			Expect(conflicts[0].Changes).To(Equal(DefaultFlapThreshold))
+
+			By("expiring address changes outside of the window")
+			reg.FlapWindow = time.Nanosecond
+			Eventually(reg.Conflicts).Should(BeEmpty())
+		})
+	})
 })
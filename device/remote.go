@@ -40,6 +40,13 @@ type Remote struct {
 	// constructs will use.
 	Logger logging.L
 
+	// Pacing, if not nil, enables paced packet dispatch for this device's
+	// Senders. See Pacing for more information.
+	//
+	// Pacing is read when the device's first Sender is created, and must not be
+	// changed while the device has open Senders.
+	Pacing *Pacing
+
 	// We lock around these headers. They can be updated any time by a call
 	// to "observe".
 	state atomic.Value
@@ -203,6 +210,7 @@ func (d *Remote) ensureAndRetainDispatcher() (*packetDispatcher, error) {
 	d.dispatcher = &packetDispatcher{
 		d:          d,
 		logger:     logging.Must(d.Logger),
+		pacing:     d.Pacing,
 		onShutdown: d.clearDispatcher,
 		sender:     &rds,
 	}
@@ -297,6 +305,8 @@ type remoteDynamicDatagramSender struct {
 
 	base     network.DatagramSender
 	baseAddr *net.UDPAddr
+	// baseInterface is the local interface that base is bound to, if any.
+	baseInterface string
 
 	// When we create a new base, we record its datagram size and report it
 	// here. This prevents us from needing to potentially create a new connection
@@ -310,7 +320,7 @@ func (rds *remoteDynamicDatagramSender) Close() error {
 	}
 
 	ds := rds.base
-	rds.base, rds.baseAddr = nil, nil
+	rds.base, rds.baseAddr, rds.baseInterface = nil, nil, ""
 	return ds.Close()
 }
 
@@ -343,11 +353,18 @@ func (rds *remoteDynamicDatagramSender) ensureSenderConnected() error {
 		return errors.New("device address is not a *net.UDPAddr")
 	}
 
+	// If the device was discovered on a specific interface, bind to it.
+	var iface string
+	if dh := rds.d.DiscoveryHeaders(); dh != nil {
+		iface = dh.Interface
+	}
+
 	// Loop repeatedly until the address settles and we can return with a reader
 	// lock.
 	addrMatches := func() bool {
 		return rds.base != nil &&
-			(addr.IP.Equal(rds.baseAddr.IP) && addr.Port == rds.baseAddr.Port)
+			(addr.IP.Equal(rds.baseAddr.IP) && addr.Port == rds.baseAddr.Port) &&
+			iface == rds.baseInterface
 	}
 
 	// (Common case) Do we have a base Sender, and does it match the address?
@@ -362,13 +379,23 @@ func (rds *remoteDynamicDatagramSender) ensureSenderConnected() error {
 		}
 	}
 
-	w, err := net.DialUDP("udp4", nil, addr)
+	var laddr *net.UDPAddr
+	if iface != "" {
+		ip, err := network.InterfaceIP4Address(iface, addr.IP)
+		if err != nil {
+			return errors.Wrapf(err, "could not resolve address for interface %q", iface)
+		}
+		laddr = &net.UDPAddr{IP: ip}
+	}
+
+	w, err := net.DialUDP("udp4", laddr, addr)
 	if err != nil {
 		return err
 	}
 
 	rds.base = network.UDPDatagramSender(w)
 	rds.baseAddr = addr
+	rds.baseInterface = iface
 	rds.lastDatagramSize = rds.base.MaxDatagramSize()
 	return nil
 }
@@ -9,8 +9,10 @@ import (
 	"sync"
 	"time"
 
+	"github.com/danjacques/gopushpixels/pixel"
 	"github.com/danjacques/gopushpixels/protocol"
 	"github.com/danjacques/gopushpixels/protocol/pixelpusher"
+	"github.com/danjacques/gopushpixels/support/byteslicereader"
 	"github.com/danjacques/gopushpixels/support/network"
 
 	. "github.com/onsi/ginkgo"
@@ -159,6 +161,97 @@ var _ = Describe("Remote Device (Connected)", func() {
 		})
 	})
 
+	Context("with pacing", func() {
+		const period = 50 * time.Millisecond
+
+		var s Sender
+		BeforeEach(func() {
+			dh.PixelPusher.StripsAttached = 1
+			dh.PixelPusher.MaxStripsPerPacket = 1
+			dh.PixelPusher.PixelsPerStrip = 1
+			dh.PixelPusher.UpdatePeriod = uint32(period / time.Microsecond)
+			dh.PixelPusher.StripFlags = []pixelpusher.StripFlags{0}
+			r.UpdateHeaders(time.Now(), dh)
+			r.Pacing = &Pacing{}
+
+			var err error
+			s, err = r.Sender()
+			Expect(err).ToNot(HaveOccurred())
+		})
+		AfterEach(func() {
+			if s != nil {
+				Expect(s.Close()).To(Succeed())
+			}
+		})
+
+		stripPacket := func(v byte) *protocol.Packet {
+			ss := pixelpusher.StripState{StripNumber: 0}
+			ss.Pixels.Reset(1)
+			ss.Pixels.SetPixel(0, pixel.P{Red: v})
+			return &protocol.Packet{
+				PixelPusher: &pixelpusher.Packet{
+					StripStates: []*pixelpusher.StripState{&ss},
+				},
+			}
+		}
+
+		readStrip := func() (byte, time.Time) {
+			rcp := <-rc.packetC
+			received := time.Now()
+
+			var pkt pixelpusher.Packet
+			reader := pixelpusher.PacketReader{
+				PixelsPerStrip: 1,
+				StripFlags:     []pixelpusher.StripFlags{0},
+			}
+			err := reader.ReadPacket(&byteslicereader.R{Buffer: rcp.pkt}, &pkt)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(pkt.StripStates).To(HaveLen(1))
+			return pkt.StripStates[0].Pixels.Pixel(0).Red, received
+		}
+
+		It("spaces datagrams and coalesces pending strip states", func(done Done) {
+			defer close(done)
+
+			By("sending an initial packet")
+			Expect(s.SendPacket(stripPacket(1))).To(Succeed())
+			v, lastTime := readStrip()
+			Expect(v).To(BeEquivalentTo(1))
+
+			By("sending a burst of packets")
+			for i := 2; i <= 5; i++ {
+				Expect(s.SendPacket(stripPacket(byte(i)))).To(Succeed())
+			}
+
+			// The burst will be coalesced: at most one intermediate state will be
+			// sent before the latest state.
+			received := 0
+			for v != 5 {
+				var t time.Time
+				v, t = readStrip()
+				Expect(t.Sub(lastTime)).To(BeNumerically(">=", period-(5*time.Millisecond)))
+				lastTime = t
+				received++
+			}
+			Expect(received).To(BeNumerically("<=", 2))
+			Consistently(rc.packetC, period).ShouldNot(Receive())
+		})
+
+		It("sends pending data when closed", func(done Done) {
+			defer close(done)
+
+			Expect(s.SendPacket(stripPacket(1))).To(Succeed())
+			Expect(s.SendPacket(stripPacket(2))).To(Succeed())
+			Expect(s.Close()).To(Succeed())
+			s = nil
+
+			v, _ := readStrip()
+			for v != 2 {
+				v, _ = readStrip()
+			}
+		})
+	})
+
 	Context("when marked Done", func() {
 		BeforeEach(func() { r.MarkDone() })
 
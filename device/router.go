@@ -6,6 +6,8 @@ package device
 
 import (
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/danjacques/gopushpixels/protocol"
 	"github.com/danjacques/gopushpixels/support/logging"
@@ -58,10 +60,32 @@ type Router struct {
 	// Setting or changing Logger should be done during Router setup, and is
 	// not safe for concurrent use.
 	Logger logging.L
+	// Async, if true, causes the Router to wrap each device's Sender in an
+	// AsyncSender, so that Route never blocks on the network. See AsyncSender
+	// for more information.
+	//
+	// Async must not be changed after the Router has started routing.
+	Async bool
+	// Skew, if not nil, returns the amount of time that it takes for a packet
+	// sent to d to take effect, relative to other devices.
+	//
+	// Skew is used by Frame's Commit to compensate for per-device differences:
+	// devices with a larger skew are sent to earlier, so that all devices in a
+	// frame update at the same moment. Skew may return zero for devices that
+	// require no compensation.
+	Skew func(d D) time.Duration
+	// Namer, if not nil, allows devices to be identified by name. Route IDs, as
+	// well as the IDs in RoutingTable rules, may be device names.
+	//
+	// Namer must not be changed after the Router has started routing.
+	Namer Namer
 
 	// listeners is a list of registered listeners.
 	listeners sync.Map
 
+	// table is the current routing table (*RoutingTable).
+	table atomic.Value
+
 	mu sync.RWMutex
 	// connections is the set of open router connections.
 	connections map[D]*routerConnection
@@ -69,11 +93,85 @@ type Router struct {
 
 // Route sends a packet to the device identified by the specified ordinal or id.
 //
-// If the ordinal is valid and uniquely registered, the device registered to
-// that ordinal will receive the packet. Otherwise, if the device ID is
-// registered, it will receive the packet.
+// If the Router has a RoutingTable and one of its rules matches, that rule
+// determines which devices, if any, receive the packet. Otherwise, if the
+// ordinal is valid and uniquely registered, the device registered to that
+// ordinal will receive the packet. Otherwise, if the device ID is registered,
+// it will receive the packet.
+//
+// If the packet is routed to multiple devices, Route attempts to send to each,
+// and returns the first error encountered.
 func (r *Router) Route(ordinal Ordinal, id string, pkt *protocol.Packet) error {
-	// First, see if we can find a device registered to the specified ordinal.
+	rcs, err := r.resolve(ordinal, id)
+	if err != nil {
+		return err
+	}
+
+	// Dispatch the packet to all listeners.
+	for _, rc := range rcs {
+		r.dispatchPacketToListeners(rc.device, pkt)
+	}
+
+	// Send the packet immediately. Our packet dispatch goroutines can send it
+	// while our listeners are procesing it.
+	for _, rc := range rcs {
+		if serr := rc.sendPacket(pkt); serr != nil && err == nil {
+			err = serr
+		}
+	}
+	return err
+}
+
+// SetRoutingTable installs rt as the Router's routing table, replacing any
+// existing table. If rt is nil, the current table will be removed.
+//
+// SetRoutingTable is safe for concurrent use, and may be called while the
+// Router is routing.
+func (r *Router) SetRoutingTable(rt *RoutingTable) { r.table.Store(rt) }
+
+// RoutingTable returns the Router's current routing table, or nil if it has
+// none.
+func (r *Router) RoutingTable() *RoutingTable {
+	rt, _ := r.table.Load().(*RoutingTable)
+	return rt
+}
+
+// resolve returns the connections for the devices identified by the specified
+// ordinal or id. See Route for more information.
+//
+// If no device could be found, resolve returns ErrNoRoute. If the route is
+// dropped by a routing rule, resolve returns no connections and no error.
+func (r *Router) resolve(ordinal Ordinal, id string) ([]*routerConnection, error) {
+	devices, err := r.resolveDevices(ordinal, id)
+	if err != nil {
+		return nil, err
+	}
+
+	// Get or create a connection to each device.
+	rcs := make([]*routerConnection, len(devices))
+	for i, d := range devices {
+		if rcs[i], err = r.getOrCreateConnection(d); err != nil {
+			return nil, err
+		}
+	}
+	return rcs, nil
+}
+
+func (r *Router) resolveDevices(ordinal Ordinal, id string) ([]D, error) {
+	id = resolveID(r.Namer, id)
+
+	// If we have a routing table, consult it first.
+	if rt := r.RoutingTable(); rt != nil {
+		if rr := rt.match(ordinal, id, r.Namer); rr != nil {
+			devices := rr.resolve(r.Registry, ordinal, r.Namer)
+			if len(devices) == 0 && rr.Action != RouteDrop {
+				return nil, ErrNoRoute
+			}
+			return devices, nil
+		}
+	}
+
+	// See if we can find a device registered to the specified ordinal.
 	var d D
 	if ordinal.IsValid() {
 		d = r.Registry.GetUniqueOrdinal(ordinal)
@@ -84,30 +182,34 @@ func (r *Router) Route(ordinal Ordinal, id string, pkt *protocol.Packet) error {
 	}
 	if d == nil {
 		// No registry entry for this device.
-		return ErrNoRoute
-	}
-
-	// Get or create a connection to d.
-	rc, err := r.getOrCreateConnection(d)
-	if err != nil {
-		return err
+		return nil, ErrNoRoute
 	}
-
-	// Dispatch the packet to all listeners.
-	r.dispatchPacketToListeners(rc.device, pkt)
-
-	// Send the packet immediately. Our packet dispatch goroutines can send it
-	// while our listeners are procesing it.
-	return rc.sendPacket(pkt)
+	return []D{d}, nil
 }
 
 // AddListener registers a Listener with this Router.
-func (r *Router) AddListener(l Listener) { r.listeners.Store(l, nil) }
+//
+// The Listener will be called synchronously for each routed packet. To receive
+// packets asynchronously, use AddAsyncListener.
+func (r *Router) AddListener(l Listener) {
+	if prev, ok := r.listeners.Load(l); ok {
+		stopListener(prev)
+	}
+	r.listeners.Store(l, nil)
+}
 
 // RemoveListener removes a Listener from this Router.
 //
+// If l is an asynchronous Listener, RemoveListener blocks until it has
+// processed its queued packets.
+//
 // If l is not registered, nothing will happen.
-func (r *Router) RemoveListener(l Listener) { r.listeners.Delete(l) }
+func (r *Router) RemoveListener(l Listener) {
+	if v, ok := r.listeners.Load(l); ok {
+		r.listeners.Delete(l)
+		stopListener(v)
+	}
+}
 
 func (r *Router) getOrCreateConnection(d D) (*routerConnection, error) {
 	// Fast path: is a connection already registered for this device?
@@ -141,6 +243,9 @@ func (r *Router) getOrCreateConnection(d D) (*routerConnection, error) {
 	if err != nil {
 		return nil, errors.Wrap(err, "could not create Sender")
 	}
+	if r.Async {
+		s = MakeAsyncSender(s)
+	}
 
 	const bufferSize = 1024
 	rc = &routerConnection{
@@ -161,14 +266,29 @@ func (r *Router) getOrCreateConnection(d D) (*routerConnection, error) {
 }
 
 func (r *Router) dispatchPacketToListeners(d D, pkt *protocol.Packet) {
-	r.listeners.Range(func(l, _ interface{}) bool {
-		l.(Listener).HandlePacket(d, pkt)
+	r.listeners.Range(func(l, v interface{}) bool {
+		if al, ok := v.(*asyncListener); ok {
+			al.enqueue(d, pkt)
+		} else {
+			l.(Listener).HandlePacket(d, pkt)
+		}
 		return true
 	})
 }
 
 // Shutdown all routes and resources used by the Router.
+//
+// Asynchronous Listeners are stopped and removed. Synchronous Listeners remain
+// registered.
 func (r *Router) Shutdown() {
+	r.listeners.Range(func(l, v interface{}) bool {
+		if _, ok := v.(*asyncListener); ok {
+			r.listeners.Delete(l)
+			stopListener(v)
+		}
+		return true
+	})
+
 	r.mu.Lock()
 	defer r.mu.Unlock()
 
@@ -5,7 +5,11 @@
 package device
 
 import (
+	"time"
+
+	"github.com/danjacques/gopushpixels/pixel"
 	"github.com/danjacques/gopushpixels/protocol"
+	"github.com/danjacques/gopushpixels/protocol/pixelpusher"
 
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
@@ -87,6 +91,221 @@ var _ = Describe("Router", func() {
 			Expect(d1.packets).To(ConsistOf(pktFoo))
 		})
 
+		Context("with a Frame", func() {
+			var f *Frame
+			BeforeEach(func() {
+				f = r.BeginFrame()
+			})
+
+			It("sends nothing until committed", func() {
+				pktFoo := &protocol.Packet{}
+				Expect(f.Route(InvalidOrdinal(), "foo", pktFoo)).To(Succeed())
+
+				pktBar := &protocol.Packet{}
+				Expect(f.Route(Ordinal{Group: 2}, "nonexist", pktBar)).To(Succeed())
+
+				Expect(d0.packets).To(BeEmpty())
+				Expect(d1.packets).To(BeEmpty())
+
+				Expect(f.Commit()).To(Succeed())
+				Expect(d0.packets).To(ConsistOf(pktFoo))
+				Expect(d1.packets).To(ConsistOf(pktBar))
+			})
+
+			It("returns ErrNoRoute when staging to an unregistered device", func() {
+				Expect(f.Route(InvalidOrdinal(), "nonexist", &protocol.Packet{})).To(Equal(ErrNoRoute))
+			})
+
+			It("sends nothing when discarded", func() {
+				Expect(f.Route(InvalidOrdinal(), "foo", &protocol.Packet{})).To(Succeed())
+				f.Discard()
+
+				Expect(f.Commit()).ToNot(Succeed())
+				Expect(d0.packets).To(BeEmpty())
+			})
+
+			It("can stage a Mutable's sync packet", func() {
+				d0.headers = protocol.DiscoveryHeaders{
+					DeviceHeader: protocol.DeviceHeader{
+						DeviceType: protocol.PixelPusherDeviceType,
+					},
+					PixelPusher: &pixelpusher.Device{
+						DeviceHeader: pixelpusher.DeviceHeader{
+							StripsAttached: 1,
+							PixelsPerStrip: 1,
+						},
+						DeviceHeaderExt109: pixelpusher.DeviceHeaderExt109{
+							StripFlags: []pixelpusher.StripFlags{0},
+						},
+					},
+				}
+
+				var m Mutable
+				m.Initialize(&d0.headers)
+				_ = m.SyncPacket()
+
+				By("staging an unmodified Mutable")
+				Expect(f.RouteMutable(InvalidOrdinal(), "foo", &m)).To(Succeed())
+
+				By("staging a modified Mutable")
+				m.SetPixel(0, 0, pixel.P{Red: 0xFF})
+				Expect(f.RouteMutable(InvalidOrdinal(), "foo", &m)).To(Succeed())
+
+				Expect(f.Commit()).To(Succeed())
+				Expect(d0.packets).To(HaveLen(1))
+				Expect(d0.packets[0].PixelPusher.StripStates[0].Pixels.Pixel(0)).To(Equal(pixel.P{Red: 0xFF}))
+			})
+
+			It("compensates for per-device skew", func() {
+				const skew = 20 * time.Millisecond
+				r.Skew = func(d D) time.Duration {
+					if d == D(d1) {
+						return skew
+					}
+					return 0
+				}
+
+				Expect(f.Route(InvalidOrdinal(), "foo", &protocol.Packet{})).To(Succeed())
+				Expect(f.Route(InvalidOrdinal(), "bar", &protocol.Packet{})).To(Succeed())
+
+				start := time.Now()
+				Expect(f.Commit()).To(Succeed())
+				Expect(time.Since(start)).To(BeNumerically(">=", skew))
+
+				Expect(d0.packets).To(HaveLen(1))
+				Expect(d1.packets).To(HaveLen(1))
+
+				By("sending to the most skewed device first, then to the others at their offsets")
+				first, second := d1.packetTimes[0], d0.packetTimes[0]
+				Expect(first.Sub(start)).To(BeNumerically("<", skew))
+				Expect(first.Before(second)).To(BeTrue())
+
+				// The offset is measured from just before the first send, which is
+				// immediate.
+				Expect(second.Sub(first)).To(BeNumerically(">=", skew-time.Millisecond))
+			})
+		})
+
+		Context("with an asynchronous Listener", func() {
+			type capturedPacket struct {
+				d   D
+				pkt *protocol.Packet
+			}
+
+			var gateC chan struct{}
+			var packetC chan capturedPacket
+			var l Listener
+			BeforeEach(func() {
+				gateC = make(chan struct{})
+				packetC = make(chan capturedPacket, 16)
+				l = ListenerFunc(func(d D, pkt *protocol.Packet) {
+					<-gateC
+					if pkt.PixelPusher == nil {
+						panic("no packet")
+					}
+					packetC <- capturedPacket{d, pkt}
+				})
+			})
+			AfterEach(func() {
+				select {
+				case <-gateC:
+				default:
+					close(gateC)
+				}
+				r.RemoveListener(l)
+			})
+
+			pktWithID := func(id uint32) *protocol.Packet {
+				return &protocol.Packet{
+					PixelPusher: &pixelpusher.Packet{ID: id},
+				}
+			}
+
+			It("delivers clones of routed packets", func(done Done) {
+				defer close(done)
+
+				r.AddAsyncListener(l, AsyncListenerOptions{})
+				close(gateC)
+
+				pkt := pktWithID(1)
+				Expect(r.Route(InvalidOrdinal(), "foo", pkt)).To(Succeed())
+				Expect(d0.packets).To(ConsistOf(pkt))
+
+				cp := <-packetC
+				Expect(cp.d).To(Equal(D(d0)))
+				Expect(cp.pkt).To(Equal(pkt))
+				Expect(cp.pkt).ToNot(BeIdenticalTo(pkt))
+			})
+
+			It("does not block routing, and drops the newest packets on overflow", func(done Done) {
+				defer close(done)
+
+				r.AddAsyncListener(l, AsyncListenerOptions{QueueSize: 1, Overflow: DropNewest})
+				for i := uint32(0); i < 5; i++ {
+					Expect(r.Route(InvalidOrdinal(), "foo", pktWithID(i))).To(Succeed())
+				}
+				Expect(d0.packets).To(HaveLen(5))
+
+				st, ok := r.AsyncListenerStats(l)
+				Expect(ok).To(BeTrue())
+				Expect(st.Dropped).To(BeNumerically(">=", 3))
+
+				close(gateC)
+				r.RemoveListener(l)
+
+				// The first packet is always delivered.
+				Expect((<-packetC).pkt.PixelPusher.ID).To(BeEquivalentTo(0))
+			})
+
+			It("drops the oldest packets on overflow", func(done Done) {
+				defer close(done)
+
+				r.AddAsyncListener(l, AsyncListenerOptions{QueueSize: 1, Overflow: DropOldest})
+				for i := uint32(0); i < 5; i++ {
+					Expect(r.Route(InvalidOrdinal(), "foo", pktWithID(i))).To(Succeed())
+				}
+
+				close(gateC)
+				r.RemoveListener(l)
+
+				// The last packet is always delivered last.
+				var last capturedPacket
+				for len(packetC) > 0 {
+					last = <-packetC
+				}
+				Expect(last.pkt.PixelPusher.ID).To(BeEquivalentTo(4))
+			})
+
+			It("gives unnamed Listeners of the same type distinct names", func() {
+				a := newAsyncListener(l, &AsyncListenerOptions{}, nil)
+				b := newAsyncListener(l, &AsyncListenerOptions{}, nil)
+				Expect(a.name).ToNot(Equal(b.name))
+				Expect(a.labels).ToNot(Equal(b.labels))
+
+				named := newAsyncListener(l, &AsyncListenerOptions{Name: "foo"}, nil)
+				Expect(named.name).To(Equal("foo"))
+			})
+
+			It("recovers from Listener panics", func(done Done) {
+				defer close(done)
+
+				r.AddAsyncListener(l, AsyncListenerOptions{})
+				close(gateC)
+
+				Expect(r.Route(InvalidOrdinal(), "foo", &protocol.Packet{})).To(Succeed())
+				Expect(r.Route(InvalidOrdinal(), "foo", pktWithID(1))).To(Succeed())
+				Expect((<-packetC).pkt.PixelPusher.ID).To(BeEquivalentTo(1))
+
+				Eventually(func() AsyncListenerStats {
+					st, _ := r.AsyncListenerStats(l)
+					return st
+				}).Should(And(
+					HaveField("Panics", BeEquivalentTo(1)),
+					HaveField("Delivered", BeEquivalentTo(1)),
+				))
+			})
+		})
+
 		Context("when connected to a Listener", func() {
 			type capturedPacket struct {
 				d   D
@@ -119,6 +338,19 @@ var _ = Describe("Router", func() {
 				}))
 			})
 
+			It("receives a Frame's packets when it is committed", func() {
+				f := r.BeginFrame()
+
+				pkt := &protocol.Packet{}
+				Expect(f.Route(InvalidOrdinal(), "foo", pkt)).To(Succeed())
+				Expect(packets).To(BeEmpty())
+
+				Expect(f.Commit()).To(Succeed())
+				Expect(packets).To(Equal([]capturedPacket{
+					{d: d0, pkt: pkt},
+				}))
+			})
+
 			It("when unroutable, the Listener does not receive the packet", func() {
 				pkt := &protocol.Packet{}
 				err := r.Route(InvalidOrdinal(), "nonexist", pkt)
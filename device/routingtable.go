@@ -0,0 +1,243 @@
+// Copyright 2018 Dan Jacques. All rights reserved.
+// Use of this source code is governed under the MIT License
+// that can be found in the LICENSE file.
+
+package device
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+	"strings"
+	"sync/atomic"
+
+	"github.com/pkg/errors"
+)
+
+// RoutingAction is the action that a RoutingRule takes when it matches.
+type RoutingAction string
+
+const (
+	// RouteGroup routes to every device in a group. The group is the rule's
+	// Group, if specified, or else the group of the routed ordinal.
+	RouteGroup RoutingAction = "group"
+	// RouteRemap routes to the device uniquely registered to the rule's Ordinal.
+	RouteRemap RoutingAction = "remap"
+	// RouteFanOut routes to every device in the rule's IDs.
+	RouteFanOut RoutingAction = "fanout"
+	// RouteDrop silently discards the routed packet.
+	RouteDrop RoutingAction = "drop"
+	// RouteMACPrefix routes to every device whose ID (hardware address) begins
+	// with the rule's MACPrefix.
+	RouteMACPrefix RoutingAction = "mac_prefix"
+)
+
+// RoutingMatch describes the routes that a RoutingRule matches. A route matches
+// if it matches all of the specified fields. An empty RoutingMatch matches all
+// routes.
+type RoutingMatch struct {
+	// Group, if not nil, matches routes whose ordinal has this group.
+	Group *int `json:"group,omitempty"`
+	// Controller, if not nil, matches routes whose ordinal has this controller.
+	Controller *int `json:"controller,omitempty"`
+	// ID, if not empty, matches routes with this device ID. If the Router has a
+	// Namer, ID may also be a device name.
+	ID string `json:"id,omitempty"`
+}
+
+func (m *RoutingMatch) matches(ordinal Ordinal, id string, n Namer) bool {
+	if m.Group != nil && (!ordinal.IsValid() || ordinal.Group != *m.Group) {
+		return false
+	}
+	if m.Controller != nil && (!ordinal.IsValid() || ordinal.Controller != *m.Controller) {
+		return false
+	}
+	if m.ID != "" && resolveID(n, m.ID) != id {
+		return false
+	}
+	return true
+}
+
+// RoutingRule is a single rule in a RoutingTable.
+type RoutingRule struct {
+	// hits is the number of routes that this rule has matched. It is first in
+	// the struct to ensure 64-bit alignment for atomic operations.
+	hits int64
+
+	// Name is an optional name for this rule, used for diagnostics.
+	Name string `json:"name,omitempty"`
+
+	// Match describes the routes that this rule applies to.
+	Match RoutingMatch `json:"match"`
+	// Action is the action to take when this rule matches.
+	Action RoutingAction `json:"action"`
+
+	// Group is the target group for RouteGroup.
+	Group *int `json:"group,omitempty"`
+	// Ordinal is the target ordinal for RouteRemap.
+	Ordinal *Ordinal `json:"ordinal,omitempty"`
+	// IDs are the target device IDs (or names) for RouteFanOut.
+	IDs []string `json:"ids,omitempty"`
+	// MACPrefix is the target hardware address prefix for RouteMACPrefix.
+	MACPrefix string `json:"mac_prefix,omitempty"`
+}
+
+// Hits returns the number of routes that this rule has matched.
+func (rr *RoutingRule) Hits() int64 { return atomic.LoadInt64(&rr.hits) }
+
+func (rr *RoutingRule) String() string {
+	if rr.Name != "" {
+		return rr.Name
+	}
+	return string(rr.Action)
+}
+
+func (rr *RoutingRule) validate() error {
+	switch rr.Action {
+	case RouteGroup, RouteDrop:
+		return nil
+
+	case RouteRemap:
+		if rr.Ordinal == nil || !rr.Ordinal.IsValid() {
+			return errors.New("remap rule requires a valid ordinal")
+		}
+		return nil
+
+	case RouteFanOut:
+		if len(rr.IDs) == 0 {
+			return errors.New("fanout rule requires at least one ID")
+		}
+		return nil
+
+	case RouteMACPrefix:
+		if rr.MACPrefix == "" {
+			return errors.New("mac_prefix rule requires a prefix")
+		}
+		return nil
+
+	default:
+		return errors.Errorf("unknown action %q", rr.Action)
+	}
+}
+
+// resolve returns the devices in reg that this rule routes ordinal to. Device
+// names are resolved using n, if not nil.
+func (rr *RoutingRule) resolve(reg *Registry, ordinal Ordinal, n Namer) []D {
+	switch rr.Action {
+	case RouteGroup:
+		group := ordinal.Group
+		if rr.Group != nil {
+			group = *rr.Group
+		}
+		return reg.DevicesForGroup(group)
+
+	case RouteRemap:
+		if d := reg.GetUniqueOrdinal(*rr.Ordinal); d != nil {
+			return []D{d}
+		}
+		return nil
+
+	case RouteFanOut:
+		devices := make([]D, 0, len(rr.IDs))
+		seen := make(map[D]struct{}, len(rr.IDs))
+		for _, id := range rr.IDs {
+			d := reg.Get(resolveID(n, id))
+			if d == nil {
+				continue
+			}
+			if _, ok := seen[d]; !ok {
+				seen[d] = struct{}{}
+				devices = append(devices, d)
+			}
+		}
+		return devices
+
+	case RouteMACPrefix:
+		prefix := strings.ToLower(rr.MACPrefix)
+
+		var devices []D
+		for _, group := range reg.AllGroups() {
+			for _, d := range group {
+				if strings.HasPrefix(strings.ToLower(d.ID()), prefix) {
+					devices = append(devices, d)
+				}
+			}
+		}
+		return devices
+
+	default:
+		// RouteDrop
+		return nil
+	}
+}
+
+// RoutingTable is a set of rules that a Router uses to resolve routes.
+//
+// Rules are evaluated in order, and the first matching rule determines the
+// route. If no rule matches, the Router falls back to its default resolution
+// (see Router's Route method).
+//
+// A RoutingTable may be loaded from JSON via LoadRoutingTable. Once installed
+// in a Router, a RoutingTable must not be modified; instead, a new table should
+// be installed in its place.
+type RoutingTable struct {
+	// unmatched is the number of routes that matched no rules. It is first in
+	// the struct to ensure 64-bit alignment for atomic operations.
+	unmatched int64
+
+	// Rules is the ordered set of routing rules.
+	Rules []*RoutingRule `json:"rules"`
+}
+
+// LoadRoutingTable loads a JSON-encoded RoutingTable from r and validates it.
+func LoadRoutingTable(r io.Reader) (*RoutingTable, error) {
+	dec := json.NewDecoder(r)
+	dec.DisallowUnknownFields()
+
+	var rt RoutingTable
+	if err := dec.Decode(&rt); err != nil {
+		return nil, errors.Wrap(err, "could not decode routing table")
+	}
+	if err := rt.Validate(); err != nil {
+		return nil, err
+	}
+	return &rt, nil
+}
+
+// LoadRoutingTableFile loads a JSON-encoded RoutingTable from the file at path.
+func LoadRoutingTableFile(path string) (*RoutingTable, error) {
+	fd, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer fd.Close()
+
+	return LoadRoutingTable(fd)
+}
+
+// Validate returns an error if any of rt's rules are invalid.
+func (rt *RoutingTable) Validate() error {
+	for i, rr := range rt.Rules {
+		if err := rr.validate(); err != nil {
+			return errors.Wrapf(err, "invalid rule #%d (%s)", i, rr)
+		}
+	}
+	return nil
+}
+
+// Unmatched returns the number of routes that matched none of rt's rules.
+func (rt *RoutingTable) Unmatched() int64 { return atomic.LoadInt64(&rt.unmatched) }
+
+// match returns the first rule in rt that matches the route, or nil if no rule
+// matches. It updates the table's hit counters. Device names are resolved
+// using n, if not nil.
+func (rt *RoutingTable) match(ordinal Ordinal, id string, n Namer) *RoutingRule {
+	for _, rr := range rt.Rules {
+		if rr.Match.matches(ordinal, id, n) {
+			atomic.AddInt64(&rr.hits, 1)
+			return rr
+		}
+	}
+	atomic.AddInt64(&rt.unmatched, 1)
+	return nil
+}
@@ -0,0 +1,212 @@
+// Copyright 2018 Dan Jacques. All rights reserved.
+// Use of this source code is governed under the MIT License
+// that can be found in the LICENSE file.
+
+package device
+
+import (
+	"strings"
+
+	"github.com/danjacques/gopushpixels/protocol"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("RoutingTable", func() {
+	Context("loading", func() {
+		It("can load a valid routing table", func() {
+			rt, err := LoadRoutingTable(strings.NewReader(`{
+				"rules": [
+					{"name": "stage", "match": {"group": 1}, "action": "group", "group": 2},
+					{"match": {"id": "foo"}, "action": "fanout", "ids": ["bar", "baz"]},
+					{"match": {"group": 3, "controller": 4}, "action": "remap",
+					 "ordinal": {"group": 5, "controller": 6}},
+					{"match": {"id": "mac"}, "action": "mac_prefix", "mac_prefix": "d8:80"},
+					{"action": "drop"}
+				]
+			}`))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(rt.Rules).To(HaveLen(5))
+			Expect(rt.Rules[0].String()).To(Equal("stage"))
+			Expect(*rt.Rules[0].Match.Group).To(Equal(1))
+			Expect(*rt.Rules[2].Ordinal).To(Equal(Ordinal{Group: 5, Controller: 6}))
+		})
+
+		for _, tc := range []struct {
+			name string
+			json string
+		}{
+			{"an unknown action", `{"rules": [{"action": "explode"}]}`},
+			{"a remap without an ordinal", `{"rules": [{"action": "remap"}]}`},
+			{"a fanout without IDs", `{"rules": [{"action": "fanout"}]}`},
+			{"a MAC prefix rule without a prefix", `{"rules": [{"action": "mac_prefix"}]}`},
+			{"an unknown field", `{"rules": [{"action": "drop", "bogus": true}]}`},
+		} {
+			tc := tc
+			It("rejects "+tc.name, func() {
+				_, err := LoadRoutingTable(strings.NewReader(tc.json))
+				Expect(err).To(HaveOccurred())
+			})
+		}
+	})
+
+	Context("installed in a Router", func() {
+		var r *Router
+		var d0, d1, d2 *testD
+		BeforeEach(func() {
+			r = &Router{
+				Registry: &Registry{},
+			}
+
+			d0 = makeTestD("d8:80:39:00:00:01")
+			d0.ordinal = Ordinal{Group: 1, Controller: 1}
+			r.Registry.Add(d0)
+
+			d1 = makeTestD("d8:80:39:00:00:02")
+			d1.ordinal = Ordinal{Group: 1, Controller: 2}
+			r.Registry.Add(d1)
+
+			d2 = makeTestD("00:11:22:00:00:03")
+			d2.ordinal = Ordinal{Group: 2, Controller: 1}
+			r.Registry.Add(d2)
+		})
+		AfterEach(func() {
+			d0.markDone()
+			d1.markDone()
+			d2.markDone()
+			r.Shutdown()
+		})
+
+		intPtr := func(v int) *int { return &v }
+
+		It("broadcasts to all devices in a group", func() {
+			r.SetRoutingTable(&RoutingTable{Rules: []*RoutingRule{
+				{Match: RoutingMatch{Group: intPtr(1)}, Action: RouteGroup},
+			}})
+
+			pkt := &protocol.Packet{}
+			Expect(r.Route(Ordinal{Group: 1, Controller: 0}, "", pkt)).To(Succeed())
+			Expect(d0.packets).To(ConsistOf(pkt))
+			Expect(d1.packets).To(ConsistOf(pkt))
+			Expect(d2.packets).To(BeEmpty())
+			Expect(r.RoutingTable().Rules[0].Hits()).To(BeEquivalentTo(1))
+		})
+
+		It("remaps one ordinal to another", func() {
+			r.SetRoutingTable(&RoutingTable{Rules: []*RoutingRule{
+				{
+					Match:   RoutingMatch{Group: intPtr(9), Controller: intPtr(9)},
+					Action:  RouteRemap,
+					Ordinal: &Ordinal{Group: 2, Controller: 1},
+				},
+			}})
+
+			pkt := &protocol.Packet{}
+			Expect(r.Route(Ordinal{Group: 9, Controller: 9}, "", pkt)).To(Succeed())
+			Expect(d2.packets).To(ConsistOf(pkt))
+		})
+
+		It("fans out one ID to several devices", func() {
+			r.SetRoutingTable(&RoutingTable{Rules: []*RoutingRule{
+				{
+					Match:  RoutingMatch{ID: "recorded"},
+					Action: RouteFanOut,
+					IDs:    []string{d0.ID(), d2.ID(), d2.ID(), "nonexist"},
+				},
+			}})
+
+			pkt := &protocol.Packet{}
+			Expect(r.Route(InvalidOrdinal(), "recorded", pkt)).To(Succeed())
+			Expect(d0.packets).To(ConsistOf(pkt))
+			Expect(d1.packets).To(BeEmpty())
+			Expect(d2.packets).To(ConsistOf(pkt))
+		})
+
+		It("routes by MAC prefix", func() {
+			r.SetRoutingTable(&RoutingTable{Rules: []*RoutingRule{
+				{Action: RouteMACPrefix, MACPrefix: "D8:80:39"},
+			}})
+
+			pkt := &protocol.Packet{}
+			Expect(r.Route(InvalidOrdinal(), "whatever", pkt)).To(Succeed())
+			Expect(d0.packets).To(ConsistOf(pkt))
+			Expect(d1.packets).To(ConsistOf(pkt))
+			Expect(d2.packets).To(BeEmpty())
+		})
+
+		It("drops matching packets", func() {
+			r.SetRoutingTable(&RoutingTable{Rules: []*RoutingRule{
+				{Match: RoutingMatch{ID: d0.ID()}, Action: RouteDrop},
+			}})
+
+			Expect(r.Route(InvalidOrdinal(), d0.ID(), &protocol.Packet{})).To(Succeed())
+			Expect(d0.packets).To(BeEmpty())
+		})
+
+		It("returns ErrNoRoute if a rule resolves to no devices", func() {
+			r.SetRoutingTable(&RoutingTable{Rules: []*RoutingRule{
+				{Action: RouteGroup, Group: intPtr(42)},
+			}})
+
+			Expect(r.Route(InvalidOrdinal(), d0.ID(), &protocol.Packet{})).To(Equal(ErrNoRoute))
+		})
+
+		It("falls back to default routing when no rule matches", func() {
+			r.SetRoutingTable(&RoutingTable{Rules: []*RoutingRule{
+				{Match: RoutingMatch{ID: "other"}, Action: RouteDrop},
+			}})
+
+			pkt := &protocol.Packet{}
+			Expect(r.Route(InvalidOrdinal(), d1.ID(), pkt)).To(Succeed())
+			Expect(d1.packets).To(ConsistOf(pkt))
+			Expect(r.RoutingTable().Unmatched()).To(BeEquivalentTo(1))
+			Expect(r.RoutingTable().Rules[0].Hits()).To(BeZero())
+		})
+
+		It("resolves device names using its Namer", func() {
+			r.Namer = testNamer{"left": d0.ID(), "right": d2.ID()}
+			r.SetRoutingTable(&RoutingTable{Rules: []*RoutingRule{
+				{Match: RoutingMatch{ID: "left"}, Action: RouteFanOut, IDs: []string{"left", "right"}},
+			}})
+
+			pkt := &protocol.Packet{}
+			Expect(r.Route(InvalidOrdinal(), d0.ID(), pkt)).To(Succeed())
+			Expect(d0.packets).To(ConsistOf(pkt))
+			Expect(d2.packets).To(ConsistOf(pkt))
+
+			By("routing to a name without a matching rule")
+			Expect(r.Route(InvalidOrdinal(), "right", pkt)).To(Succeed())
+			Expect(d2.packets).To(ConsistOf(pkt, pkt))
+		})
+
+		It("can swap and remove routing tables", func() {
+			r.SetRoutingTable(&RoutingTable{Rules: []*RoutingRule{
+				{Action: RouteDrop},
+			}})
+			Expect(r.Route(InvalidOrdinal(), d0.ID(), &protocol.Packet{})).To(Succeed())
+			Expect(d0.packets).To(BeEmpty())
+
+			r.SetRoutingTable(nil)
+			Expect(r.RoutingTable()).To(BeNil())
+
+			pkt := &protocol.Packet{}
+			Expect(r.Route(InvalidOrdinal(), d0.ID(), pkt)).To(Succeed())
+			Expect(d0.packets).To(ConsistOf(pkt))
+		})
+	})
+})
+
+// testNamer is a Namer backed by a map of names to IDs.
+type testNamer map[string]string
+
+func (tn testNamer) Name(id string) string {
+	for name, v := range tn {
+		if v == id {
+			return name
+		}
+	}
+	return ""
+}
+
+func (tn testNamer) ResolveName(name string) string { return tn[name] }
@@ -0,0 +1,15 @@
+// Copyright 2018 Dan Jacques. All rights reserved.
+// Use of this source code is governed under the MIT License
+// that can be found in the LICENSE file.
+
+// Package simulator implements a simulated PixelPusher device.
+//
+// A simulated Device runs entirely in-process. It listens for pixel and command
+// packets on a local UDP port, parses them as a physical PixelPusher would, and
+// maintains a framebuffer and command history which can be inspected by tests.
+// It can optionally broadcast its own discovery headers, allowing it to be
+// discovered and driven by the same code that drives physical devices.
+//
+// The simulator is intended for integration testing and development in the
+// absence of physical hardware.
+package simulator
@@ -0,0 +1,513 @@
+// Copyright 2018 Dan Jacques. All rights reserved.
+// Use of this source code is governed under the MIT License
+// that can be found in the LICENSE file.
+
+package simulator
+
+import (
+	"bytes"
+	"context"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/danjacques/gopushpixels/device"
+	"github.com/danjacques/gopushpixels/discovery"
+	"github.com/danjacques/gopushpixels/pixel"
+	"github.com/danjacques/gopushpixels/protocol"
+	"github.com/danjacques/gopushpixels/protocol/pixelpusher"
+	"github.com/danjacques/gopushpixels/support/byteslicereader"
+	"github.com/danjacques/gopushpixels/support/fmtutil"
+	"github.com/danjacques/gopushpixels/support/logging"
+	"github.com/danjacques/gopushpixels/support/network"
+
+	"github.com/pkg/errors"
+)
+
+// DefaultBroadcastInterval is the default interval in between discovery
+// broadcasts. It matches the interval used by physical PixelPusher devices.
+const DefaultBroadcastInterval = time.Second
+
+// CommandRecord is a single command received by a simulated Device.
+type CommandRecord struct {
+	// Received is the time when the command was received.
+	Received time.Time
+	// PacketID is the ID of the packet containing the command.
+	PacketID uint32
+	// Command is the received command.
+	Command pixelpusher.Command
+}
+
+// Stats is a set of statistics collected by a simulated Device.
+type Stats struct {
+	// PacketsReceived is the number of datagrams that were received, including
+	// dropped datagrams.
+	PacketsReceived int64
+	// BytesReceived is the number of bytes that were received, including those
+	// in dropped datagrams.
+	BytesReceived int64
+
+	// PacketsDropped is the number of datagrams that were dropped due to
+	// simulated packet loss.
+	PacketsDropped int64
+	// PixelPackets is the number of pixel packets that were processed.
+	PixelPackets int64
+	// CommandPackets is the number of command packets that were processed.
+	CommandPackets int64
+	// ParseErrors is the number of datagrams that could not be parsed.
+	ParseErrors int64
+	// SizeErrors is the number of datagrams that did not match the device's
+	// fixed packet size (fixed-size mode only).
+	SizeErrors int64
+
+	// Broadcasts is the number of discovery broadcasts that were sent.
+	Broadcasts int64
+}
+
+// Device is a simulated PixelPusher device.
+//
+// Device's exported fields must not be changed after Start is called.
+//
+// Device is safe for concurrent use.
+type Device struct {
+	// HardwareAddr is the device's hardware address. It must be a 6-byte address.
+	//
+	// Once discovered, a device's ID is the string form of its hardware address.
+	HardwareAddr net.HardwareAddr
+
+	// Group and Controller are the device's group and controller ordinals.
+	Group      int32
+	Controller int32
+
+	// NumStrips is the number of strips attached to the device. It must be >0.
+	NumStrips int
+	// PixelsPerStrip is the number of pixels on each strip. It must be >0.
+	PixelsPerStrip int
+	// MaxStripsPerPacket is the maximum number of strips that the device accepts
+	// in a single packet. If <= 0, NumStrips will be used.
+	MaxStripsPerPacket int
+	// StripFlags are the flags for each strip. If it has fewer than NumStrips
+	// entries, the remaining strips will have no flags.
+	StripFlags []pixelpusher.StripFlags
+	// PusherFlags are the device's PixelPusher flags.
+	PusherFlags uint32
+	// FixedSize, if true, enables the PFlagFixedSize device flag. In this mode,
+	// the device will expect all received datagrams to have the fixed size
+	// advertised by its headers, and will count deviations as SizeErrors.
+	FixedSize bool
+	// UpdatePeriod is the device's advertised update period.
+	UpdatePeriod time.Duration
+	// SoftwareRevision is the device's advertised software revision. If zero,
+	// pixelpusher.LatestSoftwareRevision will be used.
+	SoftwareRevision uint16
+
+	// PacketLoss is the probability, [0, 1], that a received datagram will be
+	// dropped without processing.
+	PacketLoss float64
+	// Rand, if not nil, is the random number generator used to simulate packet
+	// loss. If nil, a generator will be created on Start.
+	Rand *rand.Rand
+
+	// Discovery, if not nil, is the DatagramSender that the device will send its
+	// discovery broadcasts through. The Device takes ownership of Discovery, and
+	// will close it on Close.
+	//
+	// discovery.DefaultTransmitterConn can be used to generate a multicast
+	// Discovery sender.
+	Discovery network.DatagramSender
+	// BroadcastInterval is the interval in between discovery broadcasts. If
+	// <= 0, DefaultBroadcastInterval will be used.
+	BroadcastInterval time.Duration
+
+	// Logger, if not nil, is the logger to use.
+	Logger logging.L
+
+	logger logging.L
+	conn   *net.UDPConn
+	addr   *net.UDPAddr
+
+	// reader is the packet reader for this device's configuration.
+	reader *protocol.PacketReader
+	// fixedSize is the device's fixed packet size, or <=0 if not fixed.
+	fixedSize int
+
+	doneC chan struct{}
+	wg    sync.WaitGroup
+
+	// closeOnce ensures that the device is only torn down once, and closeErr is
+	// the result of that teardown.
+	closeOnce sync.Once
+	closeErr  error
+
+	// mu protects the following state.
+	mu sync.Mutex
+	// framebuffer is the device's current pixel state.
+	framebuffer device.Mutable
+	// commands is the history of received commands.
+	commands []*CommandRecord
+	// stats is the current device stats.
+	stats Stats
+	// deltaSequence is the number of packet IDs that were skipped.
+	deltaSequence uint32
+	// nextID is the next expected packet ID.
+	nextID uint32
+	// hasNextID is true if nextID is valid.
+	hasNextID bool
+	// updateC is closed and replaced whenever a datagram is received.
+	updateC chan struct{}
+}
+
+// Start starts the simulated device, listening for packets on conn.
+//
+// Start takes ownership of conn, and will close it on Close, regardless of
+// success.
+func (d *Device) Start(conn *net.UDPConn) error {
+	if d.conn != nil {
+		return errors.New("already started")
+	}
+
+	if err := d.validate(); err != nil {
+		_ = conn.Close()
+		return err
+	}
+
+	d.logger = logging.Must(d.Logger)
+	if d.Rand == nil {
+		d.Rand = rand.New(rand.NewSource(time.Now().UnixNano()))
+	}
+
+	d.conn = conn
+	d.addr = conn.LocalAddr().(*net.UDPAddr)
+	d.doneC = make(chan struct{})
+	d.updateC = make(chan struct{})
+
+	dh := d.buildHeaders(0)
+	d.framebuffer.Initialize(dh)
+	d.fixedSize = dh.PixelPusher.FixedSize()
+
+	var err error
+	if d.reader, err = dh.PacketReader(); err != nil {
+		// Clear conn, so that Close won't close it again.
+		_ = conn.Close()
+		d.conn = nil
+		return err
+	}
+
+	d.wg.Add(1)
+	go func() {
+		defer d.wg.Done()
+		d.listenForPackets()
+	}()
+
+	if d.Discovery != nil {
+		d.wg.Add(1)
+		go func() {
+			defer d.wg.Done()
+			d.broadcastUntilClosed()
+		}()
+	}
+
+	d.logger.Infof("Simulated device %s listening on %s.", d.HardwareAddr, d.addr)
+	return nil
+}
+
+func (d *Device) validate() error {
+	switch {
+	case len(d.HardwareAddr) != 6:
+		return errors.Errorf("invalid hardware address %q", d.HardwareAddr)
+	case d.NumStrips <= 0 || d.NumStrips > 0xFF:
+		return errors.Errorf("invalid number of strips (%d)", d.NumStrips)
+	case d.PixelsPerStrip <= 0 || d.PixelsPerStrip > 0xFFFF:
+		return errors.Errorf("invalid number of pixels per strip (%d)", d.PixelsPerStrip)
+	case d.PacketLoss < 0 || d.PacketLoss > 1:
+		return errors.Errorf("packet loss (%f) must be in [0, 1]", d.PacketLoss)
+	default:
+		return nil
+	}
+}
+
+// Close stops the simulated device, closing its connections.
+//
+// Close may be called more than once; subsequent calls return the result of
+// the first.
+func (d *Device) Close() error {
+	if d.conn == nil {
+		return nil
+	}
+
+	d.closeOnce.Do(func() {
+		close(d.doneC)
+		err := d.conn.Close()
+		d.wg.Wait()
+
+		if d.Discovery != nil {
+			if derr := d.Discovery.Close(); derr != nil && err == nil {
+				err = derr
+			}
+		}
+		d.closeErr = err
+	})
+	return d.closeErr
+}
+
+// Addr returns the address that the device is listening on.
+//
+// Addr will be nil until the device has been started.
+func (d *Device) Addr() *net.UDPAddr { return d.addr }
+
+// ID returns the device's ID, as it would be registered when discovered.
+func (d *Device) ID() string { return d.HardwareAddr.String() }
+
+// DiscoveryHeaders builds the device's current discovery headers.
+func (d *Device) DiscoveryHeaders() *protocol.DiscoveryHeaders {
+	d.mu.Lock()
+	deltaSequence := d.deltaSequence
+	d.mu.Unlock()
+
+	return d.buildHeaders(deltaSequence)
+}
+
+func (d *Device) buildHeaders(deltaSequence uint32) *protocol.DiscoveryHeaders {
+	swRevision := d.SoftwareRevision
+	if swRevision == 0 {
+		swRevision = pixelpusher.LatestSoftwareRevision
+	}
+
+	maxStripsPerPacket := d.MaxStripsPerPacket
+	if maxStripsPerPacket <= 0 {
+		maxStripsPerPacket = d.NumStrips
+	}
+
+	dh := protocol.DiscoveryHeaders{
+		DeviceHeader: protocol.DeviceHeader{
+			DeviceType:       protocol.PixelPusherDeviceType,
+			ProtocolVersion:  protocol.DefaultProtocolVersion,
+			SoftwareRevision: swRevision,
+		},
+		PixelPusher: &pixelpusher.Device{
+			DeviceHeader: pixelpusher.DeviceHeader{
+				StripsAttached:     uint8(d.NumStrips),
+				MaxStripsPerPacket: uint8(maxStripsPerPacket),
+				PixelsPerStrip:     uint16(d.PixelsPerStrip),
+				UpdatePeriod:       uint32(d.UpdatePeriod / time.Microsecond),
+				ControllerOrdinal:  d.Controller,
+				GroupOrdinal:       d.Group,
+			},
+		},
+	}
+	dh.SetHardwareAddr(d.HardwareAddr)
+
+	pp := dh.PixelPusher
+	pp.MyPort = pixelpusher.DefaultPort
+	if d.addr != nil {
+		if ip4 := d.addr.IP.To4(); ip4 != nil {
+			dh.SetIP4Address(ip4)
+		}
+		pp.MyPort = uint16(d.addr.Port)
+	}
+
+	pp.StripFlags = make([]pixelpusher.StripFlags, d.NumStrips)
+	copy(pp.StripFlags, d.StripFlags)
+
+	pp.PusherFlags = d.PusherFlags
+	if d.FixedSize {
+		pp.PusherFlags |= pixelpusher.PFlagFixedSize
+	}
+
+	pp.DeltaSequence = deltaSequence
+	return &dh
+}
+
+// Pixel returns the current value of the specified pixel.
+//
+// If the pixel does not exist, a zero-value pixel will be returned.
+func (d *Device) Pixel(strip, i int) pixel.P {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.framebuffer.GetPixel(strip, i)
+}
+
+// Snapshot returns a snapshot of the device's current framebuffer.
+func (d *Device) Snapshot() *device.Snapshot {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	ss := device.Snapshot{
+		ID:     d.ID(),
+		Strips: make([]*pixelpusher.StripState, d.framebuffer.NumStrips()),
+	}
+	for i := range ss.Strips {
+		var clone pixelpusher.StripState
+		clone.StripNumber = pixelpusher.StripNumber(i)
+		d.framebuffer.ClonePixelsTo(i, &clone.Pixels)
+		ss.Strips[i] = &clone
+	}
+	return &ss
+}
+
+// Commands returns the history of commands that the device has received, in
+// the order that they were received.
+func (d *Device) Commands() []*CommandRecord {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return append([]*CommandRecord(nil), d.commands...)
+}
+
+// Stats returns the device's current statistics.
+func (d *Device) Stats() Stats {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.stats
+}
+
+// Reboot simulates a device reboot. The device's framebuffer, command history,
+// and sequence tracking will be cleared.
+func (d *Device) Reboot() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.framebuffer = device.Mutable{}
+	d.framebuffer.Initialize(d.buildHeaders(0))
+	d.commands = nil
+	d.deltaSequence = 0
+	d.hasNextID = false
+}
+
+// WaitForPackets blocks until the device has received at least count
+// datagrams (including dropped datagrams), or until c is cancelled.
+func (d *Device) WaitForPackets(c context.Context, count int64) error {
+	for {
+		d.mu.Lock()
+		received, updateC := d.stats.PacketsReceived, d.updateC
+		d.mu.Unlock()
+
+		if received >= count {
+			return nil
+		}
+
+		select {
+		case <-updateC:
+		case <-d.doneC:
+			return errors.New("device is closed")
+		case <-c.Done():
+			return c.Err()
+		}
+	}
+}
+
+func (d *Device) listenForPackets() {
+	buf := make([]byte, network.MaxUDPSize)
+	for {
+		size, addr, err := d.conn.ReadFromUDP(buf)
+		if err != nil {
+			select {
+			case <-d.doneC:
+				return
+			default:
+				d.logger.Warnf("Simulated device %s failed to read packet: %s", d.HardwareAddr, err)
+				continue
+			}
+		}
+
+		d.logger.Debugf("Simulated device %s received packet from %s (%d byte(s)):\n%s",
+			d.HardwareAddr, addr, size, fmtutil.Hex(buf[:size]))
+		d.handleDatagram(buf[:size])
+	}
+}
+
+func (d *Device) handleDatagram(data []byte) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	// Notify any waiting users once we've processed this datagram.
+	defer func() {
+		close(d.updateC)
+		d.updateC = make(chan struct{})
+	}()
+
+	d.stats.PacketsReceived++
+	d.stats.BytesReceived += int64(len(data))
+
+	// Simulate packet loss.
+	if d.PacketLoss > 0 && d.Rand.Float64() < d.PacketLoss {
+		d.stats.PacketsDropped++
+		return
+	}
+
+	if d.fixedSize > 0 && len(data) != d.fixedSize {
+		d.stats.SizeErrors++
+	}
+
+	var pkt protocol.Packet
+	if err := d.reader.ReadPacket(&byteslicereader.R{Buffer: data}, &pkt); err != nil {
+		d.logger.Warnf("Simulated device %s could not parse packet: %s", d.HardwareAddr, err)
+		d.stats.ParseErrors++
+		return
+	}
+	pp := pkt.PixelPusher
+
+	// Track sequence gaps, as a physical device would.
+	if d.hasNextID && pp.ID > d.nextID {
+		d.deltaSequence += pp.ID - d.nextID
+	}
+	d.nextID, d.hasNextID = pp.ID+1, true
+
+	if pp.Command != nil {
+		d.stats.CommandPackets++
+		d.commands = append(d.commands, &CommandRecord{
+			Received: time.Now(),
+			PacketID: pp.ID,
+			Command:  pp.Command,
+		})
+		return
+	}
+
+	d.stats.PixelPackets++
+	for i, ss := range pp.StripStates {
+		if d.FixedSize && i > 0 && isPadding(ss) {
+			// The remainder of the packet is fixed-size padding.
+			break
+		}
+		d.framebuffer.SetPixels(int(ss.StripNumber), &ss.Pixels)
+	}
+}
+
+// isPadding returns true if ss looks like fixed-size packet padding: a strip
+// #0 state consisting entirely of zero bytes.
+func isPadding(ss *pixelpusher.StripState) bool {
+	if ss.StripNumber != 0 {
+		return false
+	}
+	data := ss.Pixels.Bytes()
+	return len(bytes.Trim(data, "\x00")) == 0
+}
+
+func (d *Device) broadcastUntilClosed() {
+	interval := d.BroadcastInterval
+	if interval <= 0 {
+		interval = DefaultBroadcastInterval
+	}
+
+	var t discovery.Transmitter
+	t.Logger = d.Logger
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if err := t.Broadcast(d.Discovery, d.DiscoveryHeaders()); err != nil {
+			d.logger.Warnf("Simulated device %s failed to broadcast: %s", d.HardwareAddr, err)
+		} else {
+			d.mu.Lock()
+			d.stats.Broadcasts++
+			d.mu.Unlock()
+		}
+
+		select {
+		case <-ticker.C:
+		case <-d.doneC:
+			return
+		}
+	}
+}
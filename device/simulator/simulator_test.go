@@ -0,0 +1,193 @@
+// Copyright 2018 Dan Jacques. All rights reserved.
+// Use of this source code is governed under the MIT License
+// that can be found in the LICENSE file.
+
+package simulator
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/danjacques/gopushpixels/device"
+	"github.com/danjacques/gopushpixels/pixel"
+	"github.com/danjacques/gopushpixels/protocol"
+	"github.com/danjacques/gopushpixels/protocol/pixelpusher"
+	"github.com/danjacques/gopushpixels/support/network"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+type chanDatagramSender struct {
+	network.DatagramSender
+	datagramC chan []byte
+}
+
+func (cds *chanDatagramSender) SendDatagram(d []byte) error {
+	select {
+	case cds.datagramC <- append([]byte(nil), d...):
+	default:
+	}
+	return nil
+}
+
+func (cds *chanDatagramSender) Close() error { return nil }
+
+var _ = Describe("Device", func() {
+	var sim *Device
+	BeforeEach(func() {
+		sim = &Device{
+			HardwareAddr:   net.HardwareAddr{0x02, 0x00, 0x00, 0x00, 0x00, 0x01},
+			Group:          2,
+			Controller:     3,
+			NumStrips:      2,
+			PixelsPerStrip: 4,
+			StripFlags:     []pixelpusher.StripFlags{0, pixelpusher.SFlagRGBOW},
+		}
+	})
+
+	start := func() {
+		conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(sim.Start(conn)).To(Succeed())
+	}
+	AfterEach(func() {
+		Expect(sim.Close()).To(Succeed())
+	})
+
+	It("refuses to start with an invalid configuration", func() {
+		sim.NumStrips = 0
+
+		conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(sim.Start(conn)).ToNot(Succeed())
+	})
+
+	It("can be closed more than once", func() {
+		start()
+
+		Expect(sim.Close()).To(Succeed())
+		Expect(sim.Close()).To(Succeed())
+	})
+
+	It("advertises its configuration in its discovery headers", func() {
+		start()
+
+		dh := sim.DiscoveryHeaders()
+		Expect(dh.HardwareAddr().String()).To(Equal(sim.ID()))
+		addr := dh.Addr().(*net.UDPAddr)
+		Expect(addr.IP.Equal(sim.Addr().IP)).To(BeTrue())
+		Expect(addr.Port).To(Equal(sim.Addr().Port))
+		Expect(dh.NumStrips()).To(Equal(2))
+		Expect(dh.PixelPusher.PixelsPerStrip).To(BeEquivalentTo(4))
+		Expect(dh.PixelPusher.GroupOrdinal).To(BeEquivalentTo(2))
+		Expect(dh.PixelPusher.ControllerOrdinal).To(BeEquivalentTo(3))
+		Expect(dh.PixelPusher.StripFlags[1].IsRGBOW()).To(BeTrue())
+	})
+
+	It("periodically broadcasts its discovery headers", func(done Done) {
+		defer close(done)
+
+		cds := &chanDatagramSender{datagramC: make(chan []byte, 2)}
+		sim.Discovery = cds
+		sim.BroadcastInterval = 10 * time.Millisecond
+		start()
+
+		for i := 0; i < 2; i++ {
+			dh, err := protocol.ParseDiscoveryHeaders(<-cds.datagramC)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(dh.HardwareAddr().String()).To(Equal(sim.ID()))
+		}
+	})
+
+	Context("when driven by a Remote device", func() {
+		var (
+			c          context.Context
+			cancelFunc context.CancelFunc
+			r          *device.Remote
+			s          device.Sender
+		)
+		BeforeEach(func() {
+			start()
+
+			c, cancelFunc = context.WithTimeout(context.Background(), 5*time.Second)
+
+			r = device.MakeRemote(sim.ID(), sim.DiscoveryHeaders())
+
+			var err error
+			s, err = r.Sender()
+			Expect(err).ToNot(HaveOccurred())
+		})
+		AfterEach(func() {
+			Expect(s.Close()).To(Succeed())
+			r.MarkDone()
+			cancelFunc()
+		})
+
+		It("updates its framebuffer from pixel packets", func() {
+			var m device.Mutable
+			m.Initialize(r.DiscoveryHeaders())
+			m.SetPixel(0, 1, pixel.P{Red: 0x10, Green: 0x20, Blue: 0x30})
+			m.SetPixel(1, 3, pixel.P{Red: 0x40, White: 0x50})
+
+			Expect(s.SendPacket(m.SyncPacket())).To(Succeed())
+			Expect(sim.WaitForPackets(c, 1)).To(Succeed())
+
+			Expect(sim.Pixel(0, 1)).To(Equal(pixel.P{Red: 0x10, Green: 0x20, Blue: 0x30}))
+			Expect(sim.Pixel(1, 3)).To(Equal(pixel.P{Red: 0x40, White: 0x50}))
+			Expect(sim.Snapshot().Strips).To(HaveLen(2))
+			Expect(sim.Stats().PixelPackets).To(BeEquivalentTo(1))
+		})
+
+		It("records received commands", func() {
+			cmd := &pixelpusher.GlobalBrightnessSetCommand{Parameter: 0x1337}
+			Expect(s.SendPacket(&protocol.Packet{
+				PixelPusher: &pixelpusher.Packet{Command: cmd},
+			})).To(Succeed())
+			Expect(sim.WaitForPackets(c, 1)).To(Succeed())
+
+			commands := sim.Commands()
+			Expect(commands).To(HaveLen(1))
+			Expect(commands[0].Command).To(Equal(cmd))
+		})
+
+		It("can reboot, clearing its state", func() {
+			var m device.Mutable
+			m.Initialize(r.DiscoveryHeaders())
+			m.SetPixel(0, 0, pixel.P{Red: 0xFF})
+			Expect(s.SendPacket(m.SyncPacket())).To(Succeed())
+			Expect(sim.WaitForPackets(c, 1)).To(Succeed())
+
+			sim.Reboot()
+			Expect(sim.Pixel(0, 0)).To(BeZero())
+		})
+	})
+
+	Context("with total packet loss", func() {
+		BeforeEach(func() {
+			sim.PacketLoss = 1
+			start()
+		})
+
+		It("drops all received packets", func() {
+			conn, err := net.DialUDP("udp4", nil, sim.Addr())
+			Expect(err).ToNot(HaveOccurred())
+			defer conn.Close()
+
+			_, err = conn.Write([]byte{0x00, 0x00, 0x00, 0x00})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(sim.WaitForPackets(context.Background(), 1)).To(Succeed())
+
+			st := sim.Stats()
+			Expect(st.PacketsDropped).To(BeEquivalentTo(1))
+			Expect(st.PixelPackets).To(BeZero())
+		})
+	})
+})
+
+func TestSimulator(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Simulator")
+}
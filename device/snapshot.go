@@ -5,6 +5,7 @@
 package device
 
 import (
+	"sort"
 	"sync"
 	"time"
 
@@ -22,6 +23,9 @@ type Snapshot struct {
 	// ID is the snapshot device ID.
 	ID string
 
+	// Time is the time when the snapshot's state was last updated.
+	Time time.Time
+
 	// Strips is the set of strips on this device.
 	Strips []*pixelpusher.StripState
 }
@@ -38,6 +42,21 @@ type SnapshotManager struct {
 	// If SampleRate is <= 0, all samples will be taken.
 	SampleRate time.Duration
 
+	// HistorySize, if > 0, is the number of snapshots to retain for each device.
+	// Each time a sample is taken, a Snapshot of the device's full state is
+	// added to its history, discarding the oldest if the history is full.
+	//
+	// History can be queried using SnapshotAt and SnapshotHistory.
+	HistorySize int
+
+	// Retention, if > 0, is the amount of time that a device's snapshot state is
+	// retained after the device is done. If a device with the same ID is seen
+	// within that time (e.g., it expired and was rediscovered), it will inherit
+	// the retained state.
+	//
+	// If Retention is <= 0, a device's state is deleted as soon as it is done.
+	Retention time.Duration
+
 	mu     sync.RWMutex
 	states map[string]*snapshotDeviceState
 
@@ -74,43 +93,66 @@ func (m *SnapshotManager) getOrCreateDeviceState(d D) *snapshotDeviceState {
 	id := d.ID()
 
 	// See if the device is already registered under read-lock. This is likely.
-	ds := m.getDeviceState(id)
-	if ds != nil {
+	m.mu.RLock()
+	ds := m.states[id]
+	if ds != nil && ds.owner == d {
+		m.mu.RUnlock()
 		return ds
 	}
+	m.mu.RUnlock()
 
-	// The device doesn't exist; create it.
+	// The device doesn't exist, or its state is owned by a previous instance of
+	// the device; create or claim it.
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
 	ds = m.states[id]
-	if ds != nil {
+	switch {
+	case ds == nil:
+		ds = &snapshotDeviceState{
+			m:      m,
+			id:     id,
+			device: &Mutable{},
+		}
+		if m.states == nil {
+			m.states = make(map[string]*snapshotDeviceState)
+		}
+		m.states[id] = ds
+
+	case ds.owner == d:
 		// The device was created since we checked under read-lock. Return.
 		return ds
 	}
 
-	ds = &snapshotDeviceState{
-		m:      m,
-		id:     id,
-		device: &Mutable{},
-	}
+	// Take ownership of the state, initializing it for d's current layout.
+	ds.owner = d
+	ds.mu.Lock()
 	ds.device.Initialize(d.DiscoveryHeaders())
-
-	if m.states == nil {
-		m.states = make(map[string]*snapshotDeviceState)
-	}
-	m.states[id] = ds
+	ds.mu.Unlock()
 
 	// Unregister this from the SnapshotManager when the device closes. This
 	// avoids indefinite accumultaion of snapshot state as devices come and go.
 	go func() {
 		<-d.DoneC()
-		m.Delete(d)
+		if m.Retention > 0 {
+			time.AfterFunc(m.Retention, func() { m.deleteOwned(ds, d) })
+		} else {
+			m.deleteOwned(ds, d)
+		}
 	}()
 
 	return ds
 }
 
+// deleteOwned deletes ds if it is still registered and owned by d.
+func (m *SnapshotManager) deleteOwned(ds *snapshotDeviceState, d D) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.states[ds.id] == ds && ds.owner == d {
+		delete(m.states, ds.id)
+	}
+}
+
 // SnapshotForDevice returns the current snapshot for the specified device.
 func (m *SnapshotManager) SnapshotForDevice(d D) *Snapshot {
 	ds := m.getDeviceState(d.ID())
@@ -120,6 +162,45 @@ func (m *SnapshotManager) SnapshotForDevice(d D) *Snapshot {
 	return ds.getSnapshot()
 }
 
+// SnapshotAt returns the snapshot of the specified device's state at t. This
+// is the most recent snapshot in the device's history that was taken at or
+// before t.
+//
+// If HistorySize is not set, or no such snapshot is in the device's history,
+// SnapshotAt returns nil.
+//
+// Snapshots in the history are shared, and must not be modified.
+func (m *SnapshotManager) SnapshotAt(d D, t time.Time) *Snapshot {
+	ds := m.getDeviceState(d.ID())
+	if ds == nil {
+		return nil
+	}
+
+	ds.mu.RLock()
+	defer ds.mu.RUnlock()
+	return ds.history.at(t)
+}
+
+// SnapshotHistory returns the snapshots in the specified device's history that
+// were taken within [start, end], in chronological order.
+//
+// If start is zero, the range begins with the oldest snapshot. If end is zero,
+// the range ends with the newest snapshot.
+//
+// If HistorySize is not set, SnapshotHistory returns nil.
+//
+// Snapshots in the history are shared, and must not be modified.
+func (m *SnapshotManager) SnapshotHistory(d D, start, end time.Time) []*Snapshot {
+	ds := m.getDeviceState(d.ID())
+	if ds == nil {
+		return nil
+	}
+
+	ds.mu.RLock()
+	defer ds.mu.RUnlock()
+	return ds.history.window(start, end)
+}
+
 // HasSnapshotForDevice returns true if a snapshot is stored for d.
 func (m *SnapshotManager) HasSnapshotForDevice(d D) bool {
 	ds := m.getDeviceState(d.ID())
@@ -209,10 +290,17 @@ func (m *SnapshotManager) shouldSnapshot(now, last time.Time) bool {
 type snapshotDeviceState struct {
 	m  *SnapshotManager
 	id string
+	// owner is the device instance that currently owns this state. It is
+	// protected by m's mu.
+	owner D
 
 	mu             sync.RWMutex
 	device         *Mutable
 	lastSampleTime map[pixelpusher.StripNumber]time.Time
+	// updated is the time when device was last updated.
+	updated time.Time
+	// history is the device's snapshot history.
+	history snapshotHistory
 }
 
 func (ds *snapshotDeviceState) updatePixelPusherStrips(strips []*pixelpusher.StripState) {
@@ -220,13 +308,26 @@ func (ds *snapshotDeviceState) updatePixelPusherStrips(strips []*pixelpusher.Str
 	defer ds.mu.Unlock()
 
 	now := time.Now()
+	sampled := false
 	for _, ss := range strips {
-		ds.updatePixelPusherStripLocked(now, ss.StripNumber, &ss.Pixels)
+		if ds.updatePixelPusherStripLocked(now, ss.StripNumber, &ss.Pixels) {
+			sampled = true
+		}
+	}
+	if !sampled {
+		return
+	}
+
+	ds.updated = now
+	if size := ds.m.HistorySize; size > 0 {
+		ds.history.add(ds.getSnapshotLocked(), size)
 	}
 }
 
+// updatePixelPusherStripLocked updates the state of the specified strip. It
+// returns true if a sample was taken.
 func (ds *snapshotDeviceState) updatePixelPusherStripLocked(now time.Time,
-	stripNumber pixelpusher.StripNumber, pixels *pixel.Buffer) {
+	stripNumber pixelpusher.StripNumber, pixels *pixel.Buffer) bool {
 
 	// If we are sampling, are we within our sample window?
 	sr := ds.m.SampleRate
@@ -235,7 +336,7 @@ func (ds *snapshotDeviceState) updatePixelPusherStripLocked(now time.Time,
 		lastSampleTime := ds.lastSampleTime[stripNumber]
 		if !ds.m.shouldSnapshot(now, lastSampleTime) {
 			// Decided not to snapshot.
-			return
+			return false
 		}
 	}
 
@@ -249,6 +350,7 @@ func (ds *snapshotDeviceState) updatePixelPusherStripLocked(now time.Time,
 		}
 		ds.lastSampleTime[stripNumber] = now
 	}
+	return true
 }
 
 func (ds *snapshotDeviceState) hasSnapshot() bool {
@@ -260,9 +362,13 @@ func (ds *snapshotDeviceState) hasSnapshot() bool {
 func (ds *snapshotDeviceState) getSnapshot() *Snapshot {
 	ds.mu.RLock()
 	defer ds.mu.RUnlock()
+	return ds.getSnapshotLocked()
+}
 
+func (ds *snapshotDeviceState) getSnapshotLocked() *Snapshot {
 	ss := Snapshot{
 		ID:     ds.id,
+		Time:   ds.updated,
 		Strips: make([]*pixelpusher.StripState, ds.device.NumStrips()),
 	}
 	for i := range ss.Strips {
@@ -274,3 +380,63 @@ func (ds *snapshotDeviceState) getSnapshot() *Snapshot {
 
 	return &ss
 }
+
+// snapshotHistory is a ring buffer of Snapshots, in chronological order.
+type snapshotHistory struct {
+	entries []*Snapshot
+	// head is the index of the oldest entry, once entries is full.
+	head int
+}
+
+// add adds s to the history, discarding the oldest snapshot if the history
+// already holds size snapshots.
+func (h *snapshotHistory) add(s *Snapshot, size int) {
+	if len(h.entries) < size {
+		if h.head != 0 {
+			// HistorySize has grown after we wrapped; restore chronological order
+			// before appending.
+			h.entries = h.ordered()
+			h.head = 0
+		}
+		h.entries = append(h.entries, s)
+		return
+	}
+
+	if len(h.entries) > size {
+		// HistorySize has shrunk; discard our oldest entries.
+		h.entries = h.ordered()[len(h.entries)-size:]
+		h.head = 0
+	}
+	h.entries[h.head] = s
+	h.head = (h.head + 1) % len(h.entries)
+}
+
+// ordered returns the history's entries, oldest first.
+func (h *snapshotHistory) ordered() []*Snapshot {
+	ordered := make([]*Snapshot, 0, len(h.entries))
+	ordered = append(ordered, h.entries[h.head:]...)
+	return append(ordered, h.entries[:h.head]...)
+}
+
+func (h *snapshotHistory) at(t time.Time) *Snapshot {
+	ordered := h.ordered()
+	idx := sort.Search(len(ordered), func(i int) bool { return ordered[i].Time.After(t) })
+	if idx == 0 {
+		return nil
+	}
+	return ordered[idx-1]
+}
+
+func (h *snapshotHistory) window(start, end time.Time) []*Snapshot {
+	var result []*Snapshot
+	for _, s := range h.ordered() {
+		if !start.IsZero() && s.Time.Before(start) {
+			continue
+		}
+		if !end.IsZero() && s.Time.After(end) {
+			break
+		}
+		result = append(result, s)
+	}
+	return result
+}
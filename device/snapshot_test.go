@@ -0,0 +1,120 @@
+// Copyright 2018 Dan Jacques. All rights reserved.
+// Use of this source code is governed under the MIT License
+// that can be found in the LICENSE file.
+
+package device
+
+import (
+	"time"
+
+	"github.com/danjacques/gopushpixels/pixel"
+	"github.com/danjacques/gopushpixels/protocol"
+	"github.com/danjacques/gopushpixels/protocol/pixelpusher"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("SnapshotManager", func() {
+	var sm *SnapshotManager
+	var d *testD
+	BeforeEach(func() {
+		sm = &SnapshotManager{HistorySize: 3}
+		d = makeTestD("foo")
+		d.headers = makePixelPusherHeaders(1, 2)
+	})
+	AfterEach(func() {
+		d.markDone()
+	})
+
+	send := func(v uint8) time.Time {
+		ss := pixelpusher.StripState{StripNumber: 0}
+		ss.Pixels.Reset(2)
+		ss.Pixels.SetPixels(pixel.P{Red: v}, pixel.P{Blue: v})
+		sm.HandlePacket(d, &protocol.Packet{
+			PixelPusher: &pixelpusher.Packet{StripStates: []*pixelpusher.StripState{&ss}},
+		})
+
+		// Ensure that each sample has a distinct time.
+		time.Sleep(time.Millisecond)
+		return time.Now()
+	}
+	red := func(s *Snapshot) uint8 { return s.Strips[0].Pixels.Pixel(0).Red }
+
+	It("does not retain history if HistorySize is not set", func() {
+		sm.HistorySize = 0
+		send(1)
+		Expect(sm.SnapshotForDevice(d)).ToNot(BeNil())
+		Expect(sm.SnapshotAt(d, time.Now())).To(BeNil())
+		Expect(sm.SnapshotHistory(d, time.Time{}, time.Time{})).To(BeEmpty())
+	})
+
+	It("retains a bounded history of snapshots", func() {
+		start := time.Now()
+		t1 := send(1)
+		t2 := send(2)
+
+		Expect(sm.SnapshotAt(d, start)).To(BeNil())
+		Expect(red(sm.SnapshotAt(d, t1))).To(Equal(uint8(1)))
+		Expect(red(sm.SnapshotAt(d, t2))).To(Equal(uint8(2)))
+		Expect(sm.SnapshotForDevice(d).Time.After(t1)).To(BeTrue())
+
+		send(3)
+		t4 := send(4)
+		history := sm.SnapshotHistory(d, time.Time{}, time.Time{})
+		Expect(history).To(HaveLen(3))
+		for i, s := range history {
+			Expect(red(s)).To(Equal(uint8(i + 2)))
+		}
+
+		By("returning the snapshots within a window")
+		history = sm.SnapshotHistory(d, t2, t4)
+		Expect(history).To(HaveLen(2))
+		Expect(red(history[0])).To(Equal(uint8(3)))
+		Expect(red(history[1])).To(Equal(uint8(4)))
+
+		By("adjusting to a smaller HistorySize")
+		sm.HistorySize = 2
+		send(5)
+		history = sm.SnapshotHistory(d, time.Time{}, time.Time{})
+		Expect(history).To(HaveLen(2))
+		Expect(red(history[0])).To(Equal(uint8(4)))
+		Expect(red(history[1])).To(Equal(uint8(5)))
+	})
+
+	It("keeps its history in order when HistorySize grows after wrapping", func() {
+		for i := 1; i <= 4; i++ {
+			send(uint8(i))
+		}
+
+		sm.HistorySize = 5
+		t5 := send(5)
+		send(6)
+
+		history := sm.SnapshotHistory(d, time.Time{}, time.Time{})
+		Expect(history).To(HaveLen(5))
+		for i, s := range history {
+			Expect(red(s)).To(Equal(uint8(i + 2)))
+		}
+		Expect(red(sm.SnapshotAt(d, t5))).To(Equal(uint8(5)))
+	})
+
+	It("retains the state of done devices for its Retention", func() {
+		sm.Retention = time.Hour
+		send(1)
+		d.markDone()
+
+		readded := makeTestD("foo")
+		readded.headers = d.headers
+		defer readded.markDone()
+
+		Expect(sm.HasSnapshotForDevice(readded)).To(BeTrue())
+		Expect(red(sm.SnapshotForDevice(readded))).To(Equal(uint8(1)))
+	})
+
+	It("deletes the state of done devices without Retention", func() {
+		send(1)
+		d.markDone()
+		Eventually(func() bool { return sm.HasSnapshotForDevice(d) }).Should(BeFalse())
+	})
+})
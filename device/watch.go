@@ -0,0 +1,152 @@
+// Copyright 2018 Dan Jacques. All rights reserved.
+// Use of this source code is governed under the MIT License
+// that can be found in the LICENSE file.
+
+package device
+
+import (
+	"context"
+	"sync"
+
+	"github.com/danjacques/gopushpixels/protocol"
+	"github.com/danjacques/gopushpixels/support/eventqueue"
+)
+
+// RegistryEventType is the type of a RegistryEvent.
+type RegistryEventType int
+
+const (
+	// DeviceAdded indicates that a device has been added to a registry.
+	DeviceAdded RegistryEventType = iota
+	// DeviceUpdated indicates that a registered device's discovery headers have
+	// changed.
+	DeviceUpdated
+	// DeviceRemoved indicates that a device has been removed from a registry,
+	// either because it expired or because it was explicitly removed.
+	DeviceRemoved
+	// DeviceStale indicates that a registered device has not been observed
+	// recently, but has not yet been removed. A stale device remains usable.
+	DeviceStale
+	// DeviceRecovered indicates that a stale device has been observed again.
+	DeviceRecovered
+)
+
+func (t RegistryEventType) String() string {
+	switch t {
+	case DeviceAdded:
+		return "added"
+	case DeviceUpdated:
+		return "updated"
+	case DeviceRemoved:
+		return "removed"
+	case DeviceStale:
+		return "stale"
+	case DeviceRecovered:
+		return "recovered"
+	default:
+		return "unknown"
+	}
+}
+
+// RegistryEvent describes a change in a registry's devices.
+type RegistryEvent struct {
+	// Type is the type of event.
+	Type RegistryEventType
+	// Device is the device that the event applies to.
+	Device D
+
+	// Initial is true if this event is part of the initial snapshot delivered
+	// to a new watcher. Initial events are always of type DeviceAdded.
+	Initial bool
+
+	// Changes, for DeviceUpdated events, is the set of fields that changed.
+	Changes []protocol.HeaderChange
+}
+
+// RegistryWatchers manages a set of registry watchers, delivering
+// RegistryEvents to each of them. It is used by registries to implement their
+// Watch methods.
+//
+// Each watcher has its own unbounded queue, so a slow watcher will never block
+// the registry or other watchers.
+//
+// The zero value is an empty RegistryWatchers. RegistryWatchers is safe for
+// concurrent use.
+type RegistryWatchers struct {
+	mu       sync.Mutex
+	watchers map[*registryWatcher]struct{}
+}
+
+// Watch registers a new watcher, returning a channel that receives its events.
+//
+// The watcher first receives an Initial DeviceAdded event for each device in
+// snapshot, followed by every event passed to Send. To ensure that the
+// watcher observes a consistent view, the caller should hold a lock that
+// prevents calls to Send while building snapshot and calling Watch.
+//
+// The watcher is unregistered, and the returned channel is closed, when ctx is
+// cancelled.
+func (rw *RegistryWatchers) Watch(c context.Context, snapshot []D) <-chan RegistryEvent {
+	initial := make([]interface{}, len(snapshot))
+	for i, d := range snapshot {
+		initial[i] = RegistryEvent{
+			Type:    DeviceAdded,
+			Device:  d,
+			Initial: true,
+		}
+	}
+	w := &registryWatcher{
+		eventC: make(chan RegistryEvent),
+		queue:  eventqueue.Make(initial...),
+	}
+
+	rw.mu.Lock()
+	if rw.watchers == nil {
+		rw.watchers = make(map[*registryWatcher]struct{})
+	}
+	rw.watchers[w] = struct{}{}
+	rw.mu.Unlock()
+
+	go func() {
+		defer rw.remove(w)
+		w.run(c)
+	}()
+	return w.eventC
+}
+
+// Send delivers ev to all registered watchers.
+func (rw *RegistryWatchers) Send(ev RegistryEvent) {
+	rw.mu.Lock()
+	defer rw.mu.Unlock()
+
+	for w := range rw.watchers {
+		w.push(ev)
+	}
+}
+
+func (rw *RegistryWatchers) remove(w *registryWatcher) {
+	rw.mu.Lock()
+	defer rw.mu.Unlock()
+	delete(rw.watchers, w)
+}
+
+// registryWatcher is a single registered watcher.
+type registryWatcher struct {
+	eventC chan RegistryEvent
+	queue  *eventqueue.Queue
+}
+
+func (w *registryWatcher) push(ev RegistryEvent) { w.queue.Push(ev) }
+
+func (w *registryWatcher) run(c context.Context) {
+	defer close(w.eventC)
+
+	w.queue.Run(c, func(ev interface{}) bool {
+		select {
+		case w.eventC <- ev.(RegistryEvent):
+			return true
+		case <-c.Done():
+			return false
+		}
+	})
+}
@@ -0,0 +1,285 @@
+// Copyright 2018 Dan Jacques. All rights reserved.
+// Use of this source code is governed under the MIT License
+// that can be found in the LICENSE file.
+
+package discovery
+
+import (
+	"context"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/danjacques/gopushpixels/device"
+	"github.com/danjacques/gopushpixels/support/logging"
+	"github.com/danjacques/gopushpixels/support/network"
+)
+
+const (
+	// DefaultAdvertiseInterval is the default interval in between an
+	// Advertiser's broadcasts for a device. It matches the interval used by
+	// physical PixelPusher devices.
+	DefaultAdvertiseInterval = time.Second
+
+	// DefaultBurstCount is the default number of additional broadcasts that an
+	// Advertiser sends for a device immediately after it is added.
+	DefaultBurstCount = 3
+	// DefaultBurstInterval is the default interval in between an Advertiser's
+	// burst broadcasts.
+	DefaultBurstInterval = 100 * time.Millisecond
+)
+
+// Advertiser periodically broadcasts the discovery headers of a dynamic set of
+// devices, so that they can be discovered like physical devices.
+//
+// Each device is broadcast every Interval, plus a random amount of Jitter, so
+// that broadcasts for many devices are spread out. When a device is first
+// added, it is broadcast immediately, followed by a burst of BurstCount
+// broadcasts every BurstInterval, so that listeners pick it up quickly.
+//
+// Devices are removed automatically when they are Done.
+//
+// Advertiser is safe for concurrent use. Devices may be added and removed
+// while it is running.
+type Advertiser struct {
+	// Sender is the connection to broadcast on. It must not be nil. Typically,
+	// this will be a connection to DefaultTransmitterConn.
+	Sender network.DatagramSender
+
+	// Interval is the interval in between broadcasts for each device. If <= 0,
+	// DefaultAdvertiseInterval will be used.
+	Interval time.Duration
+	// Jitter is the maximum random amount of time added to each Interval. If
+	// <= 0, no jitter will be added.
+	Jitter time.Duration
+
+	// BurstCount is the number of additional broadcasts sent after a device is
+	// first added. If 0, DefaultBurstCount will be used. If < 0, no burst will
+	// be sent.
+	BurstCount int
+	// BurstInterval is the interval in between burst broadcasts. If <= 0,
+	// DefaultBurstInterval will be used.
+	BurstInterval time.Duration
+
+	// Logger, if not nil, is the logger to use.
+	Logger logging.L
+
+	mu sync.Mutex
+	// devices is the set of advertised devices, keyed on device ID.
+	devices map[string]*advertisedDevice
+	// wakeC is signalled when the set of devices changes.
+	wakeC chan struct{}
+	// rng generates jitter.
+	rng *rand.Rand
+}
+
+// advertisedDevice is a single device managed by an Advertiser.
+type advertisedDevice struct {
+	d device.D
+
+	// next is the time of the device's next broadcast.
+	next time.Time
+	// burst is the number of burst broadcasts remaining.
+	burst int
+
+	// removedC is closed when the device is removed from the Advertiser.
+	removedC chan struct{}
+}
+
+// Add adds d to the set of advertised devices. It will be broadcast as soon
+// as possible.
+//
+// If a device with the same ID is already advertised, it is replaced by d. If
+// d is already advertised, Add does nothing.
+func (a *Advertiser) Add(d device.D) {
+	if device.IsDone(d) {
+		return
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	id := d.ID()
+	if ad := a.devices[id]; ad != nil {
+		if ad.d == d {
+			return
+		}
+		a.removeLocked(ad)
+	}
+
+	ad := &advertisedDevice{
+		d:        d,
+		next:     time.Now(),
+		burst:    a.burstCount(),
+		removedC: make(chan struct{}),
+	}
+	if a.devices == nil {
+		a.devices = make(map[string]*advertisedDevice)
+	}
+	a.devices[id] = ad
+	a.logger().Debugf("Advertising device %q.", id)
+
+	// Remove the device automatically when it is Done.
+	go func() {
+		select {
+		case <-d.DoneC():
+			a.Remove(d)
+		case <-ad.removedC:
+		}
+	}()
+
+	a.wakeLocked()
+}
+
+// Remove removes d from the set of advertised devices. If d is not
+// advertised, Remove does nothing.
+func (a *Advertiser) Remove(d device.D) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if ad := a.devices[d.ID()]; ad != nil && ad.d == d {
+		a.removeLocked(ad)
+		a.wakeLocked()
+	}
+}
+
+// Devices returns the set of advertised devices, sorted by ID.
+func (a *Advertiser) Devices() []device.D {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	devices := make([]device.D, 0, len(a.devices))
+	for _, ad := range a.devices {
+		devices = append(devices, ad.d)
+	}
+	sort.Slice(devices, func(i, j int) bool { return devices[i].ID() < devices[j].ID() })
+	return devices
+}
+
+// Run broadcasts the advertised devices until c is cancelled.
+//
+// Run must not be called more than once at a time.
+func (a *Advertiser) Run(c context.Context) error {
+	a.mu.Lock()
+	if a.wakeC == nil {
+		a.wakeC = make(chan struct{}, 1)
+	}
+	wakeC := a.wakeC
+	a.mu.Unlock()
+
+	t := Transmitter{Logger: a.Logger}
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+
+	for {
+		next := a.advertise(&t, time.Now())
+
+		// Reset our timer. It may have fired while we were advertising.
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+		if !next.IsZero() {
+			timer.Reset(time.Until(next))
+		}
+
+		select {
+		case <-c.Done():
+			return c.Err()
+		case <-wakeC:
+		case <-timer.C:
+		}
+	}
+}
+
+// advertise broadcasts each device that is due at now, and schedules its next
+// broadcast. It returns the time of the next scheduled broadcast, or the zero
+// time if there are no devices.
+func (a *Advertiser) advertise(t *Transmitter, now time.Time) time.Time {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	var next time.Time
+	for id, ad := range a.devices {
+		if device.IsDone(ad.d) {
+			a.removeLocked(ad)
+			continue
+		}
+
+		if !ad.next.After(now) {
+			if dh := ad.d.DiscoveryHeaders(); dh != nil {
+				if err := t.Broadcast(a.Sender, dh); err != nil {
+					a.logger().Warnf("Failed to advertise device %q: %s", id, err)
+				}
+			}
+
+			if ad.burst > 0 {
+				ad.burst--
+				ad.next = now.Add(a.burstInterval())
+			} else {
+				ad.next = now.Add(a.interval() + a.jitterLocked())
+			}
+		}
+
+		if next.IsZero() || ad.next.Before(next) {
+			next = ad.next
+		}
+	}
+	return next
+}
+
+func (a *Advertiser) removeLocked(ad *advertisedDevice) {
+	delete(a.devices, ad.d.ID())
+	close(ad.removedC)
+	a.logger().Debugf("Stopped advertising device %q.", ad.d.ID())
+}
+
+func (a *Advertiser) wakeLocked() {
+	if a.wakeC == nil {
+		a.wakeC = make(chan struct{}, 1)
+	}
+	select {
+	case a.wakeC <- struct{}{}:
+	default:
+	}
+}
+
+func (a *Advertiser) jitterLocked() time.Duration {
+	if a.Jitter <= 0 {
+		return 0
+	}
+	if a.rng == nil {
+		a.rng = rand.New(rand.NewSource(time.Now().UnixNano()))
+	}
+	return time.Duration(a.rng.Int63n(int64(a.Jitter)))
+}
+
+func (a *Advertiser) interval() time.Duration {
+	if a.Interval <= 0 {
+		return DefaultAdvertiseInterval
+	}
+	return a.Interval
+}
+
+func (a *Advertiser) burstCount() int {
+	switch {
+	case a.BurstCount == 0:
+		return DefaultBurstCount
+	case a.BurstCount < 0:
+		return 0
+	default:
+		return a.BurstCount
+	}
+}
+
+func (a *Advertiser) burstInterval() time.Duration {
+	if a.BurstInterval <= 0 {
+		return DefaultBurstInterval
+	}
+	return a.BurstInterval
+}
+
+func (a *Advertiser) logger() logging.L { return logging.Must(a.Logger) }
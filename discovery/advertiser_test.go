@@ -0,0 +1,160 @@
+// Copyright 2018 Dan Jacques. All rights reserved.
+// Use of this source code is governed under the MIT License
+// that can be found in the LICENSE file.
+
+package discovery
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/danjacques/gopushpixels/device"
+	"github.com/danjacques/gopushpixels/protocol"
+	"github.com/danjacques/gopushpixels/support/network"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+// lockedDatagramSender is a mockDatagramSender that is safe for concurrent
+// use.
+type lockedDatagramSender struct {
+	network.DatagramSender
+
+	mu        sync.Mutex
+	datagrams int
+}
+
+func (lds *lockedDatagramSender) SendDatagram(data []byte) error {
+	lds.mu.Lock()
+	defer lds.mu.Unlock()
+	lds.datagrams++
+	return nil
+}
+
+func (lds *lockedDatagramSender) count() int {
+	lds.mu.Lock()
+	defer lds.mu.Unlock()
+	return lds.datagrams
+}
+
+var _ = Describe("Advertiser", func() {
+	makeDevice := func(id string, mac byte) *device.Remote {
+		var dh protocol.DiscoveryHeaders
+		dh.SetHardwareAddr(net.HardwareAddr{0, 1, 2, 3, 4, mac})
+		return device.MakeRemote(id, &dh)
+	}
+
+	var (
+		mds *mockDatagramSender
+		a   *Advertiser
+		t   *Transmitter
+	)
+	BeforeEach(func() {
+		mds = &mockDatagramSender{}
+		a = &Advertiser{
+			Sender:        mds,
+			Interval:      time.Second,
+			BurstCount:    2,
+			BurstInterval: 100 * time.Millisecond,
+		}
+		t = &Transmitter{}
+	})
+
+	It("sends a burst, then broadcasts every interval", func() {
+		d := makeDevice("foo", 1)
+		a.Add(d)
+		Expect(a.Devices()).To(Equal([]device.D{d}))
+
+		now := time.Now()
+		next := a.advertise(t, now)
+		Expect(mds.Datagrams).To(HaveLen(1))
+		Expect(next).To(Equal(now.Add(100 * time.Millisecond)))
+
+		By("not broadcasting before it is due")
+		Expect(a.advertise(t, now.Add(50*time.Millisecond))).To(Equal(next))
+		Expect(mds.Datagrams).To(HaveLen(1))
+
+		By("sending the rest of the burst")
+		now = next
+		next = a.advertise(t, now)
+		Expect(next).To(Equal(now.Add(100 * time.Millisecond)))
+		now = next
+		next = a.advertise(t, now)
+		Expect(mds.Datagrams).To(HaveLen(3))
+
+		By("falling back to the regular interval")
+		Expect(next).To(Equal(now.Add(time.Second)))
+		Expect(a.advertise(t, next)).To(Equal(next.Add(time.Second)))
+		Expect(mds.Datagrams).To(HaveLen(4))
+	})
+
+	It("adds jitter to the regular interval", func() {
+		a.BurstCount = -1
+		a.Jitter = 500 * time.Millisecond
+
+		a.Add(makeDevice("foo", 1))
+		now := time.Now()
+		for i := 0; i < 10; i++ {
+			next := a.advertise(t, now)
+			Expect(next).To(BeTemporally(">=", now.Add(time.Second)))
+			Expect(next).To(BeTemporally("<", now.Add(1500*time.Millisecond)))
+			now = next
+		}
+		Expect(mds.Datagrams).To(HaveLen(10))
+	})
+
+	It("replaces devices with the same ID", func() {
+		d0, d1 := makeDevice("foo", 1), makeDevice("foo", 2)
+		a.Add(d0)
+		a.Add(d1)
+		Expect(a.Devices()).To(Equal([]device.D{d1}))
+
+		By("ignoring removal of the replaced device")
+		a.Remove(d0)
+		Expect(a.Devices()).To(Equal([]device.D{d1}))
+
+		a.Remove(d1)
+		Expect(a.Devices()).To(BeEmpty())
+		Expect(a.advertise(t, time.Now()).IsZero()).To(BeTrue())
+		Expect(mds.Datagrams).To(BeEmpty())
+	})
+
+	It("removes devices when they are done", func() {
+		d0, d1 := makeDevice("foo", 1), makeDevice("bar", 2)
+		a.Add(d0)
+		a.Add(d1)
+		Expect(a.Devices()).To(Equal([]device.D{d1, d0}))
+
+		d0.MarkDone()
+		Eventually(a.Devices).Should(Equal([]device.D{d1}))
+
+		By("not adding done devices")
+		a.Add(d0)
+		Expect(a.Devices()).To(Equal([]device.D{d1}))
+	})
+
+	It("broadcasts newly-added devices while running", func(done Done) {
+		defer close(done)
+
+		lds := &lockedDatagramSender{}
+		a.Sender = lds
+		a.BurstCount = -1
+		a.Interval = time.Hour
+
+		c, cancelFunc := context.WithCancel(context.Background())
+		defer cancelFunc()
+		errC := make(chan error)
+		go func() { errC <- a.Run(c) }()
+
+		a.Add(makeDevice("foo", 1))
+		Eventually(lds.count).Should(Equal(1))
+		a.Add(makeDevice("bar", 2))
+		Eventually(lds.count).Should(Equal(2))
+
+		cancelFunc()
+		Expect(<-errC).To(Equal(context.Canceled))
+	}, 10)
+})
@@ -0,0 +1,222 @@
+// Copyright 2018 Dan Jacques. All rights reserved.
+// Use of this source code is governed under the MIT License
+// that can be found in the LICENSE file.
+
+package discovery
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/danjacques/gopushpixels/support/network"
+
+	"github.com/pkg/errors"
+)
+
+// CaptureRecord is a single raw discovery datagram in a capture.
+type CaptureRecord struct {
+	// Time is the time when the datagram was received.
+	Time time.Time `json:"time"`
+	// Addr is the address that the datagram was received from. It may be empty
+	// if the address is not known.
+	Addr string `json:"addr,omitempty"`
+	// Data is the raw datagram.
+	Data []byte `json:"data"`
+}
+
+// CaptureWriter writes CaptureRecords to an underlying io.Writer.
+//
+// A capture is a series of JSON-encoded CaptureRecords, one per line.
+//
+// CaptureWriter is safe for concurrent use, so a single CaptureWriter may be
+// shared by several Listeners.
+type CaptureWriter struct {
+	mu  sync.Mutex
+	enc *json.Encoder
+}
+
+// MakeCaptureWriter returns a CaptureWriter that writes to w.
+func MakeCaptureWriter(w io.Writer) *CaptureWriter {
+	return &CaptureWriter{enc: json.NewEncoder(w)}
+}
+
+// Write writes rec to the capture.
+func (cw *CaptureWriter) Write(rec *CaptureRecord) error {
+	cw.mu.Lock()
+	defer cw.mu.Unlock()
+	return cw.enc.Encode(rec)
+}
+
+// capture writes a record for a datagram received from addr at now.
+func (cw *CaptureWriter) capture(now time.Time, addr net.Addr, data []byte) error {
+	rec := CaptureRecord{
+		Time: now,
+		Data: data,
+	}
+	if addr != nil {
+		rec.Addr = addr.String()
+	}
+	return cw.Write(&rec)
+}
+
+// CaptureReader reads CaptureRecords written by a CaptureWriter.
+//
+// CaptureReader is not safe for concurrent use.
+type CaptureReader struct {
+	dec *json.Decoder
+}
+
+// MakeCaptureReader returns a CaptureReader that reads from r.
+func MakeCaptureReader(r io.Reader) *CaptureReader {
+	return &CaptureReader{dec: json.NewDecoder(bufio.NewReader(r))}
+}
+
+// Next returns the next record in the capture. It returns io.EOF when there
+// are no more records.
+func (cr *CaptureReader) Next() (*CaptureRecord, error) {
+	var rec CaptureRecord
+	if err := cr.dec.Decode(&rec); err != nil {
+		if err == io.EOF {
+			return nil, err
+		}
+		return nil, errors.Wrap(err, "could not decode capture record")
+	}
+	return &rec, nil
+}
+
+// replayClock schedules replayed records relative to the first record.
+type replayClock struct {
+	// speed is the replay speed multiplier. If <= 0, records are not delayed.
+	speed float64
+
+	start time.Time
+	first time.Time
+}
+
+// wait blocks until rec is due to be replayed, or until doneC is closed. It
+// returns false if doneC was closed.
+func (rc *replayClock) wait(rec *CaptureRecord, doneC <-chan struct{}) bool {
+	if rc.speed <= 0 {
+		return true
+	}
+
+	if rc.start.IsZero() {
+		rc.start, rc.first = time.Now(), rec.Time
+		return true
+	}
+
+	offset := time.Duration(float64(rec.Time.Sub(rc.first)) / rc.speed)
+	delay := time.Until(rc.start.Add(offset))
+	if delay <= 0 {
+		return true
+	}
+
+	t := time.NewTimer(delay)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return true
+	case <-doneC:
+		return false
+	}
+}
+
+// ReplayConn replays a capture as a Listener's connection. Use a Listener's
+// StartReplay method to accept discovery headers from a capture.
+//
+// Once the capture is exhausted, the Listener's Accept will return io.EOF.
+type ReplayConn struct {
+	// Reader is the capture to replay. It must not be nil.
+	Reader *CaptureReader
+
+	// Speed is the replay speed, relative to the time in between captured
+	// records. For example, 1 replays the capture in real time, and 2 replays it
+	// twice as fast. If <= 0, records are replayed as fast as they are read.
+	Speed float64
+
+	clock     replayClock
+	closeOnce sync.Once
+	doneC     chan struct{}
+}
+
+var _ listenerConnection = (*ReplayConn)(nil)
+
+// StartReplay starts the Listener, accepting discovery headers from rc. It is
+// the replay counterpart to Start.
+func (l *Listener) StartReplay(rc *ReplayConn) error {
+	rc.clock.speed = rc.Speed
+	if rc.doneC == nil {
+		rc.doneC = make(chan struct{})
+	}
+	return l.startInternal(rc)
+}
+
+// Close implements listenerConnection. It interrupts any pending replay
+// delays.
+func (rc *ReplayConn) Close() error {
+	if rc.doneC != nil {
+		rc.closeOnce.Do(func() { close(rc.doneC) })
+	}
+	return nil
+}
+
+// LocalAddr implements listenerConnection.
+func (rc *ReplayConn) LocalAddr() net.Addr { return replayAddr{} }
+
+// SetReadBuffer implements listenerConnection.
+func (rc *ReplayConn) SetReadBuffer(int) error { return nil }
+
+// ReadFromUDP implements listenerConnection.
+func (rc *ReplayConn) ReadFromUDP(b []byte) (int, *net.UDPAddr, error) {
+	rec, err := rc.Reader.Next()
+	if err != nil {
+		return 0, nil, err
+	}
+
+	var addr *net.UDPAddr
+	if rec.Addr != "" {
+		if addr, err = net.ResolveUDPAddr("udp", rec.Addr); err != nil {
+			return 0, nil, errors.Wrapf(err, "invalid capture address %q", rec.Addr)
+		}
+	}
+
+	if !rc.clock.wait(rec, rc.doneC) {
+		return 0, nil, errors.New("replay closed")
+	}
+	return copy(b, rec.Data), addr, nil
+}
+
+// replayAddr is the local address of a ReplayConn.
+type replayAddr struct{}
+
+func (replayAddr) Network() string { return "replay" }
+func (replayAddr) String() string  { return "replay" }
+
+// Rebroadcast re-broadcasts the datagrams in cr to w, until cr is exhausted or
+// c is cancelled.
+//
+// speed is the replay speed, as in ReplayConn's Speed.
+func Rebroadcast(c context.Context, cr *CaptureReader, w network.DatagramSender, speed float64) error {
+	clock := replayClock{speed: speed}
+	for {
+		rec, err := cr.Next()
+		switch {
+		case err == io.EOF:
+			return nil
+		case err != nil:
+			return err
+		}
+
+		if !clock.wait(rec, c.Done()) {
+			return c.Err()
+		}
+		if err := w.SendDatagram(rec.Data); err != nil {
+			return errors.Wrap(err, "could not send datagram")
+		}
+	}
+}
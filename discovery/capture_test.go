@@ -0,0 +1,141 @@
+// Copyright 2018 Dan Jacques. All rights reserved.
+// Use of this source code is governed under the MIT License
+// that can be found in the LICENSE file.
+
+package discovery
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/danjacques/gopushpixels/protocol/protocoltest"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Capture", func() {
+	pp := protocoltest.PixelPusherDiscoveryPacket()
+	clientAddr := &net.UDPAddr{IP: net.ParseIP("127.0.0.2"), Port: 2468}
+
+	var buf bytes.Buffer
+	BeforeEach(func() {
+		buf.Reset()
+	})
+
+	It("records datagrams received by a Listener, including invalid ones", func(done Done) {
+		defer close(done)
+
+		conn := &mockListenerConnection{
+			DataC:      make(chan []byte, 2),
+			ClientAddr: clientAddr,
+		}
+		l := Listener{Capture: MakeCaptureWriter(&buf)}
+		Expect(l.startInternal(conn)).To(Succeed())
+		defer l.Close()
+
+		conn.DataC <- []byte("garbage")
+		conn.DataC <- pp
+		dh, err := l.Accept(context.Background())
+		Expect(err).ToNot(HaveOccurred())
+		Expect(dh).ToNot(BeNil())
+
+		cr := MakeCaptureReader(&buf)
+		rec, err := cr.Next()
+		Expect(err).ToNot(HaveOccurred())
+		Expect(rec.Addr).To(Equal("127.0.0.2:2468"))
+		Expect(rec.Data).To(Equal([]byte("garbage")))
+
+		rec, err = cr.Next()
+		Expect(err).ToNot(HaveOccurred())
+		Expect(rec.Data).To(Equal(pp))
+		Expect(rec.Time).To(BeTemporally("~", time.Now(), time.Second))
+
+		_, err = cr.Next()
+		Expect(err).To(Equal(io.EOF))
+	}, 1)
+
+	It("returns an error for a corrupt capture", func() {
+		_, err := MakeCaptureReader(strings.NewReader("{not json")).Next()
+		Expect(err).To(HaveOccurred())
+		Expect(err).ToNot(Equal(io.EOF))
+	})
+
+	Context("with a capture", func() {
+		start := time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC)
+
+		BeforeEach(func() {
+			cw := MakeCaptureWriter(&buf)
+			for i := 0; i < 3; i++ {
+				Expect(cw.capture(start.Add(time.Duration(i)*time.Second), clientAddr, pp)).To(Succeed())
+			}
+		})
+
+		It("can replay it through a Listener", func(done Done) {
+			defer close(done)
+
+			var l Listener
+			Expect(l.StartReplay(&ReplayConn{Reader: MakeCaptureReader(&buf)})).To(Succeed())
+			defer l.Close()
+
+			for i := 0; i < 3; i++ {
+				dh, err := l.Accept(context.Background())
+				Expect(err).ToNot(HaveOccurred())
+				Expect(dh).ToNot(BeNil())
+			}
+
+			_, err := l.Accept(context.Background())
+			Expect(err).To(Equal(io.EOF))
+		}, 1)
+
+		It("replays each datagram's source address", func() {
+			rc := ReplayConn{Reader: MakeCaptureReader(&buf)}
+			defer rc.Close()
+
+			data := make([]byte, len(pp))
+			size, addr, err := rc.ReadFromUDP(data)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(data[:size]).To(Equal(pp))
+			Expect(addr).To(Equal(clientAddr))
+		})
+
+		It("replays it at the requested speed", func(done Done) {
+			defer close(done)
+
+			var l Listener
+			Expect(l.StartReplay(&ReplayConn{Reader: MakeCaptureReader(&buf), Speed: 10})).To(Succeed())
+			defer l.Close()
+
+			now := time.Now()
+			for i := 0; i < 3; i++ {
+				_, err := l.Accept(context.Background())
+				Expect(err).ToNot(HaveOccurred())
+			}
+			Expect(time.Since(now)).To(BeNumerically(">=", 200*time.Millisecond))
+		}, 2)
+
+		It("can re-broadcast it", func() {
+			mds := &mockDatagramSender{}
+			Expect(Rebroadcast(context.Background(), MakeCaptureReader(&buf), mds, 0)).To(Succeed())
+			Expect(mds.Datagrams).To(Equal([][]byte{pp, pp, pp}))
+		})
+
+		It("stops re-broadcasting when cancelled", func(done Done) {
+			defer close(done)
+
+			c, cancelFunc := context.WithCancel(context.Background())
+			mds := &mockDatagramSender{}
+			go func() {
+				time.Sleep(10 * time.Millisecond)
+				cancelFunc()
+			}()
+			err := Rebroadcast(c, MakeCaptureReader(&buf), mds, 1)
+			Expect(err).To(Equal(context.Canceled))
+			Expect(mds.Datagrams).To(HaveLen(1))
+		}, 2)
+	})
+})
@@ -9,4 +9,19 @@
 //
 // Transmitter and Listener are low-level discovery primitives that can
 // broadcast discovery packets and receive discovery packets respectively.
+// MultiListener receives discovery packets on several network interfaces at
+// once, tagging each device with the interface that it was discovered on.
+//
+// A Listener's traffic can be recorded with a CaptureWriter, and replayed
+// through a Listener (see ReplayConn) or re-broadcast (see Rebroadcast) to
+// reproduce discovery behavior offline.
+//
+// ParseFilter compiles filter expressions, such as "group=3 and not proxy",
+// into FilterFuncs that can restrict the devices a Listener accepts.
+//
+// Advertiser periodically broadcasts discovery packets for a dynamic set of
+// devices, such as proxy or emulated devices.
+//
+// On networks where discovery announcements are blocked, Static can populate a
+// Registry with devices at known addresses.
 package discovery
@@ -0,0 +1,391 @@
+// Copyright 2018 Dan Jacques. All rights reserved.
+// Use of this source code is governed under the MIT License
+// that can be found in the LICENSE file.
+
+package discovery
+
+import (
+	"bytes"
+	"net"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/danjacques/gopushpixels/protocol"
+
+	"github.com/pkg/errors"
+)
+
+// FilterFunc is a function that returns true if a device with the supplied
+// discovery headers should be accepted. It can be used as a Listener's or
+// MultiListener's FilterFunc.
+type FilterFunc func(dh *protocol.DiscoveryHeaders) bool
+
+// ParseFilter compiles a filter expression into a FilterFunc.
+//
+// A filter expression is made up of predicates, combined with "and", "or",
+// "not", and parentheses. "and" binds more tightly than "or". Predicates take
+// the form "<key><op><value>", with no spaces:
+//
+//	mac=<prefix>        The hardware address begins with prefix (e.g., "d8:80").
+//	ip=<addr|cidr>      The IP address equals addr, or is within cidr.
+//	group<op><n>        The PixelPusher group ordinal.
+//	controller<op><n>   The PixelPusher controller ordinal.
+//	type=<type>         The device type, by name (e.g., "pixelpusher") or number.
+//	revision<op><n>     The software revision.
+//	strips<op><n>       The number of attached strips.
+//
+// mac, ip, and type support the "=" and "!=" operators. Numeric keys
+// additionally support "<", "<=", ">", and ">=", and "=" accepts an inclusive
+// range, "<min>..<max>". Numeric predicates never match devices that don't
+// have the field (e.g., non-PixelPusher devices have no group).
+//
+// A predicate may also be the name of an entry in builtins, which is matched
+// by calling that entry. For example, proxy.AddressRegistry's FilterBuiltins
+// supplies a "proxy" builtin that matches proxy devices.
+//
+// For example:
+//
+//	group=3 and not proxy
+//	(mac=d8:80:39 or ip=10.0.0.0/24) and revision=121..200
+func ParseFilter(expr string, builtins map[string]FilterFunc) (FilterFunc, error) {
+	fp := filterParser{
+		tokens:   tokenizeFilter(expr),
+		builtins: builtins,
+	}
+	if len(fp.tokens) == 0 {
+		return nil, errors.New("empty filter expression")
+	}
+
+	fn, err := fp.parseOr()
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid filter %q", expr)
+	}
+	if tok := fp.peek(); tok != "" {
+		return nil, errors.Errorf("invalid filter %q: unexpected %q", expr, tok)
+	}
+	return fn, nil
+}
+
+// tokenizeFilter splits a filter expression into tokens. Parentheses are
+// individual tokens, and all other tokens are separated by whitespace.
+func tokenizeFilter(expr string) []string {
+	var (
+		tokens []string
+		cur    strings.Builder
+	)
+	flush := func() {
+		if cur.Len() > 0 {
+			tokens = append(tokens, cur.String())
+			cur.Reset()
+		}
+	}
+
+	for _, r := range expr {
+		switch {
+		case unicode.IsSpace(r):
+			flush()
+		case r == '(', r == ')':
+			flush()
+			tokens = append(tokens, string(r))
+		default:
+			cur.WriteRune(r)
+		}
+	}
+	flush()
+	return tokens
+}
+
+// filterParser is a recursive descent parser for filter expressions.
+type filterParser struct {
+	tokens   []string
+	pos      int
+	builtins map[string]FilterFunc
+}
+
+func (fp *filterParser) peek() string {
+	if fp.pos >= len(fp.tokens) {
+		return ""
+	}
+	return fp.tokens[fp.pos]
+}
+
+func (fp *filterParser) next() string {
+	tok := fp.peek()
+	if tok != "" {
+		fp.pos++
+	}
+	return tok
+}
+
+func (fp *filterParser) peekKeyword(kw string) bool { return strings.EqualFold(fp.peek(), kw) }
+
+func (fp *filterParser) parseOr() (FilterFunc, error) {
+	fn, err := fp.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for fp.peekKeyword("or") {
+		fp.next()
+		lhs := fn
+		rhs, err := fp.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		fn = func(dh *protocol.DiscoveryHeaders) bool { return lhs(dh) || rhs(dh) }
+	}
+	return fn, nil
+}
+
+func (fp *filterParser) parseAnd() (FilterFunc, error) {
+	fn, err := fp.parseNot()
+	if err != nil {
+		return nil, err
+	}
+	for fp.peekKeyword("and") {
+		fp.next()
+		lhs := fn
+		rhs, err := fp.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		fn = func(dh *protocol.DiscoveryHeaders) bool { return lhs(dh) && rhs(dh) }
+	}
+	return fn, nil
+}
+
+func (fp *filterParser) parseNot() (FilterFunc, error) {
+	if !fp.peekKeyword("not") {
+		return fp.parsePrimary()
+	}
+	fp.next()
+
+	fn, err := fp.parseNot()
+	if err != nil {
+		return nil, err
+	}
+	return func(dh *protocol.DiscoveryHeaders) bool { return !fn(dh) }, nil
+}
+
+func (fp *filterParser) parsePrimary() (FilterFunc, error) {
+	switch tok := fp.next(); {
+	case tok == "":
+		return nil, errors.New("unexpected end of expression")
+
+	case tok == "(":
+		fn, err := fp.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if fp.next() != ")" {
+			return nil, errors.New("missing closing parenthesis")
+		}
+		return fn, nil
+
+	case tok == ")":
+		return nil, errors.New("unexpected closing parenthesis")
+
+	case strings.EqualFold(tok, "and"), strings.EqualFold(tok, "or"), strings.EqualFold(tok, "not"):
+		return nil, errors.Errorf("unexpected %q", tok)
+
+	default:
+		return fp.parsePredicate(tok)
+	}
+}
+
+// filterOps are the supported predicate operators. Two-character operators
+// come first, so they are matched in preference to their prefixes.
+var filterOps = []string{"!=", "<=", ">=", "=", "<", ">"}
+
+func (fp *filterParser) parsePredicate(tok string) (FilterFunc, error) {
+	idx := strings.IndexAny(tok, "=!<>")
+	if idx < 0 {
+		if fn := fp.builtins[tok]; fn != nil {
+			return fn, nil
+		}
+		return nil, errors.Errorf("unknown predicate %q", tok)
+	}
+
+	key, rest := strings.ToLower(tok[:idx]), tok[idx:]
+	var op string
+	for _, candidate := range filterOps {
+		if strings.HasPrefix(rest, candidate) {
+			op = candidate
+			break
+		}
+	}
+	if op == "" {
+		return nil, errors.Errorf("invalid operator in %q", tok)
+	}
+	value := rest[len(op):]
+	if value == "" {
+		return nil, errors.Errorf("missing value in %q", tok)
+	}
+
+	var (
+		fn  FilterFunc
+		err error
+	)
+	switch key {
+	case "mac":
+		fn, err = macFilter(value)
+	case "ip":
+		fn, err = ipFilter(value)
+	case "type":
+		fn, err = typeFilter(value)
+	case "group":
+		return numericFilter(op, value, func(dh *protocol.DiscoveryHeaders) (int64, bool) {
+			if dh.PixelPusher == nil {
+				return 0, false
+			}
+			return int64(dh.PixelPusher.GroupOrdinal), true
+		})
+	case "controller":
+		return numericFilter(op, value, func(dh *protocol.DiscoveryHeaders) (int64, bool) {
+			if dh.PixelPusher == nil {
+				return 0, false
+			}
+			return int64(dh.PixelPusher.ControllerOrdinal), true
+		})
+	case "revision":
+		return numericFilter(op, value, func(dh *protocol.DiscoveryHeaders) (int64, bool) {
+			return int64(dh.SoftwareRevision), true
+		})
+	case "strips":
+		return numericFilter(op, value, func(dh *protocol.DiscoveryHeaders) (int64, bool) {
+			if dh.PixelPusher == nil {
+				return 0, false
+			}
+			return int64(dh.NumStrips()), true
+		})
+	default:
+		return nil, errors.Errorf("unknown key %q", key)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	switch op {
+	case "=":
+		return fn, nil
+	case "!=":
+		return func(dh *protocol.DiscoveryHeaders) bool { return !fn(dh) }, nil
+	default:
+		return nil, errors.Errorf("operator %q is not supported for %q", op, key)
+	}
+}
+
+func macFilter(value string) (FilterFunc, error) {
+	var prefix []byte
+	for _, part := range strings.FieldsFunc(value, func(r rune) bool { return r == ':' || r == '-' }) {
+		v, err := strconv.ParseUint(part, 16, 8)
+		if err != nil {
+			return nil, errors.Errorf("invalid hardware address prefix %q", value)
+		}
+		prefix = append(prefix, byte(v))
+	}
+	if len(prefix) == 0 || len(prefix) > 6 {
+		return nil, errors.Errorf("invalid hardware address prefix %q", value)
+	}
+
+	return func(dh *protocol.DiscoveryHeaders) bool {
+		return bytes.HasPrefix(dh.HardwareAddr(), prefix)
+	}, nil
+}
+
+func ipFilter(value string) (FilterFunc, error) {
+	if strings.Contains(value, "/") {
+		_, ipNet, err := net.ParseCIDR(value)
+		if err != nil {
+			return nil, errors.Errorf("invalid CIDR %q", value)
+		}
+		return func(dh *protocol.DiscoveryHeaders) bool { return ipNet.Contains(dh.IP4Address()) }, nil
+	}
+
+	ip := net.ParseIP(value)
+	if ip == nil {
+		return nil, errors.Errorf("invalid IP address %q", value)
+	}
+	return func(dh *protocol.DiscoveryHeaders) bool { return ip.Equal(dh.IP4Address()) }, nil
+}
+
+func typeFilter(value string) (FilterFunc, error) {
+	var dt protocol.DeviceType
+	if v, err := strconv.ParseUint(value, 10, 8); err == nil {
+		dt = protocol.DeviceType(v)
+	} else {
+		found := false
+		for _, candidate := range []protocol.DeviceType{
+			protocol.EtherDreamDeviceType,
+			protocol.LumiaBridgeDeviceType,
+			protocol.PixelPusherDeviceType,
+		} {
+			if strings.EqualFold(value, candidate.String()) {
+				dt, found = candidate, true
+				break
+			}
+		}
+		if !found {
+			return nil, errors.Errorf("unknown device type %q", value)
+		}
+	}
+
+	return func(dh *protocol.DiscoveryHeaders) bool { return dh.DeviceType == dt }, nil
+}
+
+// numericFilter builds a FilterFunc that compares the value returned by get
+// against value using op. If get returns false, the FilterFunc does not match.
+func numericFilter(op, value string, get func(*protocol.DiscoveryHeaders) (int64, bool)) (FilterFunc, error) {
+	parse := func(s string) (int64, error) {
+		v, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return 0, errors.Errorf("invalid number %q", s)
+		}
+		return v, nil
+	}
+
+	if op == "=" {
+		if parts := strings.SplitN(value, "..", 2); len(parts) == 2 {
+			min, err := parse(parts[0])
+			if err != nil {
+				return nil, err
+			}
+			max, err := parse(parts[1])
+			if err != nil {
+				return nil, err
+			}
+			if min > max {
+				return nil, errors.Errorf("invalid range %q", value)
+			}
+			return func(dh *protocol.DiscoveryHeaders) bool {
+				v, ok := get(dh)
+				return ok && v >= min && v <= max
+			}, nil
+		}
+	}
+
+	n, err := parse(value)
+	if err != nil {
+		return nil, err
+	}
+
+	var cmp func(v int64) bool
+	switch op {
+	case "=":
+		cmp = func(v int64) bool { return v == n }
+	case "!=":
+		cmp = func(v int64) bool { return v != n }
+	case "<":
+		cmp = func(v int64) bool { return v < n }
+	case "<=":
+		cmp = func(v int64) bool { return v <= n }
+	case ">":
+		cmp = func(v int64) bool { return v > n }
+	case ">=":
+		cmp = func(v int64) bool { return v >= n }
+	}
+	return func(dh *protocol.DiscoveryHeaders) bool {
+		v, ok := get(dh)
+		return ok && cmp(v)
+	}, nil
+}
@@ -0,0 +1,118 @@
+// Copyright 2018 Dan Jacques. All rights reserved.
+// Use of this source code is governed under the MIT License
+// that can be found in the LICENSE file.
+
+package discovery
+
+import (
+	"net"
+
+	"github.com/danjacques/gopushpixels/protocol"
+	"github.com/danjacques/gopushpixels/protocol/pixelpusher"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("ParseFilter", func() {
+	makeHeaders := func(mac byte, ip byte, group, controller int32, rev uint16, strips uint8) *protocol.DiscoveryHeaders {
+		dh := protocol.DiscoveryHeaders{
+			DeviceHeader: protocol.DeviceHeader{
+				DeviceType:       protocol.PixelPusherDeviceType,
+				SoftwareRevision: rev,
+			},
+			PixelPusher: &pixelpusher.Device{
+				DeviceHeader: pixelpusher.DeviceHeader{
+					StripsAttached:    strips,
+					GroupOrdinal:      group,
+					ControllerOrdinal: controller,
+				},
+			},
+		}
+		dh.SetHardwareAddr(net.HardwareAddr{0xd8, 0x80, 0x39, 0x00, 0x00, mac})
+		dh.SetIP4Address(net.IPv4(10, 0, 0, ip))
+		return &dh
+	}
+
+	var (
+		a, b, c  *protocol.DiscoveryHeaders
+		builtins map[string]FilterFunc
+	)
+	BeforeEach(func() {
+		a = makeHeaders(0x01, 1, 1, 0, 121, 4)
+		b = makeHeaders(0x02, 2, 3, 1, 122, 8)
+		c = makeHeaders(0x03, 130, 3, 2, 100, 2)
+		c.MacAddress[0] = 0x02
+
+		builtins = map[string]FilterFunc{
+			"local": func(dh *protocol.DiscoveryHeaders) bool { return dh.MacAddress[0]&0x02 != 0 },
+		}
+	})
+
+	match := func(expr string) []*protocol.DiscoveryHeaders {
+		fn, err := ParseFilter(expr, builtins)
+		Expect(err).ToNot(HaveOccurred())
+
+		var matched []*protocol.DiscoveryHeaders
+		for _, dh := range []*protocol.DiscoveryHeaders{a, b, c} {
+			if fn(dh) {
+				matched = append(matched, dh)
+			}
+		}
+		return matched
+	}
+
+	It("matches individual predicates", func() {
+		Expect(match("group=3")).To(Equal([]*protocol.DiscoveryHeaders{b, c}))
+		Expect(match("controller!=1")).To(Equal([]*protocol.DiscoveryHeaders{a, c}))
+		Expect(match("mac=d8:80")).To(Equal([]*protocol.DiscoveryHeaders{a, b}))
+		Expect(match("mac=D8-80-39-00-00-02")).To(Equal([]*protocol.DiscoveryHeaders{b}))
+		Expect(match("ip=10.0.0.0/25")).To(Equal([]*protocol.DiscoveryHeaders{a, b}))
+		Expect(match("ip=10.0.0.130")).To(Equal([]*protocol.DiscoveryHeaders{c}))
+		Expect(match("type=pixelpusher")).To(HaveLen(3))
+		Expect(match("type=0")).To(BeEmpty())
+		Expect(match("revision=121..122")).To(Equal([]*protocol.DiscoveryHeaders{a, b}))
+		Expect(match("revision<121")).To(Equal([]*protocol.DiscoveryHeaders{c}))
+		Expect(match("strips>=4")).To(Equal([]*protocol.DiscoveryHeaders{a, b}))
+		Expect(match("local")).To(Equal([]*protocol.DiscoveryHeaders{c}))
+	})
+
+	It("combines predicates", func() {
+		Expect(match("group=3 and not local")).To(Equal([]*protocol.DiscoveryHeaders{b}))
+		Expect(match("group=1 or strips<4")).To(Equal([]*protocol.DiscoveryHeaders{a, c}))
+		Expect(match("group=1 or group=3 and controller=2")).To(Equal([]*protocol.DiscoveryHeaders{a, c}))
+		Expect(match("(group=1 or group=3) and controller=2")).To(Equal([]*protocol.DiscoveryHeaders{c}))
+		Expect(match("NOT (group=3) OR local")).To(Equal([]*protocol.DiscoveryHeaders{a, c}))
+	})
+
+	It("does not match numeric predicates for devices without the field", func() {
+		a.PixelPusher = nil
+		Expect(match("group!=3")).To(BeEmpty())
+		Expect(match("not group=3")).To(Equal([]*protocol.DiscoveryHeaders{a}))
+	})
+
+	It("rejects invalid expressions", func() {
+		for _, expr := range []string{
+			"",
+			"group",
+			"group=",
+			"group=x",
+			"group=5..1",
+			"color=red",
+			"mac<d8",
+			"mac=zz",
+			"ip=10.0.0.0/99",
+			"ip=foo",
+			"type=toaster",
+			"(group=1",
+			"group=1)",
+			"group=1 and",
+			"group=1 group=2",
+			"not",
+			"group=>1",
+		} {
+			_, err := ParseFilter(expr, builtins)
+			Expect(err).To(HaveOccurred(), "expression %q", expr)
+		}
+	})
+})
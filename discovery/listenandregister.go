@@ -8,8 +8,16 @@ import (
 	"context"
 
 	"github.com/danjacques/gopushpixels/device"
+	"github.com/danjacques/gopushpixels/protocol"
 )
 
+// Acceptor accepts discovery headers. It is implemented by Listener and
+// MultiListener.
+type Acceptor interface {
+	// Accept blocks until a device broadcast is received.
+	Accept(c context.Context) (*protocol.DiscoveryHeaders, error)
+}
+
 // ListenAndRegister is a convenience function to listen for device discovery
 // packets on l and register all of these devices with reg.
 //
@@ -17,7 +25,7 @@ import (
 // an error.
 //
 // If a new device is observed, fn will be called with that device.
-func ListenAndRegister(c context.Context, l *Listener, reg *Registry, fn func(d device.D) error) error {
+func ListenAndRegister(c context.Context, l Acceptor, reg *Registry, fn func(d device.D) error) error {
 	for {
 		dh, err := l.Accept(c)
 		if err != nil {
@@ -8,6 +8,7 @@ import (
 	"context"
 	"io"
 	"net"
+	"time"
 
 	"github.com/danjacques/gopushpixels/protocol"
 	"github.com/danjacques/gopushpixels/support/fmtutil"
@@ -50,8 +51,13 @@ type Listener struct {
 	Logger logging.L
 
 	// FilterFunc, if not nil, is called with a prospective set of DeviceHeaders.
-	// If the function returns false, the device's discovery is ignored.
-	FilterFunc func(dh *protocol.DiscoveryHeaders) bool
+	// If the function returns false, the device's discovery is ignored. See
+	// ParseFilter to build a FilterFunc from an expression.
+	FilterFunc FilterFunc
+
+	// Capture, if not nil, records every raw datagram that the Listener
+	// receives, before it is parsed or filtered.
+	Capture *CaptureWriter
 
 	conn   listenerConnection
 	logger logging.L
@@ -119,7 +125,7 @@ func (l *Listener) startInternal(conn listenerConnection) error {
 		// Wait for a request.
 		for range l.requestC {
 			// Block until the next multicast packet arrives.
-			amt, addr, err := l.conn.ReadFromUDP(l.data)
+			amt, addr, err := conn.ReadFromUDP(l.data)
 			lr := listenResult{
 				addr: addr,
 				err:  err,
@@ -192,6 +198,12 @@ func (l *Listener) acceptOnce(c context.Context) (*protocol.DiscoveryHeaders, er
 
 		l.logger.Debugf("Discovery packet received (%d byte(s)):\n%s", len(lr.packet), fmtutil.Hex(lr.packet))
 
+		if l.Capture != nil {
+			if err := l.Capture.capture(time.Now(), lr.addr, lr.packet); err != nil {
+				l.logger.Warnf("Failed to capture discovery packet: %s", err)
+			}
+		}
+
 		// Parse the broadcast packet.
 		dh, err := protocol.ParseDiscoveryHeaders(lr.packet)
 		if err != nil {
@@ -0,0 +1,29 @@
+// Copyright 2018 Dan Jacques. All rights reserved.
+// Use of this source code is governed under the MIT License
+// that can be found in the LICENSE file.
+
+package discovery
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	staleDevicesGauge = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "discovery_stale_devices",
+		Help: "Number of registered devices that are currently stale.",
+	})
+
+	staleTransitionsCounter = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "discovery_stale_transitions",
+		Help: "Number of times a registered device has become stale.",
+	})
+)
+
+// RegisterMonitoring registers all of this package's monitoring metrics.
+func RegisterMonitoring(reg prometheus.Registerer) {
+	reg.MustRegister(
+		staleDevicesGauge,
+		staleTransitionsCounter,
+	)
+}
@@ -0,0 +1,310 @@
+// Copyright 2018 Dan Jacques. All rights reserved.
+// Use of this source code is governed under the MIT License
+// that can be found in the LICENSE file.
+
+package discovery
+
+import (
+	"context"
+	"net"
+	"sync"
+
+	"github.com/danjacques/gopushpixels/protocol"
+	"github.com/danjacques/gopushpixels/support/logging"
+	"github.com/danjacques/gopushpixels/support/network"
+
+	"github.com/pkg/errors"
+	"golang.org/x/net/ipv4"
+)
+
+// MultiListener listens for PixelPusher broadcasts on several network
+// interfaces at once.
+//
+// MultiListener joins the discovery multicast group on each of its
+// Interfaces. Each accepted DiscoveryHeaders has its Interface field set to
+// the name of the interface that the announcement arrived on. A Remote device
+// created from those headers will bind its Senders to that interface.
+//
+// MultiListener requires the platform to report the interface that each
+// datagram arrives on; Start will fail if it can't.
+//
+// When a user is finished with MultiListener, they should call Close to
+// release its resources.
+//
+// MultiListener is safe for concurrent use.
+type MultiListener struct {
+	// Interfaces is the set of interface names to listen on. If empty, all
+	// interfaces that are up, support multicast, have an IPv4 address, and are
+	// not loopback interfaces will be used.
+	Interfaces []string
+
+	// Port is the discovery port to listen on. If <= 0,
+	// protocol.DiscoveryUDPPort will be used.
+	Port int
+
+	// Logger, if not nil, is the Logger to log MultiListener status to.
+	Logger logging.L
+
+	// FilterFunc, if not nil, is called with a prospective set of DeviceHeaders.
+	// If the function returns false, the device's discovery is ignored. See
+	// ParseFilter to build a FilterFunc from an expression.
+	FilterFunc FilterFunc
+
+	// Capture, if not nil, records every raw datagram received on any of the
+	// MultiListener's interfaces. See Listener's Capture.
+	Capture *CaptureWriter
+
+	members    []*multiListenerMember
+	resultC    chan listenResultHeaders
+	cancelFunc context.CancelFunc
+	wg         sync.WaitGroup
+}
+
+// multiListenerMember is a single interface's Listener.
+type multiListenerMember struct {
+	iface string
+	l     Listener
+}
+
+type listenResultHeaders struct {
+	dh  *protocol.DiscoveryHeaders
+	err error
+}
+
+// Start opens a listening connection on each of the MultiListener's
+// interfaces and begins listening.
+func (ml *MultiListener) Start() error {
+	ifaces, err := ml.resolveInterfaces()
+	if err != nil {
+		return err
+	}
+
+	port := ml.Port
+	if port <= 0 {
+		port = protocol.DiscoveryUDPPort
+	}
+
+	conns := make([]listenerConnection, 0, len(ifaces))
+	closeAll := func() {
+		for _, conn := range conns {
+			_ = conn.Close()
+		}
+	}
+	for i := range ifaces {
+		rc := network.UDP4MulticastListenerConn(port)
+		rc.Interface = &ifaces[i]
+
+		conn, err := rc.ListenMulticastUDP4()
+		if err != nil {
+			closeAll()
+			return errors.Wrapf(err, "could not listen on %s", rc)
+		}
+
+		ic, err := makeInterfaceConn(conn, &ifaces[i])
+		if err != nil {
+			_ = conn.Close()
+			closeAll()
+			return errors.Wrapf(err, "could not listen on %s", rc)
+		}
+		conns = append(conns, ic)
+	}
+
+	members := make([]*multiListenerMember, len(ifaces))
+	for i := range ifaces {
+		members[i] = &multiListenerMember{iface: ifaces[i].Name}
+	}
+
+	return ml.startInternal(members, conns)
+}
+
+func (ml *MultiListener) resolveInterfaces() ([]net.Interface, error) {
+	if len(ml.Interfaces) > 0 {
+		ifaces := make([]net.Interface, len(ml.Interfaces))
+		for i, name := range ml.Interfaces {
+			iface, err := net.InterfaceByName(name)
+			if err != nil {
+				return nil, errors.Wrapf(err, "could not find interface %q", name)
+			}
+			ifaces[i] = *iface
+		}
+		return ifaces, nil
+	}
+
+	all, err := net.Interfaces()
+	if err != nil {
+		return nil, errors.Wrap(err, "could not list network interfaces")
+	}
+
+	var ifaces []net.Interface
+	for _, iface := range all {
+		const want = net.FlagUp | net.FlagMulticast
+		if iface.Flags&want != want || iface.Flags&net.FlagLoopback != 0 {
+			continue
+		}
+		if _, err := network.InterfaceIP4Address(iface.Name, nil); err != nil {
+			continue
+		}
+		ifaces = append(ifaces, iface)
+	}
+	if len(ifaces) == 0 {
+		return nil, errors.New("no multicast interfaces are available")
+	}
+	return ifaces, nil
+}
+
+// startInternal starts a Listener for each member on its respective
+// connection. It takes ownership of conns.
+func (ml *MultiListener) startInternal(members []*multiListenerMember, conns []listenerConnection) error {
+	if ml.members != nil {
+		for _, conn := range conns {
+			_ = conn.Close()
+		}
+		return errors.New("already started")
+	}
+
+	for i, m := range members {
+		m.l.Logger = ml.Logger
+		m.l.FilterFunc = ml.FilterFunc
+		m.l.Capture = ml.Capture
+		if err := m.l.startInternal(conns[i]); err != nil {
+			// startInternal closes conns[i] on failure; close the rest.
+			for _, started := range members[:i] {
+				_ = started.l.Close()
+			}
+			for _, conn := range conns[i+1:] {
+				_ = conn.Close()
+			}
+			return errors.Wrapf(err, "could not start listener on %q", m.iface)
+		}
+	}
+
+	c, cancelFunc := context.WithCancel(context.Background())
+	ml.members = members
+	ml.resultC = make(chan listenResultHeaders)
+	ml.cancelFunc = cancelFunc
+
+	for _, m := range members {
+		m := m
+		ml.wg.Add(1)
+		go func() {
+			defer ml.wg.Done()
+			ml.listen(c, m)
+		}()
+	}
+	return nil
+}
+
+// listen accepts discovery headers from m's Listener until c is cancelled or
+// the Listener fails.
+func (ml *MultiListener) listen(c context.Context, m *multiListenerMember) {
+	for {
+		// m's connection only returns datagrams that arrived on m's interface.
+		dh, err := m.l.Accept(c)
+		if err == nil {
+			dh.Interface = m.iface
+		}
+
+		select {
+		case ml.resultC <- listenResultHeaders{dh, err}:
+		case <-c.Done():
+			return
+		}
+
+		if err != nil {
+			return
+		}
+	}
+}
+
+// Accept blocks until a device broadcast is received on any interface.
+//
+// If any interface's Listener fails, its error will be returned.
+//
+// MultiListener must successfully Start prior to using Accept.
+func (ml *MultiListener) Accept(c context.Context) (*protocol.DiscoveryHeaders, error) {
+	if ml.members == nil {
+		return nil, errors.New("the MultiListener is not active")
+	}
+
+	select {
+	case res := <-ml.resultC:
+		return res.dh, res.err
+	case <-c.Done():
+		return nil, c.Err()
+	}
+}
+
+// Close closes the MultiListener, interrupting any current operations and
+// releasing its resources.
+func (ml *MultiListener) Close() error {
+	if ml.members == nil {
+		return nil
+	}
+
+	// Stop our listening goroutines. Each blocks only on Context-aware
+	// operations, so they will all exit once cancelled. Our Listeners can then
+	// be safely closed.
+	ml.cancelFunc()
+	ml.wg.Wait()
+
+	var err error
+	for _, m := range ml.members {
+		if cerr := m.l.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+
+	ml.members = nil
+	return err
+}
+
+// packetReader reads a datagram along with its control message.
+//
+// It is implemented by *ipv4.PacketConn, and is used internally for mocking.
+type packetReader interface {
+	ReadFrom([]byte) (int, *ipv4.ControlMessage, net.Addr, error)
+}
+
+// interfaceConn is a listenerConnection that discards datagrams that did not
+// arrive on a specific network interface.
+//
+// A connection that has joined a multicast group receives that group's
+// datagrams from every interface that has joined it, not just its own.
+type interfaceConn struct {
+	listenerConnection
+
+	pr      packetReader
+	ifIndex int
+}
+
+// makeInterfaceConn returns an interfaceConn that reads from conn, accepting
+// only datagrams that arrived on iface.
+func makeInterfaceConn(conn *net.UDPConn, iface *net.Interface) (*interfaceConn, error) {
+	pc := ipv4.NewPacketConn(conn)
+	if err := pc.SetControlMessage(ipv4.FlagInterface, true); err != nil {
+		return nil, errors.Wrap(err, "could not enable interface control messages")
+	}
+	return &interfaceConn{
+		listenerConnection: conn,
+		pr:                 pc,
+		ifIndex:            iface.Index,
+	}, nil
+}
+
+func (ic *interfaceConn) ReadFromUDP(b []byte) (int, *net.UDPAddr, error) {
+	for {
+		size, cm, addr, err := ic.pr.ReadFrom(b)
+		if err != nil {
+			return 0, nil, err
+		}
+
+		// Without a control message, we can't tell which interface the datagram
+		// arrived on, so we can't claim it.
+		if cm == nil || cm.IfIndex != ic.ifIndex {
+			continue
+		}
+
+		udpAddr, _ := addr.(*net.UDPAddr)
+		return size, udpAddr, nil
+	}
+}
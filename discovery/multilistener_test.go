@@ -0,0 +1,153 @@
+// Copyright 2018 Dan Jacques. All rights reserved.
+// Use of this source code is governed under the MIT License
+// that can be found in the LICENSE file.
+
+package discovery
+
+import (
+	"context"
+	"net"
+	"time"
+
+	"github.com/danjacques/gopushpixels/protocol/protocoltest"
+
+	"github.com/pkg/errors"
+	"golang.org/x/net/ipv4"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+// mockPacket is a datagram read by a mockPacketConn.
+type mockPacket struct {
+	data    []byte
+	addr    *net.UDPAddr
+	ifIndex int
+}
+
+// mockPacketConn is a listenerConnection and packetReader that reads
+// datagrams from PacketC.
+type mockPacketConn struct {
+	PacketC chan mockPacket
+}
+
+func (mpc *mockPacketConn) Close() error {
+	close(mpc.PacketC)
+	return nil
+}
+
+func (mpc *mockPacketConn) SetReadBuffer(size int) error { return nil }
+
+func (mpc *mockPacketConn) LocalAddr() net.Addr {
+	return &net.UDPAddr{
+		IP:   net.ParseIP("127.0.0.1"),
+		Port: 1337,
+	}
+}
+
+func (mpc *mockPacketConn) ReadFromUDP(buf []byte) (int, *net.UDPAddr, error) {
+	panic("reads must go through ReadFrom")
+}
+
+func (mpc *mockPacketConn) ReadFrom(buf []byte) (int, *ipv4.ControlMessage, net.Addr, error) {
+	pkt, ok := <-mpc.PacketC
+	if !ok {
+		return 0, nil, nil, errors.New("connection closed")
+	}
+	size := copy(buf, pkt.data)
+	return size, &ipv4.ControlMessage{IfIndex: pkt.ifIndex}, pkt.addr, nil
+}
+
+var _ = Describe("MultiListener", func() {
+	pp := protocoltest.PixelPusherDiscoveryPacket()
+
+	var mocks []*mockPacketConn
+	var ml *MultiListener
+	BeforeEach(func() {
+		mocks = []*mockPacketConn{
+			{PacketC: make(chan mockPacket, 1)},
+			{PacketC: make(chan mockPacket, 1)},
+		}
+		members := []*multiListenerMember{
+			{iface: "eth0"},
+			{iface: "eth1"},
+		}
+		conns := make([]listenerConnection, len(mocks))
+		for i, mpc := range mocks {
+			conns[i] = &interfaceConn{listenerConnection: mpc, pr: mpc, ifIndex: i + 1}
+		}
+
+		ml = &MultiListener{}
+		Expect(ml.startInternal(members, conns)).To(Succeed())
+	})
+	AfterEach(func() {
+		Expect(ml.Close()).To(Succeed())
+	})
+
+	// arrive simulates a discovery packet from addr arriving on the interface
+	// whose index is ifIndex. Like a multicast datagram, it is delivered to each
+	// interface's connection.
+	arrive := func(ifIndex int, addr string) {
+		for _, mpc := range mocks {
+			mpc.PacketC <- mockPacket{
+				data:    pp,
+				addr:    &net.UDPAddr{IP: net.ParseIP(addr), Port: 7331},
+				ifIndex: ifIndex,
+			}
+		}
+	}
+
+	expectNoMore := func() {
+		c, cancelFunc := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		defer cancelFunc()
+		_, err := ml.Accept(c)
+		Expect(err).To(Equal(context.DeadlineExceeded))
+	}
+
+	It("tags headers with the interface that they arrived on", func(done Done) {
+		defer close(done)
+
+		By("not inferring the interface from the device's address")
+		arrive(2, "10.0.0.5")
+		dh, err := ml.Accept(context.Background())
+		Expect(err).ToNot(HaveOccurred())
+		Expect(dh.Interface).To(Equal("eth1"))
+		expectNoMore()
+
+		arrive(1, "10.0.0.5")
+		dh, err = ml.Accept(context.Background())
+		Expect(err).ToNot(HaveOccurred())
+		Expect(dh.Interface).To(Equal("eth0"))
+		expectNoMore()
+	}, 5)
+
+	It("discards headers that arrived on other interfaces", func(done Done) {
+		defer close(done)
+
+		arrive(3, "192.168.0.5")
+		expectNoMore()
+	}, 5)
+
+	It("reads the interface that datagrams arrive on from the connection", func() {
+		lo, err := net.InterfaceByName("lo")
+		if err != nil {
+			Skip("no loopback interface named \"lo\"")
+		}
+
+		conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+		Expect(err).ToNot(HaveOccurred())
+		defer conn.Close()
+
+		ic, err := makeInterfaceConn(conn, lo)
+		Expect(err).ToNot(HaveOccurred())
+
+		_, err = conn.WriteToUDP(pp, conn.LocalAddr().(*net.UDPAddr))
+		Expect(err).ToNot(HaveOccurred())
+
+		buf := make([]byte, len(pp)+1)
+		size, addr, err := ic.ReadFromUDP(buf)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(buf[:size]).To(Equal(pp))
+		Expect(addr).To(Equal(conn.LocalAddr()))
+	})
+})
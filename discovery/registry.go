@@ -5,6 +5,8 @@
 package discovery
 
 import (
+	"context"
+	"sort"
 	"sync"
 	"time"
 
@@ -12,11 +14,6 @@ import (
 	"github.com/danjacques/gopushpixels/protocol"
 )
 
-type discoveredDeviceState struct {
-	dh      *protocol.DiscoveryHeaders
-	expires time.Time
-}
-
 // Registry tracks a list of discovered headers, instantiating a device.D
 // instance for each unique device. It uses device.Remote instances.
 //
@@ -27,6 +24,17 @@ type discoveredDeviceState struct {
 // its Expiration threshold. When a device is expired, it will have its DoneC
 // channel closed, marking it done.
 //
+// If a GracePeriod is configured, an expired device first becomes stale: it
+// remains registered and usable, but is flagged (see IsStale) and a
+// DeviceStale event is sent. If it is observed again during its GracePeriod, it
+// recovers, and a DeviceRecovered event is sent; otherwise, it is removed.
+//
+// Registry tracks the interval at which each device announces itself (see
+// AnnounceInterval). If AdaptiveExpiration is configured, devices that
+// announce infrequently have their Expiration extended accordingly.
+//
+// Changes to the Registry's devices can be observed using Watch.
+//
 // Registry is safe for concurrent use.
 type Registry struct {
 	// Expiration is the amount of time after which a device is considered
@@ -35,14 +43,52 @@ type Registry struct {
 	// If <= 0, a device will never expire once observed.
 	Expiration time.Duration
 
+	// GracePeriod, if > 0, is the amount of time that an expired device remains
+	// registered as stale before it is removed.
+	GracePeriod time.Duration
+
+	// AdaptiveExpiration, if > 0, is a multiple of a device's observed
+	// announcement interval. If that multiple is longer than Expiration, it is
+	// used as the device's expiration instead.
+	AdaptiveExpiration float64
+
 	// DeviceRegistry, if not nil, is a device.Registry that will be updated when
 	// new devices are registered.
 	DeviceRegistry *device.Registry
 
+	// Pacing, if not nil, is the packet pacing configuration to apply to newly
+	// discovered devices. See device.Pacing for more information.
+	Pacing *device.Pacing
+
 	// Protects the following data members.
 	mu sync.Mutex
 	// Map of active devices.
 	devices map[string]*registryEntry
+	// watchers receive events when devices are added, updated, or removed.
+	watchers device.RegistryWatchers
+}
+
+// Watch returns a channel that receives an event whenever a device is
+// discovered, has its discovery headers changed, or expires or is
+// unregistered.
+//
+// The channel first receives an Initial DeviceAdded event for each device that
+// is currently registered, sorted by ID. It is closed when c is cancelled.
+func (reg *Registry) Watch(c context.Context) <-chan device.RegistryEvent {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+
+	snapshot := make([]device.D, 0, len(reg.devices))
+	for _, e := range reg.devices {
+		if !device.IsDone(e.device) {
+			snapshot = append(snapshot, e.device)
+		}
+	}
+	sort.Slice(snapshot, func(i, j int) bool {
+		return snapshot[i].ID() < snapshot[j].ID()
+	})
+
+	return reg.watchers.Watch(c, snapshot)
 }
 
 // Shutdown shuts down Registry monitoring and all managed devices. It blocks
@@ -70,6 +116,28 @@ func (reg *Registry) Devices() []device.D {
 	return devices
 }
 
+// IsStale returns true if d is registered and stale. A stale device has
+// expired, but is still within its GracePeriod.
+func (reg *Registry) IsStale(d device.D) bool {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+
+	e := reg.devices[d.ID()]
+	return e != nil && e.device == d && e.stale
+}
+
+// AnnounceInterval returns the average interval at which d has been observed.
+// It returns 0 if d is not registered, or has only been observed once.
+func (reg *Registry) AnnounceInterval(d device.D) time.Duration {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+
+	if e := reg.devices[d.ID()]; e != nil && e.device == d {
+		return e.interval
+	}
+	return 0
+}
+
 // Observe observes the supplied discovery headers. This will add the device if
 // it has not been observed before, or refresh its timeout and metadata if it
 // has.
@@ -97,17 +165,21 @@ func (reg *Registry) observeImpl(dh *protocol.DiscoveryHeaders) (d device.D, isN
 	reg.unregisterDoneEntriesLocked()
 
 	// Do we already have an entry for this device?
+	var changes []protocol.HeaderChange
 	e := reg.devices[id]
-	if e == nil {
+	if e != nil {
+		changes = protocol.DiffDiscoveryHeaders(e.device.DiscoveryHeaders(), dh)
+	} else {
 		// Create a remote device.
 		d := device.MakeRemote(id, dh)
+		d.Pacing = reg.Pacing
 
 		// This is a new entry.
 		e = &registryEntry{
-			reg:               reg,
-			device:            d,
-			deviceID:          id,
-			updateExpirationC: make(chan time.Time, 1),
+			reg:      reg,
+			device:   d,
+			deviceID: id,
+			updateC:  make(chan struct{}, 1),
 		}
 
 		// Unregister this entry when it expires.
@@ -121,13 +193,19 @@ func (reg *Registry) observeImpl(dh *protocol.DiscoveryHeaders) (d device.D, isN
 	}
 
 	// Observe the entry and update its timeout and headers.
-	st := discoveredDeviceState{
-		dh: dh,
+	wasStale := e.stale
+	e.observe(now, dh)
+
+	switch {
+	case isNew:
+		reg.watchers.Send(device.RegistryEvent{Type: device.DeviceAdded, Device: e.device})
+	case len(changes) > 0:
+		reg.watchers.Send(device.RegistryEvent{Type: device.DeviceUpdated, Device: e.device, Changes: changes})
 	}
-	if reg.Expiration > 0 {
-		st.expires = now.Add(reg.Expiration)
+	if wasStale {
+		staleDevicesGauge.Dec()
+		reg.watchers.Send(device.RegistryEvent{Type: device.DeviceRecovered, Device: e.device})
 	}
-	e.updateState(now, &st)
 
 	d = e.device
 	return
@@ -174,10 +252,17 @@ func (reg *Registry) unregisterEntryLocked(e *registryEntry) {
 	}
 
 	// Entry can no longer receive updates.
-	close(e.updateExpirationC)
+	close(e.updateC)
+
+	if e.stale {
+		e.stale = false
+		staleDevicesGauge.Dec()
+	}
 
 	// Remove this entry from the devices map.
 	delete(reg.devices, e.deviceID)
+
+	reg.watchers.Send(device.RegistryEvent{Type: device.DeviceRemoved, Device: e.device})
 }
 
 type registryEntry struct {
@@ -189,16 +274,101 @@ type registryEntry struct {
 	// deviceID is a copy of device's ID.
 	deviceID string
 
-	// updateExpirationC is an internal channel used to send new expiration times
-	// to the device.
-	updateExpirationC chan time.Time
+	// updateC is an internal channel used to notify the entry's lifecycle
+	// goroutine that its deadlines have changed. It is closed when the entry is
+	// unregistered.
+	updateC chan struct{}
+
+	// The following fields are protected by reg's mu.
+
+	// lastSeen is the time when the device was last observed.
+	lastSeen time.Time
+	// interval is the device's average announcement interval.
+	interval time.Duration
+	// staleAt is the time when the device becomes stale. It is zero if the
+	// device does not have a grace period.
+	staleAt time.Time
+	// expiresAt is the time when the device is removed. It is zero if the
+	// device never expires.
+	expiresAt time.Time
+	// stale is true if the device is currently stale.
+	stale bool
+}
+
+// observe updates the entry's headers, announcement interval, and deadlines.
+// The Registry's lock must be held.
+func (e *registryEntry) observe(now time.Time, dh *protocol.DiscoveryHeaders) {
+	e.device.UpdateHeaders(now, dh)
+
+	if !e.lastSeen.IsZero() {
+		// Track a moving average of the interval between announcements.
+		if gap := now.Sub(e.lastSeen); e.interval == 0 {
+			e.interval = gap
+		} else {
+			e.interval += (gap - e.interval) / 4
+		}
+	}
+	e.lastSeen = now
+	e.stale = false
+
+	e.staleAt, e.expiresAt = time.Time{}, time.Time{}
+	if expiration := e.expiration(); expiration > 0 {
+		e.expiresAt = now.Add(expiration)
+		if grace := e.reg.GracePeriod; grace > 0 {
+			e.staleAt = e.expiresAt
+			e.expiresAt = e.staleAt.Add(grace)
+		}
+	}
+
+	select {
+	case e.updateC <- struct{}{}:
+	default:
+	}
+}
+
+// expiration returns the amount of time after which the entry expires if it
+// is not observed.
+func (e *registryEntry) expiration() time.Duration {
+	expiration := e.reg.Expiration
+	if expiration <= 0 {
+		return 0
+	}
+	if factor := e.reg.AdaptiveExpiration; factor > 0 && e.interval > 0 {
+		if adaptive := time.Duration(factor * float64(e.interval)); adaptive > expiration {
+			expiration = adaptive
+		}
+	}
+	return expiration
 }
 
-func (e *registryEntry) updateState(now time.Time, st *discoveredDeviceState) {
-	e.device.UpdateHeaders(now, st.dh)
-	if !st.expires.IsZero() {
-		e.updateExpirationC <- st.expires
+// checkDeadlines marks the entry stale if its staleAt deadline has passed. It
+// returns the time of the entry's next deadline, which is zero if it has none,
+// and whether the entry has expired.
+func (e *registryEntry) checkDeadlines(now time.Time) (next time.Time, expired bool) {
+	reg := e.reg
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+
+	if reg.devices[e.deviceID] != e {
+		// Already unregistered.
+		return time.Time{}, true
+	}
+
+	if !e.expiresAt.IsZero() && !now.Before(e.expiresAt) {
+		return time.Time{}, true
+	}
+
+	if !e.staleAt.IsZero() && !e.stale {
+		if now.Before(e.staleAt) {
+			return e.staleAt, false
+		}
+
+		e.stale = true
+		staleDevicesGauge.Inc()
+		staleTransitionsCounter.Inc()
+		reg.watchers.Send(device.RegistryEvent{Type: device.DeviceStale, Device: e.device})
 	}
+	return e.expiresAt, false
 }
 
 func (e *registryEntry) manageEntryLifecycle() {
@@ -209,45 +379,41 @@ func (e *registryEntry) manageEntryLifecycle() {
 		e.reg.unregisterEntry(e)
 	}()
 
-	var t *time.Timer
-	var timerC <-chan time.Time
+	t := time.NewTimer(0)
+	defer t.Stop()
 
 	for {
+		next, expired := e.checkDeadlines(time.Now())
+		if expired {
+			return
+		}
+
+		// Reset our timer for the next deadline. It may already have fired.
+		if !t.Stop() {
+			select {
+			case <-t.C:
+			default:
+			}
+		}
+		var timerC <-chan time.Time
+		if !next.IsZero() {
+			t.Reset(time.Until(next))
+			timerC = t.C
+		}
+
 		select {
 		case <-e.device.DoneC():
 			// The device has closed.
 			return
 
 		case <-timerC:
-			// This entry has expired.
-			return
+			// A deadline has passed.
 
-		case expireTime, ok := <-e.updateExpirationC:
+		case _, ok := <-e.updateC:
 			if !ok {
 				// This entry has been closed.
 				return
 			}
-
-			// Calculate the expiration delta.
-			expirationDelta := expireTime.Sub(time.Now())
-			if expirationDelta < 0 {
-				// We are already expired!
-				return
-			}
-
-			// Initialize or reset our expiration timer.
-			if t == nil {
-				// First run, initialize the timer.
-				t = time.NewTimer(expirationDelta)
-				defer t.Stop()
-			} else {
-				// Reset the timer for the next expiration.
-				if !t.Stop() {
-					<-t.C
-				}
-				t.Reset(expirationDelta)
-			}
-			timerC = t.C
 		}
 	}
 }
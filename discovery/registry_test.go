@@ -5,11 +5,13 @@
 package discovery
 
 import (
+	"context"
 	"net"
 	"time"
 
 	"github.com/danjacques/gopushpixels/device"
 	"github.com/danjacques/gopushpixels/protocol"
+	"github.com/danjacques/gopushpixels/protocol/pixelpusher"
 
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
@@ -195,4 +197,152 @@ var _ = Describe("Registry", func() {
 			Expect(dh.ProductID).To(BeEquivalentTo(10))
 		})
 	})
+
+	Context("when watched", func() {
+		var d0 device.D
+		var cancelFunc context.CancelFunc
+		var eventC <-chan device.RegistryEvent
+		BeforeEach(func() {
+			d0, _ = reg.Observe(&h0)
+
+			var c context.Context
+			c, cancelFunc = context.WithCancel(context.Background())
+			eventC = reg.Watch(c)
+		})
+		AfterEach(func() {
+			cancelFunc()
+		})
+
+		It("delivers an initial snapshot, followed by changes", func() {
+			var ev device.RegistryEvent
+			Eventually(eventC).Should(Receive(&ev))
+			Expect(ev).To(Equal(device.RegistryEvent{Type: device.DeviceAdded, Device: d0, Initial: true}))
+
+			By("observing a new device")
+			d1, _ := reg.Observe(&h1)
+			Eventually(eventC).Should(Receive(&ev))
+			Expect(ev).To(Equal(device.RegistryEvent{Type: device.DeviceAdded, Device: d1}))
+
+			By("observing changed headers")
+			headers := h0
+			headers.ProductID = 42
+			reg.Observe(&headers)
+			Eventually(eventC).Should(Receive(&ev))
+			Expect(ev.Type).To(Equal(device.DeviceUpdated))
+			Expect(ev.Device).To(Equal(d0))
+			Expect(ev.Changes).To(Equal([]protocol.HeaderChange{
+				{Field: "ProductID", Old: uint16(0), New: uint16(42)},
+			}))
+
+			By("unregistering a device")
+			reg.Unregister(d1)
+			Eventually(eventC).Should(Receive(&ev))
+			Expect(ev).To(Equal(device.RegistryEvent{Type: device.DeviceRemoved, Device: d1}))
+
+			By("letting a device expire")
+			Eventually(eventC, timeoutThreshold).Should(Receive(&ev))
+			Expect(ev).To(Equal(device.RegistryEvent{Type: device.DeviceRemoved, Device: d0}))
+		})
+
+		It("reports a DeltaSequence reset as an update", func() {
+			var ev device.RegistryEvent
+			Eventually(eventC).Should(Receive(&ev))
+			Expect(ev.Initial).To(BeTrue())
+
+			// The Registry retains observed headers, so each observation uses new ones.
+			withDeltaSequence := func(seq uint32) *protocol.DiscoveryHeaders {
+				headers := h1
+				headers.DeviceType = protocol.PixelPusherDeviceType
+				headers.PixelPusher = &pixelpusher.Device{}
+				headers.PixelPusher.DeltaSequence = seq
+				return &headers
+			}
+			d1, _ := reg.Observe(withDeltaSequence(5))
+			Eventually(eventC).Should(Receive(&ev))
+			Expect(ev).To(Equal(device.RegistryEvent{Type: device.DeviceAdded, Device: d1}))
+
+			By("ignoring a DeltaSequence increase, and reporting a reset")
+			reg.Observe(withDeltaSequence(10))
+			reg.Observe(withDeltaSequence(0))
+			Eventually(eventC).Should(Receive(&ev))
+			Expect(ev.Type).To(Equal(device.DeviceUpdated))
+			Expect(ev.Device).To(Equal(d1))
+			Expect(ev.Changes).To(Equal([]protocol.HeaderChange{
+				{Field: "DeltaSequence", Old: uint32(10), New: uint32(0)},
+			}))
+		})
+	})
+	Context("with a grace period", func() {
+		var d0 device.D
+		var cancelFunc context.CancelFunc
+		var eventC <-chan device.RegistryEvent
+		BeforeEach(func() {
+			reg.GracePeriod = expirationThreshold
+
+			var c context.Context
+			c, cancelFunc = context.WithCancel(context.Background())
+			eventC = reg.Watch(c)
+
+			d0, _ = reg.Observe(&h0)
+		})
+		AfterEach(func() {
+			cancelFunc()
+		})
+
+		It("marks expired devices stale before removing them", func() {
+			var ev device.RegistryEvent
+			Eventually(eventC).Should(Receive(&ev))
+			Expect(ev).To(Equal(device.RegistryEvent{Type: device.DeviceAdded, Device: d0}))
+			Expect(reg.IsStale(d0)).To(BeFalse())
+
+			By("becoming stale, but remaining registered")
+			Eventually(eventC, timeoutThreshold).Should(Receive(&ev))
+			Expect(ev).To(Equal(device.RegistryEvent{Type: device.DeviceStale, Device: d0}))
+			Expect(reg.IsStale(d0)).To(BeTrue())
+			Expect(reg.Devices()).To(ConsistOf(d0))
+			Expect(device.IsDone(d0)).To(BeFalse())
+
+			By("recovering when observed again")
+			d, isNew := reg.Observe(&h0)
+			Expect(d).To(Equal(d0))
+			Expect(isNew).To(BeFalse())
+			Eventually(eventC).Should(Receive(&ev))
+			Expect(ev).To(Equal(device.RegistryEvent{Type: device.DeviceRecovered, Device: d0}))
+			Expect(reg.IsStale(d0)).To(BeFalse())
+
+			By("being removed once the grace period elapses")
+			Eventually(eventC, timeoutThreshold).Should(Receive(&ev))
+			Expect(ev.Type).To(Equal(device.DeviceStale))
+			Eventually(eventC, timeoutThreshold).Should(Receive(&ev))
+			Expect(ev).To(Equal(device.RegistryEvent{Type: device.DeviceRemoved, Device: d0}))
+			Expect(device.IsDone(d0)).To(BeTrue())
+			Expect(reg.IsStale(d0)).To(BeFalse())
+		})
+	})
+
+	Context("with adaptive expiration", func() {
+		BeforeEach(func() {
+			reg.AdaptiveExpiration = 4
+		})
+
+		It("tracks announcement intervals and extends expiration", func(done Done) {
+			defer close(done)
+
+			const gap = expirationThreshold * 3 / 4
+			d0, _ := reg.Observe(&h0)
+			Expect(reg.AnnounceInterval(d0)).To(BeZero())
+
+			time.Sleep(gap)
+			reg.Observe(&h0)
+			Expect(reg.AnnounceInterval(d0)).To(BeNumerically(">=", gap))
+
+			By("not expiring after the base expiration")
+			time.Sleep(expirationThreshold * 3 / 2)
+			Expect(device.IsDone(d0)).To(BeFalse())
+
+			By("eventually expiring")
+			<-d0.DoneC()
+			Expect(reg.AnnounceInterval(d0)).To(BeZero())
+		}, timeoutThreshold*3)
+	})
 })
@@ -0,0 +1,276 @@
+// Copyright 2018 Dan Jacques. All rights reserved.
+// Use of this source code is governed under the MIT License
+// that can be found in the LICENSE file.
+
+package discovery
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/danjacques/gopushpixels/protocol"
+	"github.com/danjacques/gopushpixels/protocol/pixelpusher"
+	"github.com/danjacques/gopushpixels/support/logging"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// DefaultStaticRefreshInterval is the default interval at which a Static
+	// re-observes its devices.
+	DefaultStaticRefreshInterval = time.Second
+
+	// DefaultProbeTimeout is the default amount of time that a UnicastProbe
+	// waits for a response.
+	DefaultProbeTimeout = 250 * time.Millisecond
+)
+
+// StaticDevice is a device at a known address, which is configured rather than
+// discovered.
+type StaticDevice struct {
+	// Addr is the device's UDP address. Its IP must be an IPv4 address. If its
+	// Port is 0, pixelpusher.DefaultPort will be used.
+	Addr *net.UDPAddr
+
+	// Profile is a full or partial profile of the device's discovery headers.
+	// It must not be nil, and must describe a PixelPusher with a non-zero
+	// number of strips and pixels per strip. See Headers for how it is
+	// completed.
+	Profile *protocol.DiscoveryHeaders
+}
+
+// Headers returns a complete set of discovery headers for the device, based
+// on its Profile.
+//
+// The device's IP address and port are taken from Addr. If the Profile has no
+// hardware address, a locally-administered one is derived from the device's IP
+// address, so that its ID is stable. Missing protocol and software versions,
+// maximum strips per packet, and strip flags are filled in with defaults.
+func (sd *StaticDevice) Headers() (*protocol.DiscoveryHeaders, error) {
+	if sd.Addr == nil {
+		return nil, errors.New("no address")
+	}
+	ip4 := sd.Addr.IP.To4()
+	if ip4 == nil {
+		return nil, errors.Errorf("address %s is not an IPv4 address", sd.Addr)
+	}
+
+	if sd.Profile == nil {
+		return nil, errors.New("no profile")
+	}
+	dh := sd.Profile.Clone()
+	switch pp := dh.PixelPusher; {
+	case dh.DeviceType != protocol.PixelPusherDeviceType || pp == nil:
+		return nil, errors.New("profile is not a PixelPusher profile")
+	case pp.StripsAttached == 0:
+		return nil, errors.New("profile has no strips")
+	case pp.PixelsPerStrip == 0:
+		return nil, errors.New("profile has no pixels per strip")
+	}
+	pp := dh.PixelPusher
+
+	dh.SetIP4Address(ip4)
+	if dh.MacAddress == ([6]byte{}) {
+		dh.SetHardwareAddr(net.HardwareAddr{0x02, 0x00, ip4[0], ip4[1], ip4[2], ip4[3]})
+	}
+	if dh.ProtocolVersion == 0 {
+		dh.ProtocolVersion = protocol.DefaultProtocolVersion
+	}
+	if dh.SoftwareRevision == 0 {
+		dh.SoftwareRevision = pixelpusher.LatestSoftwareRevision
+	}
+
+	pp.MyPort = uint16(sd.Addr.Port)
+	if pp.MyPort == 0 {
+		pp.MyPort = pixelpusher.DefaultPort
+	}
+	if pp.MaxStripsPerPacket == 0 {
+		pp.MaxStripsPerPacket = pp.StripsAttached
+	}
+	if len(pp.StripFlags) < int(pp.StripsAttached) {
+		flags := make([]pixelpusher.StripFlags, pp.StripsAttached)
+		copy(flags, pp.StripFlags)
+		pp.StripFlags = flags
+	}
+
+	return dh, nil
+}
+
+// Prober checks whether a statically-configured device is reachable.
+type Prober interface {
+	// Probe returns nil if the device at addr appears to be reachable.
+	//
+	// Probe may be called concurrently for different devices.
+	Probe(c context.Context, addr *net.UDPAddr) error
+}
+
+// UnicastProbe is a Prober that sends an empty unicast datagram to the device
+// and waits for a response.
+//
+// PixelPusher devices do not respond to datagrams, so UnicastProbe only fails
+// if the probe is actively rejected (e.g., the host has no route, or replies
+// that the port is unreachable). If no response is received within Timeout,
+// the device is assumed to be reachable.
+type UnicastProbe struct {
+	// Timeout is the amount of time to wait for a response. If <= 0,
+	// DefaultProbeTimeout will be used.
+	Timeout time.Duration
+}
+
+// Probe implements Prober.
+func (p *UnicastProbe) Probe(c context.Context, addr *net.UDPAddr) error {
+	conn, err := net.DialUDP("udp4", nil, addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	timeout := p.Timeout
+	if timeout <= 0 {
+		timeout = DefaultProbeTimeout
+	}
+	deadline := time.Now().Add(timeout)
+	if d, ok := c.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	if err := conn.SetDeadline(deadline); err != nil {
+		return err
+	}
+
+	if _, err := conn.Write(nil); err != nil {
+		return err
+	}
+
+	var buf [1]byte
+	if _, err := conn.Read(buf[:]); err != nil {
+		if ne, ok := err.(net.Error); ok && ne.Timeout() {
+			// No response, but no rejection either.
+			return nil
+		}
+		return err
+	}
+	return nil
+}
+
+// Static populates a Registry with statically-configured devices, for networks
+// where discovery announcements are not available (e.g., multicast and
+// broadcast traffic is blocked).
+//
+// Static devices are observed by the Registry exactly as if their discovery
+// headers had been received, and are re-observed every RefreshInterval. If a
+// Registry Expiration is set, it should be greater than RefreshInterval, so
+// that static devices do not expire between refreshes.
+//
+// If a Probe is configured, only devices that pass the probe are observed.
+// Devices that fail will expire according to the Registry's Expiration.
+// Devices are probed concurrently, and each refresh waits for every probe to
+// finish, so the time that a single probe takes (e.g., UnicastProbe's
+// Timeout) must stay well below RefreshInterval.
+type Static struct {
+	// Devices are the statically-configured devices.
+	Devices []*StaticDevice
+
+	// Registry is the Registry to populate. It must not be nil.
+	Registry *Registry
+
+	// RefreshInterval is the interval at which devices are re-observed. If <= 0,
+	// DefaultStaticRefreshInterval will be used.
+	RefreshInterval time.Duration
+
+	// Probe, if not nil, is used to check that each device is reachable before
+	// it is observed. Probes of different devices run concurrently.
+	Probe Prober
+
+	// Logger, if not nil, is the logger to use.
+	Logger logging.L
+}
+
+// Run observes the Static devices in the Registry every RefreshInterval until
+// c is cancelled.
+//
+// Run returns an error immediately if any device is misconfigured.
+func (s *Static) Run(c context.Context) error {
+	headers, err := s.headers()
+	if err != nil {
+		return err
+	}
+
+	interval := s.RefreshInterval
+	if interval <= 0 {
+		interval = DefaultStaticRefreshInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		s.refresh(c, headers)
+
+		select {
+		case <-c.Done():
+			return c.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// Refresh observes each of the Static devices in the Registry once.
+//
+// Refresh is called automatically by Run, but may also be called directly.
+func (s *Static) Refresh(c context.Context) error {
+	headers, err := s.headers()
+	if err != nil {
+		return err
+	}
+	s.refresh(c, headers)
+	return nil
+}
+
+func (s *Static) headers() ([]*protocol.DiscoveryHeaders, error) {
+	headers := make([]*protocol.DiscoveryHeaders, len(s.Devices))
+	for i, sd := range s.Devices {
+		var err error
+		if headers[i], err = sd.Headers(); err != nil {
+			return nil, errors.Wrapf(err, "invalid static device #%d", i)
+		}
+	}
+	return headers, nil
+}
+
+func (s *Static) refresh(c context.Context, headers []*protocol.DiscoveryHeaders) {
+	logger := logging.Must(s.Logger)
+
+	observe := func(dh *protocol.DiscoveryHeaders) {
+		// Observe a clone, since the Registry retains the headers.
+		if _, isNew := s.Registry.Observe(dh.Clone()); isNew {
+			logger.Infof("Registered static device %s at %s.", dh.HardwareAddr(), dh.Addr())
+		}
+	}
+
+	if s.Probe == nil {
+		for _, dh := range headers {
+			observe(dh)
+		}
+		return
+	}
+
+	// Probe each device concurrently, since a probe may take its full timeout.
+	// Each device is observed as soon as its probe passes.
+	var wg sync.WaitGroup
+	for _, dh := range headers {
+		wg.Add(1)
+		go func(dh *protocol.DiscoveryHeaders) {
+			defer wg.Done()
+
+			// Probe the resolved address, which has the default port filled in.
+			addr := dh.Addr().(*net.UDPAddr)
+			if err := s.Probe.Probe(c, addr); err != nil {
+				logger.Debugf("Static device %s at %s failed probe: %s", dh.HardwareAddr(), addr, err)
+				return
+			}
+			observe(dh)
+		}(dh)
+	}
+	wg.Wait()
+}
@@ -0,0 +1,177 @@
+// Copyright 2018 Dan Jacques. All rights reserved.
+// Use of this source code is governed under the MIT License
+// that can be found in the LICENSE file.
+
+package discovery
+
+import (
+	"context"
+	"net"
+	"time"
+
+	"github.com/danjacques/gopushpixels/device"
+	"github.com/danjacques/gopushpixels/protocol"
+	"github.com/danjacques/gopushpixels/protocol/pixelpusher"
+
+	"github.com/pkg/errors"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+type testProber map[string]error
+
+func (tp testProber) Probe(c context.Context, addr *net.UDPAddr) error { return tp[addr.String()] }
+
+// slowProber is a Prober that takes a fixed amount of time to succeed.
+type slowProber time.Duration
+
+func (sp slowProber) Probe(c context.Context, addr *net.UDPAddr) error {
+	time.Sleep(time.Duration(sp))
+	return nil
+}
+
+var _ = Describe("Static", func() {
+	makeProfile := func(strips, pixels int) *protocol.DiscoveryHeaders {
+		return &protocol.DiscoveryHeaders{
+			DeviceHeader: protocol.DeviceHeader{DeviceType: protocol.PixelPusherDeviceType},
+			PixelPusher: &pixelpusher.Device{
+				DeviceHeader: pixelpusher.DeviceHeader{
+					StripsAttached: uint8(strips),
+					PixelsPerStrip: uint16(pixels),
+					GroupOrdinal:   2,
+				},
+			},
+		}
+	}
+
+	Context("StaticDevice", func() {
+		It("completes a partial profile", func() {
+			sd := StaticDevice{
+				Addr:    &net.UDPAddr{IP: net.IPv4(10, 0, 0, 7)},
+				Profile: makeProfile(2, 100),
+			}
+			dh, err := sd.Headers()
+			Expect(err).ToNot(HaveOccurred())
+
+			Expect(dh.HardwareAddr().String()).To(Equal("02:00:0a:00:00:07"))
+			Expect(dh.Addr()).To(Equal(&net.UDPAddr{IP: net.IPv4(10, 0, 0, 7), Port: int(pixelpusher.DefaultPort)}))
+			Expect(dh.SoftwareRevision).To(BeEquivalentTo(pixelpusher.LatestSoftwareRevision))
+			Expect(dh.PixelPusher.MaxStripsPerPacket).To(BeEquivalentTo(2))
+			Expect(dh.PixelPusher.StripFlags).To(HaveLen(2))
+			Expect(dh.PixelPusher.GroupOrdinal).To(BeEquivalentTo(2))
+
+			By("not modifying the profile")
+			Expect(sd.Profile.PixelPusher.StripFlags).To(BeEmpty())
+		})
+
+		It("uses the profile's hardware address and the configured port", func() {
+			profile := makeProfile(1, 1)
+			profile.SetHardwareAddr(net.HardwareAddr{0xd8, 0x80, 0x39, 0x00, 0x00, 0x01})
+			sd := StaticDevice{
+				Addr:    &net.UDPAddr{IP: net.IPv4(10, 0, 0, 7), Port: 1234},
+				Profile: profile,
+			}
+			dh, err := sd.Headers()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(dh.HardwareAddr().String()).To(Equal("d8:80:39:00:00:01"))
+			Expect(dh.PixelPusher.MyPort).To(BeEquivalentTo(1234))
+		})
+
+		for _, tc := range []struct {
+			name string
+			sd   StaticDevice
+		}{
+			{"no address", StaticDevice{Profile: makeProfile(1, 1)}},
+			{"an IPv6 address", StaticDevice{Addr: &net.UDPAddr{IP: net.IPv6loopback}, Profile: makeProfile(1, 1)}},
+			{"no profile", StaticDevice{Addr: &net.UDPAddr{IP: net.IPv4(10, 0, 0, 7)}}},
+			{"no strips", StaticDevice{Addr: &net.UDPAddr{IP: net.IPv4(10, 0, 0, 7)}, Profile: makeProfile(0, 1)}},
+			{"no pixels", StaticDevice{Addr: &net.UDPAddr{IP: net.IPv4(10, 0, 0, 7)}, Profile: makeProfile(1, 0)}},
+		} {
+			tc := tc
+			It("rejects a device with "+tc.name, func() {
+				_, err := tc.sd.Headers()
+				Expect(err).To(HaveOccurred())
+			})
+		}
+	})
+
+	Context("populating a Registry", func() {
+		var reg *Registry
+		var devReg *device.Registry
+		var s *Static
+		BeforeEach(func() {
+			devReg = &device.Registry{}
+			reg = &Registry{DeviceRegistry: devReg}
+			s = &Static{
+				Registry: reg,
+				Devices: []*StaticDevice{
+					{Addr: &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1)}, Profile: makeProfile(1, 10)},
+					{Addr: &net.UDPAddr{IP: net.IPv4(10, 0, 0, 2)}, Profile: makeProfile(1, 10)},
+				},
+			}
+		})
+		AfterEach(func() {
+			reg.Shutdown()
+		})
+
+		It("registers static devices like discovered devices", func() {
+			Expect(s.Refresh(context.Background())).To(Succeed())
+			Expect(reg.Devices()).To(HaveLen(2))
+
+			d := devReg.Get("02:00:0a:00:00:01")
+			Expect(d).ToNot(BeNil())
+			Expect(d.Addr()).To(Equal(&net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: int(pixelpusher.DefaultPort)}))
+			Expect(d.Ordinal()).To(Equal(device.Ordinal{Group: 2, Controller: 0}))
+		})
+
+		It("only registers devices that pass their probe", func() {
+			addr := net.UDPAddr{IP: net.IPv4(10, 0, 0, 2), Port: int(pixelpusher.DefaultPort)}
+			s.Probe = testProber{addr.String(): errors.New("unreachable")}
+			Expect(s.Refresh(context.Background())).To(Succeed())
+			Expect(reg.Devices()).To(HaveLen(1))
+			Expect(devReg.Get("02:00:0a:00:00:02")).To(BeNil())
+		})
+
+		It("probes devices concurrently", func() {
+			for i := 3; i <= 8; i++ {
+				s.Devices = append(s.Devices, &StaticDevice{
+					Addr:    &net.UDPAddr{IP: net.IPv4(10, 0, 0, byte(i))},
+					Profile: makeProfile(1, 10),
+				})
+			}
+			s.Probe = slowProber(100 * time.Millisecond)
+
+			start := time.Now()
+			Expect(s.Refresh(context.Background())).To(Succeed())
+			Expect(time.Since(start)).To(BeNumerically("<", 400*time.Millisecond))
+			Expect(reg.Devices()).To(HaveLen(8))
+		})
+
+		It("refuses to run with a misconfigured device", func() {
+			s.Devices = append(s.Devices, &StaticDevice{})
+			Expect(s.Run(context.Background())).ToNot(Succeed())
+		})
+	})
+
+	Context("UnicastProbe", func() {
+		It("succeeds against a listening port", func() {
+			conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+			Expect(err).ToNot(HaveOccurred())
+			defer conn.Close()
+
+			var p UnicastProbe
+			Expect(p.Probe(context.Background(), conn.LocalAddr().(*net.UDPAddr))).To(Succeed())
+		})
+
+		It("fails against a closed port", func() {
+			conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+			Expect(err).ToNot(HaveOccurred())
+			addr := conn.LocalAddr().(*net.UDPAddr)
+			Expect(conn.Close()).To(Succeed())
+
+			var p UnicastProbe
+			Expect(p.Probe(context.Background(), addr)).ToNot(Succeed())
+		})
+	})
+})
@@ -0,0 +1,17 @@
+// Copyright 2018 Dan Jacques. All rights reserved.
+// Use of this source code is governed under the MIT License
+// that can be found in the LICENSE file.
+
+// Package inventory maintains a persistent record of every device that has
+// been observed, along with user-assigned names, locations, and tags.
+//
+// An Inventory is stored as a JSON file. It can follow a live device or
+// discovery Registry, recording each device as it comes and goes, and can be
+// installed as a device.Router's Namer so that operators can refer to
+// devices as "stage-left-truss" instead of by hardware address.
+//
+// Optional Prometheus monitoring can be enabled by registering on startup
+// (generally init()) via RegisterMonitoring. The inventory_device_info metric
+// can be joined with other device metrics on their "id" label to label them
+// with device names.
+package inventory
@@ -0,0 +1,507 @@
+// Copyright 2018 Dan Jacques. All rights reserved.
+// Use of this source code is governed under the MIT License
+// that can be found in the LICENSE file.
+
+package inventory
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/danjacques/gopushpixels/device"
+	"github.com/danjacques/gopushpixels/protocol"
+	"github.com/danjacques/gopushpixels/support/logging"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// DefaultFlushInterval is the default interval at which Follow saves the
+// Inventory.
+const DefaultFlushInterval = 30 * time.Second
+
+// Entry is the Inventory's record of a single device.
+type Entry struct {
+	// ID is the device's ID.
+	ID string
+	// Name is the device's human-friendly name. It may be empty.
+	Name string
+	// Location is a description of the device's location. It may be empty.
+	Location string
+	// Tags are user-assigned tags for the device.
+	Tags []string
+
+	// FirstSeen is the time when the device was first observed. It is zero if
+	// the device has never been observed.
+	FirstSeen time.Time
+	// LastSeen is the time when the device was most recently observed.
+	LastSeen time.Time
+	// Headers are the device's most recently-observed discovery headers. They
+	// may be nil.
+	Headers *protocol.DiscoveryHeaders
+
+	// infoLabels are the labels of the device's exported info metric.
+	infoLabels prometheus.Labels
+}
+
+// Label returns a human-friendly label for the device: its name, if it has
+// one, or else its ID.
+func (e *Entry) Label() string {
+	if e.Name != "" {
+		return e.Name
+	}
+	return e.ID
+}
+
+// HasTag returns true if the device has been assigned tag.
+func (e *Entry) HasTag(tag string) bool {
+	for _, t := range e.Tags {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
+
+func (e *Entry) clone() Entry {
+	clone := *e
+	clone.Tags = append([]string(nil), e.Tags...)
+	if clone.Headers != nil {
+		clone.Headers = clone.Headers.Clone()
+	}
+	return clone
+}
+
+// Inventory is a persistent record of every device that has ever been
+// observed, along with user-assigned names, locations, and tags.
+//
+// Inventory implements device.Namer, and can be installed in a device.Router
+// so that devices can be routed to by name.
+//
+// Inventory is safe for concurrent use.
+type Inventory struct {
+	// Path is the path of the file that the Inventory is saved to. If empty,
+	// the Inventory will not be persisted.
+	Path string
+
+	// FlushInterval is the interval at which Follow saves the Inventory. If
+	// <= 0, DefaultFlushInterval will be used.
+	FlushInterval time.Duration
+
+	// Logger, if not nil, is the logger to use.
+	Logger logging.L
+
+	mu sync.RWMutex
+	// entries maps device IDs to their entries.
+	entries map[string]*Entry
+	// names maps device names to their IDs.
+	names map[string]string
+	// dirty is true if the Inventory has changed since it was last saved.
+	dirty bool
+}
+
+// Load loads an Inventory from the file at path.
+//
+// If the file does not exist, Load returns an empty Inventory, which will be
+// created at path when it is saved.
+func Load(path string) (*Inventory, error) {
+	inv := Inventory{
+		Path: path,
+	}
+
+	data, err := ioutil.ReadFile(path)
+	switch {
+	case os.IsNotExist(err):
+		return &inv, nil
+	case err != nil:
+		return nil, errors.Wrap(err, "could not read inventory")
+	}
+
+	var f inventoryFile
+	if err := json.Unmarshal(data, &f); err != nil {
+		return nil, errors.Wrapf(err, "could not decode inventory %q", path)
+	}
+	for _, rec := range f.Devices {
+		e, err := rec.toEntry()
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid inventory entry %q", rec.ID)
+		}
+		if e.Name != "" {
+			if err := inv.checkNameLocked(e.ID, e.Name); err != nil {
+				return nil, err
+			}
+		}
+		inv.putLocked(e)
+		updateInfoMetric(e)
+	}
+	return &inv, nil
+}
+
+// Save writes the Inventory to its Path. The file is replaced atomically.
+//
+// If the Inventory has no Path, Save does nothing.
+func (inv *Inventory) Save() error {
+	if inv.Path == "" {
+		return nil
+	}
+
+	inv.mu.Lock()
+	defer inv.mu.Unlock()
+
+	var f inventoryFile
+	for _, e := range inv.sortedEntriesLocked() {
+		f.Devices = append(f.Devices, makeEntryRecord(e))
+	}
+	data, err := json.MarshalIndent(&f, "", "  ")
+	if err != nil {
+		return errors.Wrap(err, "could not encode inventory")
+	}
+
+	// Write to a temporary file in the same directory, then rename it into
+	// place.
+	tmp, err := ioutil.TempFile(filepath.Dir(inv.Path), filepath.Base(inv.Path)+".tmp")
+	if err != nil {
+		return errors.Wrap(err, "could not create temporary file")
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return errors.Wrap(err, "could not write inventory")
+	}
+	if err := tmp.Close(); err != nil {
+		return errors.Wrap(err, "could not write inventory")
+	}
+	if err := os.Rename(tmp.Name(), inv.Path); err != nil {
+		return errors.Wrap(err, "could not replace inventory")
+	}
+
+	inv.dirty = false
+	return nil
+}
+
+// Observe records that d was observed at now, updating its headers and seen
+// times. If d has never been observed, a new entry will be created for it.
+func (inv *Inventory) Observe(d device.D, now time.Time) {
+	inv.mu.Lock()
+	defer inv.mu.Unlock()
+
+	e := inv.entries[d.ID()]
+	if e == nil {
+		e = &Entry{ID: d.ID()}
+		inv.putLocked(e)
+	}
+	if e.FirstSeen.IsZero() {
+		e.FirstSeen = now
+	}
+	e.LastSeen = now
+	if dh := d.DiscoveryHeaders(); dh != nil {
+		e.Headers = dh.Clone()
+	}
+	inv.dirty = true
+
+	updateInfoMetric(e)
+}
+
+// Get returns the entry for the device with the specified ID or name.
+func (inv *Inventory) Get(idOrName string) (Entry, bool) {
+	inv.mu.RLock()
+	defer inv.mu.RUnlock()
+
+	if e := inv.getLocked(idOrName); e != nil {
+		return e.clone(), true
+	}
+	return Entry{}, false
+}
+
+// Entries returns all of the Inventory's entries, sorted by ID.
+func (inv *Inventory) Entries() []Entry {
+	inv.mu.RLock()
+	defer inv.mu.RUnlock()
+
+	sorted := inv.sortedEntriesLocked()
+	entries := make([]Entry, len(sorted))
+	for i, e := range sorted {
+		entries[i] = e.clone()
+	}
+	return entries
+}
+
+// SetName assigns a name to the device with the specified ID. If name is
+// empty, the device's name will be removed.
+//
+// Names must be unique, and a name may not be the ID of a different device.
+//
+// If the device has never been observed, an entry will be created for it.
+func (inv *Inventory) SetName(id, name string) error {
+	inv.mu.Lock()
+	defer inv.mu.Unlock()
+
+	if name != "" {
+		if err := inv.checkNameLocked(id, name); err != nil {
+			return err
+		}
+	}
+
+	e := inv.getOrCreateLocked(id)
+	if e.Name != "" {
+		delete(inv.names, e.Name)
+	}
+	e.Name = name
+	inv.putLocked(e)
+	inv.dirty = true
+
+	updateInfoMetric(e)
+	return nil
+}
+
+// SetLocation assigns a location to the device with the specified ID.
+//
+// If the device has never been observed, an entry will be created for it.
+func (inv *Inventory) SetLocation(id, location string) {
+	inv.mu.Lock()
+	defer inv.mu.Unlock()
+
+	e := inv.getOrCreateLocked(id)
+	e.Location = location
+	inv.dirty = true
+
+	updateInfoMetric(e)
+}
+
+// SetTags replaces the tags assigned to the device with the specified ID.
+//
+// If the device has never been observed, an entry will be created for it.
+func (inv *Inventory) SetTags(id string, tags ...string) {
+	inv.mu.Lock()
+	defer inv.mu.Unlock()
+
+	e := inv.getOrCreateLocked(id)
+	e.Tags = append([]string(nil), tags...)
+	inv.dirty = true
+}
+
+// Name implements device.Namer.
+func (inv *Inventory) Name(id string) string {
+	inv.mu.RLock()
+	defer inv.mu.RUnlock()
+
+	if e := inv.entries[id]; e != nil {
+		return e.Name
+	}
+	return ""
+}
+
+// ResolveName implements device.Namer.
+func (inv *Inventory) ResolveName(name string) string {
+	inv.mu.RLock()
+	defer inv.mu.RUnlock()
+	return inv.names[name]
+}
+
+// Label returns a human-friendly label for the device with the specified ID,
+// suitable for logging. If the device has a name, Label returns the name
+// followed by the ID; otherwise, it returns the ID.
+func (inv *Inventory) Label(id string) string {
+	if name := inv.Name(id); name != "" {
+		return name + " (" + id + ")"
+	}
+	return id
+}
+
+// Watchable is a device registry that can be watched for changes. Both
+// device.Registry and discovery.Registry are Watchable.
+type Watchable interface {
+	Watch(c context.Context) <-chan device.RegistryEvent
+}
+
+// Follow merges the devices in w into the Inventory, recording every device
+// that is added or updated, until c is cancelled.
+//
+// While following, the Inventory is periodically saved, refreshing the
+// LastSeen time of each live device. It is saved a final time when Follow
+// returns.
+func (inv *Inventory) Follow(c context.Context, w Watchable) error {
+	flushInterval := inv.FlushInterval
+	if flushInterval <= 0 {
+		flushInterval = DefaultFlushInterval
+	}
+	ticker := time.NewTicker(flushInterval)
+	defer ticker.Stop()
+
+	live := make(map[string]device.D)
+	flush := func() error {
+		for _, d := range live {
+			inv.Observe(d, lastObserved(d))
+		}
+		return inv.saveIfDirty()
+	}
+
+	eventC := w.Watch(c)
+	for {
+		select {
+		case ev, ok := <-eventC:
+			if !ok {
+				return flush()
+			}
+
+			inv.Observe(ev.Device, lastObserved(ev.Device))
+			switch ev.Type {
+			case device.DeviceAdded:
+				live[ev.Device.ID()] = ev.Device
+				if !ev.Initial {
+					inv.logger().Infof("Device %s is online.", inv.Label(ev.Device.ID()))
+				}
+			case device.DeviceRemoved:
+				delete(live, ev.Device.ID())
+				inv.logger().Infof("Device %s is offline.", inv.Label(ev.Device.ID()))
+			}
+
+		case <-ticker.C:
+			if err := flush(); err != nil {
+				inv.logger().Warnf("Failed to save inventory: %s", err)
+			}
+		}
+	}
+}
+
+// lastObserved returns the time when d was last observed, or the current time
+// if d doesn't track its observation time.
+func lastObserved(d device.D) time.Time {
+	if observed := d.Info().Observed; !observed.IsZero() {
+		return observed
+	}
+	return time.Now()
+}
+
+func (inv *Inventory) saveIfDirty() error {
+	inv.mu.RLock()
+	dirty := inv.dirty
+	inv.mu.RUnlock()
+
+	if !dirty {
+		return nil
+	}
+	return inv.Save()
+}
+
+func (inv *Inventory) getLocked(idOrName string) *Entry {
+	if e := inv.entries[idOrName]; e != nil {
+		return e
+	}
+	if id, ok := inv.names[idOrName]; ok {
+		return inv.entries[id]
+	}
+	return nil
+}
+
+func (inv *Inventory) getOrCreateLocked(id string) *Entry {
+	e := inv.entries[id]
+	if e == nil {
+		e = &Entry{ID: id}
+		inv.putLocked(e)
+	}
+	return e
+}
+
+func (inv *Inventory) putLocked(e *Entry) {
+	if inv.entries == nil {
+		inv.entries = make(map[string]*Entry)
+	}
+	inv.entries[e.ID] = e
+
+	if e.Name != "" {
+		if inv.names == nil {
+			inv.names = make(map[string]string)
+		}
+		inv.names[e.Name] = e.ID
+	}
+}
+
+func (inv *Inventory) checkNameLocked(id, name string) error {
+	if other, ok := inv.names[name]; ok && other != id {
+		return errors.Errorf("name %q is already assigned to %s", name, other)
+	}
+	if name != id {
+		if _, ok := inv.entries[name]; ok {
+			return errors.Errorf("name %q is the ID of another device", name)
+		}
+	}
+	return nil
+}
+
+func (inv *Inventory) sortedEntriesLocked() []*Entry {
+	entries := make([]*Entry, 0, len(inv.entries))
+	for _, e := range inv.entries {
+		entries = append(entries, e)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].ID < entries[j].ID })
+	return entries
+}
+
+func (inv *Inventory) logger() logging.L { return logging.Must(inv.Logger) }
+
+// inventoryFile is the JSON-encoded form of an Inventory.
+type inventoryFile struct {
+	Devices []*entryRecord `json:"devices"`
+}
+
+// entryRecord is the JSON-encoded form of an Entry.
+type entryRecord struct {
+	ID        string    `json:"id"`
+	Name      string    `json:"name,omitempty"`
+	Location  string    `json:"location,omitempty"`
+	Tags      []string  `json:"tags,omitempty"`
+	FirstSeen time.Time `json:"first_seen,omitempty"`
+	LastSeen  time.Time `json:"last_seen,omitempty"`
+
+	// Headers is the device's raw discovery packet.
+	Headers []byte `json:"headers,omitempty"`
+}
+
+func makeEntryRecord(e *Entry) *entryRecord {
+	rec := entryRecord{
+		ID:        e.ID,
+		Name:      e.Name,
+		Location:  e.Location,
+		Tags:      e.Tags,
+		FirstSeen: e.FirstSeen,
+		LastSeen:  e.LastSeen,
+	}
+	if e.Headers != nil {
+		var buf bytes.Buffer
+		if err := e.Headers.WritePacket(&buf); err == nil {
+			rec.Headers = buf.Bytes()
+		}
+	}
+	return &rec
+}
+
+func (rec *entryRecord) toEntry() (*Entry, error) {
+	if rec.ID == "" {
+		return nil, errors.New("missing ID")
+	}
+
+	e := Entry{
+		ID:        rec.ID,
+		Name:      rec.Name,
+		Location:  rec.Location,
+		Tags:      rec.Tags,
+		FirstSeen: rec.FirstSeen,
+		LastSeen:  rec.LastSeen,
+	}
+	if len(rec.Headers) > 0 {
+		var err error
+		if e.Headers, err = protocol.ParseDiscoveryHeaders(rec.Headers); err != nil {
+			return nil, errors.Wrap(err, "could not parse headers")
+		}
+	}
+	return &e, nil
+}
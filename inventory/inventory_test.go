@@ -0,0 +1,145 @@
+// Copyright 2018 Dan Jacques. All rights reserved.
+// Use of this source code is governed under the MIT License
+// that can be found in the LICENSE file.
+
+package inventory
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/danjacques/gopushpixels/device"
+	"github.com/danjacques/gopushpixels/discovery"
+	"github.com/danjacques/gopushpixels/protocol"
+	"github.com/danjacques/gopushpixels/protocol/pixelpusher"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Inventory", func() {
+	var tdir string
+	var path string
+	BeforeEach(func() {
+		var err error
+		tdir, err = ioutil.TempDir("", "gopushpixels_inventory")
+		Expect(err).ToNot(HaveOccurred())
+		path = filepath.Join(tdir, "inventory.json")
+	})
+	AfterEach(func() {
+		if tdir != "" {
+			os.RemoveAll(tdir)
+		}
+	})
+
+	dh := protocol.DiscoveryHeaders{
+		DeviceHeader: protocol.DeviceHeader{
+			MacAddress:       [6]byte{0xd8, 0x80, 0x39, 0x00, 0x00, 0x01},
+			IPAddress:        [4]byte{127, 0, 0, 1},
+			DeviceType:       protocol.PixelPusherDeviceType,
+			SoftwareRevision: pixelpusher.LatestSoftwareRevision,
+		},
+		PixelPusher: &pixelpusher.Device{
+			DeviceHeader: pixelpusher.DeviceHeader{
+				StripsAttached: 2,
+				PixelsPerStrip: 10,
+				GroupOrdinal:   1,
+			},
+			DeviceHeaderExt101: pixelpusher.DeviceHeaderExt101{
+				MyPort: pixelpusher.DefaultPort,
+			},
+			DeviceHeaderExt109: pixelpusher.DeviceHeaderExt109{
+				StripFlags: []pixelpusher.StripFlags{0, 0},
+			},
+		},
+	}
+	id := dh.HardwareAddr().String()
+
+	It("returns an empty Inventory if the file does not exist", func() {
+		inv, err := Load(path)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(inv.Entries()).To(BeEmpty())
+	})
+
+	It("can save and load an Inventory", func() {
+		inv, err := Load(path)
+		Expect(err).ToNot(HaveOccurred())
+
+		now := time.Date(2018, 1, 2, 3, 4, 5, 0, time.UTC)
+		inv.Observe(device.MakeRemote(id, &dh), now)
+		Expect(inv.SetName(id, "stage-left-truss")).To(Succeed())
+		inv.SetLocation(id, "stage left")
+		inv.SetTags(id, "truss", "stage")
+		Expect(inv.Save()).To(Succeed())
+
+		loaded, err := Load(path)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(loaded.Entries()).To(HaveLen(1))
+
+		e, ok := loaded.Get("stage-left-truss")
+		Expect(ok).To(BeTrue())
+		Expect(e.ID).To(Equal(id))
+		Expect(e.Location).To(Equal("stage left"))
+		Expect(e.Tags).To(Equal([]string{"truss", "stage"}))
+		Expect(e.HasTag("truss")).To(BeTrue())
+		Expect(e.FirstSeen.Equal(now)).To(BeTrue())
+		Expect(e.LastSeen.Equal(now)).To(BeTrue())
+		Expect(e.Headers).ToNot(BeNil())
+		Expect(protocol.DiffDiscoveryHeaders(e.Headers, &dh)).To(BeEmpty())
+
+		Expect(loaded.ResolveName("stage-left-truss")).To(Equal(id))
+		Expect(loaded.Name(id)).To(Equal("stage-left-truss"))
+		Expect(loaded.Label(id)).To(Equal("stage-left-truss (" + id + ")"))
+		Expect(loaded.Label("unknown")).To(Equal("unknown"))
+	})
+
+	It("enforces unique names", func() {
+		inv := Inventory{}
+		Expect(inv.SetName("foo", "alpha")).To(Succeed())
+		Expect(inv.SetName("bar", "alpha")).ToNot(Succeed())
+		Expect(inv.SetName("bar", "foo")).ToNot(Succeed())
+
+		By("allowing a name to be reassigned once released")
+		Expect(inv.SetName("foo", "beta")).To(Succeed())
+		Expect(inv.ResolveName("alpha")).To(BeEmpty())
+		Expect(inv.SetName("bar", "alpha")).To(Succeed())
+		Expect(inv.ResolveName("alpha")).To(Equal("bar"))
+	})
+
+	It("follows a discovery Registry", func(done Done) {
+		defer close(done)
+
+		inv, err := Load(path)
+		Expect(err).ToNot(HaveOccurred())
+
+		reg := discovery.Registry{}
+		defer reg.Shutdown()
+		reg.Observe(&dh)
+
+		c, cancelFunc := context.WithCancel(context.Background())
+		errC := make(chan error)
+		go func() {
+			errC <- inv.Follow(c, &reg)
+		}()
+
+		Eventually(func() int { return len(inv.Entries()) }).Should(Equal(1))
+		cancelFunc()
+		Expect(<-errC).ToNot(HaveOccurred())
+
+		By("having saved the Inventory")
+		loaded, err := Load(path)
+		Expect(err).ToNot(HaveOccurred())
+		e, ok := loaded.Get(id)
+		Expect(ok).To(BeTrue())
+		Expect(e.FirstSeen.IsZero()).To(BeFalse())
+	}, 5)
+})
+
+func TestInventory(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Inventory")
+}
@@ -0,0 +1,43 @@
+// Copyright 2018 Dan Jacques. All rights reserved.
+// Use of this source code is governed under the MIT License
+// that can be found in the LICENSE file.
+
+package inventory
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	deviceInfoGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "inventory_device_info",
+		Help: "Inventory information for a device. Always 1; join on \"id\" to label other device metrics.",
+	},
+		[]string{"id", "name", "location"})
+)
+
+// RegisterMonitoring registers all of this package's monitoring metrics.
+func RegisterMonitoring(reg prometheus.Registerer) {
+	reg.MustRegister(
+		deviceInfoGauge,
+	)
+}
+
+// updateInfoMetric updates e's device info metric, replacing any previously
+// exported labels.
+func updateInfoMetric(e *Entry) {
+	labels := prometheus.Labels{
+		"id":       e.ID,
+		"name":     e.Label(),
+		"location": e.Location,
+	}
+	if old := e.infoLabels; old != nil {
+		if old["name"] == labels["name"] && old["location"] == labels["location"] {
+			return
+		}
+		deviceInfoGauge.Delete(old)
+	}
+
+	deviceInfoGauge.With(labels).Set(1)
+	e.infoLabels = labels
+}
@@ -0,0 +1,236 @@
+// Copyright 2018 Dan Jacques. All rights reserved.
+// Use of this source code is governed under the MIT License
+// that can be found in the LICENSE file.
+
+package manifest
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/danjacques/gopushpixels/device"
+	"github.com/danjacques/gopushpixels/support/eventqueue"
+	"github.com/danjacques/gopushpixels/support/logging"
+)
+
+// DefaultCheckInterval is the default interval at which a Checker re-checks
+// its Manifest, in addition to checking whenever its devices change.
+const DefaultCheckInterval = 10 * time.Second
+
+// EventType is the type of an Event.
+type EventType int
+
+const (
+	// ProblemRaised indicates that a new problem was identified.
+	ProblemRaised EventType = iota
+	// ProblemCleared indicates that a previously-identified problem has been
+	// resolved.
+	ProblemCleared
+)
+
+func (t EventType) String() string {
+	switch t {
+	case ProblemRaised:
+		return "raised"
+	case ProblemCleared:
+		return "cleared"
+	default:
+		return "unknown"
+	}
+}
+
+// Event is emitted by a Checker when a problem is raised or cleared.
+type Event struct {
+	// Type is the type of event.
+	Type EventType
+	// Problem is the problem that was raised or cleared.
+	Problem *Problem
+	// Time is the time of the check that raised or cleared the problem.
+	Time time.Time
+}
+
+// Registry is a device registry that a Checker can check. It is implemented
+// by discovery.Registry.
+type Registry interface {
+	// Devices returns the current set of devices.
+	Devices() []device.D
+	// Watch returns a channel that receives an event whenever the registry's
+	// devices change.
+	Watch(c context.Context) <-chan device.RegistryEvent
+}
+
+// Checker continuously checks a Manifest against the devices in a Registry.
+//
+// A Checker re-checks its Manifest whenever the Registry's devices change,
+// and periodically at its Interval. Each check updates the Checker's Report
+// and Prometheus metrics, and emits an Event for each problem that is raised
+// or cleared.
+type Checker struct {
+	// Manifest is the Manifest to check. It must not be nil.
+	Manifest *Manifest
+	// Registry is the Registry whose devices are checked. It must not be nil.
+	Registry Registry
+
+	// Interval is the interval at which the Manifest is periodically
+	// re-checked. If <= 0, DefaultCheckInterval will be used.
+	Interval time.Duration
+
+	// Logger, if not nil, is the logger to use. Problems are logged as they are
+	// raised and cleared.
+	Logger logging.L
+
+	mu sync.Mutex
+	// report is the most recent Report.
+	report *Report
+	// problems is the set of problems in report, keyed on their key.
+	problems map[string]*Problem
+	// watchers receive Events.
+	watchers map[*eventWatcher]struct{}
+}
+
+// Run runs the Checker until c is cancelled.
+func (ch *Checker) Run(c context.Context) error {
+	interval := ch.Interval
+	if interval <= 0 {
+		interval = DefaultCheckInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	eventC := ch.Registry.Watch(c)
+	ch.Check()
+	for {
+		select {
+		case <-c.Done():
+			return c.Err()
+
+		case _, ok := <-eventC:
+			if !ok {
+				return c.Err()
+			}
+
+			// Coalesce any other pending events into a single check.
+			for drained := false; !drained; {
+				select {
+				case _, ok := <-eventC:
+					if !ok {
+						return c.Err()
+					}
+				default:
+					drained = true
+				}
+			}
+			ch.Check()
+
+		case <-ticker.C:
+			ch.Check()
+		}
+	}
+}
+
+// Check checks the Manifest against the Registry's current devices,
+// updating the Checker's state, and returns the resulting Report.
+//
+// Check is called automatically by Run, but may also be called directly.
+func (ch *Checker) Check() *Report {
+	r := ch.Manifest.Check(ch.Registry.Devices())
+
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+
+	problems := make(map[string]*Problem, len(r.Problems))
+	for _, p := range r.Problems {
+		key := p.key()
+		problems[key] = p
+
+		if _, ok := ch.problems[key]; !ok {
+			ch.logger().Warnf("Manifest problem raised: %s", p)
+			ch.sendLocked(&Event{Type: ProblemRaised, Problem: p, Time: r.Time})
+		}
+	}
+	for key, p := range ch.problems {
+		if _, ok := problems[key]; !ok {
+			ch.logger().Infof("Manifest problem cleared: %s", p)
+			ch.sendLocked(&Event{Type: ProblemCleared, Problem: p, Time: r.Time})
+		}
+	}
+
+	ch.report, ch.problems = r, problems
+	updateMetrics(r)
+	return r
+}
+
+// Report returns the most recent Report, or nil if no check has been
+// performed.
+func (ch *Checker) Report() *Report {
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+	return ch.report
+}
+
+// Watch returns a channel that receives an Event whenever a problem is raised
+// or cleared.
+//
+// The channel first receives a ProblemRaised Event for each problem in the
+// most recent Report. It is closed when c is cancelled.
+func (ch *Checker) Watch(c context.Context) <-chan *Event {
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+
+	var initial []interface{}
+	if ch.report != nil {
+		for _, p := range ch.report.Problems {
+			initial = append(initial, &Event{Type: ProblemRaised, Problem: p, Time: ch.report.Time})
+		}
+	}
+	w := &eventWatcher{
+		eventC: make(chan *Event),
+		queue:  eventqueue.Make(initial...),
+	}
+
+	if ch.watchers == nil {
+		ch.watchers = make(map[*eventWatcher]struct{})
+	}
+	ch.watchers[w] = struct{}{}
+
+	go func() {
+		defer func() {
+			ch.mu.Lock()
+			defer ch.mu.Unlock()
+			delete(ch.watchers, w)
+		}()
+		w.run(c)
+	}()
+	return w.eventC
+}
+
+func (ch *Checker) sendLocked(ev *Event) {
+	for w := range ch.watchers {
+		w.push(ev)
+	}
+}
+
+func (ch *Checker) logger() logging.L { return logging.Must(ch.Logger) }
+
+// eventWatcher is a single Watch subscriber. It has an unbounded queue, so
+// that a slow subscriber never blocks the Checker.
+type eventWatcher struct {
+	eventC chan *Event
+	queue  *eventqueue.Queue
+}
+
+func (w *eventWatcher) push(ev *Event) { w.queue.Push(ev) }
+
+func (w *eventWatcher) run(c context.Context) {
+	defer close(w.eventC)
+
+	w.queue.Run(c, func(ev interface{}) bool {
+		select {
+		case w.eventC <- ev.(*Event):
+			return true
+		case <-c.Done():
+			return false
+		}
+	})
+}
@@ -0,0 +1,17 @@
+// Copyright 2018 Dan Jacques. All rights reserved.
+// Use of this source code is governed under the MIT License
+// that can be found in the LICENSE file.
+
+// Package manifest describes an expected fleet of devices, and checks the
+// devices that are actually present against it.
+//
+// A Manifest is loaded from JSON, and lists each expected device by ID or by
+// ordinal, along with its expected configuration. A Manifest's Check method
+// compares it against a set of devices, producing a Report of missing
+// devices, unexpected devices, configuration mismatches, and duplicate
+// ordinals.
+//
+// A Checker continuously checks a Manifest against a discovery.Registry,
+// exposing the latest Report, an event stream of problems as they are raised
+// and cleared, and optional Prometheus metrics (see RegisterMonitoring).
+package manifest
@@ -0,0 +1,364 @@
+// Copyright 2018 Dan Jacques. All rights reserved.
+// Use of this source code is governed under the MIT License
+// that can be found in the LICENSE file.
+
+package manifest
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/danjacques/gopushpixels/device"
+	"github.com/danjacques/gopushpixels/protocol/pixelpusher"
+
+	"github.com/pkg/errors"
+)
+
+// ExpectedDevice is a single device that a Manifest expects to be present.
+//
+// An ExpectedDevice must identify its device by ID, by Ordinal, or by both.
+// If both are specified, the device is matched by ID, and its ordinal is
+// checked like any other configuration value.
+//
+// Configuration fields that are nil or empty are not checked.
+type ExpectedDevice struct {
+	// Name is an optional name for this device, used for reporting.
+	Name string `json:"name,omitempty"`
+
+	// ID is the expected device's ID.
+	ID string `json:"id,omitempty"`
+	// Ordinal is the expected device's ordinal.
+	Ordinal *device.Ordinal `json:"ordinal,omitempty"`
+
+	// NumStrips is the expected number of attached strips.
+	NumStrips *int `json:"strips,omitempty"`
+	// PixelsPerStrip is the expected number of pixels per strip.
+	PixelsPerStrip *int `json:"pixels_per_strip,omitempty"`
+	// StripFlags are the expected flags for each strip.
+	StripFlags []pixelpusher.StripFlags `json:"strip_flags,omitempty"`
+	// SoftwareRevision is the expected software revision.
+	SoftwareRevision *int `json:"software_revision,omitempty"`
+}
+
+func (ed *ExpectedDevice) String() string {
+	switch {
+	case ed.Name != "":
+		return ed.Name
+	case ed.ID != "":
+		return ed.ID
+	default:
+		return ed.Ordinal.String()
+	}
+}
+
+// Manifest is the set of devices that are expected to be present.
+type Manifest struct {
+	// Devices are the expected devices.
+	Devices []*ExpectedDevice `json:"devices"`
+
+	// AllowUnexpected, if true, causes devices that are not in the Manifest to
+	// not be reported as problems.
+	AllowUnexpected bool `json:"allow_unexpected,omitempty"`
+}
+
+// Load loads a JSON-encoded Manifest from r and validates it.
+func Load(r io.Reader) (*Manifest, error) {
+	dec := json.NewDecoder(r)
+	dec.DisallowUnknownFields()
+
+	var m Manifest
+	if err := dec.Decode(&m); err != nil {
+		return nil, errors.Wrap(err, "could not decode manifest")
+	}
+	if err := m.Validate(); err != nil {
+		return nil, err
+	}
+	return &m, nil
+}
+
+// LoadFile loads a JSON-encoded Manifest from the file at path.
+func LoadFile(path string) (*Manifest, error) {
+	fd, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer fd.Close()
+
+	return Load(fd)
+}
+
+// Validate returns an error if the Manifest is invalid.
+//
+// A Manifest is invalid if any of its devices is not identified, or if two
+// devices are identified by the same ID or the same ordinal.
+func (m *Manifest) Validate() error {
+	ids := make(map[string]struct{}, len(m.Devices))
+	ordinals := make(map[device.Ordinal]struct{}, len(m.Devices))
+	for i, ed := range m.Devices {
+		if ed.ID == "" && ed.Ordinal == nil {
+			return errors.Errorf("device #%d has neither an ID nor an ordinal", i)
+		}
+
+		if ed.ID != "" {
+			if _, ok := ids[ed.ID]; ok {
+				return errors.Errorf("device #%d (%s) has a duplicate ID", i, ed)
+			}
+			ids[ed.ID] = struct{}{}
+		}
+
+		if ed.Ordinal != nil {
+			if !ed.Ordinal.IsValid() {
+				return errors.Errorf("device #%d (%s) has an invalid ordinal", i, ed)
+			}
+			if _, ok := ordinals[*ed.Ordinal]; ok {
+				return errors.Errorf("device #%d (%s) has a duplicate ordinal", i, ed)
+			}
+			ordinals[*ed.Ordinal] = struct{}{}
+		}
+	}
+	return nil
+}
+
+// ProblemType is the type of a Problem.
+type ProblemType string
+
+const (
+	// Missing indicates that an expected device is not present.
+	Missing ProblemType = "missing"
+	// Unexpected indicates that a device is present, but not expected.
+	Unexpected ProblemType = "unexpected"
+	// Mismatch indicates that an expected device's configuration does not
+	// match its expected configuration.
+	Mismatch ProblemType = "mismatch"
+	// DuplicateOrdinal indicates that multiple devices share the same ordinal.
+	DuplicateOrdinal ProblemType = "duplicate_ordinal"
+)
+
+// ProblemTypes is the set of all ProblemType values.
+var ProblemTypes = []ProblemType{Missing, Unexpected, Mismatch, DuplicateOrdinal}
+
+// Problem is a single discrepancy between a Manifest and the devices that are
+// actually present.
+type Problem struct {
+	// Type is the type of problem.
+	Type ProblemType
+
+	// Expected is the expected device that the problem applies to. It is nil
+	// for Unexpected and DuplicateOrdinal problems.
+	Expected *ExpectedDevice
+	// DeviceIDs are the IDs of the present devices that the problem applies to.
+	DeviceIDs []string
+
+	// Field, for Mismatch problems, is the name of the mismatched field.
+	Field string
+	// Want and Got, for Mismatch problems, are the expected and actual values.
+	Want, Got interface{}
+}
+
+func (p *Problem) String() string {
+	switch p.Type {
+	case Missing:
+		return fmt.Sprintf("missing device %s", p.Expected)
+	case Unexpected:
+		return fmt.Sprintf("unexpected device %s", p.DeviceIDs[0])
+	case Mismatch:
+		return fmt.Sprintf("device %s (%s) has %s %s, expected %s",
+			p.Expected, p.DeviceIDs[0], p.Field, formatValue(p.Got), formatValue(p.Want))
+	case DuplicateOrdinal:
+		return fmt.Sprintf("devices %v share ordinal %s", p.DeviceIDs, formatValue(p.Got))
+	default:
+		return string(p.Type)
+	}
+}
+
+// formatValue formats a Problem value for display.
+func formatValue(v interface{}) string {
+	if ord, ok := v.(device.Ordinal); ok {
+		return ord.String()
+	}
+	return fmt.Sprint(v)
+}
+
+// key returns a string that uniquely identifies this problem within a Report.
+func (p *Problem) key() string {
+	var expected string
+	if p.Expected != nil {
+		expected = p.Expected.String()
+	}
+	return fmt.Sprintf("%s|%s|%v|%s|%v", p.Type, expected, p.DeviceIDs, p.Field, p.Got)
+}
+
+// Report is the result of checking a Manifest.
+type Report struct {
+	// Time is the time when the check was performed.
+	Time time.Time
+
+	// Expected is the number of devices in the Manifest.
+	Expected int
+	// Present is the number of expected devices that are present.
+	Present int
+
+	// Problems are the problems that were identified.
+	Problems []*Problem
+}
+
+// OK returns true if the Report has no problems.
+func (r *Report) OK() bool { return len(r.Problems) == 0 }
+
+// Count returns the number of problems of type t in the Report.
+func (r *Report) Count(t ProblemType) int {
+	count := 0
+	for _, p := range r.Problems {
+		if p.Type == t {
+			count++
+		}
+	}
+	return count
+}
+
+// Check compares devices against the Manifest, returning a Report. Devices
+// that are Done are ignored.
+func (m *Manifest) Check(devices []device.D) *Report {
+	r := Report{
+		Time:     time.Now(),
+		Expected: len(m.Devices),
+	}
+
+	// Index our devices, in ID order for determinism.
+	devices = append([]device.D(nil), devices...)
+	sort.Slice(devices, func(i, j int) bool { return devices[i].ID() < devices[j].ID() })
+
+	byID := make(map[string]device.D, len(devices))
+	byOrdinal := make(map[device.Ordinal][]device.D, len(devices))
+	var ordinals []device.Ordinal
+	for _, d := range devices {
+		if device.IsDone(d) {
+			continue
+		}
+		byID[d.ID()] = d
+
+		if ord := d.Ordinal(); ord.IsValid() {
+			if _, ok := byOrdinal[ord]; !ok {
+				ordinals = append(ordinals, ord)
+			}
+			byOrdinal[ord] = append(byOrdinal[ord], d)
+		}
+	}
+
+	// Match each expected device. Devices expected by ID are matched first, so
+	// that a device expected by ID can't also satisfy an entry expected by
+	// ordinal.
+	matched := make(map[device.D]struct{}, len(devices))
+	resolved := make([]device.D, len(m.Devices))
+	for i, ed := range m.Devices {
+		if ed.ID == "" {
+			continue
+		}
+		if d := byID[ed.ID]; d != nil {
+			resolved[i] = d
+			matched[d] = struct{}{}
+		}
+	}
+	for i, ed := range m.Devices {
+		if ed.ID != "" {
+			continue
+		}
+		for _, d := range byOrdinal[*ed.Ordinal] {
+			if _, ok := matched[d]; !ok {
+				resolved[i] = d
+				matched[d] = struct{}{}
+				break
+			}
+		}
+	}
+
+	for i, ed := range m.Devices {
+		d := resolved[i]
+		if d == nil {
+			r.Problems = append(r.Problems, &Problem{Type: Missing, Expected: ed})
+			continue
+		}
+
+		r.Present++
+		r.Problems = append(r.Problems, ed.check(d)...)
+	}
+
+	// Identify unexpected devices.
+	if !m.AllowUnexpected {
+		for _, d := range devices {
+			if _, ok := byID[d.ID()]; !ok {
+				continue
+			}
+			if _, ok := matched[d]; !ok {
+				r.Problems = append(r.Problems, &Problem{Type: Unexpected, DeviceIDs: []string{d.ID()}})
+			}
+		}
+	}
+
+	// Identify duplicate ordinals.
+	for _, ord := range ordinals {
+		if dups := byOrdinal[ord]; len(dups) > 1 {
+			ids := make([]string, len(dups))
+			for i, d := range dups {
+				ids[i] = d.ID()
+			}
+			r.Problems = append(r.Problems, &Problem{Type: DuplicateOrdinal, DeviceIDs: ids, Got: ord})
+		}
+	}
+
+	return &r
+}
+
+// check returns any Mismatch problems between ed and d.
+func (ed *ExpectedDevice) check(d device.D) []*Problem {
+	var problems []*Problem
+	mismatch := func(field string, want, got interface{}) {
+		problems = append(problems, &Problem{
+			Type:      Mismatch,
+			Expected:  ed,
+			DeviceIDs: []string{d.ID()},
+			Field:     field,
+			Want:      want,
+			Got:       got,
+		})
+	}
+
+	if ed.ID != "" && ed.Ordinal != nil {
+		if ord := d.Ordinal(); ord != *ed.Ordinal {
+			mismatch("Ordinal", *ed.Ordinal, ord)
+		}
+	}
+
+	dh := d.DiscoveryHeaders()
+	if dh == nil {
+		return problems
+	}
+
+	if ed.NumStrips != nil {
+		if v := dh.NumStrips(); v != *ed.NumStrips {
+			mismatch("NumStrips", *ed.NumStrips, v)
+		}
+	}
+	if ed.SoftwareRevision != nil {
+		if v := int(dh.SoftwareRevision); v != *ed.SoftwareRevision {
+			mismatch("SoftwareRevision", *ed.SoftwareRevision, v)
+		}
+	}
+
+	if pp := dh.PixelPusher; pp != nil {
+		if ed.PixelsPerStrip != nil {
+			if v := int(pp.PixelsPerStrip); v != *ed.PixelsPerStrip {
+				mismatch("PixelsPerStrip", *ed.PixelsPerStrip, v)
+			}
+		}
+		if len(ed.StripFlags) > 0 && !pixelpusher.StripFlagsEqual(ed.StripFlags, pp.StripFlags) {
+			mismatch("StripFlags", ed.StripFlags, append([]pixelpusher.StripFlags(nil), pp.StripFlags...))
+		}
+	}
+
+	return problems
+}
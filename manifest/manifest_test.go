@@ -0,0 +1,225 @@
+// Copyright 2018 Dan Jacques. All rights reserved.
+// Use of this source code is governed under the MIT License
+// that can be found in the LICENSE file.
+
+package manifest
+
+import (
+	"context"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/danjacques/gopushpixels/device"
+	"github.com/danjacques/gopushpixels/discovery"
+	"github.com/danjacques/gopushpixels/protocol"
+	"github.com/danjacques/gopushpixels/protocol/pixelpusher"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+// makeHeaders returns discovery headers for a test device.
+func makeHeaders(mac byte, group, controller int32, pixelsPerStrip uint16) *protocol.DiscoveryHeaders {
+	dh := protocol.DiscoveryHeaders{
+		DeviceHeader: protocol.DeviceHeader{
+			MacAddress:       [6]byte{0xd8, 0x80, 0x39, 0x00, 0x00, mac},
+			DeviceType:       protocol.PixelPusherDeviceType,
+			SoftwareRevision: pixelpusher.LatestSoftwareRevision,
+		},
+		PixelPusher: &pixelpusher.Device{
+			DeviceHeader: pixelpusher.DeviceHeader{
+				StripsAttached:    2,
+				PixelsPerStrip:    pixelsPerStrip,
+				GroupOrdinal:      group,
+				ControllerOrdinal: controller,
+			},
+			DeviceHeaderExt109: pixelpusher.DeviceHeaderExt109{
+				StripFlags: []pixelpusher.StripFlags{0, 0},
+			},
+		},
+	}
+	dh.SetIP4Address(net.IPv4(127, 0, 0, 1))
+	return &dh
+}
+
+var _ = Describe("Manifest", func() {
+	intPtr := func(v int) *int { return &v }
+
+	Context("loading", func() {
+		It("can load a valid manifest", func() {
+			m, err := Load(strings.NewReader(`{
+				"devices": [
+					{"name": "left", "id": "d8:80:39:00:00:01", "strips": 2, "pixels_per_strip": 100},
+					{"ordinal": {"group": 1, "controller": 2}, "strip_flags": [0, 1], "software_revision": 122}
+				]
+			}`))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(m.Devices).To(HaveLen(2))
+			Expect(m.Devices[0].String()).To(Equal("left"))
+			Expect(*m.Devices[1].Ordinal).To(Equal(device.Ordinal{Group: 1, Controller: 2}))
+			Expect(m.Devices[1].StripFlags).To(Equal([]pixelpusher.StripFlags{0, 1}))
+		})
+
+		for _, tc := range []struct {
+			name string
+			json string
+		}{
+			{"an unidentified device", `{"devices": [{"strips": 2}]}`},
+			{"a duplicate ID", `{"devices": [{"id": "a"}, {"id": "a"}]}`},
+			{"a duplicate ordinal", `{"devices": [{"ordinal": {"group": 1}}, {"ordinal": {"group": 1}}]}`},
+			{"an invalid ordinal", `{"devices": [{"ordinal": {"group": -1}}]}`},
+			{"an unknown field", `{"devices": [{"id": "a", "bogus": 1}]}`},
+		} {
+			tc := tc
+			It("rejects "+tc.name, func() {
+				_, err := Load(strings.NewReader(tc.json))
+				Expect(err).To(HaveOccurred())
+			})
+		}
+	})
+
+	Context("checking devices", func() {
+		var devices []device.D
+		BeforeEach(func() {
+			devices = []device.D{
+				device.MakeRemote("d8:80:39:00:00:01", makeHeaders(1, 1, 1, 100)),
+				device.MakeRemote("d8:80:39:00:00:02", makeHeaders(2, 1, 2, 50)),
+				device.MakeRemote("d8:80:39:00:00:03", makeHeaders(3, 1, 2, 100)),
+			}
+		})
+		AfterEach(func() {
+			for _, d := range devices {
+				d.(*device.Remote).MarkDone()
+			}
+		})
+
+		It("reports no problems when everything matches", func() {
+			m := Manifest{
+				Devices: []*ExpectedDevice{
+					{ID: "d8:80:39:00:00:01", PixelsPerStrip: intPtr(100), NumStrips: intPtr(2)},
+				},
+				AllowUnexpected: true,
+			}
+			r := m.Check(devices[:1])
+			Expect(r.OK()).To(BeTrue())
+			Expect(r.Present).To(Equal(1))
+		})
+
+		It("reports missing, unexpected, mismatched, and duplicate devices", func() {
+			m := Manifest{
+				Devices: []*ExpectedDevice{
+					{ID: "d8:80:39:00:00:01", Ordinal: &device.Ordinal{Group: 1, Controller: 9}},
+					{Ordinal: &device.Ordinal{Group: 1, Controller: 2}, PixelsPerStrip: intPtr(100)},
+					{Name: "gone", ID: "d8:80:39:00:00:99"},
+				},
+			}
+
+			r := m.Check(devices)
+			Expect(r.Expected).To(Equal(3))
+			Expect(r.Present).To(Equal(2))
+			Expect(r.Count(Missing)).To(Equal(1))
+			Expect(r.Count(Unexpected)).To(Equal(1))
+			Expect(r.Count(Mismatch)).To(Equal(2))
+			Expect(r.Count(DuplicateOrdinal)).To(Equal(1))
+
+			var strs []string
+			for _, p := range r.Problems {
+				strs = append(strs, p.String())
+			}
+			Expect(strs).To(ConsistOf(
+				"device d8:80:39:00:00:01 (d8:80:39:00:00:01) has Ordinal {Grp=1, Cont=1}, expected {Grp=1, Cont=9}",
+				"device {Grp=1, Cont=2} (d8:80:39:00:00:02) has PixelsPerStrip 50, expected 100",
+				"missing device gone",
+				"unexpected device d8:80:39:00:00:03",
+				"devices [d8:80:39:00:00:02 d8:80:39:00:00:03] share ordinal {Grp=1, Cont=2}",
+			))
+		})
+
+		It("does not match a device expected by ID to an ordinal entry", func() {
+			m := Manifest{
+				Devices: []*ExpectedDevice{
+					{Ordinal: &device.Ordinal{Group: 1, Controller: 2}, PixelsPerStrip: intPtr(100)},
+					{ID: "d8:80:39:00:00:02"},
+				},
+				AllowUnexpected: true,
+			}
+
+			By("matching the ordinal entry to another device with that ordinal")
+			r := m.Check(devices)
+			Expect(r.Present).To(Equal(2))
+			Expect(r.Count(Missing)).To(BeZero())
+			Expect(r.Count(Mismatch)).To(BeZero())
+
+			By("reporting the ordinal entry missing when no other device has it")
+			r = m.Check(devices[:2])
+			Expect(r.Present).To(Equal(1))
+			Expect(r.Count(Missing)).To(Equal(1))
+			Expect(r.Problems[0].Expected).To(Equal(m.Devices[0]))
+		})
+	})
+
+	Context("with a Checker", func() {
+		var reg *discovery.Registry
+		var checker *Checker
+		var cancelFunc context.CancelFunc
+		var errC chan error
+		BeforeEach(func() {
+			reg = &discovery.Registry{}
+			checker = &Checker{
+				Manifest: &Manifest{
+					Devices: []*ExpectedDevice{
+						{ID: "d8:80:39:00:00:01", PixelsPerStrip: intPtr(100)},
+					},
+				},
+				Registry: reg,
+			}
+
+			var c context.Context
+			c, cancelFunc = context.WithCancel(context.Background())
+			errC = make(chan error, 1)
+			go func() {
+				errC <- checker.Run(c)
+			}()
+		})
+		AfterEach(func() {
+			cancelFunc()
+			Eventually(errC).Should(Receive())
+			reg.Shutdown()
+		})
+
+		It("reports problems as they are raised and cleared", func() {
+			Eventually(checker.Report).ShouldNot(BeNil())
+
+			c, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			eventC := checker.Watch(c)
+
+			var ev *Event
+			Eventually(eventC).Should(Receive(&ev))
+			Expect(ev.Type).To(Equal(ProblemRaised))
+			Expect(ev.Problem.Type).To(Equal(Missing))
+
+			By("discovering a misconfigured device")
+			reg.Observe(makeHeaders(1, 0, 0, 50))
+			Eventually(eventC).Should(Receive(&ev))
+			Expect(ev.Type).To(Equal(ProblemRaised))
+			Expect(ev.Problem.Type).To(Equal(Mismatch))
+			Eventually(eventC).Should(Receive(&ev))
+			Expect(ev.Type).To(Equal(ProblemCleared))
+			Expect(ev.Problem.Type).To(Equal(Missing))
+
+			By("reconfiguring the device")
+			reg.Observe(makeHeaders(1, 0, 0, 100))
+			Eventually(eventC).Should(Receive(&ev))
+			Expect(ev.Type).To(Equal(ProblemCleared))
+			Expect(ev.Problem.Type).To(Equal(Mismatch))
+			Eventually(func() bool { return checker.Report().OK() }).Should(BeTrue())
+		})
+	})
+})
+
+func TestManifest(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Manifest")
+}
@@ -0,0 +1,44 @@
+// Copyright 2018 Dan Jacques. All rights reserved.
+// Use of this source code is governed under the MIT License
+// that can be found in the LICENSE file.
+
+package manifest
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	expectedDevicesGauge = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "manifest_expected_devices",
+		Help: "Number of devices expected by the manifest.",
+	})
+
+	presentDevicesGauge = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "manifest_present_devices",
+		Help: "Number of expected devices that are present.",
+	})
+
+	problemsGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "manifest_problems",
+		Help: "Number of current manifest problems, by type.",
+	},
+		[]string{"type"})
+)
+
+// RegisterMonitoring registers all of this package's monitoring metrics.
+func RegisterMonitoring(reg prometheus.Registerer) {
+	reg.MustRegister(
+		expectedDevicesGauge,
+		presentDevicesGauge,
+		problemsGauge,
+	)
+}
+
+func updateMetrics(r *Report) {
+	expectedDevicesGauge.Set(float64(r.Expected))
+	presentDevicesGauge.Set(float64(r.Present))
+	for _, t := range ProblemTypes {
+		problemsGauge.With(prometheus.Labels{"type": string(t)}).Set(float64(r.Count(t)))
+	}
+}
@@ -0,0 +1,20 @@
+// Copyright 2018 Dan Jacques. All rights reserved.
+// Use of this source code is governed under the MIT License
+// that can be found in the LICENSE file.
+
+// Package patterns offers standard diagnostic test patterns, useful when
+// commissioning an installation.
+//
+// A Pattern renders frames onto a device.Mutable. A Runner drives a Pattern
+// across every device in a set of groups in a device.Registry, sending each
+// frame through the devices' Senders.
+//
+// The following patterns are available:
+//   - StripIdentify, which colors each strip with a distinct color.
+//   - BinaryCounter, which blinks each pixel's index in binary.
+//   - Chase, which moves a single lit pixel along each strip.
+//   - ChannelWalk, which lights each color channel in turn.
+//   - BurnIn, which lights every channel of every pixel at full intensity.
+//   - Gradient, which ramps from black to a color along each strip.
+//   - Blink, which blinks a single device, identified by ID.
+package patterns
@@ -0,0 +1,243 @@
+// Copyright 2018 Dan Jacques. All rights reserved.
+// Use of this source code is governed under the MIT License
+// that can be found in the LICENSE file.
+
+package patterns
+
+import (
+	"github.com/danjacques/gopushpixels/device"
+	"github.com/danjacques/gopushpixels/pixel"
+	"github.com/danjacques/gopushpixels/protocol/pixelpusher"
+)
+
+// Target is a single device that a Pattern renders onto.
+type Target struct {
+	// Device is the target device.
+	Device device.D
+	// Mutable is the target device's pixel state, which the Pattern updates.
+	Mutable *device.Mutable
+}
+
+// stripFlags returns the flags of the specified strip on the target device.
+func (t *Target) stripFlags(strip int) pixelpusher.StripFlags {
+	dh := t.Device.DiscoveryHeaders()
+	if dh == nil || dh.PixelPusher == nil || strip >= len(dh.PixelPusher.StripFlags) {
+		return 0
+	}
+	return dh.PixelPusher.StripFlags[strip]
+}
+
+// fill sets every pixel on every strip of t to the value returned by fn.
+func (t *Target) fill(fn func(strip, i int) pixel.P) {
+	m := t.Mutable
+	for s := 0; s < m.NumStrips(); s++ {
+		for i := 0; i < m.PixelsPerStrip(); i++ {
+			m.SetPixel(s, i, fn(s, i))
+		}
+	}
+}
+
+// Pattern is a test pattern.
+type Pattern interface {
+	// Render renders the specified frame of the pattern onto t.
+	//
+	// Frames begin at zero and increase by one for each rendered frame.
+	Render(t *Target, frame int)
+}
+
+// PatternFunc is a Pattern implemented as a function.
+type PatternFunc func(t *Target, frame int)
+
+// Render implements Pattern.
+func (fn PatternFunc) Render(t *Target, frame int) { fn(t, frame) }
+
+var (
+	black = pixel.P{}
+	white = pixel.P{Red: 0xFF, Green: 0xFF, Blue: 0xFF}
+)
+
+// IdentifyColors is the palette used by StripIdentify. Strip N is colored
+// IdentifyColors[N % len(IdentifyColors)].
+var IdentifyColors = []pixel.P{
+	{Red: 0xFF},
+	{Green: 0xFF},
+	{Blue: 0xFF},
+	{Red: 0xFF, Green: 0xFF},
+	{Green: 0xFF, Blue: 0xFF},
+	{Red: 0xFF, Blue: 0xFF},
+	{Red: 0xFF, Green: 0x80},
+	white,
+}
+
+// StripIdentify colors each strip with a distinct color from IdentifyColors.
+//
+// The first pixel of each strip is left black, so that strip boundaries are
+// visible when strips are chained.
+var StripIdentify Pattern = PatternFunc(func(t *Target, frame int) {
+	t.fill(func(strip, i int) pixel.P {
+		if i == 0 {
+			return black
+		}
+		return IdentifyColors[strip%len(IdentifyColors)]
+	})
+})
+
+// BinaryCounter blinks each pixel's index in binary, one bit per frame, least
+// significant bit first. A pixel is white if the bit is set, and black if it
+// is not. After the last bit, a single blue frame marks the start of the next
+// sequence.
+//
+// This can be used to map pixel positions from a video recording.
+var BinaryCounter Pattern = PatternFunc(func(t *Target, frame int) {
+	bits := 1
+	for (1 << uint(bits)) < t.Mutable.PixelsPerStrip() {
+		bits++
+	}
+
+	bit := frame % (bits + 1)
+	t.fill(func(strip, i int) pixel.P {
+		switch {
+		case bit == bits:
+			return pixel.P{Blue: 0xFF}
+		case i&(1<<uint(bit)) != 0:
+			return white
+		default:
+			return black
+		}
+	})
+})
+
+// Chase moves a single lit pixel along every strip, one pixel per frame.
+type Chase struct {
+	// Color is the color of the lit pixel. If zero, white will be used.
+	Color pixel.P
+}
+
+// Render implements Pattern.
+func (ch *Chase) Render(t *Target, frame int) {
+	color := ch.Color
+	if color == black {
+		color = white
+	}
+
+	pos := 0
+	if pps := t.Mutable.PixelsPerStrip(); pps > 0 {
+		pos = frame % pps
+	}
+	t.fill(func(strip, i int) pixel.P {
+		if i == pos {
+			return color
+		}
+		return black
+	})
+}
+
+// ChannelWalk lights every pixel with a single color channel at a time,
+// advancing to the next channel each frame: red, green, blue, and, for RGBOW
+// strips, orange and white.
+var ChannelWalk Pattern = PatternFunc(func(t *Target, frame int) {
+	t.fill(func(strip, i int) pixel.P {
+		channels := 3
+		if t.stripFlags(strip)&pixelpusher.SFlagRGBOW != 0 {
+			channels = 5
+		}
+
+		var p pixel.P
+		switch frame % channels {
+		case 0:
+			p.Red = 0xFF
+		case 1:
+			p.Green = 0xFF
+		case 2:
+			p.Blue = 0xFF
+		case 3:
+			p.Orange = 0xFF
+		case 4:
+			p.White = 0xFF
+		}
+		return p
+	})
+})
+
+// BurnIn lights every channel of every pixel at full intensity.
+//
+// This draws maximum power, and can be used to test power supplies and
+// identify failing pixels.
+var BurnIn Pattern = PatternFunc(func(t *Target, frame int) {
+	t.fill(func(strip, i int) pixel.P {
+		if t.stripFlags(strip)&pixelpusher.SFlagRGBOW != 0 {
+			return pixel.P{Red: 0xFF, Green: 0xFF, Blue: 0xFF, Orange: 0xFF, White: 0xFF}
+		}
+		return white
+	})
+})
+
+// Gradient ramps from black at the first pixel of each strip to Color at the
+// last.
+type Gradient struct {
+	// Color is the color at the end of the ramp. If zero, white will be used.
+	Color pixel.P
+	// Scroll, if true, scrolls the ramp along the strip by one pixel per frame.
+	Scroll bool
+}
+
+// Render implements Pattern.
+func (g *Gradient) Render(t *Target, frame int) {
+	color := g.Color
+	if color == black {
+		color = white
+	}
+
+	pps := t.Mutable.PixelsPerStrip()
+	t.fill(func(strip, i int) pixel.P {
+		if g.Scroll {
+			i = (i + frame) % pps
+		}
+		return scale(color, i, pps-1)
+	})
+}
+
+// Blink blinks every pixel of a single device, identified by ID. All other
+// devices are black.
+type Blink struct {
+	// ID is the ID of the device to blink.
+	ID string
+	// Color is the blink color. If zero, white will be used.
+	Color pixel.P
+	// Frames is the number of frames that the device is on, and then off. If
+	// <= 0, the device will alternate every frame.
+	Frames int
+}
+
+// Render implements Pattern.
+func (b *Blink) Render(t *Target, frame int) {
+	color := b.Color
+	if color == black {
+		color = white
+	}
+
+	frames := b.Frames
+	if frames <= 0 {
+		frames = 1
+	}
+	if t.Device.ID() != b.ID || (frame/frames)%2 != 0 {
+		color = black
+	}
+
+	t.fill(func(strip, i int) pixel.P { return color })
+}
+
+// scale scales each channel of p by num/denom.
+func scale(p pixel.P, num, denom int) pixel.P {
+	if denom <= 0 {
+		return p
+	}
+	sc := func(v uint8) uint8 { return uint8(int(v) * num / denom) }
+	return pixel.P{
+		Red:    sc(p.Red),
+		Green:  sc(p.Green),
+		Blue:   sc(p.Blue),
+		Orange: sc(p.Orange),
+		White:  sc(p.White),
+	}
+}
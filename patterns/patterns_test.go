@@ -0,0 +1,229 @@
+// Copyright 2018 Dan Jacques. All rights reserved.
+// Use of this source code is governed under the MIT License
+// that can be found in the LICENSE file.
+
+package patterns
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+
+	"github.com/danjacques/gopushpixels/device"
+	"github.com/danjacques/gopushpixels/pixel"
+	"github.com/danjacques/gopushpixels/protocol"
+	"github.com/danjacques/gopushpixels/protocol/pixelpusher"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+// testDevice is a device.D that records the pixel state that is sent to it.
+type testDevice struct {
+	device.D
+
+	id      string
+	ordinal device.Ordinal
+	dh      protocol.DiscoveryHeaders
+	doneC   chan struct{}
+
+	mu    sync.Mutex
+	state device.Mutable
+	sends int
+}
+
+func makeTestDevice(id string, group int, flags ...pixelpusher.StripFlags) *testDevice {
+	td := testDevice{
+		id:      id,
+		ordinal: device.Ordinal{Group: group, Controller: 1},
+		dh: protocol.DiscoveryHeaders{
+			DeviceHeader: protocol.DeviceHeader{DeviceType: protocol.PixelPusherDeviceType},
+			PixelPusher: &pixelpusher.Device{
+				DeviceHeader: pixelpusher.DeviceHeader{
+					StripsAttached: uint8(len(flags)),
+					PixelsPerStrip: 4,
+					GroupOrdinal:   int32(group),
+				},
+				DeviceHeaderExt109: pixelpusher.DeviceHeaderExt109{StripFlags: flags},
+			},
+		},
+		doneC: make(chan struct{}),
+	}
+	td.state.Initialize(&td.dh)
+	return &td
+}
+
+func (td *testDevice) ID() string                                   { return td.id }
+func (td *testDevice) Ordinal() device.Ordinal                      { return td.ordinal }
+func (td *testDevice) DiscoveryHeaders() *protocol.DiscoveryHeaders { return &td.dh }
+func (td *testDevice) DoneC() <-chan struct{}                       { return td.doneC }
+func (td *testDevice) Addr() net.Addr                               { return nil }
+func (td *testDevice) Sender() (device.Sender, error)               { return &testSender{td: td}, nil }
+
+func (td *testDevice) pixel(strip, i int) pixel.P {
+	td.mu.Lock()
+	defer td.mu.Unlock()
+	return td.state.GetPixel(strip, i)
+}
+
+func (td *testDevice) numSends() int {
+	td.mu.Lock()
+	defer td.mu.Unlock()
+	return td.sends
+}
+
+type testSender struct {
+	device.Sender
+	td *testDevice
+}
+
+func (ts *testSender) SendPacket(pkt *protocol.Packet) error {
+	ts.td.mu.Lock()
+	defer ts.td.mu.Unlock()
+
+	for _, ss := range pkt.PixelPusher.StripStates {
+		ts.td.state.SetPixels(int(ss.StripNumber), &ss.Pixels)
+	}
+	ts.td.sends++
+	return nil
+}
+
+func (ts *testSender) Close() error { return nil }
+
+var _ = Describe("Patterns", func() {
+	var d *testDevice
+	var t *Target
+	BeforeEach(func() {
+		d = makeTestDevice("foo", 1, 0, pixelpusher.SFlagRGBOW)
+		t = &Target{Device: d, Mutable: &device.Mutable{}}
+		t.Mutable.Initialize(d.DiscoveryHeaders())
+	})
+
+	render := func(p Pattern, frame int) []pixel.P {
+		p.Render(t, frame)
+		var pixels []pixel.P
+		for i := 0; i < t.Mutable.PixelsPerStrip(); i++ {
+			pixels = append(pixels, t.Mutable.GetPixel(0, i))
+		}
+		return pixels
+	}
+
+	It("StripIdentify colors each strip", func() {
+		Expect(render(StripIdentify, 0)).To(Equal([]pixel.P{black, IdentifyColors[0], IdentifyColors[0], IdentifyColors[0]}))
+		Expect(t.Mutable.GetPixel(1, 1)).To(Equal(IdentifyColors[1]))
+	})
+
+	It("BinaryCounter blinks pixel indexes", func() {
+		Expect(render(BinaryCounter, 0)).To(Equal([]pixel.P{black, white, black, white}))
+		Expect(render(BinaryCounter, 1)).To(Equal([]pixel.P{black, black, white, white}))
+		blue := pixel.P{Blue: 0xFF}
+		Expect(render(BinaryCounter, 2)).To(Equal([]pixel.P{blue, blue, blue, blue}))
+		Expect(render(BinaryCounter, 3)).To(Equal([]pixel.P{black, white, black, white}))
+	})
+
+	It("Chase moves a single pixel", func() {
+		red := pixel.P{Red: 0xFF}
+		Expect(render(&Chase{Color: red}, 1)).To(Equal([]pixel.P{black, red, black, black}))
+		Expect(render(&Chase{}, 6)).To(Equal([]pixel.P{black, black, white, black}))
+	})
+
+	It("ChannelWalk walks each strip's channels", func() {
+		render(ChannelWalk, 3)
+		Expect(t.Mutable.GetPixel(0, 0)).To(Equal(pixel.P{Red: 0xFF}))
+		Expect(t.Mutable.GetPixel(1, 0)).To(Equal(pixel.P{Orange: 0xFF}))
+
+		render(ChannelWalk, 4)
+		Expect(t.Mutable.GetPixel(0, 0)).To(Equal(pixel.P{Green: 0xFF}))
+		Expect(t.Mutable.GetPixel(1, 0)).To(Equal(pixel.P{White: 0xFF}))
+	})
+
+	It("BurnIn lights every channel", func() {
+		full := pixel.P{Red: 0xFF, Green: 0xFF, Blue: 0xFF, Orange: 0xFF, White: 0xFF}
+		render(BurnIn, 0)
+		Expect(t.Mutable.GetPixel(1, 3)).To(Equal(full))
+	})
+
+	It("Gradient ramps along each strip", func() {
+		ramp := []pixel.P{{}, {Red: 0x55}, {Red: 0xAA}, {Red: 0xFF}}
+		Expect(render(&Gradient{Color: pixel.P{Red: 0xFF}}, 0)).To(Equal(ramp))
+		Expect(render(&Gradient{Color: pixel.P{Red: 0xFF}, Scroll: true}, 1)).To(Equal(
+			[]pixel.P{ramp[1], ramp[2], ramp[3], ramp[0]}))
+	})
+
+	It("Blink blinks only the identified device", func() {
+		all := func(p pixel.P) []pixel.P { return []pixel.P{p, p, p, p} }
+		b := Blink{ID: "foo", Frames: 2}
+		Expect(render(&b, 1)).To(Equal(all(white)))
+		Expect(render(&b, 2)).To(Equal(all(black)))
+
+		b.ID = "bar"
+		Expect(render(&b, 0)).To(Equal(all(black)))
+	})
+})
+
+var _ = Describe("Runner", func() {
+	var reg *device.Registry
+	var d1, d2 *testDevice
+	BeforeEach(func() {
+		reg = &device.Registry{}
+		d1 = makeTestDevice("d1", 1, 0)
+		d2 = makeTestDevice("d2", 2, 0)
+		reg.Add(d1)
+		reg.Add(d2)
+	})
+	AfterEach(func() {
+		close(d1.doneC)
+		close(d2.doneC)
+	})
+
+	It("renders to all groups by default", func() {
+		r := Runner{Registry: reg, Pattern: &Chase{}}
+		defer r.Close()
+
+		Expect(r.Step()).To(Succeed())
+		Expect(d1.pixel(0, 0)).To(Equal(white))
+		Expect(d2.pixel(0, 0)).To(Equal(white))
+
+		Expect(r.Step()).To(Succeed())
+		Expect(d1.pixel(0, 0)).To(Equal(black))
+		Expect(d2.pixel(0, 1)).To(Equal(white))
+	})
+
+	It("only sends updates", func() {
+		r := Runner{Registry: reg, Pattern: BurnIn}
+		defer r.Close()
+
+		Expect(r.Step()).To(Succeed())
+		Expect(r.Step()).To(Succeed())
+		Expect(d1.numSends()).To(Equal(1))
+	})
+
+	It("can be restricted to specific groups", func() {
+		r := Runner{Registry: reg, Pattern: BurnIn, Groups: []int{2}}
+		defer r.Close()
+
+		Expect(r.Step()).To(Succeed())
+		Expect(d1.numSends()).To(BeZero())
+		Expect(d2.numSends()).To(Equal(1))
+	})
+
+	It("runs until cancelled", func(done Done) {
+		defer close(done)
+
+		c, cancel := context.WithCancel(context.Background())
+		r := Runner{Registry: reg, Pattern: &Chase{}, FrameInterval: 1}
+
+		errC := make(chan error)
+		go func() { errC <- r.Run(c) }()
+		Eventually(d1.numSends).Should(BeNumerically(">", 2))
+
+		cancel()
+		Expect(<-errC).To(Equal(context.Canceled))
+	}, 5)
+})
+
+func TestPatterns(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Patterns")
+}
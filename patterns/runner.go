@@ -0,0 +1,186 @@
+// Copyright 2018 Dan Jacques. All rights reserved.
+// Use of this source code is governed under the MIT License
+// that can be found in the LICENSE file.
+
+package patterns
+
+import (
+	"context"
+	"time"
+
+	"github.com/danjacques/gopushpixels/device"
+	"github.com/danjacques/gopushpixels/support/logging"
+
+	"github.com/pkg/errors"
+)
+
+// DefaultFrameInterval is the default interval between a Runner's frames.
+const DefaultFrameInterval = 100 * time.Millisecond
+
+// Runner renders a Pattern to every device in a set of groups.
+//
+// Devices are enumerated through the Registry's AllGroups on each frame, so
+// devices that are added or removed while a Runner is running are picked up
+// or dropped.
+//
+// A Runner is not safe for concurrent use.
+type Runner struct {
+	// Registry is the registry of devices to render to. It must not be nil.
+	Registry *device.Registry
+	// Pattern is the pattern to render. It must not be nil.
+	Pattern Pattern
+
+	// Groups, if not empty, restricts the Runner to devices in these groups.
+	// If empty, devices in all groups will be rendered to.
+	Groups []int
+
+	// FrameInterval is the interval between frames. If <= 0,
+	// DefaultFrameInterval will be used.
+	FrameInterval time.Duration
+
+	// Logger, if not nil, is the logger to use.
+	Logger logging.L
+
+	// frame is the next frame to render.
+	frame int
+	// targets is the state of each device that has been rendered to.
+	targets map[device.D]*runnerTarget
+}
+
+// runnerTarget is the Runner's state for a single device.
+type runnerTarget struct {
+	Target
+	sender device.Sender
+}
+
+// Run renders frames until c is cancelled.
+//
+// Errors sending to individual devices are logged, and do not stop the
+// Runner.
+func (r *Runner) Run(c context.Context) error {
+	defer r.Close()
+
+	interval := r.FrameInterval
+	if interval <= 0 {
+		interval = DefaultFrameInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if err := r.Step(); err != nil {
+			r.logger().Warnf("Failed to render pattern frame: %s", err)
+		}
+
+		select {
+		case <-c.Done():
+			return c.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// Step renders the next frame to each device, and sends any resulting
+// updates.
+//
+// If any device could not be sent to, the remaining devices are still sent
+// to, and the first error is returned.
+func (r *Runner) Step() error {
+	frame := r.frame
+	r.frame++
+
+	var err error
+	seen := make(map[device.D]struct{}, len(r.targets))
+	for _, d := range r.devices() {
+		seen[d] = struct{}{}
+
+		t, terr := r.getTarget(d)
+		if terr != nil {
+			if err == nil {
+				err = terr
+			}
+			continue
+		}
+
+		r.Pattern.Render(&t.Target, frame)
+		if pkt := t.Mutable.SyncPacket(); pkt != nil {
+			if serr := t.sender.SendPacket(pkt); serr != nil && err == nil {
+				err = errors.Wrapf(serr, "failed to send to %s", d.ID())
+			}
+		}
+	}
+
+	// Release devices that are no longer present.
+	for d, t := range r.targets {
+		if _, ok := seen[d]; !ok {
+			_ = t.sender.Close()
+			delete(r.targets, d)
+		}
+	}
+	return err
+}
+
+// Close releases the Runner's device Senders.
+func (r *Runner) Close() error {
+	var err error
+	for d, t := range r.targets {
+		if cerr := t.sender.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+		delete(r.targets, d)
+	}
+	return err
+}
+
+// devices returns the devices in the Runner's groups.
+func (r *Runner) devices() []device.D {
+	groups := r.Registry.AllGroups()
+	if len(r.Groups) == 0 {
+		var devices []device.D
+		for _, g := range groups {
+			devices = append(devices, g...)
+		}
+		return devices
+	}
+
+	var devices []device.D
+	for _, group := range r.Groups {
+		devices = append(devices, groups[group]...)
+	}
+	return devices
+}
+
+func (r *Runner) getTarget(d device.D) (*runnerTarget, error) {
+	dh := d.DiscoveryHeaders()
+	if dh == nil {
+		return nil, errors.Errorf("device %s has no discovery headers", d.ID())
+	}
+
+	if t := r.targets[d]; t != nil {
+		// Track any layout changes.
+		t.Mutable.Initialize(dh)
+		return t, nil
+	}
+
+	sender, err := d.Sender()
+	if err != nil {
+		return nil, errors.Wrapf(err, "could not create Sender for %s", d.ID())
+	}
+
+	t := runnerTarget{
+		Target: Target{
+			Device:  d,
+			Mutable: &device.Mutable{},
+		},
+		sender: sender,
+	}
+	t.Mutable.Initialize(dh)
+
+	if r.targets == nil {
+		r.targets = make(map[device.D]*runnerTarget)
+	}
+	r.targets[d] = &t
+	return &t, nil
+}
+
+func (r *Runner) logger() logging.L { return logging.Must(r.Logger) }
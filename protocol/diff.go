@@ -0,0 +1,95 @@
+// Copyright 2018 Dan Jacques. All rights reserved.
+// Use of this source code is governed under the MIT License
+// that can be found in the LICENSE file.
+
+package protocol
+
+import (
+	"fmt"
+
+	"github.com/danjacques/gopushpixels/protocol/pixelpusher"
+)
+
+// HeaderChange describes a single field that differs between two sets of
+// DiscoveryHeaders.
+type HeaderChange struct {
+	// Field is the name of the field that changed (e.g., "GroupOrdinal").
+	Field string
+	// Old is the field's previous value.
+	Old interface{}
+	// New is the field's new value.
+	New interface{}
+}
+
+func (hc *HeaderChange) String() string {
+	return fmt.Sprintf("%s: %v => %v", hc.Field, hc.Old, hc.New)
+}
+
+// DiffDiscoveryHeaders returns the set of fields that differ between old and
+// new.
+//
+// Volatile fields, which change during the normal operation of a device, are
+// ignored. These are the PixelPusher's UpdatePeriod, PowerTotal, and
+// DeltaSequence fields. However, a PixelPusher resets its DeltaSequence when it
+// restarts, so a decrease in DeltaSequence is reported.
+//
+// If old or new is nil, DiffDiscoveryHeaders returns nil.
+func DiffDiscoveryHeaders(old, new *DiscoveryHeaders) []HeaderChange {
+	if old == nil || new == nil {
+		return nil
+	}
+
+	var changes []HeaderChange
+	diff := func(field string, o, n interface{}) {
+		if o != n {
+			changes = append(changes, HeaderChange{Field: field, Old: o, New: n})
+		}
+	}
+
+	if old.MacAddress != new.MacAddress {
+		diff("MacAddress", old.HardwareAddr().String(), new.HardwareAddr().String())
+	}
+	if old.IPAddress != new.IPAddress {
+		diff("IPAddress", old.IP4Address().String(), new.IP4Address().String())
+	}
+	diff("DeviceType", old.DeviceType, new.DeviceType)
+	diff("ProtocolVersion", old.ProtocolVersion, new.ProtocolVersion)
+	diff("VendorID", old.VendorID, new.VendorID)
+	diff("ProductID", old.ProductID, new.ProductID)
+	diff("HardwareRevision", old.HardwareRevision, new.HardwareRevision)
+	diff("SoftwareRevision", old.SoftwareRevision, new.SoftwareRevision)
+	diff("LinkSpeed", old.LinkSpeed, new.LinkSpeed)
+	diff("Interface", old.Interface, new.Interface)
+
+	opp, npp := old.PixelPusher, new.PixelPusher
+	switch {
+	case opp == nil && npp == nil:
+	case opp == nil || npp == nil:
+		diff("PixelPusher", opp != nil, npp != nil)
+
+	default:
+		diff("StripsAttached", opp.StripsAttached, npp.StripsAttached)
+		diff("MaxStripsPerPacket", opp.MaxStripsPerPacket, npp.MaxStripsPerPacket)
+		diff("PixelsPerStrip", opp.PixelsPerStrip, npp.PixelsPerStrip)
+		diff("ControllerOrdinal", opp.ControllerOrdinal, npp.ControllerOrdinal)
+		diff("GroupOrdinal", opp.GroupOrdinal, npp.GroupOrdinal)
+		diff("ArtNetUniverse", opp.ArtNetUniverse, npp.ArtNetUniverse)
+		diff("ArtNetChannel", opp.ArtNetChannel, npp.ArtNetChannel)
+		diff("MyPort", opp.MyPort, npp.MyPort)
+		if !pixelpusher.StripFlagsEqual(opp.StripFlags, npp.StripFlags) {
+			changes = append(changes, HeaderChange{
+				Field: "StripFlags",
+				Old:   append([]pixelpusher.StripFlags(nil), opp.StripFlags...),
+				New:   append([]pixelpusher.StripFlags(nil), npp.StripFlags...),
+			})
+		}
+		diff("PusherFlags", opp.PusherFlags, npp.PusherFlags)
+		diff("Segments", opp.Segments, npp.Segments)
+		diff("PowerDomain", opp.PowerDomain, npp.PowerDomain)
+		if npp.DeltaSequence < opp.DeltaSequence {
+			diff("DeltaSequence", opp.DeltaSequence, npp.DeltaSequence)
+		}
+	}
+
+	return changes
+}
@@ -118,6 +118,11 @@ type DiscoveryHeaders struct {
 
 	// PixelPusher describes the PixelPusher in detail.
 	PixelPusher *pixelpusher.Device
+
+	// Interface, if not empty, is the name of the local network interface that
+	// the discovery packet was received on. It is not part of the discovery
+	// packet.
+	Interface string
 }
 
 // ParseDiscoveryHeaders parses discovery packet headers from provided byte
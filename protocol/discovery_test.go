@@ -190,6 +190,50 @@ var _ = Describe("PixelPusher Discovery", func() {
 		Expect(ps.PixelPusher.PixelsPerStrip).To(BeEquivalentTo(128))
 		Expect(ps.PixelPusher.FixedSize).To(BeEquivalentTo(0))
 	})
+
+	Context("diffing discovery headers", func() {
+		It("reports no changes for identical headers", func() {
+			Expect(DiffDiscoveryHeaders(&dh, dh.Clone())).To(BeEmpty())
+		})
+
+		It("ignores volatile fields", func() {
+			other := dh.Clone()
+			other.PixelPusher.UpdatePeriod++
+			other.PixelPusher.PowerTotal++
+			other.PixelPusher.DeltaSequence++
+			Expect(DiffDiscoveryHeaders(&dh, other)).To(BeEmpty())
+		})
+
+		It("reports a DeltaSequence reset", func() {
+			dh.PixelPusher.DeltaSequence = 5
+			other := dh.Clone()
+			other.PixelPusher.DeltaSequence = 0
+			Expect(DiffDiscoveryHeaders(&dh, other)).To(Equal([]HeaderChange{
+				{Field: "DeltaSequence", Old: uint32(5), New: uint32(0)},
+			}))
+		})
+
+		It("reports changed fields", func() {
+			other := dh.Clone()
+			other.SetIP4Address(net.ParseIP("10.0.0.2"))
+			other.PixelPusher.GroupOrdinal = 3
+			other.PixelPusher.StripsAttached = 4
+			other.PixelPusher.StripFlags = other.PixelPusher.StripFlags[:4]
+			other.Interface = "eth1"
+
+			Expect(DiffDiscoveryHeaders(&dh, other)).To(Equal([]HeaderChange{
+				{Field: "IPAddress", Old: "10.0.0.1", New: "10.0.0.2"},
+				{Field: "Interface", Old: "", New: "eth1"},
+				{Field: "StripsAttached", Old: uint8(6), New: uint8(4)},
+				{Field: "GroupOrdinal", Old: int32(0x50515253), New: int32(3)},
+				{
+					Field: "StripFlags",
+					Old:   []pixelpusher.StripFlags{0x70, 0x71, 0x72, 0x73, 0x74, 0x75},
+					New:   []pixelpusher.StripFlags{0x70, 0x71, 0x72, 0x73},
+				},
+			}))
+		})
+	})
 })
 
 func TestProtocol(t *testing.T) {
@@ -21,6 +21,16 @@ type Packet struct {
 	PixelPusher *pixelpusher.Packet
 }
 
+// Clone returns a deep copy of pkt, which does not share any pixel data with
+// it.
+func (pkt *Packet) Clone() *Packet {
+	var clone Packet
+	if pkt.PixelPusher != nil {
+		clone.PixelPusher = pkt.PixelPusher.Clone()
+	}
+	return &clone
+}
+
 // PacketReader reads packet structure from a stream.
 //
 // PacketReader is lightweight enough to be created as-needed; however, re-using
@@ -33,6 +33,23 @@ type Packet struct {
 	StripStates []*StripState
 }
 
+// Clone returns a deep copy of p, which does not share any pixel data with it.
+//
+// Commands are treated as immutable, and are shared with the clone.
+func (p *Packet) Clone() *Packet {
+	clone := Packet{
+		ID:      p.ID,
+		Command: p.Command,
+	}
+	if len(p.StripStates) > 0 {
+		clone.StripStates = make([]*StripState, len(p.StripStates))
+		for i, ss := range p.StripStates {
+			clone.StripStates[i] = ss.Clone()
+		}
+	}
+	return &clone
+}
+
 // PacketReader reads packet structure from a stream.
 type PacketReader struct {
 	// PixelsPerStrip is the number of pixels belonging to a given strip.
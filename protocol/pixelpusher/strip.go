@@ -68,6 +68,15 @@ type StripState struct {
 	Pixels pixel.Buffer
 }
 
+// Clone returns a deep copy of ss, which does not share any pixel data with it.
+func (ss *StripState) Clone() *StripState {
+	clone := StripState{
+		StripNumber: ss.StripNumber,
+	}
+	clone.Pixels.CloneFrom(&ss.Pixels)
+	return &clone
+}
+
 // StripFlags represents information about a PixelPusher Strip.
 //
 // TODO: Add other pieces of information from flags.
@@ -108,6 +117,20 @@ func (sf StripFlags) String() string {
 	return fmt.Sprintf("0x%02X", uint8(sf))
 }
 
+// StripFlagsEqual returns true if a and b contain the same strip flags, in the
+// same order.
+func StripFlagsEqual(a, b []StripFlags) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
 func (sf StripFlags) getFlag(flag StripFlags) bool { return (sf & flag) != 0 }
 func (sf *StripFlags) setFlag(flag StripFlags, v bool) {
 	if v {
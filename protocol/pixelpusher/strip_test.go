@@ -58,4 +58,12 @@ var _ = Describe("Strip Flags", func() {
 			})
 		})
 	})
+
+	It("can compare strip flag slices", func() {
+		rgbow := StripFlags(SFlagRGBOW)
+		Expect(StripFlagsEqual(nil, []StripFlags{})).To(BeTrue())
+		Expect(StripFlagsEqual([]StripFlags{0, rgbow}, []StripFlags{0, rgbow})).To(BeTrue())
+		Expect(StripFlagsEqual([]StripFlags{0, rgbow}, []StripFlags{rgbow, 0})).To(BeFalse())
+		Expect(StripFlagsEqual([]StripFlags{0}, []StripFlags{0, 0})).To(BeFalse())
+	})
 })
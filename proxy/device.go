@@ -47,6 +47,20 @@ type Device struct {
 	// baseID is base's cached ID.
 	baseID string
 
+	// transformers are the Transformers to apply to packets forwarded to base.
+	transformers []Transformer
+
+	// sources tracks upstream sources, and arbitrates between them.
+	sources *sourceArbiter
+
+	// mirrorsMu protects mirrors and mirrorsClosed.
+	mirrorsMu sync.RWMutex
+	// mirrors are the running Mirrors that forwarded datagrams are copied to.
+	mirrors []*mirror
+	// mirrorsClosed is true if the device's mirrors have been closed, and no
+	// more can be added.
+	mirrorsClosed bool
+
 	// createdTime is the time when this device was created.
 	createdTime time.Time
 
@@ -115,8 +129,10 @@ func makeProxyDevice(m *Manager, d device.D, hwAddr net.HardwareAddr) (*Device,
 		},
 		proxyHWAddr: hwAddr,
 
-		base:   d,
-		baseID: d.ID(),
+		base:         d,
+		baseID:       d.ID(),
+		transformers: append([]Transformer(nil), m.Transformers...),
+		sources:      makeSourceArbiter(m.MergePolicy, m.SourceTimeout, m.SourcePriority),
 
 		createdTime: time.Now(),
 
@@ -125,17 +141,18 @@ func makeProxyDevice(m *Manager, d device.D, hwAddr net.HardwareAddr) (*Device,
 		listenerPacketsC: make(chan *packetData, chanSize),
 	}
 
-	// Connect our callback and start our local listener.
-	pd.proxy.OnPacketData = pd.onLocalPacketData
-	pd.proxy.Start(conn)
-	conn = nil // Owned by pd.proxy.
-
-	// Generate/cache our metric labels for this device.
+	// Generate/cache our metric labels for this device. This must happen before
+	// our listener starts, since its callback uses them.
 	pd.counterLabels = prometheus.Labels{
 		"proxy_id": pd.proxy.DeviceID,
 		"base_id":  pd.baseID,
 	}
 
+	// Connect our callback and start our local listener.
+	pd.proxy.OnPacketData = pd.onLocalPacketData
+	pd.proxy.Start(conn)
+	conn = nil // Owned by pd.proxy.
+
 	// Watch base and close the proxy when it closes.
 	go pd.closeWhenBaseCloses()
 
@@ -160,6 +177,18 @@ func makeProxyDevice(m *Manager, d device.D, hwAddr net.HardwareAddr) (*Device,
 		pd.forwardPacketsToListeners(basePR)
 	}()
 
+	// Start our initial mirrors.
+	if m.Mirrors != nil {
+		for _, mirror := range m.Mirrors(d) {
+			if err := pd.AddMirror(mirror); err != nil {
+				pd.logger.Warnf("Failed to add mirror %q to proxy device %q: %s", mirror.Name, pd.proxy.DeviceID, err)
+				if mirror.Sender != nil {
+					_ = mirror.Sender.Close()
+				}
+			}
+		}
+	}
+
 	// Update our device monitoring.
 	pd.monitoring.Update(&pd)
 
@@ -229,8 +258,157 @@ func (pd *Device) Info() (i device.Info) {
 // Proxied returns the base device that pd is proxying for.
 func (pd *Device) Proxied() device.D { return pd.base }
 
-// onLocalPacketData is called when pd.Local's callback receives data.
-func (pd *Device) onLocalPacketData(buf *bufferpool.Buffer) {
+// MergePolicy returns the policy that pd uses to arbitrate between upstream
+// sources.
+func (pd *Device) MergePolicy() MergePolicy { return pd.sources.policy }
+
+// Sources returns information about the upstream sources that have recently
+// sent packets to pd, sorted by address.
+func (pd *Device) Sources() []SourceInfo { return pd.sources.sourceInfo(time.Now()) }
+
+// SelectSource selects the upstream source, identified by its "IP:port"
+// address, whose packets are forwarded. An empty addr clears the selection,
+// causing no packets to be forwarded.
+//
+// SelectSource returns an error if pd does not use MergeManual.
+func (pd *Device) SelectSource(addr string) error {
+	if pd.sources.policy != MergeManual {
+		return errors.Errorf("device uses merge policy %q, not %q", pd.sources.policy, MergeManual)
+	}
+
+	key := ""
+	if addr != "" {
+		udpAddr, err := net.ResolveUDPAddr("udp4", addr)
+		if err != nil {
+			return errors.Wrapf(err, "invalid source address %q", addr)
+		}
+		key = udpAddr.String()
+	}
+
+	pd.sources.selectSource(key)
+	pd.logger.Infof("Selected source %q for proxy device %q.", key, pd.proxy.DeviceID)
+	return nil
+}
+
+// AddMirror adds a Mirror to pd. Datagrams that pd forwards to its base device
+// will also be sent to m.
+//
+// pd takes ownership of m's Sender, unless AddMirror returns an error.
+func (pd *Device) AddMirror(m Mirror) error {
+	switch {
+	case m.Name == "":
+		return errors.New("mirror must have a name")
+	case m.Sender == nil:
+		return errors.New("mirror must have a Sender")
+	}
+
+	pd.mirrorsMu.Lock()
+	defer pd.mirrorsMu.Unlock()
+
+	if pd.mirrorsClosed {
+		return errors.New("device is closed")
+	}
+	for _, mr := range pd.mirrors {
+		if mr.Name == m.Name {
+			return errors.Errorf("mirror %q already exists", m.Name)
+		}
+	}
+
+	// Replace our mirrors slice, rather than appending in place, so that
+	// snapshots of it are not modified.
+	mirrors := make([]*mirror, 0, len(pd.mirrors)+1)
+	mirrors = append(mirrors, pd.mirrors...)
+	pd.mirrors = append(mirrors, startMirror(m, pd.logger, pd.counterLabels))
+
+	pd.logger.Infof("Added mirror %q to proxy device %q.", m.Name, pd.proxy.DeviceID)
+	return nil
+}
+
+// RemoveMirror removes the Mirror named name from pd, and closes its Sender.
+// Datagrams still queued for the Mirror are discarded.
+func (pd *Device) RemoveMirror(name string) error {
+	pd.mirrorsMu.Lock()
+	var removed *mirror
+	mirrors := make([]*mirror, 0, len(pd.mirrors))
+	for _, mr := range pd.mirrors {
+		if mr.Name == name {
+			removed = mr
+		} else {
+			mirrors = append(mirrors, mr)
+		}
+	}
+	pd.mirrors = mirrors
+	pd.mirrorsMu.Unlock()
+
+	if removed == nil {
+		return errors.Errorf("no mirror named %q", name)
+	}
+
+	pd.logger.Infof("Removed mirror %q from proxy device %q.", name, pd.proxy.DeviceID)
+	return removed.close()
+}
+
+// Mirrors returns information about pd's Mirrors, in the order in which they
+// were added.
+func (pd *Device) Mirrors() []MirrorInfo {
+	pd.mirrorsMu.RLock()
+	defer pd.mirrorsMu.RUnlock()
+
+	if len(pd.mirrors) == 0 {
+		return nil
+	}
+	infos := make([]MirrorInfo, len(pd.mirrors))
+	for i, mr := range pd.mirrors {
+		infos[i] = mr.getInfo()
+	}
+	return infos
+}
+
+// mirrorDatagram enqueues a copy of b to each of pd's mirrors.
+func (pd *Device) mirrorDatagram(b []byte) {
+	// Hold our read lock while enqueueing, so that mirrors can't be closed
+	// while we're using them. Enqueueing never blocks.
+	pd.mirrorsMu.RLock()
+	defer pd.mirrorsMu.RUnlock()
+
+	if len(pd.mirrors) == 0 {
+		return
+	}
+
+	// b may be reused after we return, so the mirrors share a copy.
+	data := append([]byte(nil), b...)
+	for _, mr := range pd.mirrors {
+		mr.enqueue(data)
+	}
+}
+
+// closeMirrors closes all of pd's mirrors. No more mirrors can be added
+// afterwards.
+//
+// Mirrors are closed concurrently, so that several blocked mirrors only delay
+// closeMirrors by a single mirror's close timeout.
+func (pd *Device) closeMirrors() {
+	pd.mirrorsMu.Lock()
+	mirrors := pd.mirrors
+	pd.mirrors, pd.mirrorsClosed = nil, true
+	pd.mirrorsMu.Unlock()
+
+	var wg sync.WaitGroup
+	for _, mr := range mirrors {
+		wg.Add(1)
+		go func(mr *mirror) {
+			defer wg.Done()
+			if err := mr.close(); err != nil {
+				pd.logger.Warnf("Failed to close mirror %q of proxy device %q: %s", mr.Name, pd.proxy.DeviceID, err)
+			}
+		}(mr)
+	}
+	wg.Wait()
+}
+
+// onLocalPacketData is called when pd.Local's callback receives data from
+// addr.
+func (pd *Device) onLocalPacketData(buf *bufferpool.Buffer, addr *net.UDPAddr) {
 	// Update our received metrics.
 	pd.modInfo(func(di *device.Info) {
 		di.PacketsReceived++
@@ -239,17 +417,29 @@ func (pd *Device) onLocalPacketData(buf *bufferpool.Buffer) {
 	proxyReceivedPackets.With(pd.counterLabels).Inc()
 	proxyReceivedBytes.With(pd.counterLabels).Add(float64(buf.Len()))
 
+	// Determine whether this packet's source should be forwarded.
+	now := time.Now()
+	forwarding := pd.m.Forwarding()
+	source, selected := pd.sources.accept(addr, buf.Len(), now, forwarding)
+
 	// Dispatch the raw buffer to the proxied base, unless we're not forwarding.
 	pkt := packetData{
 		Buffer:    buf,
-		forwarded: pd.m.Forwarding(),
+		forwarded: forwarding && selected,
+		source:    source,
+		received:  now,
 	}
-	if pkt.forwarded {
+	switch {
+	case pkt.forwarded:
 		buf.Retain()
 		pd.basePacketsC <- &pkt
-	} else {
+	case !forwarding:
 		pd.logger.Debugf("NOT forwarding packet (size %d) to proxy device %v (forwarding is disabled).",
 			buf.Len(), pd.baseID)
+	default:
+		pd.logger.Debugf("NOT forwarding packet (size %d) from %s to proxy device %v (source not selected by %q policy).",
+			buf.Len(), source, pd.baseID, pd.sources.policy)
+		proxyArbitratedPackets.With(pd.counterLabels).Inc()
 	}
 
 	// Send the packet to our listeners channel.
@@ -267,6 +457,31 @@ func (pd *Device) forwardPacketsToBase(s device.Sender) {
 			pd.logger.Warnf("Failed to close %q Sender: %s", pd.baseID, err)
 		}
 	}()
+	defer pd.closeMirrors()
+
+	// If we're merging sources, merge each packet with the other sources' state
+	// before applying our Transformers.
+	//
+	// current is the packet being forwarded.
+	var current *packetData
+	transformers := pd.transformers
+	if pd.sources.policy == MergeHTP {
+		hm := htpMerger{timeout: pd.sources.timeout}
+		transformers = append([]Transformer{
+			TransformerFunc(func(_ device.D, pkt *protocol.Packet) bool {
+				return hm.merge(current.source, current.received, pkt)
+			}),
+		}, transformers...)
+	}
+
+	// If we have Transformers, build a pipeline to apply them.
+	var tp *transformPipeline
+	if len(transformers) > 0 {
+		var err error
+		if tp, err = makeTransformPipeline(pd.base, transformers); err != nil {
+			pd.logger.Warnf("Failed to create transform pipeline for %q; forwarding unchanged: %s", pd.baseID, err)
+		}
+	}
 
 	for pkt := range pd.basePacketsC {
 		// Dispatch the packet to our underlying device.
@@ -275,20 +490,36 @@ func (pd *Device) forwardPacketsToBase(s device.Sender) {
 		// buffer on completion.
 		func() {
 			defer pkt.Release()
+			current = pkt
+
+			// Attempt to transform the packet. If it isn't transformed, forward the
+			// raw packet data unchanged.
+			cs := countingSender{DatagramSender: &mirroringSender{DatagramSender: s, pd: pd}}
+			transformed := false
+			var err error
+			if tp != nil {
+				transformed, err = tp.forward(&cs, pkt.Bytes())
+			}
+			if transformed {
+				proxyTransformedPackets.With(pd.counterLabels).Inc()
+			} else {
+				err = cs.SendDatagram(pkt.Bytes())
+			}
 
-			if err := s.SendDatagram(pkt.Bytes()); err != nil {
+			// Update our sent metrics.
+			if cs.packets > 0 {
+				pd.modInfo(func(di *device.Info) {
+					di.PacketsSent += int64(cs.packets)
+					di.BytesSent += int64(cs.bytes)
+				})
+				proxySentPackets.With(pd.counterLabels).Add(float64(cs.packets))
+				proxySentBytes.With(pd.counterLabels).Add(float64(cs.bytes))
+			}
+
+			if err != nil {
 				pd.logger.Warnf("Failed to forward packet from proxy device %q for: %s", pd.proxy.DeviceID, err)
 				proxyForwardErrors.With(pd.counterLabels).Inc()
-				return
 			}
-
-			// Update our sent metrics.
-			pd.modInfo(func(di *device.Info) {
-				di.PacketsSent++
-				di.BytesSent += int64(pkt.Len())
-			})
-			proxySentPackets.With(pd.counterLabels).Inc()
-			proxySentBytes.With(pd.counterLabels).Add(float64(pkt.Len()))
 		}()
 	}
 }
@@ -381,4 +612,8 @@ type packetData struct {
 	*bufferpool.Buffer
 	// forwarded is true if the packet was forwarded to the underlying device.
 	forwarded bool
+	// source is the key of the upstream source that sent the packet.
+	source string
+	// received is the time when the packet was received.
+	received time.Time
 }
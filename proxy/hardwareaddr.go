@@ -9,6 +9,8 @@ import (
 	"crypto/sha256"
 	"net"
 
+	"github.com/danjacques/gopushpixels/discovery"
+	"github.com/danjacques/gopushpixels/protocol"
 	"github.com/danjacques/gopushpixels/support/fmtutil"
 
 	"github.com/pkg/errors"
@@ -82,3 +84,13 @@ func (reg *AddressRegistry) Generate(id string) (net.HardwareAddr, error) {
 func (reg *AddressRegistry) IsProxyDeviceAddr(addr net.HardwareAddr) bool {
 	return bytes.HasPrefix(addr, reg.Prefix)
 }
+
+// FilterBuiltins returns builtin predicates for discovery.ParseFilter.
+//
+// The "proxy" builtin matches devices whose hardware addresses satisfy
+// IsProxyDeviceAddr, so "not proxy" can be used to ignore proxy devices.
+func (reg *AddressRegistry) FilterBuiltins() map[string]discovery.FilterFunc {
+	return map[string]discovery.FilterFunc{
+		"proxy": func(dh *protocol.DiscoveryHeaders) bool { return reg.IsProxyDeviceAddr(dh.HardwareAddr()) },
+	}
+}
@@ -8,8 +8,10 @@ import (
 	"net"
 	"sort"
 	"sync"
+	"time"
 
 	"github.com/danjacques/gopushpixels/device"
+	"github.com/danjacques/gopushpixels/discovery"
 	"github.com/danjacques/gopushpixels/protocol"
 	"github.com/danjacques/gopushpixels/support/bufferpool"
 	"github.com/danjacques/gopushpixels/support/logging"
@@ -40,6 +42,43 @@ type Manager struct {
 	// proxy device broadcast as group 18 (2+16).
 	GroupOffset int32
 
+	// Transformers, if not empty, is a chain of Transformers that are applied,
+	// in order, to packets before they are forwarded to base devices. Packets
+	// that no Transformer modifies are forwarded unchanged.
+	//
+	// Transformers are captured when each proxy device is created.
+	Transformers []Transformer
+
+	// MergePolicy determines which packets a proxy device forwards when several
+	// upstream sources send packets to it.
+	//
+	// MergePolicy is captured when each proxy device is created.
+	MergePolicy MergePolicy
+
+	// SourceTimeout is the amount of time after its last packet that an
+	// upstream source is considered inactive. If <= 0, DefaultSourceTimeout
+	// will be used.
+	SourceTimeout time.Duration
+
+	// SourcePriority, if not nil, returns the priority of an upstream source,
+	// identified by its address. It is used by MergePriority, where higher
+	// priority sources take precedence. If nil, all sources have priority 0.
+	//
+	// SourcePriority is called once, when a source is first seen.
+	SourcePriority func(addr *net.UDPAddr) int
+
+	// Mirrors, if not nil, returns the initial Mirrors of the proxy device for
+	// base. It is called when each proxy device is created. Mirrors can also be
+	// added and removed later through the proxy Device.
+	Mirrors func(base device.D) []Mirror
+
+	// Advertiser, if not nil, is used to advertise proxy devices. Each proxy
+	// device is added to the Advertiser when it is created, and is removed
+	// automatically when it is closed.
+	//
+	// The Advertiser must be run independently.
+	Advertiser *discovery.Advertiser
+
 	// Logger is the logger instance to use. If nil, no logs will be generated.
 	Logger logging.L
 
@@ -133,6 +172,10 @@ func (m *Manager) AddDevice(d device.D) error {
 	}
 	m.devices[baseID] = pd
 
+	if m.Advertiser != nil {
+		m.Advertiser.Add(pd)
+	}
+
 	m.logger().Infof("Created proxy device %q on %q for device %s.", pd.ID(), pd.Addr(), baseID)
 	return nil
 }
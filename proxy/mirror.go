@@ -0,0 +1,228 @@
+// Copyright 2018 Dan Jacques. All rights reserved.
+// Use of this source code is governed under the MIT License
+// that can be found in the LICENSE file.
+
+package proxy
+
+import (
+	"sync"
+	"time"
+
+	"github.com/danjacques/gopushpixels/device"
+	"github.com/danjacques/gopushpixels/support/logging"
+	"github.com/danjacques/gopushpixels/support/network"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// DefaultMirrorQueueSize is the default number of datagrams that may be queued
+// for a Mirror.
+const DefaultMirrorQueueSize = 256
+
+// mirrorRetryDelay is the amount of time after a failed send during which a
+// mirror's datagrams are dropped, rather than sent.
+const mirrorRetryDelay = time.Second
+
+// mirrorCloseTimeout is the maximum amount of time that closing a mirror will
+// wait for a send that is in progress to finish.
+const mirrorCloseTimeout = 250 * time.Millisecond
+
+// Mirror is a destination that receives a copy of every datagram that a proxy
+// Device forwards to its base device. Mirrors can be used to drive a second
+// installation, a simulator, or a different kind of node alongside the base
+// device.
+//
+// Each Mirror is sent to independently of the base device and of other
+// Mirrors. If a Mirror can't keep up, its datagrams are dropped; if it fails,
+// its datagrams are dropped for a short time before it is retried. Neither
+// stalls the base device.
+type Mirror struct {
+	// Name identifies the Mirror. It must be unique among a device's Mirrors.
+	Name string
+
+	// Sender sends datagrams to the Mirror.
+	//
+	// The proxy Device takes ownership of Sender, and will close it when the
+	// Mirror is removed or the Device is closed. Close may be called while a
+	// SendDatagram call is in progress, and should cause it to return.
+	Sender network.DatagramSender
+
+	// QueueSize is the number of datagrams that may be queued for the Mirror. If
+	// <= 0, DefaultMirrorQueueSize will be used.
+	QueueSize int
+}
+
+// MirrorDevice returns a Mirror that sends to d, named after d's ID.
+func MirrorDevice(d device.D) (Mirror, error) {
+	s, err := d.Sender()
+	if err != nil {
+		return Mirror{}, errors.Wrapf(err, "could not create Sender for %s", d.ID())
+	}
+	return Mirror{
+		Name:   d.ID(),
+		Sender: s,
+	}, nil
+}
+
+// MirrorInfo is information about a proxy Device's Mirror.
+type MirrorInfo struct {
+	// Name is the Mirror's name.
+	Name string
+
+	// PacketsSent is the number of datagrams sent to the Mirror.
+	PacketsSent int64
+	// PacketsDropped is the number of datagrams dropped, because the Mirror's
+	// queue was full or the Mirror was failing.
+	PacketsDropped int64
+	// Errors is the number of failed sends.
+	Errors int64
+	// LastError is the most recent send error, or nil if no send has failed.
+	LastError error
+}
+
+// mirror is a running Mirror.
+type mirror struct {
+	Mirror
+
+	logger logging.L
+	labels prometheus.Labels
+
+	dataC chan []byte
+	// stopC is closed to stop the mirror's goroutine.
+	stopC chan struct{}
+	// doneC is closed when the mirror's goroutine has exited.
+	doneC chan struct{}
+
+	// mu protects info.
+	mu   sync.Mutex
+	info MirrorInfo
+}
+
+// startMirror starts a goroutine that sends datagrams to m.
+func startMirror(m Mirror, logger logging.L, labels prometheus.Labels) *mirror {
+	queueSize := m.QueueSize
+	if queueSize <= 0 {
+		queueSize = DefaultMirrorQueueSize
+	}
+
+	mr := mirror{
+		Mirror: m,
+		logger: logger,
+		labels: prometheus.Labels{
+			"proxy_id": labels["proxy_id"],
+			"base_id":  labels["base_id"],
+			"mirror":   m.Name,
+		},
+		dataC: make(chan []byte, queueSize),
+		stopC: make(chan struct{}),
+		doneC: make(chan struct{}),
+		info: MirrorInfo{
+			Name: m.Name,
+		},
+	}
+	go mr.run()
+	return &mr
+}
+
+// enqueue queues data to be sent to the mirror. It never blocks; if the
+// mirror's queue is full, data is dropped.
+//
+// data must not be modified after it is enqueued.
+func (mr *mirror) enqueue(data []byte) {
+	select {
+	case mr.dataC <- data:
+	default:
+		mr.drop()
+	}
+}
+
+// close stops the mirror and closes its Sender. Queued datagrams are
+// discarded.
+//
+// close waits at most mirrorCloseTimeout for a send that is in progress to
+// finish, so that a mirror whose Sender blocks can't stall its caller.
+func (mr *mirror) close() error {
+	close(mr.stopC)
+	err := mr.Sender.Close()
+
+	select {
+	case <-mr.doneC:
+	case <-time.After(mirrorCloseTimeout):
+		mr.logger.Warnf("Mirror %q did not stop within %s; abandoning it.", mr.Name, mirrorCloseTimeout)
+	}
+	return err
+}
+
+func (mr *mirror) run() {
+	defer close(mr.doneC)
+
+	var retryAt time.Time
+	for {
+		var data []byte
+		select {
+		case <-mr.stopC:
+			return
+		case data = <-mr.dataC:
+		}
+
+		// If we've been stopped while waiting, don't send.
+		select {
+		case <-mr.stopC:
+			return
+		default:
+		}
+
+		// If we've recently failed, drop the datagram.
+		now := time.Now()
+		if now.Before(retryAt) {
+			mr.drop()
+			continue
+		}
+
+		if err := mr.Sender.SendDatagram(data); err != nil {
+			mr.logger.Warnf("Failed to send to mirror %q; dropping datagrams for %s: %s", mr.Name, mirrorRetryDelay, err)
+			retryAt = now.Add(mirrorRetryDelay)
+
+			mr.modInfo(func(mi *MirrorInfo) {
+				mi.Errors++
+				mi.LastError = err
+			})
+			proxyMirrorErrors.With(mr.labels).Inc()
+			continue
+		}
+
+		mr.modInfo(func(mi *MirrorInfo) { mi.PacketsSent++ })
+		proxyMirrorSentPackets.With(mr.labels).Inc()
+	}
+}
+
+func (mr *mirror) drop() {
+	mr.modInfo(func(mi *MirrorInfo) { mi.PacketsDropped++ })
+	proxyMirrorDroppedPackets.With(mr.labels).Inc()
+}
+
+func (mr *mirror) getInfo() (mi MirrorInfo) {
+	mr.modInfo(func(info *MirrorInfo) { mi = *info })
+	return
+}
+
+func (mr *mirror) modInfo(fn func(*MirrorInfo)) {
+	mr.mu.Lock()
+	defer mr.mu.Unlock()
+	fn(&mr.info)
+}
+
+// mirroringSender is a network.DatagramSender that sends datagrams to its
+// underlying DatagramSender, and also mirrors each datagram to a proxy
+// Device's Mirrors.
+type mirroringSender struct {
+	network.DatagramSender
+
+	pd *Device
+}
+
+func (ms *mirroringSender) SendDatagram(b []byte) error {
+	ms.pd.mirrorDatagram(b)
+	return ms.DatagramSender.SendDatagram(b)
+}
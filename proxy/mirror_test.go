@@ -0,0 +1,200 @@
+// Copyright 2018 Dan Jacques. All rights reserved.
+// Use of this source code is governed under the MIT License
+// that can be found in the LICENSE file.
+
+package proxy
+
+import (
+	"errors"
+	"net"
+	"sync"
+
+	"github.com/danjacques/gopushpixels/device"
+	"github.com/danjacques/gopushpixels/protocol"
+	"github.com/danjacques/gopushpixels/protocol/pixelpusher"
+	"github.com/danjacques/gopushpixels/support/logging"
+	"github.com/danjacques/gopushpixels/support/network"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+// mirrorSender is a network.DatagramSender that records datagrams, and can be
+// made to fail or block.
+type mirrorSender struct {
+	mu        sync.Mutex
+	datagrams [][]byte
+	err       error
+	closed    bool
+
+	// blockC, if not nil, blocks each send until it is readable.
+	blockC chan struct{}
+}
+
+func (ms *mirrorSender) SendDatagram(b []byte) error {
+	if ms.blockC != nil {
+		<-ms.blockC
+	}
+
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	if ms.err != nil {
+		return ms.err
+	}
+	ms.datagrams = append(ms.datagrams, b)
+	return nil
+}
+
+func (ms *mirrorSender) MaxDatagramSize() int { return network.MaxUDPSize }
+
+func (ms *mirrorSender) Close() error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	ms.closed = true
+	return nil
+}
+
+func (ms *mirrorSender) sent() [][]byte {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	return append([][]byte(nil), ms.datagrams...)
+}
+
+func (ms *mirrorSender) isClosed() bool {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	return ms.closed
+}
+
+var _ = Describe("Mirrors", func() {
+	var (
+		pd      *Device
+		primary *recordingSender
+		sender  *mirroringSender
+	)
+	BeforeEach(func() {
+		pd = &Device{logger: logging.Must(nil)}
+		primary = &recordingSender{}
+		sender = &mirroringSender{DatagramSender: primary, pd: pd}
+	})
+
+	It("sends forwarded datagrams to each mirror", func() {
+		a, b := &mirrorSender{}, &mirrorSender{}
+		Expect(pd.AddMirror(Mirror{Name: "a", Sender: a})).To(Succeed())
+		Expect(pd.AddMirror(Mirror{Name: "b", Sender: b})).To(Succeed())
+
+		data := []byte("hello")
+		Expect(sender.SendDatagram(data)).To(Succeed())
+
+		By("sending a copy, since the original may be reused")
+		data[0] = 'j'
+
+		Expect(primary.datagrams).To(Equal([][]byte{[]byte("hello")}))
+		Eventually(a.sent).Should(Equal([][]byte{[]byte("hello")}))
+		Eventually(b.sent).Should(Equal([][]byte{[]byte("hello")}))
+		Eventually(func() int64 { return pd.Mirrors()[0].PacketsSent }).Should(BeEquivalentTo(1))
+
+		By("closing mirrors when they are removed")
+		Expect(pd.RemoveMirror("a")).To(Succeed())
+		Expect(a.isClosed()).To(BeTrue())
+		Expect(pd.Mirrors()).To(HaveLen(1))
+		Expect(pd.RemoveMirror("a")).ToNot(Succeed())
+
+		By("closing all mirrors when the device's mirrors are closed")
+		pd.closeMirrors()
+		Expect(b.isClosed()).To(BeTrue())
+		Expect(pd.Mirrors()).To(BeEmpty())
+		Expect(pd.AddMirror(Mirror{Name: "c", Sender: &mirrorSender{}})).ToNot(Succeed())
+	})
+
+	It("rejects invalid and duplicate mirrors", func() {
+		Expect(pd.AddMirror(Mirror{Sender: &mirrorSender{}})).ToNot(Succeed())
+		Expect(pd.AddMirror(Mirror{Name: "a"})).ToNot(Succeed())
+
+		Expect(pd.AddMirror(Mirror{Name: "a", Sender: &mirrorSender{}})).To(Succeed())
+		Expect(pd.AddMirror(Mirror{Name: "a", Sender: &mirrorSender{}})).ToNot(Succeed())
+		pd.closeMirrors()
+	})
+
+	It("drops datagrams rather than blocking when a mirror is backlogged", func() {
+		blocked := &mirrorSender{blockC: make(chan struct{})}
+		Expect(pd.AddMirror(Mirror{Name: "blocked", Sender: blocked, QueueSize: 1})).To(Succeed())
+
+		for i := 0; i < 10; i++ {
+			Expect(sender.SendDatagram([]byte{byte(i)})).To(Succeed())
+		}
+		Expect(primary.datagrams).To(HaveLen(10))
+
+		// At most one datagram is being sent, and one is queued.
+		Expect(pd.Mirrors()[0].PacketsDropped).To(BeNumerically(">=", 8))
+
+		close(blocked.blockC)
+		pd.closeMirrors()
+	})
+
+	It("reports mirror failures, and drops datagrams while backing off", func() {
+		failing := &mirrorSender{err: errors.New("dead")}
+		mr := startMirror(Mirror{Name: "failing", Sender: failing}, logging.Must(nil), nil)
+
+		mr.enqueue([]byte("a"))
+		mr.enqueue([]byte("b"))
+		Eventually(func() int64 { return mr.getInfo().PacketsDropped }).Should(BeEquivalentTo(1))
+		Expect(mr.close()).To(Succeed())
+
+		info := mr.getInfo()
+		Expect(info.Errors).To(BeEquivalentTo(1))
+		Expect(info.LastError).To(MatchError("dead"))
+		Expect(info.PacketsSent).To(BeZero())
+	})
+
+	Context("with a Sender that blocks forever", func() {
+		var blocked *mirrorSender
+		BeforeEach(func() {
+			blocked = &mirrorSender{blockC: make(chan struct{})}
+		})
+		AfterEach(func() {
+			// Release the abandoned mirror goroutine.
+			close(blocked.blockC)
+		})
+
+		It("can remove the mirror", func(done Done) {
+			defer close(done)
+
+			Expect(pd.AddMirror(Mirror{Name: "blocked", Sender: blocked})).To(Succeed())
+			for i := 0; i < 3; i++ {
+				Expect(sender.SendDatagram([]byte{byte(i)})).To(Succeed())
+			}
+
+			Expect(pd.RemoveMirror("blocked")).To(Succeed())
+			Expect(blocked.isClosed()).To(BeTrue())
+		}, 5)
+
+		It("can shut down the proxy Device", func(done Done) {
+			defer close(done)
+
+			tb := startTestBase("base", &protocol.DiscoveryHeaders{
+				DeviceHeader: protocol.DeviceHeader{DeviceType: protocol.PixelPusherDeviceType},
+				PixelPusher:  &pixelpusher.Device{},
+			})
+			defer tb.close()
+
+			m := Manager{
+				ProxyAddr: net.ParseIP("127.0.0.1"),
+				Mirrors: func(base device.D) []Mirror {
+					return []Mirror{{Name: "blocked", Sender: blocked}}
+				},
+			}
+			Expect(m.AddDevice(tb)).To(Succeed())
+			pd := m.ProxyDevices()[0]
+
+			By("forwarding to the base device while the mirror is blocked")
+			for i := 0; i < 3; i++ {
+				sendToProxy(pd, []byte{byte(i)})
+				Eventually(tb.datagramC).Should(Receive(Equal([]byte{byte(i)})))
+			}
+
+			Expect(m.Close()).To(Succeed())
+			Expect(blocked.isClosed()).To(BeTrue())
+		}, 5)
+	})
+})
@@ -0,0 +1,359 @@
+// Copyright 2018 Dan Jacques. All rights reserved.
+// Use of this source code is governed under the MIT License
+// that can be found in the LICENSE file.
+
+package proxy
+
+import (
+	"context"
+	"math"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/danjacques/gopushpixels/device"
+	"github.com/danjacques/gopushpixels/pixel"
+	"github.com/danjacques/gopushpixels/protocol"
+	"github.com/danjacques/gopushpixels/protocol/pixelpusher"
+	"github.com/danjacques/gopushpixels/support/logging"
+)
+
+// DefaultMixerFrameInterval is the default interval at which a Mixer sends
+// frames while it is crossfading.
+const DefaultMixerFrameInterval = time.Second / 30
+
+// Mixer blends live proxy traffic with playback (e.g., from a replay.Player),
+// enabling smooth crossfades between the two.
+//
+// A Mixer keeps the latest live and the latest playback state of each strip,
+// and sends a blend of the two to Output. The blend is controlled by the mix
+// value, which is the weight of playback: 0, the initial value, outputs only
+// live traffic, and 1 outputs only playback. A strip that has no state from
+// one of the sources is treated as black for that source.
+//
+// Live traffic is received as a proxy Listener. While running, the Mixer
+// holds a lease on its Manager, so that live traffic is not also forwarded
+// directly. Playback is received through SendPacket, which can be used as a
+// replay.Player's SendPacket.
+//
+// Live and playback states are matched by device ordinal if it is valid, and
+// by device ID otherwise, consistent with device.Router.
+//
+// Command packets from either source are sent to Output unchanged.
+type Mixer struct {
+	// Manager, if not nil, is the proxy Manager to receive live traffic from.
+	// If nil, live traffic must be delivered by calling ReceivePacket directly.
+	Manager *Manager
+
+	// Output receives blended packets. It must not be nil. Typically, this will
+	// be a device.Router's Route method.
+	Output func(ord device.Ordinal, id string, pkt *protocol.Packet) error
+
+	// FrameInterval is the interval at which frames are sent while the Mixer is
+	// crossfading. If <= 0, DefaultMixerFrameInterval will be used.
+	FrameInterval time.Duration
+
+	// Logger, if not nil, is the logger to use.
+	Logger logging.L
+
+	mu sync.Mutex
+	// devices is the per-device mixer state.
+	devices map[mixerKey]*mixerDevice
+	// fade is the current crossfade.
+	fade mixerFade
+
+	// sendMu serializes calls to Output.
+	sendMu sync.Mutex
+}
+
+var _ Listener = (*Mixer)(nil)
+
+// mixerKey identifies a device in a Mixer.
+type mixerKey struct {
+	ordinal device.Ordinal
+	id      string
+}
+
+func makeMixerKey(ord device.Ordinal, id string) mixerKey {
+	if ord.IsValid() {
+		return mixerKey{ordinal: ord}
+	}
+	return mixerKey{ordinal: ord, id: id}
+}
+
+// mixerDevice is the mixer state for a single device.
+type mixerDevice struct {
+	ordinal device.Ordinal
+	id      string
+
+	strips map[pixelpusher.StripNumber]*mixerStrip
+}
+
+// mixerStrip is the mixer state for a single strip.
+type mixerStrip struct {
+	live     *pixelpusher.StripState
+	playback *pixelpusher.StripState
+}
+
+// mixerFade is a linear crossfade between two mix values.
+type mixerFade struct {
+	from, to float64
+	start    time.Time
+	duration time.Duration
+}
+
+// at returns the mix value at now.
+func (f *mixerFade) at(now time.Time) float64 {
+	if f.duration <= 0 {
+		return f.to
+	}
+	progress := float64(now.Sub(f.start)) / float64(f.duration)
+	switch {
+	case progress <= 0:
+		return f.from
+	case progress >= 1:
+		return f.to
+	default:
+		return f.from + (f.to-f.from)*progress
+	}
+}
+
+// done returns true if the crossfade has completed at now.
+func (f *mixerFade) done(now time.Time) bool { return !now.Before(f.start.Add(f.duration)) }
+
+// Mix returns the current mix value.
+func (m *Mixer) Mix() float64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.fade.at(time.Now())
+}
+
+// SetMix crossfades from the current mix value to mix over duration. mix is
+// clamped to [0, 1]. If duration <= 0, the mix value changes immediately.
+//
+// Frames are sent while crossfading by Run.
+func (m *Mixer) SetMix(mix float64, duration time.Duration) {
+	mix = math.Max(0, math.Min(1, mix))
+
+	now := time.Now()
+	m.mu.Lock()
+	m.fade = mixerFade{
+		from:     m.fade.at(now),
+		to:       mix,
+		start:    now,
+		duration: duration,
+	}
+	m.mu.Unlock()
+
+	m.logger().Infof("Mixer crossfading to %.2f over %s.", mix, duration)
+	if duration <= 0 {
+		m.sendAll(now)
+	}
+}
+
+// Run sends frames while the Mixer is crossfading, until c is cancelled.
+//
+// If the Mixer has a Manager, Run receives live traffic from it, and holds a
+// lease on it while running.
+func (m *Mixer) Run(c context.Context) error {
+	if m.Manager != nil {
+		m.Manager.AddLease(m)
+		m.Manager.AddListener(m)
+		defer func() {
+			m.Manager.RemoveListener(m)
+			m.Manager.RemoveLease(m)
+		}()
+	}
+
+	interval := m.FrameInterval
+	if interval <= 0 {
+		interval = DefaultMixerFrameInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	// fading is true if a frame was sent while crossfading on the previous
+	// tick. This ensures that the final frame of each crossfade is sent.
+	fading := false
+	for {
+		select {
+		case <-c.Done():
+			return c.Err()
+
+		case now := <-ticker.C:
+			m.mu.Lock()
+			done := m.fade.done(now)
+			m.mu.Unlock()
+
+			if !done || fading {
+				m.sendAll(now)
+			}
+			fading = !done
+		}
+	}
+}
+
+// ReceivePacket implements Listener, receiving live traffic for d.
+func (m *Mixer) ReceivePacket(d device.D, pkt *protocol.Packet, forwarded bool) {
+	if err := m.receive(d.Ordinal(), d.ID(), pkt, true); err != nil {
+		m.logger().Warnf("Mixer failed to send live packet for %s: %s", d.ID(), err)
+	}
+}
+
+// SendPacket receives playback traffic for the device identified by ord and
+// id. Its signature matches replay.Player's SendPacket.
+func (m *Mixer) SendPacket(ord device.Ordinal, id string, pkt *protocol.Packet) error {
+	return m.receive(ord, id, pkt, false)
+}
+
+func (m *Mixer) receive(ord device.Ordinal, id string, pkt *protocol.Packet, live bool) error {
+	pp := pkt.PixelPusher
+	switch {
+	case pp == nil:
+		return nil
+	case pp.Command != nil:
+		return m.send(ord, id, pkt)
+	}
+
+	now := time.Now()
+	m.mu.Lock()
+	md := m.getDeviceLocked(ord, id)
+	for _, ss := range pp.StripStates {
+		ms := md.strips[ss.StripNumber]
+		if ms == nil {
+			ms = &mixerStrip{}
+			md.strips[ss.StripNumber] = ms
+		}
+
+		// Clone the strip state, since pkt's pixel data may be reused.
+		if live {
+			ms.live = ss.Clone()
+		} else {
+			ms.playback = ss.Clone()
+		}
+	}
+	out := md.packetLocked(m.fade.at(now), pp.StripStates)
+	ord, id = md.ordinal, md.id
+	m.mu.Unlock()
+
+	return m.send(ord, id, out)
+}
+
+func (m *Mixer) getDeviceLocked(ord device.Ordinal, id string) *mixerDevice {
+	key := makeMixerKey(ord, id)
+	md := m.devices[key]
+	if md == nil {
+		md = &mixerDevice{
+			ordinal: ord,
+			strips:  make(map[pixelpusher.StripNumber]*mixerStrip),
+		}
+		if m.devices == nil {
+			m.devices = make(map[mixerKey]*mixerDevice)
+		}
+		m.devices[key] = md
+	}
+	md.id = id
+	return md
+}
+
+// sendAll sends the blended state of every strip of every device.
+func (m *Mixer) sendAll(now time.Time) {
+	type devicePacket struct {
+		ordinal device.Ordinal
+		id      string
+		pkt     *protocol.Packet
+	}
+
+	m.mu.Lock()
+	mix := m.fade.at(now)
+	packets := make([]devicePacket, 0, len(m.devices))
+	for _, md := range m.devices {
+		packets = append(packets, devicePacket{md.ordinal, md.id, md.packetLocked(mix, nil)})
+	}
+	m.mu.Unlock()
+
+	sort.Slice(packets, func(i, j int) bool { return packets[i].id < packets[j].id })
+	for _, dp := range packets {
+		if err := m.send(dp.ordinal, dp.id, dp.pkt); err != nil {
+			m.logger().Warnf("Mixer failed to send frame for %s: %s", dp.id, err)
+		}
+	}
+}
+
+func (m *Mixer) send(ord device.Ordinal, id string, pkt *protocol.Packet) error {
+	m.sendMu.Lock()
+	defer m.sendMu.Unlock()
+	return m.Output(ord, id, pkt)
+}
+
+// packetLocked builds a packet containing the blended state of the strips
+// in states, or of all strips if states is nil.
+func (md *mixerDevice) packetLocked(mix float64, states []*pixelpusher.StripState) *protocol.Packet {
+	var strips []pixelpusher.StripNumber
+	if states != nil {
+		strips = make([]pixelpusher.StripNumber, len(states))
+		for i, ss := range states {
+			strips[i] = ss.StripNumber
+		}
+	} else {
+		strips = make([]pixelpusher.StripNumber, 0, len(md.strips))
+		for sn := range md.strips {
+			strips = append(strips, sn)
+		}
+		sort.Slice(strips, func(i, j int) bool { return strips[i] < strips[j] })
+	}
+
+	pp := pixelpusher.Packet{StripStates: make([]*pixelpusher.StripState, len(strips))}
+	for i, sn := range strips {
+		pp.StripStates[i] = md.strips[sn].blend(sn, mix)
+	}
+	return &protocol.Packet{PixelPusher: &pp}
+}
+
+// blend returns a new StripState blending ms's live and playback states. mix
+// is the weight of the playback state.
+func (ms *mixerStrip) blend(sn pixelpusher.StripNumber, mix float64) *pixelpusher.StripState {
+	live, playback := ms.live, ms.playback
+	switch {
+	case live == nil:
+		live = &pixelpusher.StripState{Pixels: pixel.Buffer{Layout: playback.Pixels.Layout}}
+	case playback == nil:
+		playback = &pixelpusher.StripState{Pixels: pixel.Buffer{Layout: live.Pixels.Layout}}
+	}
+
+	// Use the live layout, unless there is no live state.
+	layout := live.Pixels.Layout
+	if ms.live == nil {
+		layout = playback.Pixels.Layout
+	}
+	count := live.Pixels.Len()
+	if l := playback.Pixels.Len(); l > count {
+		count = l
+	}
+
+	out := pixelpusher.StripState{
+		StripNumber: sn,
+		Pixels:      pixel.Buffer{Layout: layout},
+	}
+	out.Pixels.Reset(count)
+	for i := 0; i < count; i++ {
+		out.Pixels.SetPixel(i, blendPixel(live.Pixels.Pixel(i), playback.Pixels.Pixel(i), mix))
+	}
+	return &out
+}
+
+// blendPixel linearly interpolates between a and b. mix is the weight of b.
+func blendPixel(a, b pixel.P, mix float64) pixel.P {
+	lerp := func(a, b uint8) uint8 {
+		return uint8(math.Round(float64(a)*(1-mix) + float64(b)*mix))
+	}
+	return pixel.P{
+		Red:    lerp(a.Red, b.Red),
+		Green:  lerp(a.Green, b.Green),
+		Blue:   lerp(a.Blue, b.Blue),
+		Orange: lerp(a.Orange, b.Orange),
+		White:  lerp(a.White, b.White),
+	}
+}
+
+func (m *Mixer) logger() logging.L { return logging.Must(m.Logger) }
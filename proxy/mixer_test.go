@@ -0,0 +1,160 @@
+// Copyright 2018 Dan Jacques. All rights reserved.
+// Use of this source code is governed under the MIT License
+// that can be found in the LICENSE file.
+
+package proxy
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/danjacques/gopushpixels/device"
+	"github.com/danjacques/gopushpixels/pixel"
+	"github.com/danjacques/gopushpixels/protocol"
+	"github.com/danjacques/gopushpixels/protocol/pixelpusher"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+// mixerOutput records the packets that a Mixer outputs.
+type mixerOutput struct {
+	mu      sync.Mutex
+	ids     []string
+	packets []*protocol.Packet
+}
+
+func (mo *mixerOutput) send(ord device.Ordinal, id string, pkt *protocol.Packet) error {
+	mo.mu.Lock()
+	defer mo.mu.Unlock()
+	mo.ids = append(mo.ids, id)
+	mo.packets = append(mo.packets, pkt)
+	return nil
+}
+
+// last returns the first pixel of each strip in the last output packet.
+func (mo *mixerOutput) last() []pixel.P {
+	mo.mu.Lock()
+	defer mo.mu.Unlock()
+
+	if len(mo.packets) == 0 {
+		return nil
+	}
+	pkt := mo.packets[len(mo.packets)-1]
+	result := make([]pixel.P, len(pkt.PixelPusher.StripStates))
+	for i, ss := range pkt.PixelPusher.StripStates {
+		result[i] = ss.Pixels.Pixel(0)
+	}
+	return result
+}
+
+func (mo *mixerOutput) count() int {
+	mo.mu.Lock()
+	defer mo.mu.Unlock()
+	return len(mo.packets)
+}
+
+var _ = Describe("Mixer", func() {
+	var dh protocol.DiscoveryHeaders
+	dh.SetHardwareAddr([]byte{0, 1, 2, 3, 4, 5})
+	dh.PixelPusher = &pixelpusher.Device{
+		DeviceHeader: pixelpusher.DeviceHeader{GroupOrdinal: 1, ControllerOrdinal: 2},
+	}
+	d := device.MakeRemote("live", &dh)
+
+	makePacket := func(strips ...pixel.P) *protocol.Packet {
+		var pp pixelpusher.Packet
+		for i, p := range strips {
+			ss := pixelpusher.StripState{StripNumber: pixelpusher.StripNumber(i)}
+			ss.Pixels.SetPixels(p)
+			pp.StripStates = append(pp.StripStates, &ss)
+		}
+		return &protocol.Packet{PixelPusher: &pp}
+	}
+
+	var (
+		mo *mixerOutput
+		m  *Mixer
+	)
+	BeforeEach(func() {
+		mo = &mixerOutput{}
+		m = &Mixer{
+			Output:        mo.send,
+			FrameInterval: 5 * time.Millisecond,
+		}
+	})
+
+	live := pixel.P{Red: 200}
+	playback := pixel.P{Blue: 100}
+
+	It("outputs live traffic by default", func() {
+		Expect(m.Mix()).To(BeZero())
+
+		m.ReceivePacket(d, makePacket(live), false)
+		Expect(mo.last()).To(Equal([]pixel.P{live}))
+		Expect(mo.ids).To(Equal([]string{"live"}))
+
+		By("matching playback by ordinal")
+		Expect(m.SendPacket(d.Ordinal(), "recorded", makePacket(playback, playback))).To(Succeed())
+		Expect(mo.last()).To(Equal([]pixel.P{live, {}}))
+	})
+
+	It("blends live and playback state", func() {
+		m.ReceivePacket(d, makePacket(live), false)
+		Expect(m.SendPacket(d.Ordinal(), d.ID(), makePacket(playback))).To(Succeed())
+
+		m.SetMix(1, 0)
+		Expect(mo.last()).To(Equal([]pixel.P{playback}))
+
+		m.SetMix(0.5, 0)
+		Expect(m.Mix()).To(Equal(0.5))
+		Expect(mo.last()).To(Equal([]pixel.P{{Red: 100, Blue: 50}}))
+
+		By("clamping the mix value")
+		m.SetMix(-1, 0)
+		Expect(m.Mix()).To(BeZero())
+		Expect(mo.last()).To(Equal([]pixel.P{live}))
+	})
+
+	It("matches devices without valid ordinals by ID", func() {
+		ord := device.InvalidOrdinal()
+		Expect(m.SendPacket(ord, "foo", makePacket(playback))).To(Succeed())
+		Expect(m.SendPacket(ord, "bar", makePacket(playback))).To(Succeed())
+
+		m.SetMix(1, 0)
+		Expect(mo.ids[2:]).To(Equal([]string{"bar", "foo"}))
+	})
+
+	It("passes commands through", func() {
+		pkt := protocol.Packet{PixelPusher: &pixelpusher.Packet{Command: &pixelpusher.ResetCommand{}}}
+		Expect(m.SendPacket(d.Ordinal(), d.ID(), &pkt)).To(Succeed())
+		Expect(mo.packets).To(Equal([]*protocol.Packet{&pkt}))
+	})
+
+	It("crossfades while running, holding a Manager lease", func(done Done) {
+		defer close(done)
+
+		m.Manager = &Manager{}
+		m.ReceivePacket(d, makePacket(live), false)
+		Expect(m.SendPacket(d.Ordinal(), d.ID(), makePacket(playback))).To(Succeed())
+
+		c, cancelFunc := context.WithCancel(context.Background())
+		defer cancelFunc()
+		errC := make(chan error)
+		go func() { errC <- m.Run(c) }()
+		Eventually(m.Manager.Forwarding).Should(BeFalse())
+
+		m.SetMix(1, 100*time.Millisecond)
+		Eventually(mo.last).Should(Equal([]pixel.P{playback}))
+		Expect(mo.count()).To(BeNumerically(">", 4))
+
+		By("not sending frames once the crossfade completes")
+		count := mo.count()
+		Consistently(mo.count, 50*time.Millisecond).Should(BeNumerically("<=", count+1))
+
+		cancelFunc()
+		Expect(<-errC).To(Equal(context.Canceled))
+		Expect(m.Manager.Forwarding()).To(BeTrue())
+	}, 5)
+})
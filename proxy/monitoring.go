@@ -38,6 +38,36 @@ var (
 	},
 		[]string{"proxy_id", "base_id"})
 
+	proxyTransformedPackets = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "pixelproxy_proxy_transformed_packets",
+		Help: "Count of packets modified by Transformers before being sent to a proxied device.",
+	},
+		[]string{"proxy_id", "base_id"})
+
+	proxyArbitratedPackets = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "pixelproxy_proxy_arbitrated_packets",
+		Help: "Count of packets not forwarded by a device proxy because their source was not selected by its merge policy.",
+	},
+		[]string{"proxy_id", "base_id"})
+
+	proxyMirrorSentPackets = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "pixelproxy_proxy_mirror_sent_packets",
+		Help: "Count of packets sent by a device proxy to a mirror.",
+	},
+		[]string{"proxy_id", "base_id", "mirror"})
+
+	proxyMirrorDroppedPackets = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "pixelproxy_proxy_mirror_dropped_packets",
+		Help: "Count of packets dropped by a device proxy mirror that was backlogged or failing.",
+	},
+		[]string{"proxy_id", "base_id", "mirror"})
+
+	proxyMirrorErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "pixelproxy_proxy_mirror_errors",
+		Help: "Number of errors encountered while sending packets to a device proxy mirror.",
+	},
+		[]string{"proxy_id", "base_id", "mirror"})
+
 	proxyRecvErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
 		Name: "pixelproxy_proxy_recv_errors",
 		Help: "Number of errors encountered while receiving packets.",
@@ -62,6 +92,11 @@ func RegisterMonitoring(reg prometheus.Registerer) {
 		proxyReceivedBytes,
 		proxySentPackets,
 		proxySentBytes,
+		proxyTransformedPackets,
+		proxyArbitratedPackets,
+		proxyMirrorSentPackets,
+		proxyMirrorDroppedPackets,
+		proxyMirrorErrors,
 		proxyRecvErrors,
 		proxyForwardErrors,
 	)
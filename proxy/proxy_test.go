@@ -0,0 +1,76 @@
+// Copyright 2018 Dan Jacques. All rights reserved.
+// Use of this source code is governed under the MIT License
+// that can be found in the LICENSE file.
+
+package proxy
+
+import (
+	"net"
+	"testing"
+
+	"github.com/danjacques/gopushpixels/device"
+	"github.com/danjacques/gopushpixels/protocol"
+	"github.com/danjacques/gopushpixels/support/network"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+func TestProxy(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Proxy")
+}
+
+// testBase is a base device backed by a local UDP socket. It records the
+// datagrams that it receives.
+type testBase struct {
+	*device.Remote
+
+	conn      *net.UDPConn
+	datagramC chan []byte
+}
+
+// startTestBase starts a testBase whose discovery headers are a copy of dh,
+// addressed to its local socket.
+func startTestBase(id string, dh *protocol.DiscoveryHeaders) *testBase {
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+	Expect(err).ToNot(HaveOccurred())
+
+	addr := conn.LocalAddr().(*net.UDPAddr)
+	dh = dh.Clone()
+	dh.SetIP4Address(addr.IP)
+	dh.PixelPusher.MyPort = uint16(addr.Port)
+
+	tb := testBase{
+		Remote:    device.MakeRemote(id, dh),
+		conn:      conn,
+		datagramC: make(chan []byte, 16),
+	}
+	go func() {
+		for {
+			buf := make([]byte, network.MaxUDPSize)
+			size, err := conn.Read(buf)
+			if err != nil {
+				close(tb.datagramC)
+				return
+			}
+			tb.datagramC <- buf[:size]
+		}
+	}()
+	return &tb
+}
+
+func (tb *testBase) close() {
+	tb.MarkDone()
+	_ = tb.conn.Close()
+}
+
+// sendToProxy sends a datagram to the proxy device pd.
+func sendToProxy(pd *Device, data []byte) {
+	conn, err := net.DialUDP("udp4", nil, pd.Addr().(*net.UDPAddr))
+	Expect(err).ToNot(HaveOccurred())
+	defer conn.Close()
+
+	_, err = conn.Write(data)
+	Expect(err).ToNot(HaveOccurred())
+}
@@ -0,0 +1,377 @@
+// Copyright 2018 Dan Jacques. All rights reserved.
+// Use of this source code is governed under the MIT License
+// that can be found in the LICENSE file.
+
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/danjacques/gopushpixels/pixel"
+	"github.com/danjacques/gopushpixels/protocol"
+	"github.com/danjacques/gopushpixels/protocol/pixelpusher"
+)
+
+// DefaultSourceTimeout is the default amount of time after its last packet
+// that an upstream source is considered inactive.
+const DefaultSourceTimeout = 2 * time.Second
+
+// sourceRetention is the amount of time after which an inactive upstream
+// source is forgotten.
+const sourceRetention = time.Minute
+
+// MergePolicy determines which packets a proxy Device forwards to its base
+// device when several upstream sources (e.g., lighting programs) send packets
+// to it.
+//
+// Upstream sources are identified by their address (IP:port). A source is
+// active if it has sent a packet within the Manager's SourceTimeout.
+type MergePolicy int
+
+const (
+	// MergeAll forwards every packet from every source as it arrives. If
+	// several sources are active, their packets will interleave. This is the
+	// default.
+	MergeAll MergePolicy = iota
+	// MergePriority forwards packets only from the active source with the
+	// highest priority (see Manager's SourcePriority). Ties are won by the
+	// source that became active first.
+	MergePriority
+	// MergeLatest forwards packets only from the source that most recently
+	// became active ("last takes precedence"). Control returns to the other
+	// active sources when that source becomes inactive.
+	MergeLatest
+	// MergeHTP merges the latest pixel state of every active source, forwarding
+	// the highest value of each pixel channel ("highest takes precedence").
+	MergeHTP
+	// MergeManual forwards packets only from the source selected with a
+	// Device's SelectSource method. If no source is selected, no packets are
+	// forwarded.
+	MergeManual
+)
+
+func (mp MergePolicy) String() string {
+	switch mp {
+	case MergeAll:
+		return "all"
+	case MergePriority:
+		return "priority"
+	case MergeLatest:
+		return "latest"
+	case MergeHTP:
+		return "htp"
+	case MergeManual:
+		return "manual"
+	default:
+		return fmt.Sprintf("MergePolicy(%d)", int(mp))
+	}
+}
+
+// SourceInfo is information about an upstream source that has sent packets to
+// a proxy Device.
+type SourceInfo struct {
+	// Addr is the address of the source.
+	Addr *net.UDPAddr
+	// Priority is the source's priority, used by MergePriority.
+	Priority int
+
+	// Active is true if the source has sent a packet within the source timeout.
+	Active bool
+	// Selected is true if the source's packets are currently forwarded,
+	// according to the Device's MergePolicy.
+	Selected bool
+
+	// PacketsReceived is the number of packets received from this source.
+	PacketsReceived int64
+	// BytesReceived is the number of bytes received from this source.
+	BytesReceived int64
+	// PacketsForwarded is the number of packets from this source that were
+	// forwarded to the base device.
+	PacketsForwarded int64
+
+	// FirstSeen is the time when the first packet from this source was received.
+	FirstSeen time.Time
+	// LastSeen is the time when the latest packet from this source was received.
+	LastSeen time.Time
+}
+
+// sourceArbiter tracks the upstream sources of a proxy Device, and decides
+// which of their packets are forwarded.
+//
+// sourceArbiter is safe for concurrent use.
+type sourceArbiter struct {
+	policy   MergePolicy
+	timeout  time.Duration
+	priority func(addr *net.UDPAddr) int
+
+	mu sync.Mutex
+	// sources is the set of known sources, keyed on their address string.
+	sources map[string]*sourceState
+	// selected is the address of the manually-selected source, for MergeManual.
+	selected string
+}
+
+// sourceState is the state of a single upstream source.
+type sourceState struct {
+	key  string
+	info SourceInfo
+
+	// activeSince is the time when the source most recently became active.
+	activeSince time.Time
+}
+
+func makeSourceArbiter(policy MergePolicy, timeout time.Duration, priority func(*net.UDPAddr) int) *sourceArbiter {
+	if timeout <= 0 {
+		timeout = DefaultSourceTimeout
+	}
+	return &sourceArbiter{
+		policy:   policy,
+		timeout:  timeout,
+		priority: priority,
+	}
+}
+
+// accept records a packet of the specified size received from addr at now.
+//
+// It returns the source's key, and whether the packet should be forwarded
+// according to the arbiter's policy. If forwarding is false, the packet will
+// not be forwarded regardless, and is only recorded.
+func (sa *sourceArbiter) accept(addr *net.UDPAddr, size int, now time.Time, forwarding bool) (string, bool) {
+	key := addr.String()
+
+	sa.mu.Lock()
+	defer sa.mu.Unlock()
+
+	s := sa.sources[key]
+	switch {
+	case s == nil:
+		s = &sourceState{
+			key: key,
+			info: SourceInfo{
+				Addr:      addr,
+				FirstSeen: now,
+			},
+			activeSince: now,
+		}
+		if sa.priority != nil {
+			s.info.Priority = sa.priority(addr)
+		}
+
+		if sa.sources == nil {
+			sa.sources = make(map[string]*sourceState)
+		}
+		sa.sources[key] = s
+
+	case !sa.isActive(s, now):
+		s.activeSince = now
+	}
+	s.info.LastSeen = now
+	s.info.PacketsReceived++
+	s.info.BytesReceived += int64(size)
+
+	sa.forgetInactiveLocked(now)
+
+	selected := sa.isSelectedLocked(s, now)
+	if selected && forwarding {
+		s.info.PacketsForwarded++
+	}
+	return key, selected
+}
+
+// selectSource sets the manually-selected source to key. An empty key clears
+// the selection.
+func (sa *sourceArbiter) selectSource(key string) {
+	sa.mu.Lock()
+	defer sa.mu.Unlock()
+	sa.selected = key
+}
+
+// sourceInfo returns the SourceInfo of each known source, sorted by address.
+func (sa *sourceArbiter) sourceInfo(now time.Time) []SourceInfo {
+	sa.mu.Lock()
+	defer sa.mu.Unlock()
+
+	if len(sa.sources) == 0 {
+		return nil
+	}
+
+	winner := sa.winnerLocked(now)
+	infos := make([]SourceInfo, 0, len(sa.sources))
+	for _, s := range sa.sources {
+		info := s.info
+		info.Active = sa.isActive(s, now)
+		switch sa.policy {
+		case MergeAll, MergeHTP:
+			info.Selected = info.Active
+		default:
+			info.Selected = (s == winner)
+		}
+		infos = append(infos, info)
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Addr.String() < infos[j].Addr.String() })
+	return infos
+}
+
+func (sa *sourceArbiter) isActive(s *sourceState, now time.Time) bool {
+	return now.Sub(s.info.LastSeen) <= sa.timeout
+}
+
+// isSelectedLocked returns true if packets from s should be forwarded at now.
+func (sa *sourceArbiter) isSelectedLocked(s *sourceState, now time.Time) bool {
+	switch sa.policy {
+	case MergeAll, MergeHTP:
+		return true
+	default:
+		return s == sa.winnerLocked(now)
+	}
+}
+
+// winnerLocked returns the single source whose packets are forwarded at now,
+// for policies that forward a single source. It returns nil if there is no
+// such source.
+func (sa *sourceArbiter) winnerLocked(now time.Time) *sourceState {
+	if sa.policy == MergeManual {
+		return sa.sources[sa.selected]
+	}
+
+	var best *sourceState
+	for _, s := range sa.sources {
+		if !sa.isActive(s, now) {
+			continue
+		}
+		if best == nil || sa.beats(s, best) {
+			best = s
+		}
+	}
+	return best
+}
+
+// beats returns true if a takes precedence over b.
+func (sa *sourceArbiter) beats(a, b *sourceState) bool {
+	switch {
+	case sa.policy == MergePriority && a.info.Priority != b.info.Priority:
+		return a.info.Priority > b.info.Priority
+	case sa.policy == MergePriority && !a.activeSince.Equal(b.activeSince):
+		return a.activeSince.Before(b.activeSince)
+	case sa.policy == MergeLatest && !a.activeSince.Equal(b.activeSince):
+		return a.activeSince.After(b.activeSince)
+	default:
+		// Break ties deterministically.
+		return a.key < b.key
+	}
+}
+
+func (sa *sourceArbiter) forgetInactiveLocked(now time.Time) {
+	retention := sourceRetention
+	if sa.timeout > retention {
+		retention = sa.timeout
+	}
+
+	for key, s := range sa.sources {
+		if now.Sub(s.info.LastSeen) > retention && key != sa.selected {
+			delete(sa.sources, key)
+		}
+	}
+}
+
+// htpMerger merges the pixel states of several upstream sources, taking the
+// highest value of each pixel channel.
+//
+// htpMerger is not safe for concurrent use.
+type htpMerger struct {
+	timeout time.Duration
+
+	// sources is the latest strip state of each source, keyed on the source's
+	// key.
+	sources map[string]*htpSource
+}
+
+// htpSource is the latest state of a single upstream source.
+type htpSource struct {
+	lastSeen time.Time
+	strips   map[pixelpusher.StripNumber]*pixelpusher.StripState
+}
+
+// merge records the strip states in pkt, received from source at now, and
+// replaces each of them with its merge with the states of the other active
+// sources. It returns true if pkt was modified.
+func (hm *htpMerger) merge(source string, now time.Time, pkt *protocol.Packet) bool {
+	states := pixelStripStates(pkt)
+	if states == nil {
+		return false
+	}
+
+	hs := hm.sources[source]
+	if hs == nil {
+		hs = &htpSource{strips: make(map[pixelpusher.StripNumber]*pixelpusher.StripState)}
+		if hm.sources == nil {
+			hm.sources = make(map[string]*htpSource)
+		}
+		hm.sources[source] = hs
+	}
+	hs.lastSeen = now
+
+	// Forget sources that are no longer active.
+	for key, other := range hm.sources {
+		if now.Sub(other.lastSeen) > hm.timeout {
+			delete(hm.sources, key)
+		}
+	}
+
+	modified := false
+	for i, ss := range states {
+		// Record a clone, since ss's pixel data belongs to the received datagram.
+		hs.strips[ss.StripNumber] = ss.Clone()
+
+		var merged *pixelpusher.StripState
+		for key, other := range hm.sources {
+			if key == source {
+				continue
+			}
+			oss := other.strips[ss.StripNumber]
+			if oss == nil {
+				continue
+			}
+			if merged == nil {
+				merged = ss.Clone()
+			}
+			mergeHTP(merged, oss)
+		}
+
+		if merged != nil {
+			states[i] = merged
+			modified = true
+		}
+	}
+	return modified
+}
+
+// mergeHTP sets each pixel channel in dst to the higher of its value and the
+// corresponding value in src.
+func mergeHTP(dst, src *pixelpusher.StripState) {
+	count := dst.Pixels.Len()
+	if l := src.Pixels.Len(); l < count {
+		count = l
+	}
+
+	max := func(a, b uint8) uint8 {
+		if a > b {
+			return a
+		}
+		return b
+	}
+	for i := 0; i < count; i++ {
+		a, b := dst.Pixels.Pixel(i), src.Pixels.Pixel(i)
+		dst.Pixels.SetPixel(i, pixel.P{
+			Red:    max(a.Red, b.Red),
+			Green:  max(a.Green, b.Green),
+			Blue:   max(a.Blue, b.Blue),
+			Orange: max(a.Orange, b.Orange),
+			White:  max(a.White, b.White),
+		})
+	}
+}
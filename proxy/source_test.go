@@ -0,0 +1,159 @@
+// Copyright 2018 Dan Jacques. All rights reserved.
+// Use of this source code is governed under the MIT License
+// that can be found in the LICENSE file.
+
+package proxy
+
+import (
+	"net"
+	"time"
+
+	"github.com/danjacques/gopushpixels/pixel"
+	"github.com/danjacques/gopushpixels/protocol"
+	"github.com/danjacques/gopushpixels/protocol/pixelpusher"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Source arbitration", func() {
+	srcA := &net.UDPAddr{IP: net.ParseIP("10.0.0.1"), Port: 1000}
+	srcB := &net.UDPAddr{IP: net.ParseIP("10.0.0.2"), Port: 2000}
+	now := time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC)
+	at := func(ms int) time.Time { return now.Add(time.Duration(ms) * time.Millisecond) }
+
+	accept := func(sa *sourceArbiter, addr *net.UDPAddr, t time.Time) bool {
+		_, selected := sa.accept(addr, 10, t, true)
+		return selected
+	}
+
+	It("forwards every source by default", func() {
+		sa := makeSourceArbiter(MergeAll, 0, nil)
+		Expect(sa.timeout).To(Equal(DefaultSourceTimeout))
+		Expect(accept(sa, srcA, at(0))).To(BeTrue())
+		Expect(accept(sa, srcB, at(1))).To(BeTrue())
+		Expect(accept(sa, srcA, at(2))).To(BeTrue())
+
+		infos := sa.sourceInfo(at(3))
+		Expect(infos).To(HaveLen(2))
+		Expect(infos[0].Addr).To(Equal(srcA))
+		Expect(infos[0].PacketsReceived).To(BeEquivalentTo(2))
+		Expect(infos[0].BytesReceived).To(BeEquivalentTo(20))
+		Expect(infos[0].PacketsForwarded).To(BeEquivalentTo(2))
+		Expect(infos[0].FirstSeen).To(Equal(at(0)))
+		Expect(infos[0].LastSeen).To(Equal(at(2)))
+		Expect(infos[0].Active).To(BeTrue())
+		Expect(infos[0].Selected).To(BeTrue())
+		Expect(infos[1].Addr).To(Equal(srcB))
+	})
+
+	It("does not count packets as forwarded when forwarding is disabled", func() {
+		sa := makeSourceArbiter(MergeAll, 0, nil)
+		_, selected := sa.accept(srcA, 10, at(0), false)
+		Expect(selected).To(BeTrue())
+		Expect(sa.sourceInfo(at(0))[0].PacketsForwarded).To(BeZero())
+	})
+
+	It("forwards the highest priority active source", func() {
+		sa := makeSourceArbiter(MergePriority, 100*time.Millisecond, func(addr *net.UDPAddr) int {
+			if addr.IP.Equal(srcB.IP) {
+				return 10
+			}
+			return 0
+		})
+
+		Expect(accept(sa, srcA, at(0))).To(BeTrue())
+		Expect(accept(sa, srcB, at(10))).To(BeTrue())
+		Expect(accept(sa, srcA, at(20))).To(BeFalse())
+
+		infos := sa.sourceInfo(at(20))
+		Expect(infos[0].Selected).To(BeFalse())
+		Expect(infos[0].PacketsForwarded).To(BeEquivalentTo(1))
+		Expect(infos[1].Priority).To(Equal(10))
+		Expect(infos[1].Selected).To(BeTrue())
+
+		By("falling back once the higher priority source is inactive")
+		Expect(accept(sa, srcA, at(200))).To(BeTrue())
+		Expect(sa.sourceInfo(at(200))[1].Active).To(BeFalse())
+	})
+
+	It("forwards the source that most recently became active", func() {
+		sa := makeSourceArbiter(MergeLatest, 100*time.Millisecond, nil)
+
+		Expect(accept(sa, srcA, at(0))).To(BeTrue())
+		Expect(accept(sa, srcB, at(10))).To(BeTrue())
+		Expect(accept(sa, srcA, at(20))).To(BeFalse())
+		Expect(accept(sa, srcB, at(30))).To(BeTrue())
+
+		By("returning control once the latest source is inactive")
+		Expect(accept(sa, srcA, at(90))).To(BeFalse())
+		Expect(accept(sa, srcA, at(180))).To(BeTrue())
+
+		By("taking control again when the source becomes active again")
+		Expect(accept(sa, srcB, at(190))).To(BeTrue())
+		Expect(accept(sa, srcA, at(200))).To(BeFalse())
+	})
+
+	It("forwards only the manually selected source", func() {
+		sa := makeSourceArbiter(MergeManual, 0, nil)
+
+		Expect(accept(sa, srcA, at(0))).To(BeFalse())
+		Expect(accept(sa, srcB, at(0))).To(BeFalse())
+
+		sa.selectSource(srcB.String())
+		Expect(accept(sa, srcA, at(10))).To(BeFalse())
+		Expect(accept(sa, srcB, at(10))).To(BeTrue())
+
+		sa.selectSource("")
+		Expect(accept(sa, srcB, at(20))).To(BeFalse())
+	})
+
+	It("forgets sources that have been inactive for a long time", func() {
+		sa := makeSourceArbiter(MergeAll, 0, nil)
+		accept(sa, srcA, at(0))
+		accept(sa, srcB, at(0).Add(sourceRetention+time.Second))
+
+		infos := sa.sourceInfo(at(0).Add(sourceRetention + time.Second))
+		Expect(infos).To(HaveLen(1))
+		Expect(infos[0].Addr).To(Equal(srcB))
+	})
+
+	Context("merging highest-takes-precedence", func() {
+		makePacket := func(p pixel.P) *protocol.Packet {
+			ss := pixelpusher.StripState{StripNumber: 0}
+			ss.Pixels.SetPixels(p, p)
+			return &protocol.Packet{PixelPusher: &pixelpusher.Packet{
+				StripStates: []*pixelpusher.StripState{&ss},
+			}}
+		}
+		firstPixel := func(pkt *protocol.Packet) pixel.P {
+			return pkt.PixelPusher.StripStates[0].Pixels.Pixel(0)
+		}
+
+		It("merges the highest channel values of active sources", func() {
+			hm := htpMerger{timeout: 100 * time.Millisecond}
+
+			pkt := makePacket(pixel.P{Red: 100, Green: 10})
+			Expect(hm.merge("a", at(0), pkt)).To(BeFalse())
+
+			pkt = makePacket(pixel.P{Red: 50, Blue: 200})
+			orig := pkt.PixelPusher.StripStates[0]
+			Expect(hm.merge("b", at(10), pkt)).To(BeTrue())
+			Expect(firstPixel(pkt)).To(Equal(pixel.P{Red: 100, Green: 10, Blue: 200}))
+
+			By("not modifying the received pixel data")
+			Expect(orig.Pixels.Pixel(0)).To(Equal(pixel.P{Red: 50, Blue: 200}))
+
+			By("excluding sources once they are inactive")
+			pkt = makePacket(pixel.P{Red: 50})
+			Expect(hm.merge("b", at(200), pkt)).To(BeFalse())
+			Expect(firstPixel(pkt)).To(Equal(pixel.P{Red: 50}))
+		})
+
+		It("ignores command packets", func() {
+			hm := htpMerger{timeout: time.Second}
+			pkt := protocol.Packet{PixelPusher: &pixelpusher.Packet{Command: &pixelpusher.ResetCommand{}}}
+			Expect(hm.merge("a", at(0), &pkt)).To(BeFalse())
+		})
+	})
+})
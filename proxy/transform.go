@@ -0,0 +1,115 @@
+// Copyright 2018 Dan Jacques. All rights reserved.
+// Use of this source code is governed under the MIT License
+// that can be found in the LICENSE file.
+
+package proxy
+
+import (
+	"github.com/danjacques/gopushpixels/device"
+	"github.com/danjacques/gopushpixels/protocol"
+	"github.com/danjacques/gopushpixels/support/byteslicereader"
+	"github.com/danjacques/gopushpixels/support/network"
+
+	"github.com/pkg/errors"
+)
+
+// Transformer modifies packets that a proxy Device forwards to its base
+// device.
+//
+// The packets passed to a Transformer share their pixel data with the received
+// datagram, which is also delivered to Listeners. A Transformer must not modify
+// pixel data in place; instead, it should replace a StripState with a modified
+// copy (see pixelpusher.StripState's Clone).
+type Transformer interface {
+	// Transform transforms pkt, which is being forwarded to base. It returns
+	// true if it modified pkt.
+	Transform(base device.D, pkt *protocol.Packet) bool
+}
+
+// TransformerFunc is a function that implements Transformer.
+type TransformerFunc func(base device.D, pkt *protocol.Packet) bool
+
+// Transform implements Transformer.
+func (fn TransformerFunc) Transform(base device.D, pkt *protocol.Packet) bool { return fn(base, pkt) }
+
+// transformPipeline applies a chain of Transformers to the datagrams that a
+// proxy Device forwards to its base device.
+//
+// A transformPipeline is not safe for concurrent use.
+type transformPipeline struct {
+	transformers []Transformer
+	base         device.D
+
+	pr     *protocol.PacketReader
+	ps     *protocol.PacketStream
+	parsed protocol.Packet
+}
+
+func makeTransformPipeline(base device.D, transformers []Transformer) (*transformPipeline, error) {
+	dh := base.DiscoveryHeaders()
+	pr, err := dh.PacketReader()
+	if err != nil {
+		return nil, errors.Wrap(err, "could not create PacketReader")
+	}
+	ps, err := dh.PacketStream()
+	if err != nil {
+		return nil, errors.Wrap(err, "could not create PacketStream")
+	}
+
+	return &transformPipeline{
+		transformers: transformers,
+		base:         base,
+		pr:           pr,
+		ps:           ps,
+	}, nil
+}
+
+// forward parses data and applies the pipeline's Transformers to it. If any
+// Transformer modified the packet, it is re-encoded and sent to ds.
+//
+// If no Transformer modified the packet, forward returns false without sending
+// anything, and the caller should forward data unchanged.
+func (tp *transformPipeline) forward(ds network.DatagramSender, data []byte) (bool, error) {
+	bsr := byteslicereader.R{Buffer: data}
+	if err := tp.pr.ReadPacket(&bsr, &tp.parsed); err != nil {
+		// We can't transform a packet that we can't parse.
+		return false, nil
+	}
+
+	modified := false
+	for _, t := range tp.transformers {
+		if t.Transform(tp.base, &tp.parsed) {
+			modified = true
+		}
+	}
+	if !modified {
+		return false, nil
+	}
+
+	// Preserve the sender's packet sequence.
+	if pp := tp.parsed.PixelPusher; pp != nil {
+		tp.ps.PixelPusher.NextID = pp.ID
+	}
+	if err := tp.ps.Send(ds, &tp.parsed); err != nil {
+		return true, err
+	}
+	return true, tp.ps.Flush(ds)
+}
+
+// countingSender is a network.DatagramSender that counts the datagrams that
+// it sends.
+type countingSender struct {
+	network.DatagramSender
+
+	packets int
+	bytes   int
+}
+
+func (cs *countingSender) SendDatagram(b []byte) error {
+	if err := cs.DatagramSender.SendDatagram(b); err != nil {
+		return err
+	}
+	cs.packets++
+	cs.bytes += len(b)
+	return nil
+}
@@ -0,0 +1,230 @@
+// Copyright 2018 Dan Jacques. All rights reserved.
+// Use of this source code is governed under the MIT License
+// that can be found in the LICENSE file.
+
+package proxy
+
+import (
+	"net"
+
+	"github.com/danjacques/gopushpixels/device"
+	"github.com/danjacques/gopushpixels/pixel"
+	"github.com/danjacques/gopushpixels/protocol"
+	"github.com/danjacques/gopushpixels/protocol/pixelpusher"
+	"github.com/danjacques/gopushpixels/support/byteslicereader"
+	"github.com/danjacques/gopushpixels/support/network"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+type recordingSender struct {
+	datagrams [][]byte
+}
+
+func (rs *recordingSender) SendDatagram(b []byte) error {
+	rs.datagrams = append(rs.datagrams, append([]byte(nil), b...))
+	return nil
+}
+
+func (rs *recordingSender) MaxDatagramSize() int { return network.MaxUDPSize }
+
+func (rs *recordingSender) Close() error { return nil }
+
+var _ = Describe("Transformers", func() {
+	dh := protocol.DiscoveryHeaders{
+		DeviceHeader: protocol.DeviceHeader{
+			DeviceType: protocol.PixelPusherDeviceType,
+		},
+		PixelPusher: &pixelpusher.Device{
+			DeviceHeader: pixelpusher.DeviceHeader{
+				StripsAttached:     2,
+				MaxStripsPerPacket: 2,
+				PixelsPerStrip:     3,
+			},
+			DeviceHeaderExt109: pixelpusher.DeviceHeaderExt109{
+				StripFlags: make([]pixelpusher.StripFlags, 2),
+			},
+		},
+	}
+	base := device.MakeRemote("base", &dh)
+
+	makeStripState := func(strip int, pixels ...pixel.P) *pixelpusher.StripState {
+		ss := pixelpusher.StripState{StripNumber: pixelpusher.StripNumber(strip)}
+		ss.Pixels.SetPixels(pixels...)
+		return &ss
+	}
+
+	// encode encodes strip states into a single datagram.
+	encode := func(id uint32, states ...*pixelpusher.StripState) []byte {
+		ps, err := dh.PacketStream()
+		Expect(err).ToNot(HaveOccurred())
+		ps.PixelPusher.NextID = id
+
+		var rs recordingSender
+		Expect(ps.Send(&rs, &protocol.Packet{PixelPusher: &pixelpusher.Packet{StripStates: states}})).To(Succeed())
+		Expect(ps.Flush(&rs)).To(Succeed())
+		Expect(rs.datagrams).To(HaveLen(1))
+		return rs.datagrams[0]
+	}
+
+	decode := func(data []byte) *pixelpusher.Packet {
+		pr, err := dh.PacketReader()
+		Expect(err).ToNot(HaveOccurred())
+
+		var pkt protocol.Packet
+		Expect(pr.ReadPacket(&byteslicereader.R{Buffer: data}, &pkt)).To(Succeed())
+		return pkt.PixelPusher
+	}
+
+	pixels := func(ss *pixelpusher.StripState) []pixel.P {
+		result := make([]pixel.P, ss.Pixels.Len())
+		for i := range result {
+			result[i] = ss.Pixels.Pixel(i)
+		}
+		return result
+	}
+
+	var data, orig []byte
+	BeforeEach(func() {
+		data = encode(42,
+			makeStripState(0, pixel.P{Red: 255}, pixel.P{Green: 128}, pixel.P{Blue: 64}),
+			makeStripState(1, pixel.P{Red: 10, Green: 20, Blue: 30}, pixel.P{}, pixel.P{}))
+		orig = append([]byte(nil), data...)
+	})
+
+	transform := func(transformers ...Transformer) (bool, *pixelpusher.Packet) {
+		tp, err := makeTransformPipeline(base, transformers)
+		Expect(err).ToNot(HaveOccurred())
+
+		var rs recordingSender
+		transformed, err := tp.forward(&rs, data)
+		Expect(err).ToNot(HaveOccurred())
+
+		By("never modifying the original datagram")
+		Expect(data).To(Equal(orig))
+
+		if !transformed {
+			Expect(rs.datagrams).To(BeEmpty())
+			return false, nil
+		}
+		Expect(rs.datagrams).To(HaveLen(1))
+		return true, decode(rs.datagrams[0])
+	}
+
+	It("does not send packets that are not modified", func() {
+		transformed, _ := transform(MakeBrightness(1), MakeGamma(1), ChannelSwap{0, 1, 2}, StripRemap{})
+		Expect(transformed).To(BeFalse())
+	})
+
+	It("does not transform unparseable packets", func() {
+		data = []byte{0x00}
+		orig = data
+		transformed, _ := transform(MakeBrightness(0.5))
+		Expect(transformed).To(BeFalse())
+	})
+
+	It("scales brightness and preserves the packet ID", func() {
+		transformed, pkt := transform(MakeBrightness(0.5))
+		Expect(transformed).To(BeTrue())
+		Expect(pkt.ID).To(BeEquivalentTo(42))
+		Expect(pixels(pkt.StripStates[0])).To(Equal([]pixel.P{{Red: 128}, {Green: 64}, {Blue: 32}}))
+		Expect(pixels(pkt.StripStates[1])).To(Equal([]pixel.P{{Red: 5, Green: 10, Blue: 15}, {}, {}}))
+	})
+
+	It("applies gamma correction", func() {
+		transformed, pkt := transform(MakeGamma(2))
+		Expect(transformed).To(BeTrue())
+		Expect(pixels(pkt.StripStates[0])).To(Equal([]pixel.P{{Red: 255}, {Green: 64}, {Blue: 16}}))
+	})
+
+	It("swaps channels", func() {
+		transformed, pkt := transform(ChannelSwap{1, 0, 2})
+		Expect(transformed).To(BeTrue())
+		Expect(pixels(pkt.StripStates[0])).To(Equal([]pixel.P{{Green: 255}, {Red: 128}, {Blue: 64}}))
+	})
+
+	It("remaps and drops strips", func() {
+		transformed, pkt := transform(StripRemap{0: -1, 1: 0})
+		Expect(transformed).To(BeTrue())
+		Expect(pkt.StripStates).To(HaveLen(1))
+		Expect(pkt.StripStates[0].StripNumber).To(BeEquivalentTo(0))
+		Expect(pixels(pkt.StripStates[0])).To(Equal([]pixel.P{{Red: 10, Green: 20, Blue: 30}, {}, {}}))
+	})
+
+	It("masks pixel ranges", func() {
+		transformed, pkt := transform(Mask{{Strip: 0, Offset: 1, Length: 2}})
+		Expect(transformed).To(BeTrue())
+		Expect(pixels(pkt.StripStates[0])).To(Equal([]pixel.P{{Red: 255}, {}, {}}))
+		Expect(pixels(pkt.StripStates[1])).To(Equal([]pixel.P{{Red: 10, Green: 20, Blue: 30}, {}, {}}))
+	})
+
+	It("chains transformers in order", func() {
+		transformed, pkt := transform(
+			TransformerFunc(func(d device.D, pkt *protocol.Packet) bool {
+				Expect(d).To(Equal(base))
+				return false
+			}),
+			ChannelSwap{2, 1, 0},
+			Mask{{Strip: 0, Offset: 0, Length: 1}},
+		)
+		Expect(transformed).To(BeTrue())
+		Expect(pixels(pkt.StripStates[0])).To(Equal([]pixel.P{{}, {Green: 128}, {Red: 64}}))
+	})
+
+	Context("forwarding through a proxy Device", func() {
+		var (
+			tb *testBase
+			m  *Manager
+		)
+		BeforeEach(func() {
+			tb = startTestBase("base", &dh)
+			m = &Manager{ProxyAddr: net.ParseIP("127.0.0.1")}
+		})
+		AfterEach(func() {
+			Expect(m.Close()).To(Succeed())
+			tb.close()
+		})
+
+		// forward sends data through a proxy Device for tb with the specified
+		// Transformers. It returns the datagram that tb receives, and the number
+		// of packets that were counted as transformed.
+		forward := func(transformers ...Transformer) (*Device, []byte, float64) {
+			m.Transformers = transformers
+			Expect(m.AddDevice(tb)).To(Succeed())
+			pd := m.ProxyDevices()[0]
+			transformed := proxyTransformedPackets.With(pd.counterLabels)
+			before := testutil.ToFloat64(transformed)
+
+			sendToProxy(pd, data)
+			var received []byte
+			Eventually(tb.datagramC).Should(Receive(&received))
+			return pd, received, testutil.ToFloat64(transformed) - before
+		}
+
+		It("forwards the raw datagram when no Transformer modifies it", func(done Done) {
+			defer close(done)
+
+			pd, received, transformed := forward(MakeBrightness(1))
+			Expect(received).To(Equal(orig))
+			Expect(transformed).To(BeZero())
+			Expect(pd.Info().PacketsSent).To(BeEquivalentTo(1))
+		}, 5)
+
+		It("forwards re-encoded datagrams when a Transformer modifies them", func(done Done) {
+			defer close(done)
+
+			pd, received, transformed := forward(MakeBrightness(0.5))
+			Expect(received).ToNot(Equal(orig))
+
+			pkt := decode(received)
+			Expect(pkt.ID).To(BeEquivalentTo(42))
+			Expect(pixels(pkt.StripStates[0])).To(Equal([]pixel.P{{Red: 128}, {Green: 64}, {Blue: 32}}))
+			Expect(transformed).To(BeEquivalentTo(1))
+			Expect(pd.Info().PacketsSent).To(BeEquivalentTo(1))
+			Expect(pd.Info().BytesSent).To(BeEquivalentTo(len(received)))
+		}, 5)
+	})
+})
@@ -0,0 +1,204 @@
+// Copyright 2018 Dan Jacques. All rights reserved.
+// Use of this source code is governed under the MIT License
+// that can be found in the LICENSE file.
+
+package proxy
+
+import (
+	"math"
+
+	"github.com/danjacques/gopushpixels/device"
+	"github.com/danjacques/gopushpixels/pixel"
+	"github.com/danjacques/gopushpixels/protocol"
+	"github.com/danjacques/gopushpixels/protocol/pixelpusher"
+)
+
+// pixelStripStates returns the strip states of pkt, or nil if pkt is not a
+// PixelPusher pixel packet.
+func pixelStripStates(pkt *protocol.Packet) []*pixelpusher.StripState {
+	if pp := pkt.PixelPusher; pp != nil && pp.Command == nil {
+		return pp.StripStates
+	}
+	return nil
+}
+
+// mapPixels replaces each strip state in states for which include returns
+// true with a copy whose pixels have been transformed by fn. It returns true if
+// any strip state was replaced.
+func mapPixels(states []*pixelpusher.StripState, include func(ss *pixelpusher.StripState) bool,
+	fn func(ss *pixelpusher.StripState, i int, p pixel.P) pixel.P) bool {
+
+	modified := false
+	for i, ss := range states {
+		if include != nil && !include(ss) {
+			continue
+		}
+
+		clone := ss.Clone()
+		for j := 0; j < clone.Pixels.Len(); j++ {
+			clone.Pixels.SetPixel(j, fn(clone, j, clone.Pixels.Pixel(j)))
+		}
+		states[i] = clone
+		modified = true
+	}
+	return modified
+}
+
+// channelTransform is a Transformer that maps every pixel channel value
+// through a lookup table.
+type channelTransform struct {
+	table    [256]uint8
+	identity bool
+}
+
+func makeChannelTransform(fn func(v float64) float64) *channelTransform {
+	var ct channelTransform
+	ct.identity = true
+	for i := range ct.table {
+		v := math.Round(fn(float64(i)/255) * 255)
+		switch {
+		case v < 0:
+			v = 0
+		case v > 255:
+			v = 255
+		}
+		ct.table[i] = uint8(v)
+		if ct.table[i] != uint8(i) {
+			ct.identity = false
+		}
+	}
+	return &ct
+}
+
+// Transform implements Transformer.
+func (ct *channelTransform) Transform(base device.D, pkt *protocol.Packet) bool {
+	if ct.identity {
+		return false
+	}
+
+	return mapPixels(pixelStripStates(pkt), nil, func(_ *pixelpusher.StripState, _ int, p pixel.P) pixel.P {
+		return pixel.P{
+			Red:    ct.table[p.Red],
+			Green:  ct.table[p.Green],
+			Blue:   ct.table[p.Blue],
+			Orange: ct.table[p.Orange],
+			White:  ct.table[p.White],
+		}
+	})
+}
+
+// MakeBrightness returns a Transformer that scales the brightness of every
+// pixel channel by scale. Scales above 1 brighten pixels, saturating at full
+// brightness.
+func MakeBrightness(scale float64) Transformer {
+	return makeChannelTransform(func(v float64) float64 { return v * scale })
+}
+
+// MakeGamma returns a Transformer that applies gamma correction to every pixel
+// channel, raising each normalized channel value to the power of gamma.
+func MakeGamma(gamma float64) Transformer {
+	return makeChannelTransform(func(v float64) float64 { return math.Pow(v, gamma) })
+}
+
+// ChannelSwap is a Transformer that permutes the red, green, and blue
+// channels of every pixel. Each entry identifies the source channel of the
+// corresponding output channel: 0 for red, 1 for green, and 2 for blue.
+//
+// For example, ChannelSwap{1, 0, 2} swaps the red and green channels, which
+// corrects for GRB strips. An invalid ChannelSwap does nothing.
+type ChannelSwap [3]int
+
+// Transform implements Transformer.
+func (cs ChannelSwap) Transform(base device.D, pkt *protocol.Packet) bool {
+	identity := true
+	for i, src := range cs {
+		if src < 0 || src > 2 {
+			return false
+		}
+		if src != i {
+			identity = false
+		}
+	}
+	if identity {
+		return false
+	}
+
+	return mapPixels(pixelStripStates(pkt), nil, func(_ *pixelpusher.StripState, _ int, p pixel.P) pixel.P {
+		rgb := [3]uint8{p.Red, p.Green, p.Blue}
+		p.Red, p.Green, p.Blue = rgb[cs[0]], rgb[cs[1]], rgb[cs[2]]
+		return p
+	})
+}
+
+// StripRemap is a Transformer that changes the strip numbers of strip states.
+// It maps a source strip number to a destination strip number. Strips that are
+// not in the map are unchanged, and strips mapped to a negative number are
+// dropped.
+type StripRemap map[int]int
+
+// Transform implements Transformer.
+func (sr StripRemap) Transform(base device.D, pkt *protocol.Packet) bool {
+	states := pixelStripStates(pkt)
+	if len(states) == 0 || len(sr) == 0 {
+		return false
+	}
+
+	modified := false
+	kept := states[:0]
+	for _, ss := range states {
+		dst, ok := sr[int(ss.StripNumber)]
+		switch {
+		case !ok:
+			kept = append(kept, ss)
+		case dst < 0:
+			modified = true
+		default:
+			// The pixel data is not modified, so it can be shared.
+			kept = append(kept, &pixelpusher.StripState{
+				StripNumber: pixelpusher.StripNumber(dst),
+				Pixels:      ss.Pixels,
+			})
+			modified = true
+		}
+	}
+	pkt.PixelPusher.StripStates = kept
+	return modified
+}
+
+// MaskRange is a range of pixels on a strip.
+type MaskRange struct {
+	// Strip is the strip number.
+	Strip int
+	// Offset is the index of the first pixel in the range.
+	Offset int
+	// Length is the number of pixels in the range.
+	Length int
+}
+
+func (mr *MaskRange) contains(strip, i int) bool {
+	return strip == mr.Strip && i >= mr.Offset && i < mr.Offset+mr.Length
+}
+
+// Mask is a Transformer that sets the pixels in each of its ranges to black.
+type Mask []MaskRange
+
+// Transform implements Transformer.
+func (m Mask) Transform(base device.D, pkt *protocol.Packet) bool {
+	include := func(ss *pixelpusher.StripState) bool {
+		for i := range m {
+			if m[i].Strip == int(ss.StripNumber) {
+				return true
+			}
+		}
+		return false
+	}
+
+	return mapPixels(pixelStripStates(pkt), include, func(ss *pixelpusher.StripState, i int, p pixel.P) pixel.P {
+		for j := range m {
+			if m[j].contains(int(ss.StripNumber), i) {
+				return pixel.P{}
+			}
+		}
+		return p
+	})
+}
@@ -0,0 +1,16 @@
+// Copyright 2018 Dan Jacques. All rights reserved.
+// Use of this source code is governed under the MIT License
+// that can be found in the LICENSE file.
+
+// Package restore automatically restores a device's last known pixel state
+// after it reboots or reappears.
+//
+// A PixelPusher that power-cycles comes back dark. If its generator is
+// displaying a static scene, it may not resend for some time, leaving the
+// device dark. A Restorer watches a device registry for reboots and
+// reappearances and resends the device's last snapshot, as recorded by a
+// device.SnapshotManager.
+//
+// Optional Prometheus monitoring can be enabled by registering on startup
+// (generally init()) via RegisterMonitoring.
+package restore
@@ -0,0 +1,36 @@
+// Copyright 2018 Dan Jacques. All rights reserved.
+// Use of this source code is governed under the MIT License
+// that can be found in the LICENSE file.
+
+package restore
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	restoresCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "restore_restores",
+		Help: "Number of device state restores, by reason.",
+	},
+		[]string{"reason"})
+
+	restoreErrorsCounter = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "restore_errors",
+		Help: "Number of device state restores that failed to send.",
+	})
+
+	restoresSuppressedCounter = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "restore_suppressed",
+		Help: "Number of device state restores suppressed by rate limiting.",
+	})
+)
+
+// RegisterMonitoring registers all of this package's monitoring metrics.
+func RegisterMonitoring(reg prometheus.Registerer) {
+	reg.MustRegister(
+		restoresCounter,
+		restoreErrorsCounter,
+		restoresSuppressedCounter,
+	)
+}
@@ -0,0 +1,348 @@
+// Copyright 2018 Dan Jacques. All rights reserved.
+// Use of this source code is governed under the MIT License
+// that can be found in the LICENSE file.
+
+package restore
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/danjacques/gopushpixels/device"
+	"github.com/danjacques/gopushpixels/protocol"
+	"github.com/danjacques/gopushpixels/protocol/pixelpusher"
+	"github.com/danjacques/gopushpixels/support/logging"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	// DefaultPollInterval is the default interval at which a Restorer examines
+	// its devices.
+	DefaultPollInterval = time.Second
+
+	// DefaultGapThreshold is the default amount of time that a device must go
+	// unobserved before its next observation is considered a reappearance.
+	DefaultGapThreshold = 5 * time.Second
+
+	// DefaultMinInterval is the default minimum amount of time between restores
+	// of the same device.
+	DefaultMinInterval = 5 * time.Second
+)
+
+// Reason is the reason that a device's state is being restored.
+type Reason int
+
+const (
+	// Rebooted indicates that the device's discovery DeltaSequence was reset,
+	// suggesting that it rebooted.
+	Rebooted Reason = iota
+	// Reappeared indicates that the device was observed again after a gap in
+	// discovery announcements.
+	Reappeared
+	// Readded indicates that the device expired or was removed, and was then
+	// added back to the registry.
+	Readded
+)
+
+func (r Reason) String() string {
+	switch r {
+	case Rebooted:
+		return "rebooted"
+	case Reappeared:
+		return "reappeared"
+	case Readded:
+		return "readded"
+	default:
+		return "unknown"
+	}
+}
+
+// Policy determines whether a device's state should be restored for the
+// specified reason.
+type Policy func(d device.D, reason Reason) bool
+
+// Registry is a device registry that a Restorer can watch. It is implemented
+// by both device.Registry and discovery.Registry.
+type Registry interface {
+	// Watch returns a channel that receives an event whenever the registry's
+	// devices change.
+	Watch(c context.Context) <-chan device.RegistryEvent
+}
+
+// Restorer detects device reboots and reappearances, and resends the
+// device's last known snapshot when they occur.
+//
+// A device is considered to have rebooted if its discovery headers'
+// DeltaSequence decreases, since a PixelPusher resets this count when it
+// starts. Reboots are detected both when the Registry reports a DeltaSequence
+// reset and when devices are polled. A device has reappeared if it was observed
+// again after not being observed for GapThreshold. A device has been readded if
+// it was added to the Registry (other than initially) and the SnapshotManager
+// has a snapshot for it. The SnapshotManager's Retention should be set so that
+// it retains snapshots for devices that expire.
+//
+// A device's state is restored at most once per MinInterval.
+type Restorer struct {
+	// Snapshots is the SnapshotManager that records device state. It must not
+	// be nil.
+	Snapshots *device.SnapshotManager
+	// Registry is the registry whose devices are watched. It must not be nil.
+	Registry Registry
+
+	// Policy, if not nil, is consulted before each restore. If it returns
+	// false, the restore will be skipped. If nil, all restores will be
+	// performed.
+	Policy Policy
+
+	// PollInterval is the interval at which devices are examined for reboots
+	// and gaps. If <= 0, DefaultPollInterval will be used.
+	PollInterval time.Duration
+	// GapThreshold is the amount of time that a device must go unobserved
+	// before its next observation is considered a reappearance. If <= 0,
+	// DefaultGapThreshold will be used.
+	GapThreshold time.Duration
+	// MinInterval is the minimum amount of time between restores of the same
+	// device. If <= 0, DefaultMinInterval will be used.
+	MinInterval time.Duration
+
+	// Logger, if not nil, is the logger to use.
+	Logger logging.L
+
+	mu sync.Mutex
+	// devices is the state of each watched device, keyed on device ID.
+	devices map[string]*deviceState
+	// lastRestore is the time of the last restore of each device, keyed on
+	// device ID. It outlives devices, so that rate limiting spans a device
+	// being removed and readded.
+	lastRestore map[string]time.Time
+}
+
+// deviceState is the Restorer's record of a single device.
+type deviceState struct {
+	d device.D
+
+	deltaSequence uint32
+	observed      time.Time
+	// absent is true if the device has not been observed for GapThreshold.
+	absent bool
+}
+
+// Run runs the Restorer until c is cancelled.
+func (r *Restorer) Run(c context.Context) error {
+	pollInterval := r.PollInterval
+	if pollInterval <= 0 {
+		pollInterval = DefaultPollInterval
+	}
+	ticker := time.NewTicker(pollInterval)
+	defer ticker.Stop()
+
+	eventC := r.Registry.Watch(c)
+	for {
+		select {
+		case <-c.Done():
+			return c.Err()
+
+		case ev, ok := <-eventC:
+			if !ok {
+				return c.Err()
+			}
+			r.handleEvent(&ev, time.Now())
+
+		case now := <-ticker.C:
+			r.Poll(now)
+		}
+	}
+}
+
+func (r *Restorer) handleEvent(ev *device.RegistryEvent, now time.Time) {
+	d := ev.Device
+
+	switch ev.Type {
+	case device.DeviceAdded:
+		r.mu.Lock()
+		r.trackLocked(d)
+		r.mu.Unlock()
+
+		if !ev.Initial && r.Snapshots.HasSnapshotForDevice(d) {
+			r.restore(d, Readded, now)
+		}
+
+	case device.DeviceUpdated:
+		// Headers changed; examine the device immediately.
+		r.mu.Lock()
+		ds := r.devices[d.ID()]
+		var reason Reason
+		var ok bool
+		if ds != nil {
+			reason, ok = ds.examine(now, r.gapThreshold())
+
+			// A reported DeltaSequence change is a reset. We may not have seen the
+			// count rise since we last examined the device, so examine can miss it.
+			if hasChange(ev.Changes, "DeltaSequence") {
+				reason, ok = Rebooted, true
+			}
+		}
+		r.mu.Unlock()
+
+		if ok {
+			r.restore(d, reason, now)
+		}
+
+	case device.DeviceRemoved:
+		r.mu.Lock()
+		if ds := r.devices[d.ID()]; ds != nil && ds.d == d {
+			delete(r.devices, d.ID())
+		}
+		r.mu.Unlock()
+	}
+}
+
+// Poll examines each of the Restorer's devices for reboots and reappearances,
+// restoring them as needed.
+//
+// Poll is called automatically by Run, but may also be called directly.
+func (r *Restorer) Poll(now time.Time) {
+	type restore struct {
+		d      device.D
+		reason Reason
+	}
+	var restores []restore
+
+	r.mu.Lock()
+	gap := r.gapThreshold()
+	for _, ds := range r.devices {
+		if reason, ok := ds.examine(now, gap); ok {
+			restores = append(restores, restore{ds.d, reason})
+		}
+	}
+	r.mu.Unlock()
+
+	// Send outside of our lock.
+	for _, rs := range restores {
+		r.restore(rs.d, rs.reason, now)
+	}
+}
+
+func (r *Restorer) trackLocked(d device.D) {
+	ds := deviceState{d: d}
+	ds.deltaSequence = deltaSequence(d)
+	ds.observed = d.Info().Observed
+
+	if r.devices == nil {
+		r.devices = make(map[string]*deviceState)
+	}
+	r.devices[d.ID()] = &ds
+}
+
+// examine updates ds from its device's current state, and returns the reason
+// that it should be restored, if any.
+func (ds *deviceState) examine(now time.Time, gap time.Duration) (Reason, bool) {
+	seq := deltaSequence(ds.d)
+	observed := ds.d.Info().Observed
+
+	rebooted := seq < ds.deltaSequence
+	ds.deltaSequence = seq
+
+	reappeared := false
+	if observed.After(ds.observed) {
+		if ds.absent || observed.Sub(ds.observed) >= gap {
+			reappeared = !ds.observed.IsZero()
+		}
+		ds.observed = observed
+		ds.absent = false
+	} else if !ds.observed.IsZero() && now.Sub(ds.observed) >= gap {
+		ds.absent = true
+	}
+
+	switch {
+	case rebooted:
+		return Rebooted, true
+	case reappeared:
+		return Reappeared, true
+	default:
+		return 0, false
+	}
+}
+
+// restore resends d's last snapshot, subject to the Restorer's Policy and
+// rate limiting.
+func (r *Restorer) restore(d device.D, reason Reason, now time.Time) {
+	if r.Policy != nil && !r.Policy(d, reason) {
+		return
+	}
+
+	snap := r.Snapshots.SnapshotForDevice(d)
+	if snap == nil || len(snap.Strips) == 0 {
+		return
+	}
+
+	r.mu.Lock()
+	minInterval := r.MinInterval
+	if minInterval <= 0 {
+		minInterval = DefaultMinInterval
+	}
+	if last, ok := r.lastRestore[d.ID()]; ok && now.Sub(last) < minInterval {
+		r.mu.Unlock()
+		r.logger().Debugf("Suppressing restore of %s (%s): restored %s ago.", d.ID(), reason, now.Sub(last))
+		restoresSuppressedCounter.Inc()
+		return
+	}
+	if r.lastRestore == nil {
+		r.lastRestore = make(map[string]time.Time)
+	}
+	r.lastRestore[d.ID()] = now
+	r.mu.Unlock()
+
+	r.logger().Infof("Restoring state of %s (%s).", d.ID(), reason)
+	restoresCounter.With(prometheus.Labels{"reason": reason.String()}).Inc()
+	if err := send(d, snap); err != nil {
+		r.logger().Warnf("Failed to restore state of %s: %s", d.ID(), err)
+		restoreErrorsCounter.Inc()
+	}
+}
+
+func (r *Restorer) gapThreshold() time.Duration {
+	if r.GapThreshold > 0 {
+		return r.GapThreshold
+	}
+	return DefaultGapThreshold
+}
+
+func (r *Restorer) logger() logging.L { return logging.Must(r.Logger) }
+
+// send sends snap to d through a new Sender.
+func send(d device.D, snap *device.Snapshot) error {
+	s, err := d.Sender()
+	if err != nil {
+		return errors.Wrap(err, "could not create Sender")
+	}
+	defer s.Close()
+
+	pkt := protocol.Packet{
+		PixelPusher: &pixelpusher.Packet{
+			StripStates: snap.Strips,
+		},
+	}
+	return s.SendPacket(&pkt)
+}
+
+// hasChange returns true if changes includes a change to field.
+func hasChange(changes []protocol.HeaderChange, field string) bool {
+	for _, hc := range changes {
+		if hc.Field == field {
+			return true
+		}
+	}
+	return false
+}
+
+// deltaSequence returns d's discovery DeltaSequence, or 0 if it has none.
+func deltaSequence(d device.D) uint32 {
+	if dh := d.DiscoveryHeaders(); dh != nil && dh.PixelPusher != nil {
+		return dh.PixelPusher.DeltaSequence
+	}
+	return 0
+}
@@ -0,0 +1,250 @@
+// Copyright 2018 Dan Jacques. All rights reserved.
+// Use of this source code is governed under the MIT License
+// that can be found in the LICENSE file.
+
+package restore
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/danjacques/gopushpixels/device"
+	"github.com/danjacques/gopushpixels/pixel"
+	"github.com/danjacques/gopushpixels/protocol"
+	"github.com/danjacques/gopushpixels/protocol/pixelpusher"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+// testDevice is a device.D whose headers and observation time can be
+// manipulated, and which records the packets that are sent to it.
+type testDevice struct {
+	id    string
+	doneC chan struct{}
+
+	mu       sync.Mutex
+	dh       protocol.DiscoveryHeaders
+	observed time.Time
+	packets  []*protocol.Packet
+}
+
+func makeTestDevice(id string) *testDevice {
+	return &testDevice{
+		id:    id,
+		doneC: make(chan struct{}),
+		dh: protocol.DiscoveryHeaders{
+			DeviceHeader: protocol.DeviceHeader{DeviceType: protocol.PixelPusherDeviceType},
+			PixelPusher: &pixelpusher.Device{
+				DeviceHeader: pixelpusher.DeviceHeader{StripsAttached: 1, PixelsPerStrip: 1},
+				DeviceHeaderExt109: pixelpusher.DeviceHeaderExt109{
+					StripFlags: []pixelpusher.StripFlags{0},
+				},
+			},
+		},
+	}
+}
+
+func (td *testDevice) ID() string                     { return td.id }
+func (td *testDevice) Ordinal() device.Ordinal        { return device.InvalidOrdinal() }
+func (td *testDevice) Sender() (device.Sender, error) { return &testSender{td: td}, nil }
+func (td *testDevice) DoneC() <-chan struct{}         { return td.doneC }
+func (td *testDevice) Addr() net.Addr                 { return nil }
+
+func (td *testDevice) DiscoveryHeaders() *protocol.DiscoveryHeaders {
+	td.mu.Lock()
+	defer td.mu.Unlock()
+
+	dh := td.dh
+	pp := *dh.PixelPusher
+	dh.PixelPusher = &pp
+	return &dh
+}
+
+func (td *testDevice) Info() device.Info {
+	td.mu.Lock()
+	defer td.mu.Unlock()
+	return device.Info{Observed: td.observed}
+}
+
+func (td *testDevice) observe(t time.Time, deltaSequence uint32) {
+	td.mu.Lock()
+	defer td.mu.Unlock()
+	td.observed = t
+	td.dh.PixelPusher.DeltaSequence = deltaSequence
+}
+
+func (td *testDevice) sent() int {
+	td.mu.Lock()
+	defer td.mu.Unlock()
+	return len(td.packets)
+}
+
+type testSender struct {
+	device.Sender
+	td *testDevice
+}
+
+func (ts *testSender) SendPacket(pkt *protocol.Packet) error {
+	ts.td.mu.Lock()
+	defer ts.td.mu.Unlock()
+	ts.td.packets = append(ts.td.packets, pkt)
+	return nil
+}
+
+func (ts *testSender) Close() error { return nil }
+
+// testRegistry is a Registry that emits events on demand.
+type testRegistry struct {
+	device.RegistryWatchers
+}
+
+func (tr *testRegistry) Watch(c context.Context) <-chan device.RegistryEvent {
+	return tr.RegistryWatchers.Watch(c, nil)
+}
+
+var _ = Describe("Restorer", func() {
+	const gap = 10 * time.Second
+	start := time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	var sm *device.SnapshotManager
+	var r *Restorer
+	var d *testDevice
+	BeforeEach(func() {
+		sm = &device.SnapshotManager{}
+		r = &Restorer{
+			Snapshots:    sm,
+			Registry:     &testRegistry{},
+			GapThreshold: gap,
+			MinInterval:  time.Minute,
+		}
+
+		d = makeTestDevice("foo")
+		d.observe(start, 0)
+
+		ss := pixelpusher.StripState{StripNumber: 0}
+		ss.Pixels.Reset(1)
+		ss.Pixels.SetPixel(0, pixel.P{Red: 0xFF})
+		sm.HandlePacket(d, &protocol.Packet{
+			PixelPusher: &pixelpusher.Packet{StripStates: []*pixelpusher.StripState{&ss}},
+		})
+
+		r.handleEvent(&device.RegistryEvent{Type: device.DeviceAdded, Device: d, Initial: true}, start)
+	})
+	AfterEach(func() {
+		close(d.doneC)
+	})
+
+	It("does not restore a device that is observed regularly", func() {
+		for i := 1; i <= 5; i++ {
+			now := start.Add(time.Duration(i) * time.Second)
+			d.observe(now, uint32(i))
+			r.Poll(now)
+		}
+		Expect(d.sent()).To(BeZero())
+	})
+
+	It("restores a device whose DeltaSequence resets", func() {
+		d.observe(start.Add(time.Second), 5)
+		r.Poll(start.Add(time.Second))
+		Expect(d.sent()).To(BeZero())
+
+		d.observe(start.Add(2*time.Second), 0)
+		r.Poll(start.Add(2 * time.Second))
+		Expect(d.sent()).To(Equal(1))
+
+		pkt := d.packets[0]
+		Expect(pkt.PixelPusher.StripStates).To(HaveLen(1))
+		Expect(pkt.PixelPusher.StripStates[0].Pixels.Pixel(0)).To(Equal(pixel.P{Red: 0xFF}))
+	})
+
+	It("restores a device whose DeltaSequence reset is reported in an update", func() {
+		// The device's count rises and resets between polls.
+		d.observe(start.Add(time.Second), 5)
+		d.observe(start.Add(2*time.Second), 0)
+
+		r.handleEvent(&device.RegistryEvent{
+			Type:    device.DeviceUpdated,
+			Device:  d,
+			Changes: []protocol.HeaderChange{{Field: "DeltaSequence", Old: uint32(5), New: uint32(0)}},
+		}, start.Add(2*time.Second))
+		Expect(d.sent()).To(Equal(1))
+	})
+
+	It("restores a device that reappears after a gap", func() {
+		r.Poll(start.Add(gap))
+		Expect(d.sent()).To(BeZero())
+
+		d.observe(start.Add(gap+time.Second), 0)
+		r.Poll(start.Add(gap + time.Second))
+		Expect(d.sent()).To(Equal(1))
+	})
+
+	It("restores a device that is readded", func() {
+		r.handleEvent(&device.RegistryEvent{Type: device.DeviceRemoved, Device: d}, start)
+		r.handleEvent(&device.RegistryEvent{Type: device.DeviceAdded, Device: d}, start)
+		Expect(d.sent()).To(Equal(1))
+	})
+
+	It("rate limits restores", func() {
+		d.observe(start.Add(time.Second), 5)
+		r.Poll(start.Add(time.Second))
+		d.observe(start.Add(2*time.Second), 0)
+		r.Poll(start.Add(2 * time.Second))
+		Expect(d.sent()).To(Equal(1))
+
+		d.observe(start.Add(3*time.Second), 5)
+		r.Poll(start.Add(3 * time.Second))
+		d.observe(start.Add(4*time.Second), 0)
+		r.Poll(start.Add(4 * time.Second))
+		Expect(d.sent()).To(Equal(1))
+
+		d.observe(start.Add(2*time.Minute), 5)
+		r.Poll(start.Add(2 * time.Minute))
+		Expect(d.sent()).To(Equal(2))
+	})
+
+	It("consults its Policy", func() {
+		var reasons []Reason
+		r.Policy = func(d device.D, reason Reason) bool {
+			reasons = append(reasons, reason)
+			return false
+		}
+
+		d.observe(start.Add(gap), 0)
+		r.Poll(start.Add(gap))
+		Expect(reasons).To(Equal([]Reason{Reappeared}))
+		Expect(d.sent()).To(BeZero())
+	})
+
+	It("can run against a Registry", func(done Done) {
+		defer close(done)
+
+		c, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		reg := r.Registry.(*testRegistry)
+		r.PollInterval = time.Millisecond
+
+		errC := make(chan error)
+		go func() { errC <- r.Run(c) }()
+
+		// Events are delivered asynchronously, so keep re-adding the device until
+		// the Restorer has observed it.
+		Eventually(func() int {
+			reg.Send(device.RegistryEvent{Type: device.DeviceAdded, Device: d})
+			return d.sent()
+		}).Should(BeNumerically(">=", 1))
+
+		cancel()
+		Expect(<-errC).To(Equal(context.Canceled))
+	}, 5)
+})
+
+func TestRestore(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Restore")
+}
@@ -0,0 +1,80 @@
+// Copyright 2018 Dan Jacques. All rights reserved.
+// Use of this source code is governed under the MIT License
+// that can be found in the LICENSE file.
+
+// Package eventqueue implements an unbounded event queue, used to deliver
+// events to watchers so that a slow watcher never blocks the producer.
+package eventqueue
+
+import (
+	"context"
+	"sync"
+)
+
+// Queue is an unbounded, ordered queue of events.
+//
+// Events are added with Push, and delivered in order by Run. Queue is safe
+// for concurrent use.
+type Queue struct {
+	// signalC is signalled when an event is pushed.
+	signalC chan struct{}
+
+	mu     sync.Mutex
+	events []interface{}
+}
+
+// Make creates a new Queue, initially containing events.
+func Make(events ...interface{}) *Queue {
+	return &Queue{
+		signalC: make(chan struct{}, 1),
+		events:  events,
+	}
+}
+
+// Push adds ev to the end of the queue. Push never blocks.
+func (q *Queue) Push(ev interface{}) {
+	q.mu.Lock()
+	q.events = append(q.events, ev)
+	q.mu.Unlock()
+
+	select {
+	case q.signalC <- struct{}{}:
+	default:
+		// A signal is already pending.
+	}
+}
+
+// Run delivers queued events, in order, to deliver until c is cancelled or
+// deliver returns false.
+//
+// deliver will typically send the event on a channel, returning false if c
+// is cancelled first.
+func (q *Queue) Run(c context.Context, deliver func(ev interface{}) bool) {
+	for {
+		ev, ok := q.pop()
+		if !ok {
+			select {
+			case <-q.signalC:
+				continue
+			case <-c.Done():
+				return
+			}
+		}
+
+		if !deliver(ev) {
+			return
+		}
+	}
+}
+
+func (q *Queue) pop() (ev interface{}, ok bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if len(q.events) == 0 {
+		return
+	}
+	ev, q.events[0] = q.events[0], nil
+	q.events = q.events[1:]
+	return ev, true
+}
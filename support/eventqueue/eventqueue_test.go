@@ -0,0 +1,86 @@
+// Copyright 2018 Dan Jacques. All rights reserved.
+// Use of this source code is governed under the MIT License
+// that can be found in the LICENSE file.
+
+package eventqueue
+
+import (
+	"context"
+	"testing"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Queue", func() {
+	var (
+		c      context.Context
+		cancel context.CancelFunc
+	)
+	BeforeEach(func() {
+		c, cancel = context.WithCancel(context.Background())
+	})
+	AfterEach(func() {
+		cancel()
+	})
+
+	// run runs q, delivering its events to the returned channel until c is
+	// cancelled. The channel is closed when Run returns.
+	run := func(q *Queue) <-chan interface{} {
+		eventC := make(chan interface{})
+		go func() {
+			defer close(eventC)
+			q.Run(c, func(ev interface{}) bool {
+				select {
+				case eventC <- ev:
+					return true
+				case <-c.Done():
+					return false
+				}
+			})
+		}()
+		return eventC
+	}
+
+	It("delivers initial and pushed events in order", func() {
+		q := Make(1, 2)
+		eventC := run(q)
+
+		for i := 3; i <= 10; i++ {
+			q.Push(i)
+		}
+		for i := 1; i <= 10; i++ {
+			Eventually(eventC).Should(Receive(Equal(i)))
+		}
+		Consistently(eventC).ShouldNot(Receive())
+
+		cancel()
+		Eventually(eventC).Should(BeClosed())
+	})
+
+	It("never blocks Push, even when events are not being consumed", func(done Done) {
+		defer close(done)
+
+		q := Make()
+		for i := 0; i < 1024; i++ {
+			q.Push(i)
+		}
+	}, 5)
+
+	It("stops when deliver returns false", func(done Done) {
+		defer close(done)
+
+		q := Make(1, 2, 3)
+		var delivered []interface{}
+		q.Run(context.Background(), func(ev interface{}) bool {
+			delivered = append(delivered, ev)
+			return len(delivered) < 2
+		})
+		Expect(delivered).To(Equal([]interface{}{1, 2}))
+	}, 5)
+})
+
+func TestEventQueue(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "EventQueue")
+}
@@ -33,3 +33,38 @@ func ParseIP4Address(v string) (net.IP, error) {
 
 	return ip, nil
 }
+
+// InterfaceIP4Address returns an IPv4 address of the named interface.
+//
+// If target is not nil, an address whose network contains target is preferred.
+// Otherwise, the interface's first IPv4 address is returned.
+func InterfaceIP4Address(name string, target net.IP) (net.IP, error) {
+	iface, err := net.InterfaceByName(name)
+	if err != nil {
+		return nil, err
+	}
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return nil, err
+	}
+
+	var first net.IP
+	for _, addr := range addrs {
+		ipNet := GetIPNet(addr)
+		if ipNet == nil || ipNet.IP.To4() == nil {
+			continue
+		}
+
+		if target != nil && ipNet.Contains(target) {
+			return ipNet.IP, nil
+		}
+		if first == nil {
+			first = ipNet.IP
+		}
+	}
+
+	if first == nil {
+		return nil, errors.Errorf("interface %q has no IPv4 address", name)
+	}
+	return first, nil
+}
@@ -5,12 +5,40 @@
 package network
 
 import (
+	"net"
 	"testing"
 
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
 )
 
+var _ = Describe("InterfaceIP4Address", func() {
+	It("returns the address of the loopback interface", func() {
+		ifaces, err := net.Interfaces()
+		Expect(err).ToNot(HaveOccurred())
+
+		var loopback string
+		for _, iface := range ifaces {
+			if iface.Flags&net.FlagLoopback != 0 {
+				loopback = iface.Name
+				break
+			}
+		}
+		if loopback == "" {
+			Skip("no loopback interface")
+		}
+
+		ip, err := InterfaceIP4Address(loopback, net.IPv4(127, 0, 0, 1))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(ip.IsLoopback()).To(BeTrue())
+	})
+
+	It("fails for an unknown interface", func() {
+		_, err := InterfaceIP4Address("does-not-exist", nil)
+		Expect(err).To(HaveOccurred())
+	})
+})
+
 func TestNetwork(t *testing.T) {
 	RegisterFailHandler(Fail)
 	RunSpecs(t, "Network")